@@ -0,0 +1,220 @@
+package exec
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestNames are the names of the manifest that `nex build` looks for when none is given.
+var ManifestNames = []string{"nex.yaml", "nex.yml", "nex.json"}
+
+// Manifest lists the grammars that `nex build` generates in one invocation.
+type Manifest struct {
+	Grammars []Grammar `json:"grammars" yaml:"grammars"`
+}
+
+// Grammar is a spec in a Manifest, with the options that the flags of ExecuteWithParams set.
+// Paths are relative to the manifest's directory.
+type Grammar struct {
+	Input       string   `json:"input" yaml:"input"`
+	Inputs      []string `json:"inputs" yaml:"inputs"` // Several specs of one package, whose directory Output is then.
+	Output      string   `json:"output" yaml:"output"` // Defaults to the input, with the .nn.go extension.
+	Prefix      string   `json:"prefix" yaml:"prefix"`
+	Aliases     []string `json:"aliases" yaml:"aliases"`
+	Package     string   `json:"package" yaml:"package"`
+	PkgName     string   `json:"pkgName" yaml:"pkgName"`
+	Generator   string   `json:"generator" yaml:"generator"`
+	Command     string   `json:"command" yaml:"command"`
+	Header      string   `json:"header" yaml:"header"`
+	GoBuild     string   `json:"goBuild" yaml:"goBuild"`
+	GoVersion   string   `json:"goVersion" yaml:"goVersion"`
+	Standalone  bool     `json:"standalone" yaml:"standalone"`
+	Main        bool     `json:"main" yaml:"main"`
+	CustomError bool     `json:"customError" yaml:"customError"`
+	Caseless    bool     `json:"caseless" yaml:"caseless"`
+	Synchronous bool     `json:"sync" yaml:"sync"`
+	Tiny        bool     `json:"tiny" yaml:"tiny"`
+	Generic     bool     `json:"generic" yaml:"generic"`
+	Inline      bool     `json:"inline" yaml:"inline"`
+	Observer    bool     `json:"observer" yaml:"observer"`
+	Replay      bool     `json:"replay" yaml:"replay"`
+	Trace       bool     `json:"trace" yaml:"trace"`
+	Minify      bool     `json:"minify" yaml:"minify"`
+	Format      string   `json:"format" yaml:"format"`
+	Tables      bool     `json:"tables" yaml:"tables"`
+	Bytes       bool     `json:"bytes" yaml:"bytes"`
+	Explain     bool     `json:"explain" yaml:"explain"`
+	Serialize   bool     `json:"serialize" yaml:"serialize"`
+	Example     bool     `json:"example" yaml:"example"`
+	Cgo         bool     `json:"cgo" yaml:"cgo"`
+	Service     bool     `json:"service" yaml:"service"`
+	Symbols     string   `json:"symbols" yaml:"symbols"`
+	RuleSets    string   `json:"ruleSets" yaml:"ruleSets"`
+	Yacc        string   `json:"yacc" yaml:"yacc"`
+	Template    string   `json:"template" yaml:"template"`
+	Strict      bool     `json:"strict" yaml:"strict"`
+	Conflicts   bool     `json:"conflicts" yaml:"conflicts"`
+}
+
+// Build generates the grammars of a manifest, in parallel. It is the `nex build` command.
+func Build(name string, args ...string) error {
+	f := flag.NewFlagSet(name+" build", flag.ExitOnError)
+	jobs := f.Int("j", runtime.NumCPU(), `number of grammars to generate in parallel`)
+	// Ignore errors; CommandLine is set for ExitOnError.
+	_ = f.Parse(args)
+
+	if f.NArg() > 1 {
+		return fmt.Errorf("extraneous arguments after %s", f.Arg(0))
+	}
+	manifest := f.Arg(0)
+	if manifest == "" {
+		var err error
+		if manifest, err = findManifest(); err != nil {
+			return err
+		}
+	}
+	m, err := ReadManifest(manifest)
+	if err != nil {
+		return err
+	}
+	return m.Build(filepath.Dir(manifest), *jobs, os.Stderr)
+}
+
+func findManifest() (string, error) {
+	for _, name := range ManifestNames {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("build: no manifest; expected one of %v", ManifestNames)
+}
+
+// ReadManifest reads a manifest in YAML, or in JSON if its extension is .json.
+func ReadManifest(name string) (*Manifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	m := &Manifest{}
+	if filepath.Ext(name) == ".json" {
+		err = json.Unmarshal(data, m)
+	} else {
+		err = yaml.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", name, err)
+	}
+	return m, nil
+}
+
+// Build generates the grammars of the manifest, with up to jobs of them in parallel.
+// The warnings of each grammar are written to stderr in the order of the manifest.
+// It returns the errors of all the grammars that failed.
+func (m *Manifest) Build(dir string, jobs int, stderr io.Writer) error {
+	jobs = max(jobs, 1)
+	errs := make([]error, len(m.Grammars))
+	logs := make([]bytes.Buffer, len(m.Grammars))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, g := range m.Grammars {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := ExecuteWithParams(g.params(dir, &logs[i])); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", cmp.Or(g.Input, strings.Join(g.Inputs, ", ")), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range logs {
+		_, _ = logs[i].WriteTo(stderr)
+	}
+	return errors.Join(errs...)
+}
+
+func (g *Grammar) params(dir string, stderr io.Writer) *Params {
+	p := &Params{
+		Standalone:      g.Standalone,
+		StandaloneMain:  g.Main,
+		CustomError:     g.CustomError,
+		CustomPrefix:    g.Prefix,
+		Aliases:         g.Aliases,
+		Package:         g.Package,
+		PackageName:     g.PkgName,
+		Generator:       g.Generator,
+		Command:         g.Command,
+		BuildConstraint: g.GoBuild,
+		GoVersion:       g.GoVersion,
+		Caseless:        g.Caseless,
+		Synchronous:     g.Synchronous,
+		Tiny:            g.Tiny,
+		Generic:         g.Generic,
+		InlineRuntime:   g.Inline,
+		Observer:        g.Observer,
+		Replay:          g.Replay,
+		Trace:           g.Trace,
+		Minify:          g.Minify,
+		Format:          g.Format,
+		Tables:          g.Tables,
+		Bytes:           g.Bytes,
+		ExplainStates:   g.Explain,
+		Serialize:       g.Serialize,
+		Example:         g.Example,
+		Cgo:             g.Cgo,
+		Service:         g.Service,
+		Strict:          g.Strict,
+		Conflicts:       g.Conflicts,
+		Stdin:           os.Stdin,
+		Stdout:          os.Stdout,
+		Stderr:          stderr,
+	}
+	if g.Input != "" {
+		p.InputFilename = resolvePath(dir, g.Input)
+	}
+	for _, input := range g.Inputs {
+		p.InputFilenames = append(p.InputFilenames, resolvePath(dir, input))
+	}
+	if g.Output != "" {
+		p.OutputFilename = resolvePath(dir, g.Output)
+	}
+	if g.Symbols != "" {
+		p.SymbolsFilename = resolvePath(dir, g.Symbols)
+	}
+	if g.RuleSets != "" {
+		p.RuleSetsFilename = resolvePath(dir, g.RuleSets)
+	}
+	if g.Yacc != "" {
+		p.YaccFilename = resolvePath(dir, g.Yacc)
+	}
+	if g.Template != "" {
+		p.TemplateFilename = resolvePath(dir, g.Template)
+	}
+	if g.Header != "" {
+		p.HeaderFilename = resolvePath(dir, g.Header)
+	}
+	return p
+}
+
+func resolvePath(dir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
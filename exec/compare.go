@@ -0,0 +1,67 @@
+package exec
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// Compare reports how the rules changed from an old version of a spec to a new one, and whether
+// each change can alter the tokens of an input. It is the `nex compare` command.
+func Compare(name string, args ...string) error {
+	f := flag.NewFlagSet(name+" compare", flag.ExitOnError)
+	report := f.Bool("report", false, `write the changelog as JSON, e.g., for release notes`)
+	// Ignore errors; CommandLine is set for ExitOnError.
+	_ = f.Parse(args)
+
+	if f.NArg() != 2 {
+		return fmt.Errorf("compare: expected the old and the new spec")
+	}
+	var programs []*parser.NexProgram
+	for _, file := range f.Args() {
+		p := &Params{InputFilename: file, Quiet: true, Stderr: os.Stderr}
+		program, err := p.parseNex()
+		if err != nil {
+			return fmt.Errorf("compare %s: %w", file, err)
+		}
+		programs = append(programs, program)
+	}
+	log := parser.Compare(programs[0], programs[1])
+	if *report {
+		return log.Write(os.Stdout)
+	}
+	return writeChangelog(os.Stdout, log)
+}
+
+// writeChangelog writes a line for each change, and whether the tokens of any input change.
+func writeChangelog(w io.Writer, log *parser.Changelog) error {
+	var b strings.Builder
+	for _, c := range log.Changes {
+		ref := c.New
+		if ref == nil {
+			ref = c.Old
+		}
+		fmt.Fprintf(&b, "%s /%s/ at line %d", c.Kind, ref.Regex, ref.Line)
+		if len(c.Fields) > 0 {
+			fmt.Fprintf(&b, " (%s)", strings.Join(c.Fields, ", "))
+		}
+		if c.Retokenizes {
+			fmt.Fprintf(&b, ": retokenizes, e.g., %q", c.Example)
+		}
+		b.WriteString("\n")
+	}
+	switch {
+	case len(log.Changes) == 0:
+		b.WriteString("no rule changed\n")
+	case log.Retokenizes:
+		b.WriteString("some inputs are tokenized differently\n")
+	default:
+		b.WriteString("every input is tokenized the same\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -1,26 +1,71 @@
 package exec
 
 import (
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
+	"go/token"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/liran-funaro/nex/graph"
 	"github.com/liran-funaro/nex/parser"
 	"github.com/liran-funaro/nex/writer"
 )
 
 type Params struct {
 	Standalone           bool
+	StandaloneMain       bool
 	CustomError          bool
 	CustomPrefix         string
+	Aliases              []string
+	Package              string
+	PackageName          string
+	Generator            string
+	Command              string
+	BuildConstraint      string
+	GoVersion            string
+	Caseless             bool
+	Synchronous          bool
+	Tiny                 bool
+	Generic              bool
+	InlineRuntime        bool
+	Observer             bool
+	Replay               bool
+	Trace                bool
+	Minify               bool
+	Format               string
+	Tables               bool
+	Bytes                bool
+	ExplainStates        bool
+	Serialize            bool
+	Example              bool
+	Cgo                  bool
+	Service              bool
+	Strict               bool
+	Conflicts            bool
+	Flex                 bool
+	Quiet                bool
+	Stats                bool
 	InputFilename        string
+	InputFilenames       []string // The specs of several lexers in one package, see executePackage.
 	OutputFilename       string
 	NfaDotOutputFilename string
 	DfaDotOutputFilename string
+	DotMaxNodes          int
+	DotMaxEdges          int
+	FuzzDictFilename     string
+	SymbolsFilename      string
+	RuleSetsFilename     string
+	YaccFilename         string
+	TemplateFilename     string
+	HeaderFilename       string
 	RunProgram           bool
 	Stdin                io.Reader
 	Stdout               io.Writer
@@ -34,27 +79,73 @@ func ParseParams(name string, args ...string) (*Params, error) {
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
-	f.StringVar(&p.CustomPrefix, "p", "", `name prefix to use in generated code`)
+	f.StringVar(&p.CustomPrefix, "p", "", `name prefix to use in generated code, instead of "yy"; overrides %prefix`)
+	f.Func("alias", `comma-separated prefixes of goyacc parsers that get a wrapper of the lexer, like yyLex for yy`, func(s string) error {
+		p.Aliases = append(p.Aliases, strings.Split(s, ",")...)
+		return nil
+	})
+	f.StringVar(&p.Package, "package", "", `generate the lexer as a package of the given name, which exports Token, New and Next; overrides %package`)
+	f.StringVar(&p.PackageName, "pkgname", "", `put the lexer in the package of the given name, without the API of -package; overrides %package`)
+	f.StringVar(&p.Generator, "generator", "", `the tool that the "Code generated" comments name instead of nex; overrides %generator`)
+	f.StringVar(&p.Command, "command", "", `the command in the comment at the top of the lexer instead of that of the invocation, or - for none; overrides %command`)
+	f.StringVar(&p.HeaderFilename, "header", "", `write the comments of the given file, e.g. a license, below the "Code generated" comments; overrides %header`)
+	f.StringVar(&p.BuildConstraint, "gobuild", "", `write a //go:build line with the given constraint at the top of the generated files`)
+	f.StringVar(&p.GoVersion, "goversion", "", `fail if the lexer uses features of Go, or of its standard library, newer than the given version, e.g. 1.19`)
 	f.BoolVar(&p.Standalone, "s", false, `standalone code; NN_FUN macro substitution, no Lex() method`)
+	f.BoolVar(&p.StandaloneMain, "main", false, `with -s, append a main() that runs the rules on the standard input`)
 	f.BoolVar(&p.CustomError, "e", false, `custom error func; no Error() method`)
+	f.BoolVar(&p.Synchronous, "sync", false, `synchronous lexer; scans on demand without goroutines`)
+	f.BoolVar(&p.Tiny, "tiny", false, `lexer for TinyGo and small devices; synchronous, without channels, context or bufio`)
+	f.BoolVar(&p.Generic, "generic", false, `generate Lexer[T any], whose Lex() takes lval *T, instead of a Lexer of yySymType`)
+	f.BoolVar(&p.InlineRuntime, "inline", false, `inline the scanner core, so the lexer builds without the module of nex, instead of importing the nexruntime package`)
+	f.BoolVar(&p.Tables, "tables", false, `generate the DFAs as transition tables instead of a function for each state`)
+	f.BoolVar(&p.Bytes, "bytes", false, `generate NewBytesLexer, which scans a []byte in place, with a table of the ASCII transitions of each state`)
+	f.BoolVar(&p.ExplainStates, "explain", false, `comment each DFA state with the rules that it accepts, the one that wins, and those still alive`)
+	f.BoolVar(&p.Serialize, "serialize", false, `write the DFAs to a .dfa file next to the output, which the lexer embeds and decodes at init`)
+	f.BoolVar(&p.Example, "example", false, `write a test file with an Example of the lexer next to the output, for go doc`)
+	f.BoolVar(&p.Cgo, "cgo", false, `write a file next to the output that exports the lexer to C, for -buildmode=c-shared`)
+	f.BoolVar(&p.Service, "service", false, `write a server main and a .proto file next to the output, for a tokenizer service over HTTP`)
+	f.BoolVar(&p.Observer, "observer", false, `report Lex() calls and unmatched text to a LexerObserver; see SetObserver()`)
+	f.BoolVar(&p.Replay, "replay", false, `record the tokens of Lex() with Record(), and replay them with NewReplayLexer()`)
+	f.BoolVar(&p.Trace, "trace", false, `write each scan, DFA transition, match and buffer reset to a writer; see SetTrace()`)
+	f.BoolVar(&p.Caseless, "i", false, `case-insensitive rules; same as '%option caseless'`)
+	f.BoolVar(&p.Strict, "strict", false, `treat warnings, like shadowed rules, as errors`)
+	f.BoolVar(&p.Conflicts, "conflicts", false, `warn about rules that lose to earlier rules on the same text`)
+	f.BoolVar(&p.Flex, "flex", false, `parse a classic flex file; implied by the .l extension`)
+	f.BoolVar(&p.Quiet, "quiet", false, `do not show the progress of the compilation on a terminal`)
+	f.BoolVar(&p.Stats, "stats", false, `report the size of the automata and the time it took to build them`)
 	f.StringVar(&p.OutputFilename, "o", "", `output file`)
 	f.StringVar(&p.NfaDotOutputFilename, "nfadot", "", `show NFA graph in DOT format`)
 	f.StringVar(&p.DfaDotOutputFilename, "dfadot", "", `show DFA graph in DOT format`)
+	f.IntVar(&p.DotMaxNodes, "dotnodes", 0, `the most nodes of each DOT graph whose edges are shown; 0 for all`)
+	f.IntVar(&p.DotMaxEdges, "dotedges", 0, `the most edges of each DOT graph that are shown; 0 for all`)
+	f.StringVar(&p.FuzzDictFilename, "fuzzdict", "", `write a fuzzing dictionary of the rules' literals and samples`)
+	f.BoolVar(&p.Minify, "minify", false, `strip the comments, rule names and regexes from the generated code`)
+	f.StringVar(&p.Format, "format", "", `format the generated code with goimports, the default, with std, which is go/format only, or none`)
+	f.StringVar(&p.SymbolsFilename, "symbols", "", `write the numbers, positions, names and regexes of the rules`)
+	f.StringVar(&p.RuleSetsFilename, "rulesets", "", `write the rule sets, their rules and the actions that enable or disable them as JSON`)
+	f.StringVar(&p.YaccFilename, "yacc", "", `warn about mismatches between the rules' tokens and the %token declarations of a goyacc grammar`)
+	f.StringVar(&p.TemplateFilename, "t", "", `generate the lexer from the given template instead of the embedded one; see writer/lexer.go`)
 	f.BoolVar(&p.RunProgram, "r", false, `run generated program`)
 
 	// Ignore errors; CommandLine is set for ExitOnError.
 	_ = f.Parse(args)
 
 	if f.NArg() > 1 {
-		return nil, fmt.Errorf("extraneous arguments after %s", f.Arg(0))
-	}
-	if f.NArg() > 0 {
+		p.InputFilenames = f.Args()
+	} else if f.NArg() > 0 {
 		p.InputFilename = f.Arg(0)
 	}
 	return p, nil
 }
 
 func Execute(name string, args ...string) error {
+	if len(args) > 0 && args[0] == "build" {
+		return Build(name, args[1:]...)
+	}
+	if len(args) > 0 && args[0] == "compare" {
+		return Compare(name, args[1:]...)
+	}
 	p, err := ParseParams(name, args...)
 	if err != nil {
 		return fmt.Errorf("parse-params: %w", err)
@@ -63,15 +154,32 @@ func Execute(name string, args ...string) error {
 }
 
 func ExecuteWithParams(p *Params) error {
+	if len(p.InputFilenames) > 0 {
+		return p.executePackage()
+	}
 	var err error
 	program, err := p.parseNex()
 	if err != nil {
 		return fmt.Errorf("parse-program: %w", err)
 	}
-	if err = writeWithWriter(p.NfaDotOutputFilename, program.WriteNFADotGraph); err != nil {
+	dotOpts := graph.DotOptions{MaxNodes: p.DotMaxNodes, MaxEdges: p.DotMaxEdges}
+	if err = writeWithWriter(p.NfaDotOutputFilename, func(w io.Writer) error {
+		return program.WriteNFADotGraphWithOptions(w, dotOpts)
+	}); err != nil {
+		return err
+	}
+	if err = writeWithWriter(p.DfaDotOutputFilename, func(w io.Writer) error {
+		return program.WriteDFADotGraphWithOptions(w, dotOpts)
+	}); err != nil {
+		return err
+	}
+	if err = writeWithWriter(p.FuzzDictFilename, program.WriteFuzzDictionary); err != nil {
 		return err
 	}
-	if err = writeWithWriter(p.DfaDotOutputFilename, program.WriteDFADotGraph); err != nil {
+	if err = writeWithWriter(p.SymbolsFilename, program.WriteSymbols); err != nil {
+		return err
+	}
+	if err = writeWithWriter(p.RuleSetsFilename, program.WriteRuleSetTable); err != nil {
 		return err
 	}
 
@@ -94,10 +202,80 @@ func ExecuteWithParams(p *Params) error {
 		return nil
 	}
 
+	b, err := p.builder()
+	if err != nil {
+		return err
+	}
+	if err = p.writeLexer(b, program, p.OutputFilename); err != nil {
+		return err
+	}
+
+	if !p.RunProgram {
+		return nil
+	}
+
+	c := exec.Command("go", "run", p.OutputFilename)
+	c.Stdin, c.Stdout, c.Stderr = p.Stdin, p.Stdout, p.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("run lexer: %w", err)
+	}
+	return nil
+}
+
+// builder returns the builder of the lexers that the flags set.
+func (p *Params) builder() (*writer.LexerBuilder, error) {
 	b := &writer.LexerBuilder{
-		CustomPrefix: p.CustomPrefix,
-		Standalone:   p.Standalone,
-		CustomError:  p.CustomError,
+		CustomPrefix:    p.CustomPrefix,
+		Aliases:         p.Aliases,
+		BuildConstraint: p.BuildConstraint,
+		GoVersion:       p.GoVersion,
+		Package:         p.Package,
+		PackageName:     p.PackageName,
+		Generator:       p.Generator,
+		Command:         p.Command,
+		Standalone:      p.Standalone,
+		StandaloneMain:  p.StandaloneMain,
+		CustomError:     p.CustomError,
+		Synchronous:     p.Synchronous,
+		Tiny:            p.Tiny,
+		Generic:         p.Generic,
+		InlineRuntime:   p.InlineRuntime,
+		Observer:        p.Observer,
+		Replay:          p.Replay,
+		Trace:           p.Trace,
+		Minify:          p.Minify,
+		Format:          p.Format,
+		Tables:          p.Tables,
+		Bytes:           p.Bytes,
+		ExplainStates:   p.ExplainStates,
+	}
+	if p.RunProgram {
+		// The program builds by itself, maybe outside of a module that requires nex.
+		b.InlineRuntime = true
+	}
+	if p.TemplateFilename != "" {
+		template, err := os.ReadFile(p.TemplateFilename)
+		if err != nil {
+			return nil, fmt.Errorf("read template: %w", err)
+		}
+		b.Template = string(template)
+	}
+	if p.HeaderFilename != "" {
+		header, err := os.ReadFile(p.HeaderFilename)
+		if err != nil {
+			return nil, fmt.Errorf("read header: %w", err)
+		}
+		b.Header = string(header)
+	}
+	return b, nil
+}
+
+// writeLexer writes the lexer of the program to the output file, its DFAs next to it with
+// -serialize, and its example with -example.
+func (p *Params) writeLexer(b *writer.LexerBuilder, program *parser.NexProgram, outputFilename string) error {
+	dfaFilename := strings.TrimSuffix(outputFilename, ".go") + ".dfa"
+	if p.Serialize {
+		b.DFAFile = path.Base(dfaFilename)
 	}
 	code, err := b.DumpFormattedLexer(program)
 	if err != nil {
@@ -107,18 +285,105 @@ func ExecuteWithParams(p *Params) error {
 		return nil
 	}
 
-	if err := os.WriteFile(p.OutputFilename, code, 0666); err != nil {
+	if err := os.WriteFile(outputFilename, code, 0666); err != nil {
 		return fmt.Errorf("write lexer: %w", err)
 	}
+	if p.Serialize {
+		if err := writeWithWriter(dfaFilename, func(w io.Writer) error {
+			return b.WriteDFAFile(program, w)
+		}); err != nil {
+			return fmt.Errorf("write DFA file: %w", err)
+		}
+	}
+	if p.Example {
+		example, err := b.DumpExample(program)
+		if err != nil {
+			return fmt.Errorf("dump example: %w", err)
+		}
+		if err := os.WriteFile(strings.TrimSuffix(outputFilename, ".go")+"_example_test.go", example, 0666); err != nil {
+			return fmt.Errorf("write example: %w", err)
+		}
+	}
+	if p.Cgo {
+		wrapper, err := b.DumpCgoWrapper(program)
+		if err != nil {
+			return fmt.Errorf("dump cgo wrapper: %w", err)
+		}
+		if err := os.WriteFile(strings.TrimSuffix(outputFilename, ".go")+"_cgo.go", wrapper, 0666); err != nil {
+			return fmt.Errorf("write cgo wrapper: %w", err)
+		}
+	}
+	if p.Service {
+		service, err := b.DumpService(program)
+		if err != nil {
+			return fmt.Errorf("dump service: %w", err)
+		}
+		if err := os.WriteFile(strings.TrimSuffix(outputFilename, ".go")+"_service.go", service, 0666); err != nil {
+			return fmt.Errorf("write service: %w", err)
+		}
+		if err := os.WriteFile(strings.TrimSuffix(outputFilename, ".go")+".proto", b.DumpServiceProto(program), 0666); err != nil {
+			return fmt.Errorf("write service proto: %w", err)
+		}
+	}
+	return nil
+}
 
-	if !p.RunProgram {
-		return nil
+// SharedRuntimeFilename is the file of the runtime that the lexers of a package share.
+const SharedRuntimeFilename = "nexruntime.nn.go"
+
+// executePackage generates the lexers of several specs into one package: the output, or else the
+// directory of the first spec. Each lexer is written to a file named after its spec, without the
+// runtime, which they share in SharedRuntimeFilename, and its top-level declarations start with
+// its prefix, which is `%prefix` of the spec, or else the name of its file, e.g., CalcLexer.
+func (p *Params) executePackage() error {
+	switch {
+	case p.CustomPrefix != "":
+		return fmt.Errorf("-p applies to a single spec; set %%prefix in each spec instead")
+	case p.RunProgram || p.NfaDotOutputFilename != "" || p.DfaDotOutputFilename != "" ||
+		p.FuzzDictFilename != "" || p.SymbolsFilename != "" || p.RuleSetsFilename != "" || p.Example || p.Cgo || p.Service:
+		return fmt.Errorf("-r, -nfadot, -dfadot, -fuzzdict, -symbols, -rulesets, -example, -cgo and -service apply to a single spec")
 	}
+	dir := cmp.Or(p.OutputFilename, filepath.Dir(p.InputFilenames[0]))
+	var programs []*parser.NexProgram
+	specs := map[string]string{}
+	for _, name := range p.InputFilenames {
+		q := *p
+		q.InputFilename, q.InputFilenames = name, nil
+		program, err := q.parseNex()
+		if err != nil {
+			return fmt.Errorf("parse-program %s: %w", name, err)
+		}
+		base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		prefix := cmp.Or(program.Prefix(), base)
+		if !token.IsIdentifier(prefix) {
+			return fmt.Errorf("%s: the prefix %q is not an identifier; set %%prefix", name, prefix)
+		}
+		if other, ok := specs[prefix]; ok {
+			return fmt.Errorf("%s and %s have the same prefix %s", other, name, prefix)
+		}
+		specs[prefix] = name
 
-	c := exec.Command("go", "run", p.OutputFilename)
-	c.Stdin, c.Stdout, c.Stderr = p.Stdin, p.Stdout, p.Stderr
-	if err := c.Run(); err != nil {
-		return fmt.Errorf("run lexer: %w", err)
+		b, err := p.builder()
+		if err != nil {
+			return err
+		}
+		b.SharedPrefix = prefix
+		if err = p.writeLexer(b, program, filepath.Join(dir, base+".nn.go")); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		programs = append(programs, program)
+	}
+
+	b, err := p.builder()
+	if err != nil {
+		return err
+	}
+	code, err := b.DumpSharedRuntime(programs)
+	if err != nil {
+		return fmt.Errorf("dump runtime: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, SharedRuntimeFilename), code, 0666); err != nil {
+		return fmt.Errorf("write runtime: %w", err)
 	}
 	return nil
 }
@@ -138,13 +403,53 @@ func (p *Params) parseNex() (*parser.NexProgram, error) {
 		defer closeFile(infile)
 	}
 
-	program, err := parser.ParseNex(infile)
+	opts := parser.Options{Caseless: p.Caseless, Strict: p.Strict, Conflicts: p.Conflicts}
+	opts.Flex = p.Flex || path.Ext(p.InputFilename) == ".l"
+	if p.InputFilename != "" {
+		opts.Dir = filepath.Dir(p.InputFilename)
+	}
+	if p.YaccFilename != "" {
+		if opts.YaccTokens, err = readYaccTokens(p.YaccFilename); err != nil {
+			return nil, err
+		}
+	}
+	var progress *progressPrinter
+	if !p.Quiet && isTerminal(p.Stderr) {
+		progress = newProgressPrinter(p.Stderr)
+		opts.Progress = progress.print
+	}
+	// An interrupt stops the subset construction of an exploding spec, which explains it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	program, err := parser.ParseNexContext(ctx, infile, opts)
+	progress.done()
 	if err != nil {
 		return nil, fmt.Errorf("parse: %w", err)
 	}
+	for _, w := range program.Warnings {
+		_, _ = fmt.Fprintf(p.Stderr, "warning: %s\n", w)
+	}
+	if p.Stats {
+		s := program.Stats()
+		_, _ = fmt.Fprintf(p.Stderr, "stats: %d automata, %d NFA nodes in %v, %d DFA states in %v\n",
+			s.Automata, s.NFANodes, s.NFATime, s.DFAStates, s.DFATime)
+	}
 	return program, nil
 }
 
+func readYaccTokens(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open grammar: %w", err)
+	}
+	defer closeFile(f)
+	tokens, err := parser.ReadYaccTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("read grammar: %w", err)
+	}
+	return tokens, nil
+}
+
 func writeWithWriter(filepath string, writer func(io.Writer) error) error {
 	if filepath == "" {
 		return nil
@@ -0,0 +1,54 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+const (
+	progressDelay    = 500 * time.Millisecond // Fast compilations print nothing.
+	progressInterval = 100 * time.Millisecond
+)
+
+// progressPrinter shows the progress of a compilation on a single line of a terminal,
+// which it rewrites as the compilation goes.
+type progressPrinter struct {
+	out     io.Writer
+	next    time.Time
+	printed bool
+}
+
+func newProgressPrinter(out io.Writer) *progressPrinter {
+	return &progressPrinter{out: out, next: time.Now().Add(progressDelay)}
+}
+
+func (p *progressPrinter) print(pr parser.Progress) {
+	now := time.Now()
+	if now.Before(p.next) {
+		return
+	}
+	p.next = now.Add(progressInterval)
+	p.printed = true
+	_, _ = fmt.Fprintf(p.out, "\r\x1b[Knex: %s: %d rules, %d NFA nodes, %d DFA states",
+		pr.Phase, pr.Rules, pr.NFANodes, pr.DFAStates)
+}
+
+// done clears the progress line, if it was printed. A nil printer does nothing.
+func (p *progressPrinter) done() {
+	if p != nil && p.printed {
+		_, _ = fmt.Fprint(p.out, "\r\x1b[K")
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
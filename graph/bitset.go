@@ -0,0 +1,44 @@
+package graph
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// bitset is a set of small non-negative integers, packed in words.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (s bitset) add(i int) {
+	s[i/64] |= 1 << (i % 64)
+}
+
+func (s bitset) remove(i int) {
+	s[i/64] &^= 1 << (i % 64)
+}
+
+func (s bitset) has(i int) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+// forEach calls f for the members of the set, in increasing order.
+func (s bitset) forEach(f func(int)) {
+	for w, word := range s {
+		for word != 0 {
+			f(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// key returns a string that is equal for equal sets of the same capacity, to be used as a map key.
+func (s bitset) key() string {
+	buf := make([]byte, 0, len(s)*8)
+	for _, word := range s {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return string(buf)
+}
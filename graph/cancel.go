@@ -0,0 +1,78 @@
+package graph
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// maxCanceledRules is the number of rules that a CanceledError blames.
+const maxCanceledRules = 3
+
+// CanceledError is returned when the construction of a DFA is canceled by its context.
+// It reports how far the construction got, and which rules are most likely to blame.
+type CanceledError struct {
+	States int   // The number of DFA states discovered when the construction was canceled.
+	Rules  []int // The ids of the expressions that take part in the most states, by decreasing count.
+	Err    error // The error of the context.
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("dfa construction: %v after %d states", e.Err, e.States)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+func (b *dfaBuilder) canceledError(err error) *CanceledError {
+	rules := nfaRules(b.nfa)
+	counts := map[int]int{}
+	for _, v := range b.tab {
+		var seen []int
+		for _, i := range v.Set {
+			if r := rules[i]; r >= 0 && !slices.Contains(seen, r) {
+				seen = append(seen, r)
+				counts[r]++
+			}
+		}
+	}
+
+	var blamed []int
+	for r := range counts {
+		blamed = append(blamed, r)
+	}
+	slices.SortFunc(blamed, func(a, b int) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+	return &CanceledError{States: b.nextId, Rules: blamed[:min(len(blamed), maxCanceledRules)], Err: err}
+}
+
+// nfaRules returns the id of the expression of each NFA node, or -1 for the start node.
+// The NFA of each expression is only reachable from the start node, and only one of its nodes accepts.
+func nfaRules(nfa []*Node) []int {
+	rules := make([]int, len(nfa))
+	for i := range rules {
+		rules[i] = -1
+	}
+	for _, start := range nfa[0].E {
+		nodes := []*Node{start.Dst}
+		visited := map[int]bool{start.Dst.Id: true}
+		rule := -1
+		for pos := 0; pos < len(nodes); pos++ {
+			if nodes[pos].Accept >= 0 {
+				rule = nodes[pos].Accept
+			}
+			for _, e := range nodes[pos].E {
+				if !visited[e.Dst.Id] {
+					visited[e.Dst.Id] = true
+					nodes = append(nodes, e.Dst)
+				}
+			}
+		}
+		for _, n := range nodes {
+			rules[n.Id] = rule
+		}
+	}
+	return rules
+}
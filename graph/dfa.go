@@ -1,15 +1,34 @@
 package graph
 
 import (
+	"context"
+	"fmt"
 	"slices"
+	"time"
 )
 
 // BuildDfa NFA -> DFA
 // DFA: Deterministic Finite Automaton
 func BuildDfa(nfa []*Node) []*Node {
+	// Without limits, the construction cannot fail.
+	dfa, _ := BuildDfaWithOptions(nfa, Options{})
+	return dfa
+}
+
+// BuildDfaWithOptions is like BuildDfa, but fails with a LimitError if the
+// construction exceeds the given limits.
+func BuildDfaWithOptions(nfa []*Node, opts Options) ([]*Node, error) {
+	return BuildDfaContext(context.Background(), nfa, opts)
+}
+
+// BuildDfaContext is like BuildDfaWithOptions, but it also stops when the context is done,
+// and fails with a CanceledError.
+func BuildDfaContext(ctx context.Context, nfa []*Node, opts Options) ([]*Node, error) {
+	start := time.Now()
 	b := dfaBuilder{
-		nfa: nfa,
-		tab: make(map[stKey]*Node),
+		nfa:        nfa,
+		tab:        make(map[stKey]*Node),
+		depthFirst: opts.DepthFirst,
 	}
 	b.constructAllNilList()
 	b.constructEndNode()
@@ -19,6 +38,13 @@ func BuildDfa(nfa []*Node) []*Node {
 	b.get(b.setToSt([]int{0}, nfAccepting))
 
 	for len(b.todo) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, b.canceledError(err)
+		}
+		if err := opts.checkStates(b.nextId); err != nil {
+			return nil, err
+		}
+		opts.report(Progress{NFANodes: len(nfa), DFAStates: b.nextId})
 		v := b.nextTodo()
 		alphabet, l, allAsserts := b.getDfaEdges(v)
 
@@ -51,8 +77,9 @@ func BuildDfa(nfa []*Node) []*Node {
 			sorted[v.Id] = v
 		}
 	}
-
-	return sorted
+	sorted = minimize(sorted)
+	opts.stats(Stats{NFANodes: len(nfa), DFAStates: len(sorted), Duration: time.Since(start)})
+	return sorted, nil
 }
 
 type dfaBuilder struct {
@@ -60,23 +87,41 @@ type dfaBuilder struct {
 	nfa         []*Node
 	allNilNodes []int
 	tab         map[stKey]*Node
-	todo        []*Node
+	todo        []*Node // The discovered states whose edges were not built yet.
+	depthFirst  bool
 }
 
 type stKey struct {
-	key    string
-	accept int
+	key     string
+	accept  int
+	accepts string
 }
 
 type nodeFlag uint32
-type flagSet []nodeFlag
 
 const (
-	nfNotSet = iota
-	nfNotAccepting
+	nfNotAccepting nodeFlag = iota
 	nfAccepting
 )
 
+// flagSet is a set of NFA nodes, some of which are accepting. Only the accepting nodes of
+// the set contribute to the accepts of the DFA state.
+type flagSet struct {
+	set, accepting bitset
+}
+
+func (st flagSet) add(i int, value nodeFlag) {
+	st.set.add(i)
+	if value == nfAccepting {
+		st.accepting.add(i)
+	}
+}
+
+func (st flagSet) remove(i int) {
+	st.set.remove(i)
+	st.accepting.remove(i)
+}
+
 func (b *dfaBuilder) getDfaEdges(v *Node) ([]rune, limits, []Asserts) {
 	alphabet := make(map[rune]any)
 	var a Asserts
@@ -115,47 +160,43 @@ func (b *dfaBuilder) getDfaEdges(v *Node) ([]rune, limits, []Asserts) {
 
 func stToSet(st flagSet) []int {
 	var set []int
-	for i, v := range st {
-		if v != nfNotSet {
-			set = append(set, i)
-		}
-	}
+	st.set.forEach(func(i int) {
+		set = append(set, i)
+	})
 	return set
 }
 
-func (b *dfaBuilder) makeStKey(st flagSet) stKey {
+func (b *dfaBuilder) makeStKey(st flagSet) (stKey, []int) {
 	for _, i := range b.allNilNodes {
-		st[i] = nfNotSet
+		st.remove(i)
 	}
-	buf := make([]rune, len(st))
-	acc := -1
-	for i, v := range st {
-		if v == nfNotSet {
-			buf[i] = '0'
-			continue
+	var accepts []int
+	st.accepting.forEach(func(i int) {
+		if nodeAcc := b.nfa[i].Accept; nodeAcc >= 0 && !slices.Contains(accepts, nodeAcc) {
+			accepts = append(accepts, nodeAcc)
 		}
-		buf[i] = '1'
+	})
 
-		nodeAcc := b.nfa[i].Accept
-		if v == nfAccepting && nodeAcc >= 0 && (acc < 0 || nodeAcc < acc) {
-			acc = nodeAcc
-		}
+	slices.Sort(accepts)
+	acc := -1
+	if len(accepts) > 0 {
+		acc = accepts[0]
 	}
-
 	return stKey{
-		key:    string(buf),
-		accept: acc,
-	}
+		key:     st.set.key(),
+		accept:  acc,
+		accepts: fmt.Sprint(accepts),
+	}, accepts
 }
 
 func (b *dfaBuilder) newEmptySt() flagSet {
-	return make(flagSet, len(b.nfa))
+	return flagSet{set: newBitset(len(b.nfa)), accepting: newBitset(len(b.nfa))}
 }
 
 func (b *dfaBuilder) setToSt(set []int, value nodeFlag) flagSet {
 	st := b.newEmptySt()
 	for _, i := range set {
-		st[i] = value
+		st.add(i, value)
 	}
 	return st
 }
@@ -181,7 +222,7 @@ func (b *dfaBuilder) closure(st flagSet, cb func(*Edge) bool) {
 				continue
 			}
 			if e.Kind == KNil || (cb != nil && cb(e)) {
-				st[e.Dst.Id] = nfAccepting
+				st.add(e.Dst.Id, nfAccepting)
 				bfs = append(bfs, e.Dst.Id)
 			}
 		}
@@ -190,29 +231,35 @@ func (b *dfaBuilder) closure(st flagSet, cb func(*Edge) bool) {
 
 func (b *dfaBuilder) get(st flagSet) *Node {
 	b.nilClosure(st)
-	key := b.makeStKey(st)
+	key, accepts := b.makeStKey(st)
 	nNode, found := b.tab[key]
 	if !found {
 		nNode = b.newNode()
 		nNode.Set = stToSet(st)
 		nNode.Accept = key.accept
+		nNode.Accepts = accepts
 		b.tab[key] = nNode
-	}
-	if !found {
+		// A state is only pending once, as it is found in the table from now on.
 		b.todo = append(b.todo, nNode)
 	}
 	return nNode
 }
 
 func (b *dfaBuilder) nextTodo() *Node {
-	v := b.todo[len(b.todo)-1]
-	b.todo = b.todo[:len(b.todo)-1]
+	if b.depthFirst {
+		v := b.todo[len(b.todo)-1]
+		b.todo = b.todo[:len(b.todo)-1]
+		return v
+	}
+	v := b.todo[0]
+	b.todo = b.todo[1:]
 	return v
 }
 
 // constructEndNode Construct the node of no return.
 func (b *dfaBuilder) constructEndNode() {
-	b.tab[b.makeStKey(b.newEmptySt())] = &Node{Id: -1, Accept: -1}
+	key, _ := b.makeStKey(b.newEmptySt())
+	b.tab[key] = &Node{Id: -1, Accept: -1}
 }
 
 func (b *dfaBuilder) constructAllNilList() {
@@ -241,8 +288,8 @@ func (b *dfaBuilder) makeSt(v *Node, cb func(*Edge) bool) flagSet {
 	st := b.newEmptySt()
 	for _, i := range v.Set {
 		for _, e := range b.nfa[i].E {
-			if st[e.Dst.Id] != nfAccepting && cb(e) {
-				st[e.Dst.Id] = nfAccepting
+			if !st.accepting.has(e.Dst.Id) && cb(e) {
+				st.add(e.Dst.Id, nfAccepting)
 			}
 		}
 	}
@@ -0,0 +1,180 @@
+package graph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// DotOptions cap the size of a DOT graph, so the graphs of huge automata can still be rendered.
+// The zero value writes the whole graph.
+type DotOptions struct {
+	MaxNodes int // The most nodes whose edges are written. Zero means no limit.
+	MaxEdges int // The most edges that are written. Zero means no limit.
+
+	// RuleLabel labels a rule in the legend, e.g., with its regex. If it is nil, the rules are
+	// labeled by their ids.
+	RuleLabel func(rule int) string
+}
+
+// dotColors are the fill colors of the accepting nodes, by their rules. They repeat when the
+// rules outnumber them.
+var dotColors = []string{"green", "lightblue", "orange", "pink", "yellow", "plum", "cyan", "salmon", "khaki", "tan"}
+
+// WriteDotGraph writes the whole graph in DOT format given the start node, and ignores write
+// errors. See WriteDotGraphWithOptions.
+//
+//	$ dot -Tps input.dot -o output.ps
+func WriteDotGraph(out io.Writer, start *Node, id string) {
+	_ = WriteDotGraphWithOptions(out, start, id, DotOptions{})
+}
+
+// WriteDotGraphWithOptions writes a graph in DOT format given the start node. The nodes are written
+// in depth-first order, as they are visited, so neither the graph nor its text are held in memory.
+// The accepting nodes are colored by the rule that they accept, and a legend at the end of the
+// graph maps the colors to the rules. If the options cap the graph, a note at its end tells how
+// many nodes and edges were elided.
+func WriteDotGraphWithOptions(out io.Writer, start *Node, id string, opts DotOptions) error {
+	b := dotGraphBuilder{
+		out:     bufio.NewWriter(out),
+		opts:    opts,
+		seen:    map[*Node]bool{start: true},
+		accepts: map[int]bool{},
+	}
+	b.printf("digraph %v {\n  0[shape=box];\n", id)
+	// The stack of the depth-first walk holds the visited nodes, and the next edge of each.
+	type visit struct {
+		node *Node
+		edge int
+	}
+	stack := []visit{{start, 0}}
+	b.node(start)
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.edge == len(top.node.E) {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		e := top.node.E[top.edge]
+		top.edge++
+		// We use -1 to denote the dead end node in DFAs.
+		if e.Dst.Id == -1 || b.seen[e.Dst] {
+			continue
+		}
+		b.seen[e.Dst] = true
+		b.node(e.Dst)
+		stack = append(stack, visit{e.Dst, 0})
+	}
+	b.legend()
+	if b.elidedNodes > 0 || b.elidedEdges > 0 {
+		b.printf("  elided[shape=note,label=\"%d nodes and %d edges elided\"];\n", b.elidedNodes, b.elidedEdges)
+	}
+	b.printf("}\n")
+	if b.err != nil {
+		return b.err
+	}
+	return b.out.Flush()
+}
+
+type dotGraphBuilder struct {
+	out  *bufio.Writer
+	opts DotOptions
+	seen map[*Node]bool
+	err  error
+
+	// The rules that the written nodes accept, for the legend.
+	accepts map[int]bool
+
+	nodes, edges             int
+	elidedNodes, elidedEdges int
+}
+
+func (b *dotGraphBuilder) printf(format string, a ...any) {
+	if b.err == nil {
+		_, b.err = fmt.Fprintf(b.out, format, a...)
+	}
+}
+
+// node writes a visited node and its edges, unless the options elide them.
+func (b *dotGraphBuilder) node(u *Node) {
+	if b.opts.MaxNodes > 0 && b.nodes >= b.opts.MaxNodes {
+		b.elidedNodes++
+		for _, e := range u.E {
+			if e.Dst.Id != -1 {
+				b.elidedEdges++
+			}
+		}
+		return
+	}
+	b.nodes++
+	if u.Accept >= 0 {
+		b.accepts[u.Accept] = true
+		b.printf("  %v[style=filled,color=%s];\n", u.Id, ruleColor(u.Accept))
+	}
+	for _, e := range u.E {
+		if e.Dst.Id == -1 {
+			continue
+		}
+		if b.opts.MaxEdges > 0 && b.edges >= b.opts.MaxEdges {
+			b.elidedEdges++
+			continue
+		}
+		b.edges++
+		b.printf("  %v -> %v%v;\n", u.Id, e.Dst.Id, edgeLabel(e))
+	}
+}
+
+// legend writes a node of the color of each rule that the written nodes accept, labeled by the
+// rule, in a cluster of their own.
+func (b *dotGraphBuilder) legend() {
+	if len(b.accepts) == 0 {
+		return
+	}
+	rules := make([]int, 0, len(b.accepts))
+	for rule := range b.accepts {
+		rules = append(rules, rule)
+	}
+	slices.Sort(rules)
+	b.printf("  subgraph cluster_legend {\n    label=\"rules\";\n")
+	for _, rule := range rules {
+		label := fmt.Sprintf("rule %d", rule)
+		if b.opts.RuleLabel != nil {
+			label = b.opts.RuleLabel(rule)
+		}
+		b.printf("    rule%d[shape=box,style=filled,color=%s,label=%q];\n", rule, ruleColor(rule), label)
+	}
+	b.printf("  }\n")
+}
+
+// ruleColor returns the color of the nodes that accept the rule. The rules are numbered from 1.
+func ruleColor(rule int) string {
+	return dotColors[(rule-1+len(dotColors))%len(dotColors)]
+}
+
+func edgeLabel(e *Edge) string {
+	switch e.Kind {
+	case KRune:
+		return fmt.Sprintf("[label=%q]", runeToDot(e.R))
+	case KWild:
+		return "[color=blue]"
+	case KClass:
+		label := "[label=\"["
+		for i := 0; i < len(e.Lim); i += 2 {
+			label += runeToDot(e.Lim[i])
+			if e.Lim[i] != e.Lim[i+1] {
+				label += "-" + runeToDot(e.Lim[i+1])
+			}
+		}
+		return label + "]\"]"
+	}
+	return ""
+}
+
+func runeToDot(r rune) string {
+	if strconv.IsPrint(r) {
+		return string(r)
+	}
+	return fmt.Sprintf("U+%X", int(r))
+}
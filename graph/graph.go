@@ -1,9 +1,7 @@
 package graph
 
 import (
-	"fmt"
-	"io"
-	"strconv"
+	"slices"
 )
 
 const (
@@ -39,6 +37,10 @@ type Node struct {
 	Id     int     // Index number. Scoped to a family.
 	Accept int     // True if this is an accepting state.
 	Set    []int   // The NFA nodes represented by a DFA node.
+
+	// Accepts are all the expressions accepted by a DFA node, by precedence.
+	// Accept is the first, if there is any.
+	Accepts []int
 }
 
 type limits []rune
@@ -127,81 +129,51 @@ func newAssertEdge(u, v *Node, a Asserts) *Edge {
 	return e
 }
 
+// compactGraph returns the nodes that are reachable from the start node and can reach an
+// accepting node, numbered densely from the start node (0). The edges to the other nodes are
+// dropped, as no match passes through them. The start node is always kept.
 func compactGraph(start *Node) []*Node {
-	visited := map[int]bool{}
+	visited := map[*Node]bool{start: true}
+	reached := map[*Node][]*Node{} // The reachable nodes, by the nodes they have edges to.
 	nodes := []*Node{start}
 	for pos := 0; pos < len(nodes); pos++ {
 		n := nodes[pos]
 		for _, e := range n.E {
-			if !visited[e.Dst.Id] {
-				visited[e.Dst.Id] = true
+			reached[e.Dst] = append(reached[e.Dst], n)
+			if !visited[e.Dst] {
+				visited[e.Dst] = true
 				nodes = append(nodes, e.Dst)
 			}
 		}
 	}
 
-	for i, v := range nodes {
-		v.Id = i
-	}
-
-	return nodes
-}
-
-// WriteDotGraph Print a graph in DOT format given the start node.
-//
-//	$ dot -Tps input.dot -o output.ps
-func WriteDotGraph(out io.Writer, start *Node, id string) {
-	b := dotGraphBuilder{
-		out:  out,
-		done: make(map[*Node]bool),
-	}
-	_, _ = fmt.Fprintf(out, "digraph %v {\n  0[shape=box];\n", id)
-	b.show(start)
-	_, _ = fmt.Fprintln(out, "}")
-}
-
-type dotGraphBuilder struct {
-	out  io.Writer
-	done map[*Node]bool
-}
-
-func (b *dotGraphBuilder) show(u *Node) {
-	if u.Accept >= 0 {
-		_, _ = fmt.Fprintf(b.out, "  %v[style=filled,color=green];\n", u.Id)
-	}
-	b.done[u] = true
-	for _, e := range u.E {
-		// We use -1 to denote the dead end node in DFAs.
-		if e.Dst.Id == -1 {
-			continue
-		}
-		label := ""
-		runeToDot := func(r rune) string {
-			if strconv.IsPrint(r) {
-				return fmt.Sprintf("%v", string(r))
-			}
-			return fmt.Sprintf("U+%X", int(r))
+	live := map[*Node]bool{}
+	var todo []*Node
+	for _, n := range nodes {
+		if n.Accept >= 0 {
+			live[n] = true
+			todo = append(todo, n)
 		}
-		switch e.Kind {
-		case KRune:
-			label = fmt.Sprintf("[label=%q]", runeToDot(e.R))
-		case KWild:
-			label = "[color=blue]"
-		case KClass:
-			label = "[label=\"["
-			for i := 0; i < len(e.Lim); i += 2 {
-				label += runeToDot(e.Lim[i])
-				if e.Lim[i] != e.Lim[i+1] {
-					label += "-" + runeToDot(e.Lim[i+1])
-				}
+	}
+	for len(todo) > 0 {
+		n := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for _, u := range reached[n] {
+			if !live[u] {
+				live[u] = true
+				todo = append(todo, u)
 			}
-			label += "]\"]"
 		}
-		_, _ = fmt.Fprintf(b.out, "  %v -> %v%v;\n", u.Id, e.Dst.Id, label)
 	}
-	for _, e := range u.E {
-		if !b.done[e.Dst] {
-			b.show(e.Dst)
+
+	compact := nodes[:0]
+	for _, n := range nodes {
+		if n != start && !live[n] {
+			continue
 		}
+		n.E = slices.DeleteFunc(n.E, func(e *Edge) bool { return !live[e.Dst] })
+		n.Id = len(compact)
+		compact = append(compact, n)
 	}
+	return compact
 }
@@ -0,0 +1,93 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// Options control the construction of automata.
+// The zero value builds without any limits.
+type Options struct {
+	MaxStates   int       // Maximal number of DFA states. Zero means no limit.
+	MaxNFANodes int       // Maximal number of NFA nodes. Zero means no limit.
+	Deadline    time.Time // The construction fails after this time. Zero means no deadline.
+
+	// DepthFirst explores the DFA states depth first, as older versions did. By default, they are
+	// explored breadth first, so they are numbered by their distance from the start state, and
+	// the states that are reached together are close to each other.
+	DepthFirst bool
+
+	// Progress, if set, is called as the construction goes, so a slow construction can be
+	// told apart from a hung one.
+	Progress func(Progress)
+
+	// Stats, if set, is called when a construction completes, with its cost.
+	Stats func(Stats)
+}
+
+// Progress is the size of an automaton under construction.
+type Progress struct {
+	NFANodes  int // The number of NFA nodes built so far.
+	DFAStates int // The number of DFA states discovered so far.
+}
+
+// Stats is the cost of a completed construction of an automaton.
+type Stats struct {
+	NFANodes  int           // The number of NFA nodes.
+	DFAStates int           // The number of DFA states. Zero for the construction of an NFA.
+	Duration  time.Duration // The time the construction took.
+}
+
+// LimitError is returned when the construction of an automaton exceeds one of its limits.
+type LimitError struct {
+	Limit string // The name of the exceeded limit.
+	Max   int    // The configured value of the limit (zero for deadlines).
+	Used  int    // The amount used when the limit was exceeded.
+}
+
+func (e *LimitError) Error() string {
+	if e.Max == 0 {
+		return fmt.Sprintf("%s: %v (after %d)", e.Limit, ErrLimitExceeded, e.Used)
+	}
+	return fmt.Sprintf("%s: %v (%d > %d)", e.Limit, ErrLimitExceeded, e.Used, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+func (o *Options) stats(s Stats) {
+	if o.Stats != nil {
+		o.Stats(s)
+	}
+}
+
+func (o *Options) checkNfaNodes(count int) error {
+	if o.MaxNFANodes > 0 && count > o.MaxNFANodes {
+		return &LimitError{Limit: "nfa-nodes", Max: o.MaxNFANodes, Used: count}
+	}
+	return o.checkDeadline(count)
+}
+
+func (o *Options) checkStates(count int) error {
+	if o.MaxStates > 0 && count > o.MaxStates {
+		return &LimitError{Limit: "dfa-states", Max: o.MaxStates, Used: count}
+	}
+	return o.checkDeadline(count)
+}
+
+func (o *Options) checkDeadline(count int) error {
+	if !o.Deadline.IsZero() && time.Now().After(o.Deadline) {
+		return &LimitError{Limit: "timeout", Used: count}
+	}
+	return nil
+}
+
+func (o *Options) report(p Progress) {
+	if o.Progress != nil {
+		o.Progress(p)
+	}
+}
@@ -0,0 +1,165 @@
+package graph
+
+import (
+	"fmt"
+	"slices"
+)
+
+// minimize merges the equivalent states of the DFA with Hopcroft's algorithm, and returns its
+// states, numbered in the order of the first state of each merged group, so the start state
+// stays 0. Two states are equivalent if they accept the same rules, by precedence, and their
+// edges of each label lead to equivalent states. The labels are compared rather than the runes
+// that they match, so states whose edges split the runes differently are never merged.
+func minimize(dfa []*Node) []*Node {
+	if len(dfa) < 2 {
+		return dfa
+	}
+	// The dead state, which the DFA does not list, follows the others, and is not merged.
+	states := slices.Clone(dfa)
+	index := map[*Node]int{}
+	for i, v := range dfa {
+		index[v] = i
+	}
+	for _, v := range dfa {
+		for _, e := range v.E {
+			if _, ok := index[e.Dst]; !ok {
+				index[e.Dst] = len(states)
+				states = append(states, e.Dst)
+			}
+		}
+	}
+
+	// The labels of the edges of each state, and the edges that lead to each state, by label.
+	labels := map[string]int{}
+	type labeled struct{ label, state int }
+	edges := make([][]int, len(states))
+	inverse := make([][]labeled, len(states))
+	for i, v := range states {
+		for _, e := range v.E {
+			key := fmt.Sprint(e.Kind, e.R, e.A, e.Lim)
+			if _, ok := labels[key]; !ok {
+				labels[key] = len(labels)
+			}
+			edges[i] = append(edges[i], labels[key])
+			inverse[index[e.Dst]] = append(inverse[index[e.Dst]], labeled{labels[key], i})
+		}
+	}
+
+	// At first, the states are grouped by what they accept and by the labels of their edges.
+	block := make([]int, len(states))
+	var blocks [][]int
+	initial := map[string]int{}
+	for i, v := range states {
+		slices.Sort(edges[i])
+		key := fmt.Sprint(v.Accept, v.Accepts, edges[i])
+		if i >= len(dfa) {
+			key = "dead"
+		}
+		b, ok := initial[key]
+		if !ok {
+			b = len(blocks)
+			initial[key] = b
+			blocks = append(blocks, nil)
+		}
+		block[i] = b
+		blocks[b] = append(blocks[b], i)
+	}
+
+	// The blocks are split by the states that each label leads to a pending block from, until
+	// none is pending.
+	pending := make([]bool, len(blocks))
+	var todo []int
+	for b := range blocks {
+		pending[b] = true
+		todo = append(todo, b)
+	}
+	marked := make([]bool, len(states))
+	for len(todo) > 0 {
+		splitter := slices.Clone(blocks[todo[len(todo)-1]])
+		pending[todo[len(todo)-1]] = false
+		todo = todo[:len(todo)-1]
+
+		preimages := map[int][]int{}
+		for _, dst := range splitter {
+			for _, l := range inverse[dst] {
+				preimages[l.label] = append(preimages[l.label], l.state)
+			}
+		}
+		var splitLabels []int
+		for label := range preimages {
+			splitLabels = append(splitLabels, label)
+		}
+		// The labels are sorted, so the states are numbered the same way in every run.
+		slices.Sort(splitLabels)
+		for _, label := range splitLabels {
+			var touched []int
+			for _, src := range preimages[label] {
+				if !marked[src] {
+					marked[src] = true
+					if !slices.Contains(touched, block[src]) {
+						touched = append(touched, block[src])
+					}
+				}
+			}
+			for _, b := range touched {
+				var in, out []int
+				for _, s := range blocks[b] {
+					if marked[s] {
+						in = append(in, s)
+					} else {
+						out = append(out, s)
+					}
+				}
+				if len(out) == 0 {
+					continue
+				}
+				blocks[b] = out
+				blocks = append(blocks, in)
+				for _, s := range in {
+					block[s] = len(blocks) - 1
+				}
+				// If the block is pending, so are both of its parts. Otherwise, splitting by
+				// the smaller part is enough.
+				if pending[b] || len(in) <= len(out) {
+					pending = append(pending, true)
+					todo = append(todo, len(blocks)-1)
+				} else {
+					pending = append(pending, false)
+					pending[b] = true
+					todo = append(todo, b)
+				}
+			}
+			for _, src := range preimages[label] {
+				marked[src] = false
+			}
+		}
+	}
+
+	// The first state of each block stands for the block, with the NFA nodes of all of its states.
+	slices.SortFunc(blocks, func(u, v []int) int { return u[0] - v[0] })
+	rep := make([]*Node, len(blocks))
+	var minimized []*Node
+	for b, members := range blocks {
+		first := states[members[0]]
+		for _, s := range members {
+			block[s] = b
+		}
+		rep[b] = first
+		if members[0] >= len(dfa) {
+			continue
+		}
+		first.Id = len(minimized)
+		for _, s := range members[1:] {
+			first.Set = append(first.Set, states[s].Set...)
+		}
+		slices.Sort(first.Set)
+		first.Set = slices.Compact(first.Set)
+		minimized = append(minimized, first)
+	}
+	for _, v := range minimized {
+		for _, e := range v.E {
+			e.Dst = rep[block[index[e.Dst]]]
+		}
+	}
+	return minimized
+}
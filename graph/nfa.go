@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"regexp/syntax"
 	"slices"
+	"time"
+	"unicode"
 )
 
 type Expression interface {
@@ -29,11 +31,18 @@ type Expression interface {
 // e.g. the alphabet of /[0-9]*[Ee][2-5]*/ is singles: { E, e },
 // lim: { [0-1], [2-5], [6-9] } and the wild element.
 func BuildNfa[E Expression](expressions []E) ([]*Node, error) {
+	return BuildNfaWithOptions(expressions, Options{})
+}
+
+// BuildNfaWithOptions is like BuildNfa, but fails with a LimitError if the
+// construction exceeds the given limits.
+func BuildNfaWithOptions[E Expression](expressions []E, opts Options) ([]*Node, error) {
+	start := time.Now()
 	b := nfaBuilder{}
 	rootNode := b.newNode()
 
 	for _, x := range expressions {
-		r, err := syntax.Parse(x.GetRegex(), syntax.Perl)
+		r, err := parseRegex(x)
 		if err != nil {
 			return nil, err
 		}
@@ -43,11 +52,17 @@ func BuildNfa[E Expression](expressions []E) ([]*Node, error) {
 		}
 		sNfa.end.Accept = x.GetId()
 		newNilEdge(rootNode, sNfa.start)
+		if err = opts.checkNfaNodes(b.nextId); err != nil {
+			return nil, err
+		}
+		opts.report(Progress{NFANodes: b.nextId})
 	}
 
 	// Compute shortlist of nodes (reachable nodes), as we may have discarded
 	// nodes left over from parsing. Also, make `nfaRoot` the start node.
-	return compactGraph(rootNode), nil
+	nfa := compactGraph(rootNode)
+	opts.stats(Stats{NFANodes: len(nfa), Duration: time.Since(start)})
+	return nfa, nil
 }
 
 type nfaBuilder struct {
@@ -85,9 +100,11 @@ func (b *nfaBuilder) build(r *syntax.Regexp) (subNfa, error) {
 		for _, curRune := range r.Rune {
 			n := b.newNode()
 			newRuneEdge(curEnd, n, curRune)
-			if r.Flags&syntax.FoldCase != 0 && curRune >= 'A' && curRune <= 'Z' {
-				curRune += 'a' - 'A'
-				newRuneEdge(curEnd, n, curRune)
+			if r.Flags&syntax.FoldCase != 0 {
+				// Add an edge for every rune in the case folding orbit, e.g., k, K and the Kelvin sign.
+				for f := unicode.SimpleFold(curRune); f != curRune; f = unicode.SimpleFold(f) {
+					newRuneEdge(curEnd, n, f)
+				}
 			}
 			curEnd = n
 		}
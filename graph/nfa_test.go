@@ -3,6 +3,7 @@ package graph
 import (
 	"fmt"
 	"regexp/syntax"
+	"slices"
 	"strings"
 	"testing"
 
@@ -134,3 +135,205 @@ func parseAndShowNfa(exp string) error {
 func TestExpressions(t *testing.T) {
 	require.NoError(t, parseAndShowNfa("(?i) %[0-9a-z]+ x{2,5} (abc|c) (abc|a) (a|d) (a|b) y{3} y{3,} [^abc]"))
 }
+
+type testExpression struct {
+	regex string
+	id    int
+}
+
+func (x testExpression) GetRegex() string { return x.regex }
+func (x testExpression) GetId() int       { return x.id }
+
+func TestDfaAccepts(t *testing.T) {
+	nfa, err := BuildNfa([]testExpression{{"if", 1}, {"[a-z]+", 2}, {"i.", 3}})
+	require.NoError(t, err)
+	var accepts []string
+	for _, v := range BuildDfa(nfa) {
+		if v.Accept < 0 {
+			require.Empty(t, v.Accepts)
+			continue
+		}
+		require.Equal(t, v.Accept, v.Accepts[0])
+		accepts = append(accepts, fmt.Sprint(v.Accepts))
+	}
+	require.Contains(t, accepts, "[1 2 3]")
+	require.Contains(t, accepts, "[2 3]")
+	require.Contains(t, accepts, "[2]")
+}
+
+func TestCompactGraph(t *testing.T) {
+	b := graphBuilder{}
+	start, a, end, dead1, dead2, unreached := b.newNode(), b.newNode(), b.newNode(), b.newNode(), b.newNode(), b.newNode()
+	end.Accept = 1
+	newRuneEdge(start, dead1, 'x')
+	newNilEdge(dead1, dead2)
+	newWildEdge(dead2, dead1)
+	newRuneEdge(start, a, 'a')
+	newNilEdge(a, end)
+	newNilEdge(unreached, end)
+
+	nodes := compactGraph(start)
+	require.Equal(t, []*Node{start, a, end}, nodes)
+	for i, n := range nodes {
+		require.Equal(t, i, n.Id)
+	}
+	require.Len(t, start.E, 1)
+	require.Equal(t, a, start.E[0].Dst)
+
+	// A start node that cannot reach an accepting node is kept without edges.
+	b = graphBuilder{}
+	start, dead1 = b.newNode(), b.newNode()
+	newRuneEdge(start, dead1, 'x')
+	require.Equal(t, []*Node{start}, compactGraph(start))
+	require.Empty(t, start.E)
+}
+
+func TestBitset(t *testing.T) {
+	s := newBitset(130)
+	require.Len(t, s, 3)
+	for _, i := range []int{129, 0, 64, 63} {
+		s.add(i)
+	}
+	s.remove(64)
+	var members []int
+	s.forEach(func(i int) {
+		members = append(members, i)
+	})
+	require.Equal(t, []int{0, 63, 129}, members)
+	require.True(t, s.has(63))
+	require.False(t, s.has(64))
+
+	other := newBitset(130)
+	other.add(0)
+	require.NotEqual(t, s.key(), other.key())
+	other.add(63)
+	other.add(129)
+	require.Equal(t, s.key(), other.key())
+}
+
+func TestDfaOrder(t *testing.T) {
+	exps := []testExpression{{"ab", 1}, {"cde", 2}, {"cf", 3}}
+	for _, depthFirst := range []bool{false, true} {
+		nfa, err := BuildNfa(exps)
+		require.NoError(t, err)
+		dfa, err := BuildDfaWithOptions(nfa, Options{DepthFirst: depthFirst})
+		require.NoError(t, err)
+		require.Len(t, dfa, 7)
+
+		// Breadth first, the states are numbered by their distance from the start state.
+		distance := map[int]int{0: 0}
+		for queue := []*Node{dfa[0]}; len(queue) > 0; queue = queue[1:] {
+			for _, e := range queue[0].E {
+				if _, ok := distance[e.Dst.Id]; !ok && e.Dst.Id >= 0 {
+					distance[e.Dst.Id] = distance[queue[0].Id] + 1
+					queue = append(queue, e.Dst)
+				}
+			}
+		}
+		sorted := slices.IsSortedFunc(dfa, func(u, v *Node) int { return distance[u.Id] - distance[v.Id] })
+		require.Equal(t, !depthFirst, sorted)
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	nfa, err := BuildNfa([]testExpression{{"abc|xbc", 1}, {"[a-z]+d", 2}})
+	require.NoError(t, err)
+	dfa := BuildDfa(nfa)
+	// The states after a and after x are merged, and so are those after ab and after xb.
+	require.Len(t, dfa, 6)
+	for i, v := range dfa {
+		require.Equal(t, i, v.Id)
+	}
+
+	accept := func(text string) int {
+		v := dfa[0]
+		for _, r := range text {
+			var next *Node
+			for _, e := range v.E {
+				if next == nil && (e.Kind == KRune && e.R == r || e.Kind == KClass && e.Lim.inClass(r)) {
+					next = e.Dst
+				}
+			}
+			if next == nil || next.Id < 0 {
+				return -1
+			}
+			v = next
+		}
+		return v.Accept
+	}
+	for text, want := range map[string]int{"abc": 1, "xbc": 1, "abcd": 2, "xd": 2, "ab": -1, "xyz": -1} {
+		require.Equal(t, want, accept(text), text)
+	}
+}
+
+func TestWriteDotGraph(t *testing.T) {
+	b := graphBuilder{}
+	start, a, end := b.newNode(), b.newNode(), b.newNode()
+	end.Accept = 1
+	newRuneEdge(start, a, 'a')
+	newClassEdge(a, a, []rune{'x', 'z', '\n', '\n'})
+	newWildEdge(a, end)
+	newRuneEdge(start, end, 'b')
+
+	var out strings.Builder
+	WriteDotGraph(&out, start, "DFA_0")
+	require.Equal(t, `digraph DFA_0 {
+  0[shape=box];
+  0 -> 1[label="a"];
+  0 -> 2[label="b"];
+  1 -> 1[label="[x-zU+A]"];
+  1 -> 2[color=blue];
+  2[style=filled,color=green];
+  subgraph cluster_legend {
+    label="rules";
+    rule1[shape=box,style=filled,color=green,label="rule 1"];
+  }
+}
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, WriteDotGraphWithOptions(&out, start, "DFA_0", DotOptions{MaxNodes: 2, MaxEdges: 3}))
+	require.Equal(t, `digraph DFA_0 {
+  0[shape=box];
+  0 -> 1[label="a"];
+  0 -> 2[label="b"];
+  1 -> 1[label="[x-zU+A]"];
+  elided[shape=note,label="1 nodes and 1 edges elided"];
+}
+`, out.String())
+
+	// The accepting nodes are colored by their rules, which the legend labels.
+	a.Accept = 2
+	out.Reset()
+	require.NoError(t, WriteDotGraphWithOptions(&out, start, "DFA_0", DotOptions{
+		RuleLabel: func(rule int) string { return fmt.Sprintf("/r%d/", rule) },
+	}))
+	require.Equal(t, `digraph DFA_0 {
+  0[shape=box];
+  0 -> 1[label="a"];
+  0 -> 2[label="b"];
+  1[style=filled,color=lightblue];
+  1 -> 1[label="[x-zU+A]"];
+  1 -> 2[color=blue];
+  2[style=filled,color=green];
+  subgraph cluster_legend {
+    label="rules";
+    rule1[shape=box,style=filled,color=green,label="/r1/"];
+    rule2[shape=box,style=filled,color=lightblue,label="/r2/"];
+  }
+}
+`, out.String())
+
+	// Long chains are walked without recursion.
+	b = graphBuilder{}
+	start = b.newNode()
+	for u, i := start, 0; i < 100000; i++ {
+		v := b.newNode()
+		newRuneEdge(u, v, 'a')
+		u = v
+	}
+	out.Reset()
+	require.NoError(t, WriteDotGraphWithOptions(&out, start, "NFA_0", DotOptions{MaxEdges: 10}))
+	require.Equal(t, 14, strings.Count(out.String(), "\n"))
+	require.Contains(t, out.String(), `label="0 nodes and 99990 edges elided"`)
+}
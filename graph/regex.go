@@ -0,0 +1,141 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+)
+
+var ErrUnsupportedRegex = errors.New("unsupported regex construct")
+
+// RegexError is returned when an expression's regex cannot be used to build an NFA.
+type RegexError struct {
+	Id    int    // The Id of the offending expression.
+	Regex string // The offending regex.
+	Pos   int    // The byte offset of the problem within the regex, or -1 if unknown.
+	Err   error  // Either a *syntax.Error or wraps ErrUnsupportedRegex.
+}
+
+func (e *RegexError) Error() string {
+	if e.Pos < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (at offset %d)", e.Err, e.Pos)
+}
+
+func (e *RegexError) Unwrap() error {
+	return e.Err
+}
+
+// flagged is implemented by the expressions whose regexes are not parsed with the default flags,
+// syntax.Perl.
+type flagged interface {
+	GetFlags() syntax.Flags // The flags used to parse the regex.
+}
+
+func parseRegex[E Expression](x E) (*syntax.Regexp, error) {
+	regex := x.GetRegex()
+	flags := syntax.Perl
+	if f, ok := any(x).(flagged); ok {
+		flags = f.GetFlags()
+	}
+	r, err := syntax.Parse(regex, flags)
+	if err != nil {
+		rErr := &RegexError{Id: x.GetId(), Regex: regex, Pos: -1, Err: err}
+		var sErr *syntax.Error
+		if errors.As(err, &sErr) {
+			rErr.Pos = syntaxErrorPos(regex, flags, sErr)
+			if sErr.Code == syntax.ErrInvalidEscape && len(sErr.Expr) == 2 && '1' <= sErr.Expr[1] && sErr.Expr[1] <= '9' {
+				rErr.Err = fmt.Errorf("%w: backreference %s", ErrUnsupportedRegex, sErr.Expr)
+			}
+		}
+		return nil, rErr
+	}
+	if err = validateRegex(r); err != nil {
+		return nil, &RegexError{Id: x.GetId(), Regex: regex, Pos: constructPos(regex, err), Err: err}
+	}
+	return r, nil
+}
+
+var (
+	errNonGreedy  = fmt.Errorf("%w: non-greedy repetition", ErrUnsupportedRegex)
+	errNoMatch    = fmt.Errorf("%w: expression that matches nothing", ErrUnsupportedRegex)
+	errEmptyClass = fmt.Errorf("%w: character class that matches nothing", ErrUnsupportedRegex)
+)
+
+// validateRegex rejects constructs that the NFA builder would silently misinterpret.
+func validateRegex(r *syntax.Regexp) error {
+	switch r.Op {
+	case syntax.OpNoMatch:
+		return errNoMatch
+	case syntax.OpCharClass:
+		if len(r.Rune) == 0 {
+			return errEmptyClass
+		}
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		if r.Flags&syntax.NonGreedy != 0 {
+			return errNonGreedy
+		}
+	}
+	for _, s := range r.Sub {
+		if err := validateRegex(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// constructPos makes a best-effort attempt to locate the construct that caused the error in the regex source.
+// syntaxErrorPos returns the byte offset of the parse error in the regex. The error only has the
+// offending text, which may occur earlier in the regex too, e.g., escaped, so the error is at the
+// first occurrence at which the regex, up to the end of the text, fails with the same error.
+func syntaxErrorPos(regex string, flags syntax.Flags, sErr *syntax.Error) int {
+	if sErr.Code == syntax.ErrTrailingBackslash {
+		return len(regex) - 1
+	}
+	for i := 0; i+len(sErr.Expr) <= len(regex); i++ {
+		j := strings.Index(regex[i:], sErr.Expr)
+		if j < 0 {
+			break
+		}
+		i += j
+		_, err := syntax.Parse(regex[:i+len(sErr.Expr)], flags)
+		var prefixErr *syntax.Error
+		if errors.As(err, &prefixErr) && *prefixErr == *sErr {
+			return i
+		}
+	}
+	return strings.Index(regex, sErr.Expr)
+}
+
+func constructPos(regex string, err error) int {
+	var candidates []string
+	switch {
+	case errors.Is(err, errNonGreedy):
+		candidates = []string{"*?", "+?", "??", "}?", "(?U"}
+	case errors.Is(err, errEmptyClass):
+		candidates = []string{"[^"}
+	}
+	pos := -1
+	for _, c := range candidates {
+		if i := findUnescaped(regex, c); i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	return pos
+}
+
+// findUnescaped returns the index of the first occurrence of sub in regex that is not escaped by a backslash.
+func findUnescaped(regex, sub string) int {
+	for i := 0; i+len(sub) <= len(regex); i++ {
+		if regex[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(regex[i:], sub) {
+			return i
+		}
+	}
+	return -1
+}
@@ -2,17 +2,29 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	_ "embed"
+	"encoding/gob"
 	"fmt"
+	"go/ast"
+	gofmt "go/format"
+	goparser "go/parser"
+	"go/token"
 	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	exec2 "github.com/liran-funaro/nex/exec"
+	"github.com/liran-funaro/nex/nexruntime"
 	"github.com/liran-funaro/nex/parser"
 	"github.com/liran-funaro/nex/writer"
 	"github.com/stretchr/testify/require"
@@ -45,6 +57,8 @@ func TestNexPrograms(t *testing.T) {
 	}{
 		{"lc.nex", "no newline", "0 10\n"},
 		{"lc.nex", "one two three\nfour five six\n", "2 28\n"},
+		{"lc.l", "one two three\nfour five six\n", "2 28\n"},
+		{"echo.l", "a cat has 9 lives\n", "a catcat has # lives\n"},
 
 		{"toy.nex", toyInput, toyOutput},
 
@@ -58,6 +72,7 @@ func TestNexPrograms(t *testing.T) {
 		{"peter.nex", peterInput, peterOutput},
 		{"peter2.nex", "###\n#\n####\n", "rect 1 4 1 2\nrect 1 2 2 3\nrect 1 5 3 4\n"},
 		{"u.nex", "١ + ٢ + ... + ١٨ = 一百五十三", "1 + 2 + ... + 18 = 153"},
+		{"u-echo.nex", "١ + ٢ + ... + ١٨ = 一百五十三", "1 + 2 + ... + 18 = 153"},
 		{"bug50.nex", "# comment 1\nhello42:\n# comment 2\n\na\nblah:42x\n", "COMMENT: # comment 1\nTEXT: hello42\nERROR: :\nCOMMENT: # comment 2\nTEXT: a\nTEXT: blah:42x\n"},
 	} {
 		t.Run(x.prog, func(t *testing.T) {
@@ -191,8 +206,7 @@ func TestCornerCases(t *testing.T) {
 			"abcd\nbabcd\naabcd\nabcabcd\n", "ABCD\nABCD\nABCD\nABCD\n",
 		},
 
-		// Nested regex test. The simplistic parser means we must use commented
-		// braces to balance out quoted braces.
+		// Nested regex test. Braces in strings do not need balancing.
 		// Sprinkle in a couple of return statements to check Lex() saves stack
 		// state correctly between calls.
 		{
@@ -206,11 +220,9 @@ func TestCornerCases(t *testing.T) {
   /e/        { *lval += "E" }
   /ccc/ <    {
     *lval += "{"
-    // }  [balance out the quoted left brace]
   }
   /./        { *lval += "?" }
   >          {
-    // {  [balance out the quoted right brace]
     *lval += "}"
     return 2
   }
@@ -260,31 +272,165 @@ a a . a .
 . . c c
 d d d d
 e e . .`,
+		}, {
+			"Whole-spec case-insensitive mode",
+			`
+%option caseless
+/abc/    { *lval += "0" }
+/[x-z]+/ { *lval += "1" }
+/./      { *lval += "." }
+`,
+			"abc ABC aBc xYz", "0.0.0.1",
+		}, {
+			"Whole-spec regex flags",
+			`
+%flags dotnl -oneline
+/^a.b$/ { *lval += "0" }
+/./     { *lval += "." }
+`,
+			"a\nb\na b", "0.0",
+		}, {
+			"Gaps between matches",
+			`
+/[a-z]+/ { *lval += yySymType(fmt.Sprintf("%q@%d:%d,", yylex.Gap(), yylex.GapLine(), yylex.GapColumn())) }
+`,
+			"ab  cd\n ef--", `""@0:0,"  "@0:2,"\n "@0:6,`,
+		}, {
+			"Error frames for unmatched text",
+			`
+%error { *lval += yySymType(fmt.Sprintf("[%q@%d:%d]", yylex.Text(), yylex.Line(), yylex.Column())) }
+/[a-z]+/ < { *lval += "w" }
+  /[a-y]+/ { }
+> { }
+/ / { }
+`,
+			"ab ?? cz\n!", `w["??"@0:3]w["z"@0:7]["\n!"@0:8]`,
+		}, {
+			"One error frame for each run of unmatched text",
+			`
+%error { l, c := yylex.TextPosition(len(yylex.Text())); *lval += yySymType(fmt.Sprintf("[%d@%d:%d-%d:%d]", len(yylex.Text()), yylex.Line(), yylex.Column(), l, c)) }
+/[a-z]+/ { *lval += "w" }
+`,
+			"ab" + strings.Repeat("#!\n", 500) + "cd", "w[1500@0:2-500:0]w",
+		}, {
+			"The ranges of tokens that span lines",
+			`
+/\/\*([^*]|\*+[^*\/])*\*+\// { *lval += yySymType(fmt.Sprintf("c[%d:%d-%d:%d]", yylex.Line(), yylex.Column(), yylex.EndLine(), yylex.EndColumn())) }
+/"[^"]*"/ < { *lval += yySymType(fmt.Sprintf("s[%d:%d-%d:%d", yylex.Line(), yylex.Column(), yylex.EndLine(), yylex.EndColumn())) }
+  /\n/ { *lval += yySymType(fmt.Sprintf("(%d:%d-%d:%d)", yylex.Line(), yylex.Column(), yylex.EndLine(), yylex.EndColumn())) }
+> { *lval += "]" }
+/[a-z]+\n/ { *lval += yySymType(fmt.Sprintf("w[%d:%d-%d:%d]", yylex.Line(), yylex.Column(), yylex.EndLine(), yylex.EndColumn())) }
+/ / { }
+`,
+			"x /* a\n**\nb */ \"\nst\nr\" ab\n", "c[0:2-2:4]s[2:5-4:2(2:6-3:0)(3:2-4:0)]w[4:3-5:0]",
+		}, {
+			"Grapheme clusters",
+			`%option graphemes
+/[^ ]+/ { for _, g := range yylex.Graphemes() { *lval += yySymType(fmt.Sprintf("[%+q@%d:%d,%d]", g.Text, g.Line, g.Column, g.Offset)) } }
+/ / { }
+`,
+			"e\u0301te\u0301 \U0001f1eb\U0001f1f7x\U0001f469\u200d\U0001f4bb\U0001f44d\U0001f3fd\r\n\ud55c\u1100\u1161\u11a8",
+			`["e\u0301"@0:0,0]["t"@0:2,2]["e\u0301"@0:3,3]["\U0001f1eb\U0001f1f7"@0:6,6]["x"@0:8,8]` +
+				`["\U0001f469\u200d\U0001f4bb"@0:9,9]["\U0001f44d\U0001f3fd"@0:12,12]["\r\n"@0:14,14]["\ud55c"@1:0,16]` +
+				`["\u1100\u1161\u11a8"@1:1,17]`,
+		}, {
+			"Echo",
+			`%option echo
+/[0-9]+/ { yylex.Echo(); *lval += "#" }
+/ +/ { }
+`,
+			"ab 12 c3", "ab12c3##",
+		}, {
+			"Offsets of long lines",
+			`
+/x/  { *lval += yySymType(fmt.Sprintf("[%d:%d@%d/%d]", yylex.Line(), yylex.Column(), yylex.Offset(), yylex.ByteOffset())) }
+/é+/ ;
+/a+/ { *lval += yySymType(fmt.Sprintf("(%d+%q)", yylex.GapOffset(), yylex.Gap())) }
+`,
+			strings.Repeat("é", 1<<20) + "x\nbbax", `[0:1048576@1048576/2097152](1048577+"\nbb")[1:3@1048581/2097157]`,
+		}, {
+			"Sub-lexers",
+			`
+/"[^"]*"/ %sublexer str < { *lval += "<" }
+  /\\./ { *lval += "E" }
+  /[a-z]/ { *lval += yySymType(yylex.Text()) }
+> { *lval += ">" }
+/'[^']*'/ -> @str
+/ / { }
+`,
+			`"a\nb" 'c\td'`, "<aEb><cEd>",
+		}, {
+			"Lexer stats",
+			`
+%option stats
+< { }
+/[a-z]+/ { }
+> { *lval += yySymType(fmt.Sprintf("%+v", yylex.Stats())) }
+`,
+			"ab é?? cd\n", "{Matches:2 Runes:10 Bytes:11 Errors:2 MaxBuffer:3}",
+		}, {
+			"Gap at the end of the input",
+			`
+< { }
+/[a-z]+/ { *lval += "w" }
+> { *lval += yySymType(fmt.Sprintf("%q@%d:%d", yylex.Gap(), yylex.GapLine(), yylex.GapColumn())) }
+`,
+			"ab cd\n--", `ww"\n--"@0:5`,
+		}, {
+			"Positions inside a match",
+			`
+/x[^x]*x/ {
+  for _, i := range []int{-1, 0, 4, 7, 8, 100} {
+    l, c := yylex.TextPosition(i)
+    *lval += yySymType(fmt.Sprintf("%d:%d,", l, c))
+  }
+}
+`,
+			"ab x\nyz\nw x", "0:3,0:3,1:2,2:2,2:3,2:3,",
 		}, {
 			"Delim and escape",
 			`
 /a\// { *lval += "0" }
+/a\\/ { *lval += "2" }
 _b\__  { *lval += "1" }
 "\s+" { *lval += yylex.Text() }
 '.'   { *lval += "." }
 `,
-			"a/ a\\ aa b_ b\\ bb c", "0 .. .. 1 .. .. .",
+			"a/ a\\ aa b_ b\\ bb c", "0 2 .. 1 .. .. .",
 		},
 	} {
 		t.Run(fmt.Sprintf("[%d] %s", i, x.name), func(t *testing.T) {
 			t.Parallel()
-			program, err := parser.ParseNex(strings.NewReader(x.prog + cornerCasesMainDoc))
-			require.NoError(t, err)
-			b := writer.LexerBuilder{}
-			code, err := b.DumpFormattedLexer(program)
-			require.NoError(t, err)
-			outPath := makeProgramFile(t, outputDir, i, "prog")
-			require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
-			testProgram(t, outputDir, x.in, x.out, outPath)
+			testSpec(t, outputDir, i, x.prog+cornerCasesMainDoc, x.in, x.out)
 		})
 	}
 }
 
+const sectionLexerMainDoc = `//
+package main
+import ("bytes";"io";"os")
+
+type yySymType = string
+
+func main() {
+  b, _ := io.ReadAll(os.Stdin)
+  for _, outer := range []bool{false, true} {
+    lval := new(yySymType)
+    l, _ := NewSectionLexer(io.NewSectionReader(bytes.NewReader(b), 6, 4), outer, nil)
+    for l.Lex(lval) != 0 { }
+    fmt.Print(string(*lval))
+  }
+}
+`
+
+func TestSectionLexer(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "section-lexer")
+	testSpec(t, outputDir, 0, `
+/\*/    { *lval += yySymType(fmt.Sprintf("[%d,%d]", yylex.Line(), yylex.Column())) }
+`+sectionLexerMainDoc, "..\n.*\n*.*\n*", "[0,0][0,2][2,0][2,2]")
+}
+
 //go:embed test-data/rp-input.txt
 var rpInput string
 
@@ -309,39 +455,2151 @@ func TestWax(t *testing.T) {
 		testTackyInput, testTackyOutput)
 }
 
-// ################################################################################
-// # Helper functions
-// ################################################################################
+func TestTopBlock(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "top-block")
+	spec := `%top{
+//go:build !nex_never
 
-func copyToDir(t *testing.T, dst, src string) {
-	dst = filepath.Join(dst, filepath.Base(src))
-	s, err := os.Open(src)
+// Copyright notice.
+}
+/a/ { *lval += "A" }
+/./ { *lval += "." }
+` + cornerCasesMainDoc
+	program, err := parser.ParseNex(strings.NewReader(spec))
 	require.NoError(t, err)
-	defer func() { require.NoError(t, s.Close()) }()
-	d, err := os.Create(dst)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
 	require.NoError(t, err)
-	defer func() { require.NoError(t, d.Close()) }()
-	_, err = io.Copy(d, s)
+	require.True(t, strings.HasPrefix(string(code), "//go:build !nex_never\n\n// Copyright notice.\n\n// Code generated by nex."))
+	testSpec(t, outputDir, 0, spec, "abc", "A..")
+}
+
+// TestBuildConstraintAndGoVersion generates a lexer with a //go:build line and for Go 1.21,
+// which leaves out NewSectionLexer, and fails for an action that ranges over an int.
+func TestBuildConstraintAndGoVersion(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "go-version")
+	program, err := parser.ParseNex(strings.NewReader(`
+/a/ { *lval += "A" }
+/./ { *lval += "." }
+` + cornerCasesMainDoc))
 	require.NoError(t, err)
+	b := writer.LexerBuilder{BuildConstraint: "!nex_never", GoVersion: "1.21"}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(code), "//go:build !nex_never\n\n// Code generated by nex."))
+	require.NotContains(t, string(code), "NewSectionLexer")
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	testProgram(t, outputDir, "abc", "A..", outPath)
+
+	program, err = parser.ParseNex(strings.NewReader(`
+/a/ { for range 3 { *lval += "A" } }
+` + cornerCasesMainDoc))
+	require.NoError(t, err)
+	_, err = b.DumpFormattedLexer(program)
+	require.ErrorContains(t, err, "requires go1.22 or later")
 }
 
-func runCmd(t *testing.T, cwd, bin string, s ...string) {
-	cmd := exec.Command(bin, s...)
-	if cwd != "" {
-		cmd.Dir = cwd
+func TestTinyLexer(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "tiny")
+	program, err := parser.ParseNex(strings.NewReader(`
+/é+/ { *lval += yySymType(fmt.Sprint(len(yylex.Text()))) }
+/a/ { *lval += "A" }
+` + cornerCasesMainDoc))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{Tiny: true}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	for _, s := range []string{`"bufio"`, `"context"`, "chan ", "go func"} {
+		require.NotContains(t, string(code), s)
+	}
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	// The runes cross the ends of the buffer of the input.
+	testProgram(t, outputDir, "a"+strings.Repeat("é", 5000)+"a", "A10000A", outPath)
+
+	for spec, want := range map[string]string{
+		"%option push\n/a/ { }\n":                    "tiny: %option push needs goroutines",
+		"/a/ { go func() {}() }\n":                   "a go statement",
+		"/a/ { ch := make(chan int, 1); ch <- 1 }\n": "a channel",
+	} {
+		program, err = parser.ParseNex(strings.NewReader(spec + cornerCasesMainDoc))
+		require.NoError(t, err)
+		_, err = b.DumpFormattedLexer(program)
+		require.ErrorContains(t, err, want)
 	}
-	output, err := cmd.CombinedOutput()
-	require.NoErrorf(t, err, "Command: %s\nOutput: %s\n", s, string(output))
 }
 
-func testProgram(t *testing.T, cwd, input, output string, goFiles ...string) {
+// TestGenericLexer scans the same input with lexers of two types of semantic values.
+func TestGenericLexer(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "generic")
+	program, err := parser.ParseNex(strings.NewReader(`%prefix calc
+/[0-9]+/ {
+	switch lval := any(lval).(type) {
+	case *int:
+		*lval, _ = strconv.Atoi(yylex.Text())
+	case *string:
+		*lval = yylex.Text()
+	}
+	return 1
+}
+/./ { }
+//
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func scan[T any](l *Lexer[T]) (values []T) {
+	var lval T
+	for l.Lex(&lval) != 0 {
+		values = append(values, lval)
+	}
+	return values
+}
+
+func main() {
+	in, _ := io.ReadAll(os.Stdin)
+	fmt.Print(scan(NewLexer[int](strings.NewReader(string(in)))))
+	fmt.Printf("%q", scan(NewLexer[string](strings.NewReader(string(in)))))
+}
+`))
+	require.NoError(t, err)
+	for i, b := range []writer.LexerBuilder{{Generic: true}, {Generic: true, Synchronous: true}, {Generic: true, Replay: true, Observer: true}} {
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		require.Contains(t, string(code), "func (calclex *Lexer[T]) Lex(lval *T) int {")
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "1+23 x 456", `[1 23 456]["1" "23" "456"]`, outPath)
+	}
+
+	b := writer.LexerBuilder{Generic: true, Package: "calc"}
+	_, err = b.DumpFormattedLexer(program)
+	require.ErrorContains(t, err, "generic: Next needs the type of the semantic values")
+	program, err = parser.ParseNex(strings.NewReader("%yystype int\n/a/ { }\n" + cornerCasesMainDoc))
+	require.NoError(t, err)
+	b = writer.LexerBuilder{Generic: true}
+	_, err = b.DumpFormattedLexer(program)
+	require.ErrorContains(t, err, "generic: %yystype sets the type of the semantic values")
+}
+
+// TestCgoWrapper links a C program with the library of a lexer, which tokenizes a buffer for it.
+func TestCgoWrapper(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	outputDir := makeOutputDir(t, "cgo")
+	program, err := parser.ParseNex(strings.NewReader(`%prefix calc
+/[a-zé]+/ { return 1 }
+/[0-9]+/  { return 2 }
+/[+=]/    { return 3 }
+/\n/      { }
+/ /       { }
+//
+package main
+
+type calcSymType int
+
+func main() {}
+`))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "lexer.go"), code, os.ModePerm))
+	wrapper, err := b.DumpCgoWrapper(program)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "lexer_cgo.go"), wrapper, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "main.c"), []byte(`#include <stdio.h>
+#include <string.h>
+#include "libcalc.h"
+
+int main(void) {
+	char *in = "é = 1\n+ ab2";
+	size_t n;
+	calc_token *tokens = calc_tokenize(in, strlen(in), &n);
+	for (size_t i = 0; i < n; i++) {
+		calc_token t = tokens[i];
+		printf("%d %d:%d-%d:%d %.*s\n", t.kind, t.line, t.column, t.end_line, t.end_column, (int)t.length, in + t.offset);
+	}
+	calc_free(tokens);
+	return 0;
+}
+`), os.ModePerm))
+
+	for _, args := range [][]string{
+		{"go", "build", "-buildmode=c-archive", "-o", "libcalc.a", "lexer.go", "lexer_cgo.go"},
+		{"gcc", "-o", "main", "main.c", "libcalc.a", "-lpthread"},
+	} {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = outputDir
+		cmd.Stderr = os.Stderr
+		require.NoError(t, cmd.Run(), args[0])
+	}
+	cmd := exec.Command("./main")
+	cmd.Dir = outputDir
+	got, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, "1 0:0-0:1 é\n3 0:2-0:3 =\n2 0:4-0:5 1\n3 1:0-1:1 +\n1 1:2-1:4 ab\n2 1:4-1:5 2\n", string(got))
+
+	program, err = parser.ParseNex(strings.NewReader("/a/ { return 1 }\n//\n"))
+	require.NoError(t, err)
+	b = writer.LexerBuilder{Package: "calc"}
+	_, err = b.DumpCgoWrapper(program)
+	require.ErrorContains(t, err, "package main")
+}
+
+// TestService tokenizes a text with a request to the service of a lexer.
+func TestService(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "service")
+	program, err := parser.ParseNex(strings.NewReader(`%prefix calc
+/[a-zé]+/ { return 1 }
+/[0-9]+/  { return 2 }
+/[ \n]/   { }
+//
+package main
+
+type calcSymType int
+`))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "lexer.go"), code, os.ModePerm))
+	service, err := b.DumpService(program)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "lexer_service.go"), service, os.ModePerm))
+	require.Contains(t, string(b.DumpServiceProto(program)), "package calc;")
+
+	cmd := exec.Command("go", "build", "-o", "service", "lexer.go", "lexer_service.go")
+	cmd.Dir = outputDir
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Run())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	cmd = exec.Command(filepath.Join(outputDir, "service"), "-addr", addr)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() { _ = cmd.Process.Kill(); _ = cmd.Wait() })
+
+	var resp *http.Response
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		resp, err = http.Post("http://"+addr+"/calc.Tokenizer/Tokenize", "application/json", strings.NewReader(`{"text": "é 12\nab"}`))
+		if err == nil {
+			break
+		}
+	}
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(got))
+	require.JSONEq(t, `{"tokens": [
+		{"kind": 1, "text": "é", "line": 0, "column": 0, "endLine": 0, "endColumn": 1, "offset": "0"},
+		{"kind": 2, "text": "12", "line": 0, "column": 2, "endLine": 0, "endColumn": 4, "offset": "2"},
+		{"kind": 1, "text": "ab", "line": 1, "column": 0, "endLine": 1, "endColumn": 2, "offset": "5"}
+	]}`, string(got))
+
+	program, err = parser.ParseNex(strings.NewReader("/a/ { return 1 }\n//\npackage main\n\nfunc main() {}\n"))
+	require.NoError(t, err)
+	_, err = b.DumpService(program)
+	require.ErrorContains(t, err, "which the user code declares too")
+}
+
+func TestFieldsBlock(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "fields-block")
+	testSpec(t, outputDir, 0, `%fields { open int; deepest int }
+%fields {
+  names []string
+}
+/\(/ { yylex.open++; yylex.deepest = max(yylex.deepest, yylex.open) }
+/\)/ { yylex.open--; yylex.names = append(yylex.names, "x"); *lval = yySymType(fmt.Sprint(yylex.deepest, len(yylex.names))) }
+`+cornerCasesMainDoc, "(()(()))", "3 4")
+}
+
+func TestInitBlock(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "init-block")
+	testSpec(t, outputDir, 0, `%field counts map[string]int
+%init { yylex.counts = map[string]int{} }
+%init {
+  yylex.counts["b"] = 10
+}
+/[a-z]+/ { yylex.counts[yylex.Text()]++; *lval += yySymType(fmt.Sprint(yylex.counts[yylex.Text()])) }
+`+cornerCasesMainDoc, "a b a c", "11121")
+}
+
+func TestStdImports(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "std-imports")
+	spec := `/[a-zé]+/ { *lval += yySymType(strings.ToUpper(yylex.Text()) + strconv.Itoa(utf8.RuneLen('é'))) }
+/./       { var sort struct{ n int }; sort.n++; *lval += "." }
+//
+package main
+import "os"
+
+type yySymType = string
+
+func main() {
+	lval := new(yySymType)
+	NewLexer(os.Stdin).Lex(lval)
+	fmt.Print(*lval)
+}
+`
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	for _, p := range []string{`"fmt"`, `"os"`, `"strconv"`, `"strings"`, `"unicode/utf8"`} {
+		require.Contains(t, string(code), p)
+	}
+	require.NotContains(t, string(code), `"sort"`)
+	testSpec(t, outputDir, 0, spec, "ab cé", "AB2.CÉ2")
+}
+
+func TestTokenShorthand(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "token-shorthand")
+	program, err := parser.ParseNex(strings.NewReader(`%option tokens
+/[0-9]+/ -> NUMBER
+/[a-z]+/ -> IDENT
+/ /      { }
+//
+package main
+import ("fmt";"os")
+
+type yySymType = string
+
+func main() {
+  l := NewLexer(os.Stdin)
+  for kind := l.Lex(nil); kind != 0; kind = l.Lex(nil) {
+    fmt.Print(kind, ":", l.Text(), ",")
+  }
+  fmt.Print(NUMBER, IDENT, yyTokenKind(IDENT), yyTokenKind(0), yyTokenKind(3))
+}
+`))
+	require.NoError(t, err)
+	// The prefix renames the type, so lexers of several prefixes may share a package.
+	for i, b := range []writer.LexerBuilder{{}, {Synchronous: true}, {CustomPrefix: "calc"}} {
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		require.Contains(t, string(code), fmt.Sprintf("type %sTokenKind int", cmp.Or(b.CustomPrefix, "yy")))
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "12 ab 3", "1:12,2:ab,1:3,1 2 IDENT EOF TokenKind(3)", outPath)
+	}
+}
+
+func TestSymType(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "sym-type")
+	testSpec(t, outputDir, 0, `%yystype []string
+/[a-z]+/ { *lval = append(*lval, yylex.Text()) }
+/ /      { }
+//
+package main
+import ("fmt";"os")
+
+func main() {
+  var words []string
+  l := NewLexer(os.Stdin)
+  for l.Lex(&words) != 0 {
+  }
+  fmt.Print(len(words), words)
+}
+`, "ab cd", "2 [ab cd]")
+}
+
+func TestLiteralRules(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "literal-rules")
+	testSpec(t, outputDir, 0, `%option literals
+"a.b"    { *lval += "L" }
+"=="     { *lval += "E" }
+/[a-z]+/ { *lval += "i" }
+/./      { *lval += "." }
+//
+package main
+import "os"
+
+type yySymType = string
+
+func main() {
+  lval := new(yySymType)
+  l := NewLexer(os.Stdin)
+  for l.Lex(lval) != 0 { }
+  fmt.Print(*lval)
+}
+`, "a.b axb ==", "L.i.E")
+}
+
+// TestRuntimesAgree compares the variants of the runtime on random inputs.
+func TestRuntimesAgree(t *testing.T) {
+	t.Parallel()
+	t.Run("asserts-and-scopes", func(t *testing.T) {
+		t.Parallel()
+		testRuntimesAgree(t, "asserts-and-scopes", `
+/^a+/      { *lval += "S" + yylex.Text() }
+/[ab]+$/   { *lval += "E" + yylex.Text() }
+/b*c/ < { *lval += "<" + yylex.Gap() }
+  /b/      { *lval += "B" }
+  /\bc/    { *lval += "C" + yylex.Gap() }
+> { *lval += ">" }
+/\n/       { *lval += fmt.Sprint("/", yylex.Line(), yylex.Column()) }
+/é+a|ab/   { *lval += fmt.Sprint(".", yylex.Gap(), yylex.Column()) }
+`, "abcé\n ")
+	})
+	t.Run("rule-sets-and-guards", func(t *testing.T) {
+		t.Parallel()
+		testRuntimesAgree(t, "rule-sets-and-guards", `
+/[a-z]+/ when false { *lval += "X" }
+/ab/ %ruleset disabled { *lval += "D" }
+/[a-c]+/ %name ruleWord { *lval += "W" + yylex.Text() }
+/[^a-c]+/ < { *lval += "<" }
+  /x+/ when true { *lval += "x" }
+  /./ { *lval += "." }
+> { *lval += ">" }
+`, "abcxy\n")
+	})
+	t.Run("runes-in-classes", func(t *testing.T) {
+		t.Parallel()
+		testRuntimesAgree(t, "runes-in-classes", `
+/[a-z]+/    { *lval += "W" + yylex.Text() }
+/q[^a-c]?/  { *lval += "Q" + yylex.Text() }
+/[é-ö]|ü/   { *lval += "U" }
+/[^a-z\n]/ { *lval += "." }
+/\b/       { *lval += "|" }
+`, "abcqxéöüzy\n ")
+	})
+	t.Run("error-frames", func(t *testing.T) {
+		t.Parallel()
+		testRuntimesAgree(t, "error-frames", `%option stats
+%error { *lval += fmt.Sprintf("[%s%d]", yylex.Text(), yylex.Column()) }
+/ab+/ < { *lval += "<" }
+  /b$/ { *lval += "B" }
+> { *lval += ">" }
+/ca/ { *lval += "C" }
+/c+b/ ;
+`, "abc")
+	})
+}
+
+// TestImportedRuntime runs lexers that import the nexruntime package of this module.
+func TestImportedRuntime(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "imported-runtime")
+
+	program, err := parser.ParseNex(strings.NewReader(`
+/[^\n]+/ when false { *lval += "X" }
+/a/ %ruleset sql2016 { *lval += "A" }
+/[^\n]+/ < { *lval += "<" }
+  /b/ { *lval += "B" }
+> { *lval += ">" }
+` + ruleSetsMainDoc))
+	require.NoError(t, err)
+	for _, sync := range []bool{false, true} {
+		b := writer.LexerBuilder{Synchronous: sync}
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		require.Contains(t, string(code), `"github.com/liran-funaro/nex/nexruntime"`)
+		require.NotContains(t, string(code), "type scanner struct")
+		outPath := filepath.Join(outputDir, "main.go")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "abc\na\nbab", "<B>A<BB>", outPath)
+
+		// Code that requires a newer runtime must not compile.
+		v := fmt.Sprintf("nexruntime.MaxVersion - %d)", nexruntime.MaxVersion)
+		require.Contains(t, string(code), v)
+		newer := strings.ReplaceAll(string(code), v, fmt.Sprintf("nexruntime.MaxVersion - %d)", nexruntime.MaxVersion+1))
+		require.NoError(t, os.WriteFile(outPath, []byte(newer), os.ModePerm))
+		cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+		cmd.Dir = outputDir
+		out, err := cmd.CombinedOutput()
+		require.Error(t, err)
+		require.Contains(t, string(out), "EnforceVersion")
+	}
+}
+
+// TestSerializedDFA runs a lexer that decodes its DFA from the file next to it at init.
+func TestSerializedDFA(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "serialized-dfa")
+	outPath := makeProgramFile(t, outputDir, 0, "toy.nex")
+	var stdout bytes.Buffer
+	require.NoError(t, exec2.ExecuteWithParams(&exec2.Params{
+		InputFilename:  "test-data/toy.nex",
+		OutputFilename: outPath,
+		Standalone:     true,
+		Serialize:      true,
+		RunProgram:     true,
+		Stdin:          strings.NewReader(toyInput),
+		Stderr:         os.Stderr,
+		Stdout:         &stdout,
+	}))
+	require.Equal(t, toyOutput, stdout.String())
+
+	code, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "//go:embed main.dfa\n")
+	require.NotContains(t, string(code), "States:")
+	require.FileExists(t, filepath.Join(filepath.Dir(outPath), "main.dfa"))
+}
+
+// TestReproducibleOutput generates a lexer and its serialized DFA several times, and requires the
+// same bytes every time, in spite of the random order of the maps of the NFA and the DFA.
+func TestReproducibleOutput(t *testing.T) {
+	t.Parallel()
+	program, err := parser.ParseNex(strings.NewReader(`
+/^[a-c]+/ %ruleset upper { *lval += "S" }
+/[d-f]+$/ %ruleset lower { *lval += "E" }
+/x|y|z/ < { *lval += "<" }
+  /\bq/ { *lval += "Q" }
+  /[é-ö]|ü/ ;
+> { *lval += ">" }
+/[^a-z]/ ;
+/a|b|c|d|e|f/ { *lval += "." }
+//
+package main
+func main() {}
+`))
+	require.NoError(t, err)
+	for _, b := range []writer.LexerBuilder{{}, {Tables: true}, {InlineRuntime: true}, {DFAFile: "main.dfa"}} {
+		var wantCode, wantDFA []byte
+		for range 5 {
+			code, err := b.DumpFormattedLexer(program)
+			require.NoError(t, err)
+			var dfa bytes.Buffer
+			require.NoError(t, b.WriteDFAFile(program, &dfa))
+			if wantCode == nil {
+				wantCode, wantDFA = code, dfa.Bytes()
+				continue
+			}
+			require.Equal(t, string(wantCode), string(code))
+			require.Equal(t, wantDFA, dfa.Bytes())
+		}
+	}
+}
+
+// TestPackageLexer runs a program that imports a lexer that is generated as a package of its own.
+func TestPackageLexer(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "package-lexer")
+	lexerDir := filepath.Join(outputDir, "numlexer")
+	require.NoError(t, os.MkdirAll(lexerDir, os.ModePerm))
+	spec := filepath.Join(lexerDir, "num.nex")
+	require.NoError(t, os.WriteFile(spec, []byte(`%prefix Num
+/[0-9]+/ { n, _ := strconv.Atoi(Numlex.Text()); *lval = n; return 1 }
+/[a-z]+/ { return 2 }
+/\s+/    { }
+//
+`), os.ModePerm))
+	require.NoError(t, exec2.Execute("nex", "-package", "numlexer", spec))
+
+	require.NoError(t, os.WriteFile(filepath.Join(outputDir, "main.go"), []byte(`package main
+
+import (
+	"fmt"
+	"os"
+
+	"example.com/lexer/numlexer"
+)
+
+func main() {
+	l := numlexer.New(os.Stdin)
+	for tok := l.Next(); tok.Kind != 0; tok = l.Next() {
+		fmt.Printf("%d %q %v %d:%d-%d:%d\n", tok.Kind, tok.Text, tok.Value, tok.Line, tok.Column, tok.EndLine, tok.EndColumn)
+	}
+}
+`), os.ModePerm))
+	testProgram(t, outputDir, "abc 12\n7", "2 \"abc\" <nil> 0:0-0:3\n1 \"12\" 12 0:4-0:6\n1 \"7\" 7 1:0-1:1\n", ".")
+
+	program, err := parser.ParseNex(strings.NewReader("/a/ { }\n//\npackage other\n"))
+	require.NoError(t, err)
+	for _, b := range []writer.LexerBuilder{
+		{Package: "main"},
+		{Package: "numlexer", Standalone: true},
+		{Package: "numlexer"},
+	} {
+		_, err := b.DumpFormattedLexer(program)
+		require.Error(t, err, "%+v", b)
+	}
+}
+
+// TestStandaloneMain runs a standalone filter whose spec has no driver, as the builder writes its
+// main function.
+func TestStandaloneMain(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "standalone-main")
+	for i, spec := range []string{
+		"/[a-z]+/ { fmt.Print(strings.ToUpper(yylex.Text())) }\n/./ { yylex.Echo() }\n//\n",
+		"%%\n/[a-z]+/ { fmt.Print(upper(yylex.Text())) }\n/./ { yylex.Echo() }\n%%\npackage main\nvar upper = strings.ToUpper\n",
+	} {
+		program, err := parser.ParseNex(strings.NewReader(spec))
+		require.NoError(t, err)
+		code, err := (&writer.LexerBuilder{Standalone: true, StandaloneMain: true}).DumpFormattedLexer(program)
+		require.NoError(t, err)
+		outPath := makeProgramFile(t, outputDir, i, "main")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "hello, World 42\n", "HELLO, WORLD 42\n", outPath)
+	}
+
+	for _, spec := range []string{
+		"/a/ { }\n//\npackage main\nfunc main() {}\n",
+		"/a/ { }\n//\npackage other\n",
+	} {
+		program, err := parser.ParseNex(strings.NewReader(spec))
+		require.NoError(t, err)
+		_, err = (&writer.LexerBuilder{Standalone: true, StandaloneMain: true}).DumpFormattedLexer(program)
+		require.Error(t, err, spec)
+	}
+	program, err := parser.ParseNex(strings.NewReader("/a/ { }\n//\n"))
+	require.NoError(t, err)
+	_, err = (&writer.LexerBuilder{StandaloneMain: true}).DumpFormattedLexer(program)
+	require.Error(t, err)
+}
+
+// TestHeader checks the package clause and the comments at the top of a lexer, which the spec
+// sets, and the options of the builder override.
+func TestHeader(t *testing.T) {
+	t.Parallel()
+	spec := "%package words\n%generator make lexers\n%command nex words.nex\n%header{\nCopyright 2026 The Authors.\n\n// SPDX-License-Identifier: MIT\n}\n/a/ { }\n//\n"
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	code, err := (&writer.LexerBuilder{}).DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(code), `// Code generated by make lexers. DO NOT EDIT.
+// Command: nex words.nex.
+
+// Copyright 2026 The Authors.
+//
+// SPDX-License-Identifier: MIT
+
+package words
+`), string(code))
+
+	code, err = (&writer.LexerBuilder{PackageName: "tokens", Generator: "gen.sh", Command: "-", Header: "License."}).DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(code), "// Code generated by gen.sh. DO NOT EDIT.\n\n// License.\n\npackage tokens\n"), string(code))
+
+	_, err = (&writer.LexerBuilder{Generator: "a\nb"}).DumpFormattedLexer(program)
+	require.Error(t, err)
+}
+
+// TestFormat generates lexers that are formatted with go/format only, and unformatted, which
+// still import the packages that their actions use, and only those.
+func TestFormat(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "format")
+	spec := "/[a-z]+/ { fmt.Print(strings.ToUpper(yylex.Text())) }\n/./ { yylex.Echo() }\n//\npackage main\nimport \"io\"\nvar _ io.Reader\n"
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	for i, format := range []string{"std", "none"} {
+		code, err := (&writer.LexerBuilder{Standalone: true, StandaloneMain: true, Format: format}).DumpFormattedLexer(program)
+		require.NoError(t, err)
+		formatted, err := gofmt.Source(code)
+		require.NoError(t, err)
+		require.Equal(t, format == "std", bytes.Equal(code, formatted))
+		outPath := makeProgramFile(t, outputDir, i, "main")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "hello, World\n", "HELLO, WORLD\n", outPath)
+	}
+
+	_, err = (&writer.LexerBuilder{Format: "gofumpt"}).DumpFormattedLexer(program)
+	require.Error(t, err)
+}
+
+// TestSharedRuntime generates two lexers into one package, which share the runtime, inlined and
+// imported, and runs a program that uses both of them.
+func TestSharedRuntime(t *testing.T) {
+	t.Parallel()
+	for _, inline := range []bool{false, true} {
+		outputDir := makeOutputDir(t, "shared-runtime", fmt.Sprint(inline))
+		words := filepath.Join(outputDir, "words.nex")
+		require.NoError(t, os.WriteFile(words, []byte(`/[a-z]+/ { *lval += yySymType(yylex.Text()) }
+/./ { }
+//
+package main
+
+import "strings"
+
+type yySymType string
+
+func main() {
+  lval := new(yySymType)
+  NewLexer(strings.NewReader("ab 12 cd")).Lex(lval)
+  nums := NumsNewLexer(strings.NewReader("ab 12 cd"))
+  nums.Lex(lval)
+  fmt.Println(*lval, nums.Stats().Matches)
+}
+`), os.ModePerm))
+		nums := filepath.Join(outputDir, "nums.nex")
+		require.NoError(t, os.WriteFile(nums, []byte(`%option stats
+/[0-9]+/ { *lval += yySymType("<" + yylex.Text() + ">") }
+/./ { }
+//
+package main
+`), os.ModePerm))
+		args := []string{"-o", outputDir, words, nums}
+		if inline {
+			args = append([]string{"-inline"}, args...)
+		}
+		require.NoError(t, exec2.Execute("nex", args...))
+		testProgram(t, outputDir, "", "abcd<12> 7\n", "words.nn.go", "nums.nn.go", exec2.SharedRuntimeFilename)
+	}
+
+	// The prefixes must be distinct.
+	outputDir := makeOutputDir(t, "shared-runtime", "conflict")
+	spec := filepath.Join(outputDir, "a.nex")
+	require.NoError(t, os.WriteFile(spec, []byte("/a/ { }\n//\npackage main\n"), os.ModePerm))
+	require.ErrorContains(t, exec2.Execute("nex", spec, spec), "the same prefix")
+}
+
+// TestExample generates the examples of a lexer and of a lexer package, which go vet checks
+// against the names of the generated API.
+func TestExample(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "example")
+	spec := []byte(`%prefix Num
+/[0-9]+/ { n, _ := strconv.Atoi(yylex.Text()); *lval = n; return 1 }
+/[a-z]+/ { return 2 }
+/\s+/    { }
+//
+`)
+	mainDir := filepath.Join(outputDir, "main")
+	require.NoError(t, os.MkdirAll(mainDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(mainDir, "num.nex"), append(spec, `package main
+type NumSymType = int
+func main() {}
+`...), os.ModePerm))
+	require.NoError(t, exec2.Execute("nex", "-example", filepath.Join(mainDir, "num.nex")))
+
+	packageDir := filepath.Join(outputDir, "numlexer")
+	require.NoError(t, os.MkdirAll(packageDir, os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(packageDir, "num.nex"), spec, os.ModePerm))
+	require.NoError(t, exec2.Execute("nex", "-example", "-package", "numlexer", filepath.Join(packageDir, "num.nex")))
+
+	for dir, example := range map[string]string{mainDir: "func ExampleNewLexer() {", packageDir: "func ExampleNew() {"} {
+		code, err := os.ReadFile(filepath.Join(dir, "num.nn_example_test.go"))
+		require.NoError(t, err)
+		require.Contains(t, string(code), example)
+		require.Contains(t, string(code), `strings.NewReader("0 a \t")`)
+	}
+	runCmd(t, outputDir, "go", "vet", "./...")
+}
+
+// writeRuntimeModule makes the directory a module that imports the nexruntime package of this module.
+func writeRuntimeModule(t *testing.T, dir string) {
+	root, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte(fmt.Sprintf(`module example.com/lexer
+
+go 1.22.0
+
+require github.com/liran-funaro/nex v0.0.0
+
+replace github.com/liran-funaro/nex => %s
+`, root)), os.ModePerm))
+}
+
+// runtimesMainDoc scans each of the NUL separated inputs with a new lexer, and prints what the
+// actions appended to lval for each of them on its own line.
+const runtimesMainDoc = `//
+package main
+import ("io";"os";"strings")
+
+type yySymType = string
+
+func main() {
+  in, _ := io.ReadAll(os.Stdin)
+  for _, part := range strings.Split(string(in), "\x00") {
+    lval := new(yySymType)
+    l := NewLexer(strings.NewReader(part))
+    for l.Lex(lval) != 0 { }
+    fmt.Printf("%q\n", *lval)
+  }
+}
+`
+
+// testRuntimesAgree scans random inputs of the given runes with the variants of the runtime:
+// asynchronous and synchronous, inlined and imported, with step functions, with tables, with
+// serialized DFAs, and scanning bytes in place. The variants must produce the same tokens.
+// The spec's actions should record what they see in lval, which runtimesMainDoc prints.
+func testRuntimesAgree(t *testing.T, name, rules, alphabet string) {
+	outputDir := makeOutputDir(t, "runtimes", name)
+	program, err := parser.ParseNex(strings.NewReader(rules + runtimesMainDoc))
+	require.NoError(t, err)
+
+	// The inputs are random, but the same in every run.
+	rng := rand.New(rand.NewPCG(1, uint64(len(rules))))
+	runes := []rune(alphabet)
+	inputs := make([]string, 300)
+	for i := range inputs {
+		input := make([]rune, rng.IntN(24))
+		for j := range input {
+			input[j] = runes[rng.IntN(len(runes))]
+		}
+		inputs[i] = string(input)
+	}
+
+	var want []string
+	var wantVariant string
+	for _, b := range []writer.LexerBuilder{
+		{InlineRuntime: true},
+		{Synchronous: true, InlineRuntime: true},
+		{},
+		{Synchronous: true},
+		{InlineRuntime: true, Tables: true},
+		{Synchronous: true, Tables: true},
+		{InlineRuntime: true, DFAFile: "main.dfa"},
+		{Synchronous: true, DFAFile: "main.dfa"},
+		{InlineRuntime: true, Bytes: true},
+		{Synchronous: true, Bytes: true, DFAFile: "main.dfa"},
+	} {
+		variant := fmt.Sprintf("sync-%v-inline-%v-tables-%v-serialized-%v-bytes-%v", b.Synchronous, b.InlineRuntime, b.Tables, b.DFAFile != "", b.Bytes)
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		if b.Tables || b.Bytes {
+			require.NotContains(t, string(code), "RuneStep: func")
+		}
+		if b.Bytes {
+			code = bytes.ReplaceAll(code, []byte("NewLexer(strings.NewReader(part))"), []byte("NewBytesLexer([]byte(part), nil)"))
+			require.Contains(t, string(code), "NewBytesLexer([]byte(part), nil)")
+		}
+		require.NoError(t, os.MkdirAll(filepath.Join(outputDir, variant), os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(outputDir, variant, "main.go"), code, os.ModePerm))
+		if b.DFAFile != "" {
+			require.NotContains(t, string(code), "States:")
+			var dfa bytes.Buffer
+			require.NoError(t, b.WriteDFAFile(program, &dfa))
+			require.NoError(t, os.WriteFile(filepath.Join(outputDir, variant, b.DFAFile), dfa.Bytes(), os.ModePerm))
+		}
+
+		got := strings.Split(runProgram(t, outputDir, strings.Join(inputs, "\x00"), "./"+variant), "\n")
+		require.Len(t, got, len(inputs)+1, variant)
+		if want == nil {
+			want, wantVariant = got, variant
+			continue
+		}
+		for i, input := range inputs {
+			require.Equalf(t, want[i], got[i], "%s and %s disagree on %q", wantVariant, variant, input)
+		}
+	}
+}
+
+const ruleSetsMainDoc = `//
+package main
+import "os"
+
+type yySymType = string
+
+func main() {
+  lval := new(yySymType)
+  l := NewLexerWithInit(os.Stdin, func(l *Lexer) {
+    if err := l.EnableRuleSet("sql2016"); err != nil {
+      panic(err)
+    }
+    if l.EnableRuleSet("sql1999") == nil {
+      panic("unknown rule set enabled")
+    }
+  })
+  for l.Lex(lval) != 0 { }
+  fmt.Print(*lval)
+}
+`
+
+func TestBuildManifest(t *testing.T) {
+	outputDir := makeOutputDir(t, "build")
+	copyToDir(t, outputDir, "test-data/wc.nex")
+	copyToDir(t, outputDir, "test-data/lc.nex")
+	for name, manifest := range map[string]string{
+		"nex.yaml": `grammars:
+  - input: wc.nex
+  - input: lc.nex
+    output: lc/lexer.go
+    prefix: Lc
+    sync: true
+`,
+		"nex.json": `{"grammars": [{"input": "wc.nex", "output": "wc.go", "standalone": true}]}`,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(outputDir, name), []byte(manifest), os.ModePerm))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(outputDir, "lc"), os.ModePerm))
+
+	require.NoError(t, exec2.Execute("nex", "build", filepath.Join(outputDir, "nex.yaml")))
+	require.FileExists(t, filepath.Join(outputDir, "wc.nn.go"))
+	code, err := os.ReadFile(filepath.Join(outputDir, "lc", "lexer.go"))
+	require.NoError(t, err)
+	require.Contains(t, string(code), "LcSymType")
+	require.NotContains(t, string(code), "go ")
+
+	require.NoError(t, exec2.Execute("nex", "build", "-j", "1", filepath.Join(outputDir, "nex.json")))
+	require.FileExists(t, filepath.Join(outputDir, "wc.go"))
+
+	m := &exec2.Manifest{Grammars: []exec2.Grammar{{Input: "missing.nex"}, {Input: "wc.nex"}}}
+	err = m.Build(outputDir, 2, os.Stderr)
+	require.ErrorContains(t, err, "missing.nex: parse-program: open input")
+}
+
+func TestRuleSets(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "rule-sets")
+	testSpec(t, outputDir, 0, `
+/MERGE/    %ruleset sql2003 { *lval += "M" }
+/LATERAL/  %ruleset sql2016 { *lval += "L" }
+/WINDOW/   %ruleset sql2003 %ruleset sql2016 { *lval += "W" }
+/[A-Z]+/   { *lval += "i" }
+/ /        { }
+`+ruleSetsMainDoc, "MERGE LATERAL WINDOW SELECT", "iLWi")
+}
+
+// TestGuards runs a synchronous lexer, whose guards see the state that the previous actions set.
+func TestGuards(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "guards")
+	program, err := parser.ParseNex(strings.NewReader(`%field inMacro bool
+/#define/ { yylex.inMacro = true; *lval += "D" }
+/[a-z]+/ when yylex.inMacro { *lval += "m" }
+/[a-z_]+/ { *lval += "i" }
+/\n/ { yylex.inMacro = false; *lval += "/" }
+/ / { }
+` + cornerCasesMainDoc))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{Synchronous: true}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "case frameKey{Kind: kStartCode, Scope: 0, Rule: 2}: // [a-z]+\n\t\treturn yylex.inMacro\n")
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	// The guarded rule loses to the longer match of the next rule.
+	testProgram(t, outputDir, "#define ab cd_e\nab", "Dmi/i", outPath)
+}
+
+// TestSkippedRules runs a lexer whose rules without code produce no frames.
+func TestSkippedRules(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "skipped-rules")
+	spec := `
+/[a-z]+/  { *lval += yySymType(fmt.Sprintf("%q", yylex.Gap())) }
+/ +/      ;
+/#[^\n]*/ { }
+` + cornerCasesMainDoc
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "Skip: map[int]bool{2: true, 3: true},")
+	testSpec(t, outputDir, 0, spec, "ab  cd #x\n-ef", `""""`+`"\n-"`)
+}
+
+// TestObserver runs lexers that report their Lex() calls and unmatched text to an observer.
+func TestObserver(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "observer")
+	program, err := parser.ParseNex(strings.NewReader(`
+/[a-z]+/ { return 1 }
+/ / ;
+//
+package main
+import ("os";"strings")
+
+type yySymType struct{}
+
+type observer struct{ strings.Builder }
+
+func (o *observer) LexStarted() func(int) {
+  o.WriteString("(")
+  return func(token int) { fmt.Fprintf(o, "%d)", token) }
+}
+
+func (o *observer) Unmatched(text string, line, column int) {
+  fmt.Fprintf(o, "[%s@%d:%d]", text, line, column)
+}
+
+func main() {
+  o := &observer{}
+  l := NewLexer(os.Stdin)
+  l.SetObserver(o)
+  for l.Lex(nil) != 0 { }
+  fmt.Print(o.String())
+}
+`))
+	require.NoError(t, err)
+	for i, b := range []writer.LexerBuilder{
+		{Observer: true},
+		{Synchronous: true, Observer: true},
+		{CustomPrefix: "calc", Observer: true},
+	} {
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		prefix := cmp.Or(b.CustomPrefix, "yy")
+		require.Contains(t, string(code), fmt.Sprintf("func (%slex *Lexer) lex(lval *%sSymType) int {", prefix, prefix))
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "ab 12 c\n3", "(1)([12@0:3]1)([\n3@0:7]0)", outPath)
+	}
+}
+
+// TestReplay records the tokens of a lexer, and replays the recording through the same Lex().
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "replay")
+	program, err := parser.ParseNex(strings.NewReader(`
+/[0-9]+/ { *lval, _ = strconv.Atoi(yylex.Text()); return 1 }
+/"[^"]*"/ < { }
+  /[^"]+/ { *lval = len(yylex.Text()); return 2 }
+  /"/ ;
+> { }
+/\s+/ ;
+//
+package main
+import ("os";"strings")
+
+type yySymType = int
+
+func tokens(l *Lexer) string {
+  var s strings.Builder
+  var lval yySymType
+  for tok := l.Lex(&lval); tok != 0; tok = l.Lex(&lval) {
+    fmt.Fprintf(&s, "%d=%d@%d:%d ", tok, lval, l.Line(), l.Column())
+  }
+  return s.String()
+}
+
+func main() {
+  var recording strings.Builder
+  l := NewLexer(os.Stdin)
+  l.Record(&recording)
+  fmt.Println(tokens(l))
+  fmt.Print(recording.String())
+  l, err := NewReplayLexer(strings.NewReader(recording.String()))
+  if err != nil {
+    panic(err)
+  }
+  fmt.Println(tokens(l))
+  l, _ = NewReplayLexer(strings.NewReader("1 1:0-1:1 9 0/0/1 \"7\"\n"))
+  fmt.Println(tokens(l))
+  _, err = NewReplayLexer(strings.NewReader("1 0:0-0:1 0 0/0/1\n"))
+  fmt.Println(err)
+}
+`))
+	require.NoError(t, err)
+	want := `1=12@0:0 2=3@0:4 1=7@1:0 
+1 0:0-0:2 0 0 0/0/1 "12"
+2 0:4-0:7 4 4 0/1/1 "a\tb"
+1 1:0-1:1 9 9 0/0/1 "7"
+1=12@0:0 2=3@0:4 1=7@1:0 
+1=7@1:0 
+recording line 1: unexpected EOF
+`
+	for i, b := range []writer.LexerBuilder{
+		{Replay: true, InlineRuntime: true},
+		{Replay: true, Synchronous: true, Observer: true},
+	} {
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "12 \"a\tb\"\n7", want, outPath)
+	}
+}
+
+// TestTrace traces the scans of a lexer, with a nested scope and unmatched text.
+func TestTrace(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "trace")
+	program, err := parser.ParseNex(strings.NewReader(`
+/if/ %name ruleIf { return 1 }
+/[a-z]+/ %name ruleWord < { }
+  /a/ { return 2 }
+> { }
+/ +/ ;
+//
+package main
+import "os"
+
+type yySymType = int
+
+func main() {
+  l := NewLexerWithInit(os.Stdin, func(l *Lexer) { l.SetTrace(os.Stdout) })
+  for l.Lex(nil) != 0 { }
+}
+`))
+	require.NoError(t, err)
+	want := `scope 0: scan at 0:0
+scope 0: state 0, 'i': state 2
+scope 0: state 2 accepts rule 2 (ruleWord), "i"
+scope 0: state 2, 'f': state 4
+scope 0: state 4 accepts rule 1 (ruleIf), "if"
+scope 0: state 4, ' ': stuck
+scope 0: match rule 1 (ruleIf), "if"
+scope 0: reset the buffer by 2 runes, to 0:2
+scope 0: scan at 0:2
+scope 0: state 0, ' ': state 1
+scope 0: state 1 accepts rule 3, " "
+scope 0: state 1, '?': stuck
+scope 0: match rule 3, " "
+scope 0: reset the buffer by 1 runes, to 0:3
+scope 0: scan at 0:3
+scope 0: state 0, '?': stuck
+scope 0: no match, '?' is unmatched
+scope 0: reset the buffer by 1 runes, to 0:4
+scope 0: scan at 0:4
+scope 0: state 0, 'b': state 3
+scope 0: state 3 accepts rule 2 (ruleWord), "b"
+scope 0: state 3, 'a': state 3
+scope 0: state 3 accepts rule 2 (ruleWord), "ba"
+scope 0: match rule 2 (ruleWord), "ba"
+scope 1: scan at 0:4
+scope 1: state 0, 'b': stuck
+scope 1: no match, 'b' is unmatched
+scope 1: reset the buffer by 1 runes, to 0:5
+scope 1: scan at 0:5
+scope 1: state 0, 'a': state 1
+scope 1: state 1 accepts rule 1, "a"
+scope 1: match rule 1, "a"
+scope 1: reset the buffer by 1 runes, to 0:6
+scope 1: scan at 0:6
+scope 1: end of the input
+scope 0: reset the buffer by 2 runes, to 0:6
+scope 0: scan at 0:6
+scope 0: end of the input
+`
+	for i, b := range []writer.LexerBuilder{
+		{Trace: true, InlineRuntime: true},
+		{Trace: true, Synchronous: true},
+	} {
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "if ?ba", want, outPath)
+	}
+}
+
+// TestFindAll searches for the matches of the top-level rules, including those without code,
+// without running the actions.
+func TestFindAll(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "find-all")
+	testSpec(t, outputDir, 0, `%option search
+/[0-9]+/ %name ruleNum { panic("action") }
+/[a-z]+/ { }
+/"[^"]*"/ < { panic("action") }
+  /x/ { }
+> { }
+//
+package main
+
+type yySymType int
+
+func main() {
+  for _, m := range FindAll("ab, 12\n\"x\"!") {
+    fmt.Printf("%d %q %d:%d %d\n", m.Rule, m.Text, m.Line, m.Column, m.Offset)
+  }
+  fmt.Println(ruleNum)
+}
+`, "", `2 "ab" 0:0 0
+1 "12" 0:4 4
+3 "\"x\"" 1:0 7
+1
+`)
+}
+
+// TestMatchRule checks full matches of single rules, including those that a rule of a higher
+// precedence wins in the lexer.
+func TestMatchRule(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "match-rule")
+	testSpec(t, outputDir, 0, `%option match
+/if/ %name ruleIf { }
+/[a-z][a-z0-9]*/ %name ruleIdent { }
+/[0-9]+$/ %name ruleNum { }
+//
+package main
+
+type yySymType int
+
+func main() {
+  for _, s := range []string{"if", "x1", "1x", "", "12", "if "} {
+    fmt.Println(MatchRule(ruleIf, s), MatchRule(ruleIdent, s), MatchRule(ruleNum, s))
+  }
+}
+`, "", `true true false
+false true false
+false false false
+false false false
+false false true
+false false false
+`)
+}
+
+func TestRuleName(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "rule-name")
+	testSpec(t, outputDir, 0, `/[ \n]+/ ;
+/[0-9]+/ %name ruleNum { return 1 }
+/[a-z]+/ %name ruleWord < { fmt.Println("open", yylex.Rule(), yylex.RuleName()) }
+  /ab/ %name ruleAB { return 2 }
+  /./ { return 3 }
+> { fmt.Println("close", yylex.Rule(), yylex.RuleName()) }
+//
+package main
+
+import "os"
+
+type yySymType int
+
+func main() {
+  lex := NewLexer(os.Stdin)
+  for lex.Lex(new(yySymType)) != 0 {
+    fmt.Printf("%q %d %q\n", lex.Text(), lex.Rule(), lex.RuleName())
+  }
+  fmt.Printf("%d %q\n", lex.Rule(), lex.RuleName())
+}
+`, "12 abc\n", `"12" 2 "ruleNum"
+open 3 ruleWord
+"ab" 1 "ruleAB"
+"c" 2 ""
+close 3 ruleWord
+0 ""
+`)
+}
+
+func TestSniff(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "sniff")
+	testSpec(t, outputDir, 0, `%option sniff
+/[ \t\n]+/ ;
+/\{/ %name ruleJSON { return 1 }
+/<\?xml/ %name ruleXML { return 2 }
+/</ %name ruleTag { return 3 }
+//
+package main
+
+type yySymType int
+
+func main() {
+  for _, s := range []string{"  {\"a\": 1", "<?xml version", "<html", "<?xm", "# {", ""} {
+    fmt.Println(Sniff([]byte(s)))
+  }
+}
+`, "", `2 true
+3 true
+4 true
+4 true
+0 false
+0 false
+`)
+}
+
+// TestTemplate generates lexers from a customized copy of the embedded template.
+func TestTemplate(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "template")
+	template, err := os.ReadFile("writer/lexer.go")
+	require.NoError(t, err)
+	custom := strings.Replace(string(template), "// Text returns the matched text.\n", `// Shout returns the matched text in upper case.
+func (yylex *Lexer) Shout() string {
+	return strings.ToUpper(yylex.Text())
+}
+
+// Text returns the matched text.
+`, 1)
+	templatePath := filepath.Join(outputDir, "lexer.go.tmpl")
+	require.NoError(t, os.WriteFile(templatePath, []byte(custom), os.ModePerm))
+	specPath := filepath.Join(outputDir, "shout.nex")
+	require.NoError(t, os.WriteFile(specPath, []byte(`/[a-z]+/ { *lval += yySymType(yylex.Shout()) }
+/./ ;
+//
+package main
+import "os"
+type yySymType string
+func main() {
+  lval := new(yySymType)
+  NewLexer(os.Stdin).Lex(lval)
+  fmt.Print(*lval)
+}
+`), os.ModePerm))
+	outPath := makeProgramFile(t, outputDir, 0, "shout")
+	require.NoError(t, exec2.Execute("nex", "-t", templatePath, "-o", outPath, specPath))
+	testProgram(t, outputDir, "ab, cd", "ABCD", outPath)
+
+	// The template must have all the placeholders.
+	broken := strings.Replace(string(template), "// [SUFFIX PLACEHOLDER]\n", "", 1)
+	program, err := parser.ParseNex(strings.NewReader("/a/ { }\n//\npackage main\n"))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{Template: broken}
+	_, err = b.DumpFormattedLexer(program)
+	require.ErrorContains(t, err, `the template has no "// [SUFFIX PLACEHOLDER]" line`)
+}
+
+// adversarialGrammars are rules and inputs on which a backtracking scanner would read the same
+// runes again for each match, or for each rune that it skips, in quadratic time.
+var adversarialGrammars = []struct {
+	name, rules string
+	input       func(n int) string
+}{
+	{"near-matches", "/a/ { }\n/a*b/ { }\n", func(n int) string { return strings.Repeat("a", n) }},
+	{"no-match", "/a*b/ { }\n", func(n int) string { return strings.Repeat("a", n) }},
+	{"alternation", "/(a|b)*c/ { }\n/a/ { }\n/b/ { }\n", func(n int) string { return strings.Repeat("ab", n/2) }},
+	{"asserts", "/a+$/ { }\n/a/ { }\n/b/ { }\n", func(n int) string { return strings.Repeat("a", n) + "b" }},
+}
+
+// scannerDFA returns the DFA of the rules, as the tables of a serialized DFA.
+func scannerDFA(tb testing.TB, rules string) *nexruntime.DFA {
+	program, err := parser.ParseNex(strings.NewReader(rules + "//\npackage main\n"))
+	require.NoError(tb, err)
+	var buf bytes.Buffer
+	require.NoError(tb, (&writer.LexerBuilder{DFAFile: "main.dfa"}).WriteDFAFile(program, &buf))
+	d := &nexruntime.DFA{}
+	require.NoError(tb, gob.NewDecoder(&buf).Decode(d))
+	return d
+}
+
+// countSteps replaces the tables of the DFA, which has no nested scopes, with step functions that
+// count their calls.
+func countSteps(d *nexruntime.DFA, steps *int) {
+	t := d.Tables
+	for i := range d.States {
+		lo, hi := int(t.RuneIndex[i]), int(t.RuneIndex[i+1])
+		if lo < hi {
+			d.States[i].RuneStep = func(r rune) int {
+				*steps++
+				j := sort.Search(hi-lo, func(j int) bool { return t.RuneStart[lo+j] > r })
+				return int(t.RuneNext[lo+j-1])
+			}
+		}
+		if len(t.AssertIndex) > 0 && t.AssertIndex[i] < t.AssertIndex[i+1] {
+			asserts, next := t.Asserts[t.AssertIndex[i]:t.AssertIndex[i+1]], t.AssertNext[t.AssertIndex[i]:]
+			d.States[i].AssertStep = func(a nexruntime.Asserts) int {
+				*steps++
+				for j, b := range asserts {
+					if a == b {
+						return int(next[j])
+					}
+				}
+				return -1
+			}
+		}
+	}
+	d.Tables = nil
+}
+
+func scanAll(d *nexruntime.DFA, input string) {
+	src := nexruntime.NewSource(d, strings.NewReader(input), 0, 0)
+	for src.Next() != nil {
+	}
+}
+
+// TestLinearScanning checks that the steps of the scanner grow linearly with adversarial inputs.
+func TestLinearScanning(t *testing.T) {
+	t.Parallel()
+	for _, g := range adversarialGrammars {
+		t.Run(g.name, func(t *testing.T) {
+			var steps int
+			d := scannerDFA(t, g.rules)
+			countSteps(d, &steps)
+			scanAll(d, g.input(1000))
+			small := steps
+			steps = 0
+			scanAll(d, g.input(8000))
+			require.Less(t, steps, 9*small, "%d steps for 1000 runes", small)
+		})
+	}
+}
+
+// BenchmarkAdversarialInput scans the inputs of the adversarial grammars.
+func BenchmarkAdversarialInput(b *testing.B) {
+	for _, g := range adversarialGrammars {
+		b.Run(g.name, func(b *testing.B) {
+			d := scannerDFA(b, g.rules)
+			input := g.input(1 << 16)
+			b.SetBytes(int64(len(input)))
+			for range b.N {
+				scanAll(d, input)
+			}
+		})
+	}
+}
+
+// BenchmarkArena scans many small documents, whose frames and texts are allocated on the heap, or
+// in an arena that is reset for each of them.
+func BenchmarkArena(b *testing.B) {
+	d := scannerDFA(b, "/[a-z]+/ { return 1 }\n/[0-9]+/ { return 2 }\n/ / { return 3 }\n")
+	doc := "user 42 logged in from 10 0 0 1 at 1700000000"
+	for _, name := range []string{"heap", "arena"} {
+		b.Run(name, func(b *testing.B) {
+			var arena nexruntime.Arena
+			var text string
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for range b.N {
+				src := nexruntime.NewSource(d, strings.NewReader(doc), 0, 0)
+				if name == "arena" {
+					src.SetArena(&arena)
+				}
+				for f := src.Next(); f != nil; f = src.Next() {
+					if name == "arena" {
+						text = arena.String(f.Text)
+					} else {
+						text = string(f.Text)
+					}
+				}
+				arena.Reset()
+			}
+			_ = text
+		})
+	}
+}
+
+// TestPositionsSaturate runs a lexer whose positions start near the largest int, which they
+// reach on 32-bit platforms after long lines and inputs.
+func TestPositionsSaturate(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "positions-saturate")
+	testSpec(t, outputDir, 0, `
+/[a-z]/ { *lval += yySymType(fmt.Sprintf("[%s:%s@%d]", pos(yylex.Line()), pos(yylex.Column()), yylex.Offset())) }
+/\n/    ;
+//
+package main
+import ("math";"os")
+
+type yySymType string
+
+func pos(n int) string {
+  if n < 100 {
+    return fmt.Sprint(n)
+  }
+  return fmt.Sprintf("max-%d", math.MaxInt-n)
+}
+
+func main() {
+  lval := new(yySymType)
+  l := newLexerAt(os.Stdin, math.MaxInt-1, math.MaxInt-2, nil)
+  for l.Lex(lval) != 0 { }
+  fmt.Print(*lval)
+}
+`, "abc\nd\ne", "[max-1:max-2@0][max-1:max-1@1][max-1:max-0@2][max-0:0@4][max-0:0@6]")
+}
+
+// TestArena runs a lexer whose frames and texts are in an arena, which is reset for each line of
+// the input. The longer lines need several slabs. The first text is kept, as the next lines do
+// not overwrite it.
+func TestArena(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "arena")
+	long := strings.Repeat("ab 1 ", 200)
+	testSpec(t, outputDir, 0, `
+%option arena
+/[a-z]+/ { *lval += yySymType("<" + yylex.Text() + ">") }
+/[0-9]+/ { *lval += yySymType("#" + yylex.Text() + "(" + yylex.Gap() + ")"); return 1 }
+//
+package main
+import ("bufio";"os")
+
+type yySymType string
+
+func main() {
+  var arena LexerArena
+  var first string
+  in := bufio.NewScanner(os.Stdin)
+  for in.Scan() {
+    lval := new(yySymType)
+    l := NewLexerWithInit(strings.NewReader(in.Text()), func(l *Lexer) { l.SetArena(&arena) })
+    for l.Lex(lval) != 0 {
+      if first == "" {
+        first = l.Text()
+      }
+    }
+    fmt.Println(len(*lval), strings.Count(string(*lval), "<ab>"), (*lval)[:min(len(*lval), 20)])
+    arena.Reset()
+  }
+  fmt.Println(first)
+}
+`, "ab 12 cd\n"+long+"\nx\n\ny 3\n", "14 1 <ab>#12( )<cd>\n1800 200 <ab>#1( )<ab>#1( )<a\n3 0 <x>\n0 0 \n8 0 <y>#3( )\n12\n")
+}
+
+// TestTextSpans runs a lexer that slices the texts of its matches from its input, in nested scopes
+// and unmatched text too.
+func TestTextSpans(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "text-spans")
+	testSpec(t, outputDir, 0, `
+%option spans
+%option bytes
+%error { span(yylex, "!") }
+/"[^"]*"/ < { span(yylex, "<") }
+  /[a-zé]+/ { span(yylex, "w") }
+>           { span(yylex, ">") }
+/[a-zé]+/   { span(yylex, "w") }
+/ /         { }
+//
+package main
+import ("io";"os")
+
+type yySymType int
+
+var data []byte
+
+func span(yylex *Lexer, what string) {
+  start, end := yylex.TextSpan()
+  fmt.Printf("%s%d-%d%q ", what, start, end, data[start:end])
+  if string(data[start:end]) != yylex.Text() || string(yylex.TextRunes()) != yylex.Text() {
+    fmt.Print("mismatch ")
+  }
+}
+
+func main() {
+  data, _ = io.ReadAll(os.Stdin)
+  l := NewBytesLexer(data, nil)
+  for l.Lex(new(yySymType)) != 0 {
+  }
+}
+`, `héllo "ça va" 12 é`, `w0-6"héllo" <7-15"\"ça va\"" !7-10"\"ç" w10-11"a" !11-12" " w12-14"va" !14-15"\"" >7-15"\"ça va\"" !16-18"12" w19-21"é" `)
+}
+
+// TestAnonymize replaces the identifiers, strings and numbers of an input, and keeps the other
+// bytes, of the other rules, of the rules without code, and unmatched ones.
+func TestAnonymize(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "anonymize")
+	testSpec(t, outputDir, 0, `
+%option anonymize
+/if|else/                  { return 1 }
+/[a-z]+/ %name ruleIdent   { return 2 }
+/"([^"\\]|\\.)*"/         { return 3 }
+/[0-9]+/                   { return 4 }
+/#[^\n]*/                  { }
+//
+package main
+import "os"
+
+type yySymType int
+
+func main() {
+  ids := map[string]string{}
+  err := Anonymize(os.Stdin, os.Stdout, map[int]func(string) string{
+    ruleIdent: func(text string) string {
+      if ids[text] == "" {
+        ids[text] = fmt.Sprintf("id%d", len(ids))
+      }
+      return ids[text]
+    },
+    3: func(text string) string { return `+"`"+`"…"`+"`"+` },
+    4: func(text string) string { return strings.Repeat("9", len(text)) },
+  })
+  if err != nil {
+    panic(err)
+  }
+}
+`, "if x1 \xff== foo { print(\"a\\\"b\", x1) } # é 42\nelse 123", "if id09 \xff== id1 { id2(\"…\", id09) } # é 42\nelse 999")
+}
+
+// TestResync checks that, after a failed match, the scanner skips the input up to the next rune
+// of the `%resync` class, so a run of garbage is a single error, even if rules match within it,
+// in the nested scopes too.
+func TestResync(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "resync")
+	testSpec(t, outputDir, 0, `
+%resync [\n;]
+%error { fmt.Printf("error %q\n", yylex.Text()) }
+/[a-z]+/ { fmt.Printf("word %s\n", yylex.Text()) }
+/;/      { fmt.Println("semicolon") }
+/[ \n]/  { }
+/"[^"]*"/ < { }
+  /[a-z]/ { }
+> { }
+//
+package main
+import "os"
+type yySymType int
+func main() {
+  NewLexer(os.Stdin).Lex(new(yySymType))
+}
+`, "ab; #$ cd ef;# gh\nij ;\"a-b c\"", `word ab
+semicolon
+error "#$ cd ef"
+semicolon
+error "# gh"
+word ij
+semicolon
+error "\"a-b c\""
+`)
+
+	for _, class := range []string{"abc", "[a"} {
+		_, err := parser.ParseNex(strings.NewReader("%resync " + class + "\n/a/ { }\n//\n"))
+		require.ErrorIs(t, err, parser.ErrBadResync)
+	}
+}
+
+// TestReset scans several inputs with one lexer, after it stops in the middle of the first, and
+// checks that each input starts over, with the default rule sets, the `%init` code, and new stats.
+func TestReset(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "reset")
+	testSpec(t, outputDir, 0, `
+%option stats
+%field words int
+%init { yylex.words = 10 }
+/[a-z]+/          { yylex.words++; return 1 }
+/!/ %ruleset bang { return 2 }
+/[ \n]+/          { }
+//
+package main
+import ("os"; "strings")
+
+type yySymType int
+
+func main() {
+  lex := NewLexer(os.Stdin)
+  lex.Lex(new(yySymType))
+  _ = lex.EnableRuleSet("bang")
+  for _, input := range []string{"ab !", "cd\n ef"} {
+    lex.Reset(strings.NewReader(input))
+    for tok := lex.Lex(new(yySymType)); tok != 0; tok = lex.Lex(new(yySymType)) {
+      fmt.Println(tok, lex.Text(), lex.Line(), lex.Column(), lex.Offset(), lex.words)
+    }
+    fmt.Println("runes", lex.Stats().Runes)
+  }
+
+  // The rule sets that the init function enables stay enabled.
+  bang := NewLexerWithInit(strings.NewReader(""), func(l *Lexer) { _ = l.EnableRuleSet("bang") })
+  for _, input := range []string{"!", "a !"} {
+    bang.Reset(strings.NewReader(input))
+    for tok := bang.Lex(new(yySymType)); tok != 0; tok = bang.Lex(new(yySymType)) {
+      fmt.Print(tok, ",")
+    }
+    fmt.Println()
+  }
+}
+`, "xy ! zw", `1 ab 0 0 0 11
+runes 4
+1 cd 0 0 0 11
+1 ef 1 1 4 12
+runes 6
+2,
+1,2,
+`)
+}
+
+// TestCheckpoint saves the state of a scan in a nested scope, with a rule set enabled and a
+// reader of one byte at a time, and resumes it with another lexer from the offset of the state.
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "checkpoint")
+	testSpec(t, outputDir, 0, `
+%option checkpoint
+/[a-zé]+/         { fmt.Println("word", yylex.Text(), yylex.Line(), yylex.Column(), yylex.Offset()); return 1 }
+/!/ %ruleset bang { fmt.Println("bang"); return 2 }
+/@/               { _ = yylex.EnableRuleSet("bang") }
+/\([^)]*\)/ < { fmt.Println("open") }
+  /[0-9]+/ { fmt.Println("number", yylex.Text(), yylex.Column()); return 3 }
+  / /      { }
+> { fmt.Println("close") }
+/[ \n]+/ { }
+//
+package main
+import ("bytes"; "io"; "os"; "testing/iotest")
+
+type yySymType int
+
+func main() {
+  input, _ := io.ReadAll(os.Stdin)
+  lex := NewLexer(iotest.OneByteReader(bytes.NewReader(input)))
+  for lex.Lex(new(yySymType)) != 3 {
+  }
+  state, offset, err := lex.SaveState()
+  if err != nil {
+    panic(err)
+  }
+  fmt.Println("saved at", offset)
+  lex = NewLexer(nil)
+  if err := lex.RestoreState(state, iotest.OneByteReader(bytes.NewReader(input[offset:]))); err != nil {
+    panic(err)
+  }
+  for lex.Lex(new(yySymType)) != 0 {
+  }
+  fmt.Println(lex.RestoreState([]byte("x"), nil) != nil)
+}
+`, "ab @ (1 22) ! é cd\n!", `word ab 0 0 0
+open
+number 1 6
+saved at 11
+number 22 8
+close
+bang
+word é 0 14 14
+word cd 0 16 16
+bang
+true
+`)
+}
+
+// TestLossless checks that the gaps and the texts of the tokens, and the gap of the end of the
+// input, round-trip the input with `%option lossless`, including the text of the rules without
+// code and the unmatched text that `%error` reports, and that CheckLossless fails on invalid UTF-8.
+func TestLossless(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "lossless")
+	testSpec(t, outputDir, 0, `
+%option lossless
+%error { errors++ }
+/[a-z]+/   { return 1 }
+/"[^"]*"/  < { return 2 }
+  /\\./    { }
+>          { }
+/[ \t\n]+/  { }
+/#[^\n]*/  { }
+//
+package main
+import ("io"; "os")
+
+type yySymType int
+
+var errors int
+
+func main() {
+  input, _ := io.ReadAll(os.Stdin)
+  lex := NewLexer(bytes.NewReader(input))
+  var out strings.Builder
+  for lex.Lex(new(yySymType)) != 0 {
+    out.WriteString(lex.Gap() + lex.Text())
+  }
+  out.WriteString(lex.EndGap())
+  fmt.Println(out.String() == string(input), errors, CheckLossless(input))
+  fmt.Println(CheckLossless([]byte("ab \xff cd")))
+}
+`, "ab  # note\n\t\"x\\y\" ?? cd!\n", "true 4 <nil>\nlossless: the tokens differ from the input at byte 3\n")
+}
+
+// TestExplainStates checks the comments above the states of the DFAs, which tell the rules that
+// each state accepts, the one that wins, and those that are still alive.
+func TestExplainStates(t *testing.T) {
+	t.Parallel()
+	program, err := parser.ParseNex(strings.NewReader(`
+/if/                     { return 1 }
+/[a-z]+/ %name ruleIdent { return 2 }
+/i[0-9]/                 { return 3 }
+//
+package main
+`))
+	require.NoError(t, err)
+	for _, tables := range []bool{false, true} {
+		code, err := (&writer.LexerBuilder{ExplainStates: true, Tables: tables}).DumpFormattedLexer(program)
+		require.NoError(t, err)
+		for _, comment := range []string{
+			"// State 0 accepts no rule. Alive: 1, ruleIdent, 3.\n",
+			"// State 2 accepts ruleIdent /[a-z]+/. Alive: ruleIdent.\n",
+			"// State 3 accepts 1, ruleIdent, of which 1 /if/ wins, as it comes first. Alive: 1, ruleIdent.\n",
+			"// State 4 accepts 3 /i[0-9]/. Alive: 3.\n",
+		} {
+			require.Contains(t, string(code), comment)
+		}
+	}
+}
+
+// TestMinify runs a minified lexer, whose code has neither the regexes nor the names of the rules.
+func TestMinify(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "minify")
+	program, err := parser.ParseNex(strings.NewReader(`%top{
+//go:build !secret_grammar_tag
+}
+/secret[0-9]+/ %name ruleSecret { *lval += "S" }
+/covert/ < { *lval += "<" }
+  /v/ { *lval += "V" } // A comment on the nested rule.
+> { *lval += ">" }
+` + cornerCasesMainDoc))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{Minify: true}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(code), "//go:build !secret_grammar_tag\n"))
+	require.Contains(t, string(code), "// Code generated by nex. DO NOT EDIT.")
+	for _, secret := range []string{"secret[0-9]", "ruleSecret", "covert", "nested rule", "Command:", "// Lex runs"} {
+		require.NotContains(t, string(code), secret)
+	}
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	testProgram(t, outputDir, "secret42 covert", "S<V>", outPath)
+}
+
+// TestSpecPrefixAndPackage runs a lexer whose spec sets the prefix of the names, and the package
+// instead of the user code.
+func TestSpecPrefixAndPackage(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "spec-prefix")
+	program, err := parser.ParseNex(strings.NewReader(`%prefix calc
+%package main
+/[0-9]+/ { *lval += "N"; _ = calclex.Text() }
+/./      { *lval += "." }
+//
+import ("os")
+
+type calcSymType = string
+
+func main() {
+  lval := new(calcSymType)
+  l := NewLexer(os.Stdin)
+  for l.Lex(lval) != 0 { }
+  fmt.Print(*lval)
+}
+`))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "\npackage main\n")
+	require.Contains(t, string(code), "func (calclex *Lexer) Lex(lval *calcSymType) int {")
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	testProgram(t, outputDir, "1+23", "N.N", outPath)
+}
+
+// TestPrefixRenamesIdentifiers runs a lexer with a prefix whose actions and user code use the
+// names with yy, and strings and identifiers that merely contain yy, which must be left intact.
+// The keys of a map literal are renamed, unlike those of a struct literal.
+func TestPrefixRenamesIdentifiers(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "prefix-renames")
+	testSpec(t, outputDir, 0, `%prefix calc
+/[a-z]+/ { *lval += yySymType(yylex.Text()) + "yy" }
+/./      { }
+//
+package main
+
+import "os"
+
+type calcSymType string
+
+var keyyard = "yy"
+
+const yyKindA = 1
+
+var names = map[int]string{yyKindA: "A"}
+
+type pair struct{ yyKindA int }
+
+func main() {
+  lval := new(yySymType)
+  NewLexer(os.Stdin).Lex(lval)
+  fmt.Println(*lval, keyyard, names[calcKindA], pair{yyKindA: 2}.yyKindA)
+}
+`, "ab cd", "abyycdyy yy A 2\n")
+}
+
+// TestAliases runs a lexer with the prefix calc through its Lex method and through the wrapper
+// of the alias prefix yy, whose semantic values another file declares, like the parser of goyacc.
+func TestAliases(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "aliases")
+	program, err := parser.ParseNex(strings.NewReader(`%prefix calc
+/[a-z]+/ { lval.s = yylex.Text(); return 1 }
+/./      { }
+//
+package main
+
+type calcSymType struct{ s string }
+`))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{Aliases: []string{"yy"}}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "func (l yyLex) Lex(lval *yySymType) int {")
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	mainPath := path.Join(path.Dir(outPath), "y.go")
+	require.NoError(t, os.WriteFile(mainPath, []byte(`package main
+
+import ("fmt"; "os")
+
+type yySymType struct{ s string }
+
+func main() {
+  l := NewLexer(os.Stdin)
+  lval, yylval := new(calcSymType), new(yySymType)
+  l.Lex(lval)
+  yyLex{l}.Lex(yylval)
+  fmt.Println(lval.s, yylval.s)
+}
+`), os.ModePerm))
+	testProgram(t, path.Dir(outPath), "ab cd", "ab cd\n", "main.go", "y.go")
+
+	b.Aliases = []string{"calc"}
+	_, err = b.DumpFormattedLexer(program)
+	require.ErrorContains(t, err, "prefix of the lexer")
+}
+
+// TestSections runs a lexer whose spec separates the parameters, the rules and the user code
+// with `%%` lines, like lex.
+func TestSections(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "sections")
+	testSpec(t, outputDir, 0, `%field n int
+%%
+/a/ { yylex.n++ }
+/b/ { *lval += yySymType(fmt.Sprint(yylex.n)) }
+`+strings.Replace(cornerCasesMainDoc, "//\n", "%%\n", 1), "aabab", "23")
+}
+
+// TestNamedRules runs a lexer with named rules and a rule set in a nested scope.
+func TestNamedRules(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "named-rules")
+	spec := `
+/[^\n]+/ < { *lval += "<" }
+  /a/ %name ruleA %ruleset sql2016 { *lval += "A" }
+  /./ { *lval += "." }
+> { *lval += ">" }
+/\n/ %name ruleNewline { }
+` + ruleSetsMainDoc
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	require.Contains(t, string(code), "case frameKey{Kind: kStartCode, Scope: 1, Rule: ruleA}:")
+	require.Contains(t, string(code), "Accept:  ruleA,")
+	require.Contains(t, string(code), `"sql2016": {ruleA},`)
+	testSpec(t, outputDir, 0, spec, "ab\nb", "<A.><.>")
+}
+
+const goroutinesMainDoc = `//
+package main
+import ("os";"runtime")
+
+type yySymType = string
+
+func main() {
+  lval := new(yySymType)
+  l := NewLexer(os.Stdin)
+  // Do not drain the lexer.
+  l.Lex(lval)
+  fmt.Print(*lval, runtime.NumGoroutine())
+}
+`
+
+func TestSynchronousHasNoGoroutines(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "synchronous")
+	// The flag and the option are the same, and the prefix of -p applies to the synchronous Lex too.
+	for i, x := range []struct {
+		option string
+		b      writer.LexerBuilder
+	}{
+		{"", writer.LexerBuilder{Synchronous: true}},
+		{"%option sync\n", writer.LexerBuilder{}},
+		{"", writer.LexerBuilder{Synchronous: true, CustomPrefix: "calc"}},
+	} {
+		program, err := parser.ParseNex(strings.NewReader(x.option + `
+/a/ { *lval += "A"; return 1 }
+/./ { *lval += "." }
+` + goroutinesMainDoc))
+		require.NoError(t, err)
+		code, err := x.b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		prefix := cmp.Or(x.b.CustomPrefix, "yy")
+		require.Contains(t, string(code), fmt.Sprintf("switch %slex.curFrame.Key {", prefix))
+		require.NotContains(t, string(code), "go "+prefix+"lex")
+		require.NotContains(t, string(code), "chan ")
+		outPath := makeProgramFile(t, outputDir, i, "prog")
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, "bbab", "..A1", outPath)
+	}
+}
+
+// TestBackpressure runs an asynchronous lexer whose buffer fills up before Lex is called, so
+// its scanner reports the high-watermark and blocks.
+func TestBackpressure(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "backpressure")
+	program, err := parser.ParseNex(strings.NewReader(`
+/[a-z]/ { return 1 }
+//
+package main
+
+import ("os"; "time")
+
+type yySymType int
+
+func main() {
+  high := 0
+  l := NewLexerWithInit(os.Stdin, func(l *Lexer) {
+    l.SetBuffer(4, 3, func(pending int) { high = pending })
+  })
+  for !l.Blocked() {
+    time.Sleep(time.Millisecond)
+  }
+  fmt.Println("high", high)
+  tokens := 0
+  for l.Lex(nil) != 0 {
+    tokens++
+  }
+  fmt.Println(tokens, l.Blocked())
+}
+`))
+	require.NoError(t, err)
+	b := writer.LexerBuilder{}
+	code, err := b.DumpFormattedLexer(program)
+	require.NoError(t, err)
+	outPath := makeProgramFile(t, outputDir, 0, "prog")
+	require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+	testProgram(t, outputDir, "abcdefgh", "high 3\n8 false\n", outPath)
+}
+
+// TestPushLexer pushes an input in chunks that split the matches, and closes it in the middle
+// of a string, which is matched by its longest prefix, or left unmatched.
+func TestPushLexer(t *testing.T) {
+	t.Parallel()
+	outputDir := makeOutputDir(t, "push")
+	testSpec(t, outputDir, 0, `%option push
+%error { fmt.Print("!", yylex.Text(), "!") }
+/"[^"]*"/ { return 1 }
+/[a-z]+/  { return 1 }
+/ /       { }
+/./       { return 1 }
+//
+package main
+
+type yySymType int
+
+func main() {
+  for _, end := range []EndOfInput{EndLongestMatch, EndUnmatched} {
+    l := NewPushLexer(func(l *Lexer) { l.SetEndOfInput(end) })
+    go func() {
+      for _, chunk := range []string{"a", "b \"c", "d\" \"e", "f"} {
+        _, _ = l.Write([]byte(chunk))
+      }
+      _ = l.Close()
+    }()
+    for l.Lex(nil) != 0 {
+      fmt.Print("<", l.Text(), ">")
+    }
+    fmt.Println()
+  }
+}
+`, "", "<ab><\"cd\"><\"><ef>\n<ab><\"cd\">!\"ef!\n")
+}
+
+// TestNoGlobalState verifies that the generated code has no package-level state other than the
+// read-only DFA, so multiple lexers (or multiple versions of a lexer loaded via plugins) are independent.
+func TestNoGlobalState(t *testing.T) {
+	t.Parallel()
+	for _, b := range []writer.LexerBuilder{{}, {Standalone: true}, {InlineRuntime: true}, {DFAFile: "main.dfa"}} {
+		program, err := parser.ParseNex(strings.NewReader(`
+/a/ < { }
+  /b/ { }
+> { }
+/./ { }
+//
+package main
+`))
+		require.NoError(t, err)
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+
+		f, err := goparser.ParseFile(token.NewFileSet(), "", code, 0)
+		require.NoError(t, err)
+		var globals []string
+		inits := 0
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Name.Name == "init" {
+					inits++
+				}
+			case *ast.GenDecl:
+				if d.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range d.Specs {
+					for _, name := range spec.(*ast.ValueSpec).Names {
+						globals = append(globals, name.Name)
+					}
+				}
+			}
+		}
+		if b.DFAFile != "" {
+			// The only init function decodes the DFA from its file, which is embedded.
+			require.Equal(t, []string{"programDfa", "programDfaFile"}, globals)
+			require.Equal(t, 1, inits)
+			continue
+		}
+		require.Equal(t, []string{"programDfa"}, globals)
+		require.Zero(t, inits)
+	}
+}
+
+// ################################################################################
+// # Helper functions
+// ################################################################################
+
+// testSpec generates a lexer for the given spec and checks the output of running it against the input.
+// The lexer is tested with both the asynchronous and the synchronous runtimes.
+func testSpec(t *testing.T, outputDir string, progIndex int, spec, input, output string) {
+	program, err := parser.ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	for _, sync := range []bool{false, true} {
+		b := writer.LexerBuilder{Synchronous: sync}
+		code, err := b.DumpFormattedLexer(program)
+		require.NoError(t, err)
+		outPath := makeProgramFile(t, outputDir, progIndex, fmt.Sprintf("prog-sync-%v", sync))
+		require.NoError(t, os.WriteFile(outPath, code, os.ModePerm))
+		testProgram(t, outputDir, input, output, outPath)
+	}
+}
+
+func copyToDir(t *testing.T, dst, src string) {
+	dst = filepath.Join(dst, filepath.Base(src))
+	s, err := os.Open(src)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	d, err := os.Create(dst)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, d.Close()) }()
+	_, err = io.Copy(d, s)
+	require.NoError(t, err)
+}
+
+func runCmd(t *testing.T, cwd, bin string, s ...string) {
+	cmd := exec.Command(bin, s...)
+	if cwd != "" {
+		cmd.Dir = cwd
+	}
+	output, err := cmd.CombinedOutput()
+	require.NoErrorf(t, err, "Command: %s\nOutput: %s\n", s, string(output))
+}
+
+func testProgram(t *testing.T, cwd, input, output string, goFiles ...string) {
+	require.Equal(t, output, runProgram(t, cwd, input, goFiles...))
+}
+
+// runProgram runs the program with the given input, and returns its output.
+func runProgram(t *testing.T, cwd, input string, goFiles ...string) string {
 	cmd := exec.Command("go", append([]string{"run"}, goFiles...)...)
 	cmd.Dir = cwd
 	cmd.Stdin = strings.NewReader(input)
 	cmd.Stderr = os.Stderr
 	got, err := cmd.Output()
 	require.NoError(t, err, "Output")
-	require.Equal(t, output, string(got))
+	return string(got)
 }
 
 func testWithYacc(t *testing.T, srcDir, nexFile, yFile string, otherFiles []string, input, output string) {
@@ -365,6 +2623,8 @@ func testWithYacc(t *testing.T, srcDir, nexFile, yFile string, otherFiles []stri
 	testProgram(t, outputDir, input, output, goFiles...)
 }
 
+// makeOutputDir makes a module for the programs of a test, as the lexers import the nexruntime
+// package of this module unless they inline it.
 func makeOutputDir(t *testing.T, name ...string) string {
 	outputDir := os.Getenv("NEX_TEST_DEBUG_OUTPUT")
 	if outputDir == "" {
@@ -374,6 +2634,7 @@ func makeOutputDir(t *testing.T, name ...string) string {
 	require.NoError(t, err)
 	outputDir = filepath.Join(append([]string{outputDir}, name...)...)
 	require.NoError(t, os.MkdirAll(outputDir, os.ModePerm))
+	writeRuntimeModule(t, outputDir)
 	return outputDir
 }
 
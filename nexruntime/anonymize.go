@@ -0,0 +1,73 @@
+package nexruntime
+
+// [BEGIN ANONYMIZE]
+
+import "io"
+
+// Anonymize copies the input to out, with the text of each match of a top-level rule that replace
+// has a function for replaced by what the function returns, and all the other bytes as they are,
+// including those of the unmatched text and of invalid UTF-8. Unlike Lex, it sees the matches of
+// the rules without code too, as they are not skipped. It returns the first error of reading the
+// input or of writing out.
+func Anonymize(d *DFA, in io.Reader, out io.Writer, replace map[int]func(text string) string) error {
+	top := *d
+	// [BEGIN SKIP]
+	top.Skip = nil
+	// [END SKIP]
+	input := &inputCopy{in: in}
+	src := NewSource(&top, input, 0, 0)
+	for f := src.Next(); f != nil; f = src.Next() {
+		fn := replace[f.Key.Rule]
+		if f.Key.Kind != KStartCode || f.Key.Scope != 0 || fn == nil {
+			continue
+		}
+		if err := input.copyTo(out, f.ByteOffset); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, fn(string(f.Text))); err != nil {
+			return err
+		}
+		input.discardTo(f.ByteEnd)
+	}
+	if input.err != nil {
+		return input.err
+	}
+	return input.copyTo(out, input.offset+int64(len(input.buf)))
+}
+
+// inputCopy keeps the bytes that the source reads from the input, until they are copied to the
+// output or discarded. A read error ends the input of the source, instead of making it panic.
+type inputCopy struct {
+	in  io.Reader
+	err error
+	// The bytes that were read and are neither copied nor discarded, and the offset of the first.
+	buf    []byte
+	offset int64
+}
+
+func (c *inputCopy) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	if err != nil && err != io.EOF {
+		c.err, err = err, io.EOF
+	}
+	return n, err
+}
+
+// copyTo copies the bytes up to the given offset to out.
+func (c *inputCopy) copyTo(out io.Writer, end int64) error {
+	n := end - c.offset
+	if _, err := out.Write(c.buf[:n]); err != nil {
+		return err
+	}
+	c.discardTo(end)
+	return nil
+}
+
+// discardTo discards the bytes up to the given offset.
+func (c *inputCopy) discardTo(end int64) {
+	c.buf = c.buf[end-c.offset:]
+	c.offset = end
+}
+
+// [END ANONYMIZE]
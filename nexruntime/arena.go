@@ -0,0 +1,83 @@
+package nexruntime
+
+// [BEGIN ARENA]
+
+import "strings"
+
+// arenaSlab is the size of the first slabs of frames of an arena.
+const arenaSlab = 256
+
+// Arena allocates the frames of the sources that use it, and the strings of the texts of their
+// matches, in slabs, instead of allocating each of them on the heap. Reset reuses the slabs of
+// the frames for the next document, and starts a slab of text that fits all the strings of the
+// previous one. After a few documents, scanning one allocates no frames and a single slab of text,
+// which eases the GC when millions of small documents are scanned in a batch. The zero value is
+// an empty arena.
+//
+// The frames are only valid until Reset, so they may not be kept for the next document. The
+// strings stay valid, as the bytes of a slab of text are never overwritten, and the slab stays as
+// long as its strings do. An arena is used by one source at a time, which scans, and by the
+// goroutine that takes its frames and copies their texts, which may be another one.
+type Arena struct {
+	// The frames of the current slab that are used, and the earlier slabs of the document.
+	frames []Frame
+	used   int
+	full   int
+	// The bytes of the strings are appended to the slab of text, and size counts those of the
+	// document.
+	text strings.Builder
+	size int
+}
+
+// Reset reuses the slabs of the frames of the arena for the next document, which invalidates
+// the frames that it allocated. It may only be called once the source that uses the arena ends,
+// or is no longer used.
+func (a *Arena) Reset() {
+	// The frames of the document were in several slabs, so a slab of all of them replaces the last.
+	if a.full > 0 {
+		a.frames = make([]Frame, a.full+len(a.frames))
+	} else {
+		// The frames are cleared, so they do not keep the runes of the document.
+		for i := range a.frames[:a.used] {
+			a.frames[i] = Frame{}
+		}
+	}
+	a.used, a.full = 0, 0
+	// The strings of the document may be kept, so their slab is not reused.
+	if a.size > 0 {
+		a.text = strings.Builder{}
+		a.text.Grow(a.size)
+	}
+	a.size = 0
+}
+
+// frame returns a zero frame of the arena.
+func (a *Arena) frame() *Frame {
+	if a.used == len(a.frames) {
+		a.full += len(a.frames)
+		a.frames, a.used = make([]Frame, 2*len(a.frames)+arenaSlab), 0
+	}
+	a.used++
+	return &a.frames[a.used-1]
+}
+
+// String returns the text as a string in the arena.
+func (a *Arena) String(text []rune) string {
+	if len(text) == 0 {
+		return ""
+	}
+	// A full slab is copied to a larger one, and stays as long as its strings do.
+	start := a.text.Len()
+	for _, r := range text {
+		a.text.WriteRune(r)
+	}
+	a.size += a.text.Len() - start
+	return a.text.String()[start:]
+}
+
+// SetArena makes the source allocate its frames in the arena. It must be called before Next.
+func (src *Source) SetArena(a *Arena) {
+	src.arena = a
+}
+
+// [END ARENA]
@@ -0,0 +1,89 @@
+// Package nexruntime is the scanner core of the lexers that nex generates.
+//
+// By default, nex inlines this package into the generated code, so the generated lexers are
+// self-contained. With `nex -runtime`, the generated code imports it instead.
+// The generated code only consists of the Lexer, the actions, and the DFA values.
+package nexruntime
+
+// Asserts are the zero-width assertions that hold at a position of the input.
+type Asserts = uint64
+
+const (
+	AStartText Asserts = 1 << iota
+	AEndText
+	AStartLine
+	AEndLine
+	AWordBoundary
+	ANoWordBoundary
+)
+
+type FrameKind int
+
+const (
+	KStartCode FrameKind = iota
+	KEndCode
+	KErrorCode // The unmatched text that the scanner skipped. The rule of its key is 0.
+)
+
+// FrameKey identifies the code that runs for a frame.
+type FrameKey struct {
+	Kind  FrameKind
+	Scope int // The scope of the rule, see DFA.Scope.
+	Rule  int // The number of the rule within its scope, from 1.
+}
+
+// Frame is the start or the end of a match, for which the lexer runs the rule's code.
+type Frame struct {
+	Key          FrameKey
+	Text         []rune
+	Line, Column int
+	Offset       int64 // The number of runes that precede the match in the input.
+
+	// The offsets of the first byte of the match in the input, and of the byte right after it.
+	ByteOffset, ByteEnd int64
+
+	// The position right after the match, which differs from its line if the match spans lines.
+	EndLine, EndColumn int
+
+	// The unmatched text that precedes the match, and where it starts.
+	Gap                []rune
+	GapLine, GapColumn int
+	GapOffset          int64
+}
+
+// maxPosition is the largest line and column. They saturate at it instead of wrapping around,
+// which can only happen on 32-bit platforms. Offsets are int64, so they never do.
+const maxPosition = int(^uint(0) >> 1)
+
+type State struct {
+	Accept     int               // Accept index.
+	AssertMask Asserts           // We only apply assert-transition with masked bits.
+	AssertStep func(Asserts) int // Assert transition.
+	RuneStep   func(rune) int    // Rune transition.
+	// [BEGIN ACCEPTS]
+	Accepts []int // All the accepted rules, by precedence.
+	// [END ACCEPTS]
+}
+
+// DFA is the automaton of a scope of rules.
+type DFA struct {
+	States []State
+	Nest   map[int]DFA // The DFAs of the nested scopes, by the rules that open them.
+	Scope  int         // The index of the scope in a pre-order walk of the scopes. The root is 0.
+	// [BEGIN TABLES]
+	Tables *Tables // The transitions of the states, if they have no step functions.
+	// [END TABLES]
+	// [BEGIN SKIP]
+	Skip map[int]bool // The rules without code, whose matches produce no frames.
+	// [END SKIP]
+	// [BEGIN RULESETS]
+	// Maps the rule sets to the rules of this scope that belong to them.
+	Sets    map[string][]int
+	IdCount int
+	// [END RULESETS]
+	// [BEGIN RESYNC]
+	// The ranges of the runes up to which the scanners of all the scopes skip the input after a
+	// failed match, as pairs of their first and last runes, if the root has them, see `%resync`.
+	Resync []rune
+	// [END RESYNC]
+}
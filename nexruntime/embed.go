@@ -0,0 +1,9 @@
+package nexruntime
+
+import "embed"
+
+// Sources holds the source of this package, so nex can inline it into the generated code.
+// Programs that do not refer to it do not link it.
+//
+//go:embed dfa.go source.go rulesets.go tables.go grapheme.go replay.go match.go serialize.go arena.go anonymize.go lossless.go state.go sniff.go trace.go
+var Sources embed.FS
@@ -0,0 +1,84 @@
+package nexruntime
+
+// [BEGIN GRAPHEMES]
+
+import "unicode"
+
+// GraphemeLen returns the number of runes of the first grapheme cluster of the text, which is a
+// user-perceived character, like a letter with its combining accents, a flag, or an emoji sequence.
+// It follows the extended grapheme clusters of Unicode (UAX #29), except for the prepended
+// concatenation marks and the Indic conjuncts, which are split like other letters and marks.
+func GraphemeLen(text []rune) int {
+	if len(text) == 0 {
+		return 0
+	}
+	r := text[0]
+	switch {
+	case r == '\r' && len(text) > 1 && text[1] == '\n':
+		return 2
+	case isGraphemeControl(r):
+		return 1
+	}
+	n := 1
+	if isRegionalIndicator(r) && len(text) > 1 && isRegionalIndicator(text[1]) {
+		// Regional indicators pair up into flags.
+		n = 2
+	}
+	for n < len(text) && hangulJoins(text[n-1], text[n]) {
+		n++
+	}
+	for n < len(text) {
+		switch c := text[n]; {
+		case isGraphemeExtend(c):
+			n++
+		case text[n-1] == zeroWidthJoiner && isPictographic(c):
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+const zeroWidthJoiner = '\u200d'
+
+// isGraphemeControl returns true for the runes that are clusters of their own.
+func isGraphemeControl(r rune) bool {
+	return unicode.In(r, unicode.Cc, unicode.Zl, unicode.Zp)
+}
+
+// isGraphemeExtend returns true for the runes that never start a cluster: marks, joiners, emoji
+// modifiers, and tags.
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) || r == '\u200c' || r == zeroWidthJoiner ||
+		(0x1f3fb <= r && r <= 0x1f3ff) || (0xe0020 <= r && r <= 0xe007f)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return 0x1f1e6 <= r && r <= 0x1f1ff
+}
+
+// isPictographic approximates the emoji that a zero width joiner joins into a sequence.
+func isPictographic(r rune) bool {
+	return (0x1f000 <= r && r <= 0x1faff) || (0x2600 <= r && r <= 0x27bf) || unicode.Is(unicode.So, r)
+}
+
+// hangulJoins returns true if the two Hangul runes are parts of the same syllable.
+func hangulJoins(prev, next rune) bool {
+	isL := func(r rune) bool { return (0x1100 <= r && r <= 0x115f) || (0xa960 <= r && r <= 0xa97c) }
+	isV := func(r rune) bool { return (0x1160 <= r && r <= 0x11a7) || (0xd7b0 <= r && r <= 0xd7c6) }
+	isT := func(r rune) bool { return (0x11a8 <= r && r <= 0x11ff) || (0xd7cb <= r && r <= 0xd7fb) }
+	isSyllable := 0xac00 <= prev && prev <= 0xd7a3
+	isLV := isSyllable && (prev-0xac00)%28 == 0
+	switch {
+	case isL(prev):
+		return isL(next) || isV(next) || (0xac00 <= next && next <= 0xd7a3)
+	case isV(prev) || isLV:
+		return isV(next) || isT(next)
+	case isT(prev) || isSyllable:
+		return isT(next)
+	}
+	return false
+}
+
+// [END GRAPHEMES]
@@ -0,0 +1,68 @@
+package nexruntime
+
+// [BEGIN LOSSLESS]
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Lossless makes the source keep the text of the matches of the rules without code, which it
+// skips, in the gap of the next frame, instead of discarding it, so that the gaps and the texts
+// of the top-level matches, in order, and the gap of the end of the input, add up to the input.
+// It must be called before Next.
+func (src *Source) Lossless() {
+	src.stack[0].lossless = true
+}
+
+// keepSkipped keeps the gap and the text of the current match, which is skipped, for the next frame.
+func (s *scanner) keepSkipped() {
+	if !s.lossless {
+		return
+	}
+	if len(s.kept) == 0 {
+		s.keptLine, s.keptColumn, s.keptOffset = s.gapLine, s.gapColumn, s.gapOffset
+	}
+	s.kept = append(append(s.kept, s.gap...), s.runes[:s.matchPos]...)
+}
+
+// prependKept prepends the kept text to the gap of the frame, which then starts where it does.
+func (s *scanner) prependKept(f *Frame) {
+	if len(s.kept) == 0 {
+		return
+	}
+	f.Gap = append(s.kept[:len(s.kept):len(s.kept)], f.Gap...)
+	f.GapLine, f.GapColumn, f.GapOffset = s.keptLine, s.keptColumn, s.keptOffset
+}
+
+// CheckLossless returns an error unless the gaps and the texts of the top-level matches of the
+// data, in order, and the gap of the end of the input, are the data, byte for byte, as they are
+// with Lossless. The runes of invalid UTF-8 are the replacement character, so they do not add up
+// to the bytes of the data, and neither does a DFA whose skipped rules it does not keep.
+func CheckLossless(d *DFA, data []byte) error {
+	src := NewSource(d, bytes.NewReader(data), 0, 0)
+	src.Lossless()
+	var offset int
+	var buf [utf8.UTFMax]byte
+	for f := src.Next(); f != nil; f = src.Next() {
+		if f.Key.Scope != 0 || f.Key.Kind == KErrorCode || (f.Key.Kind == KEndCode && f.Key.Rule != 0) {
+			continue
+		}
+		for _, text := range [][]rune{f.Gap, f.Text} {
+			for _, r := range text {
+				n := utf8.EncodeRune(buf[:], r)
+				if !bytes.HasPrefix(data[offset:], buf[:n]) {
+					return fmt.Errorf("lossless: the tokens differ from the input at byte %d", offset)
+				}
+				offset += n
+			}
+		}
+	}
+	if offset < len(data) {
+		return fmt.Errorf("lossless: the tokens end at byte %d of %d of the input", offset, len(data))
+	}
+	return nil
+}
+
+// [END LOSSLESS]
@@ -0,0 +1,51 @@
+package nexruntime
+
+// [BEGIN MATCH]
+
+// FullMatch returns true if the rule of the DFA matches the whole text, even if a rule of a higher
+// precedence matches it too. The states must list all the rules they accept.
+func FullMatch(d *DFA, rule int, text []rune) bool {
+	s := &scanner{dfa: d, runes: text}
+	accepts := func(st int) bool {
+		if st < 0 || s.pos < len(s.runes) {
+			return false
+		}
+		for _, a := range d.States[st].Accepts {
+			if a == rule {
+				return true
+			}
+		}
+		return false
+	}
+
+	st := 0
+	for madeProgress := true; madeProgress && st >= 0; {
+		madeProgress = false
+		if s.hasAssertStep(st) {
+			if a := s.consumeAsserts(d.States[st].AssertMask); a != 0 {
+				st = s.assertStep(st, a)
+				if accepts(st) {
+					return true
+				}
+				madeProgress = true
+			}
+		}
+
+		if st < 0 {
+			break
+		}
+
+		if s.hasRuneStep(st) {
+			if r, ok := s.consumeRune(); ok {
+				st = s.runeStep(st, r)
+				if accepts(st) {
+					return true
+				}
+				madeProgress = true
+			}
+		}
+	}
+	return false
+}
+
+// [END MATCH]
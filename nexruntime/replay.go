@@ -0,0 +1,59 @@
+package nexruntime
+
+// [BEGIN REPLAY]
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RecordToken writes a token that Lex returned to a recording, as a line with the token, the
+// range of its match, its offsets in runes and in bytes, the key of the match's frame, and the
+// quoted text:
+//
+//	1 0:4-0:6 4 4 0/0/2 "12"
+//
+// Recordings are text, so the tokens of two versions of a lexer can be diffed.
+func RecordToken(w io.Writer, token int, f *Frame) {
+	_, _ = fmt.Fprintf(w, "%d %d:%d-%d:%d %d %d %d/%d/%d %q\n", token, f.Line, f.Column, f.EndLine, f.EndColumn,
+		f.Offset, f.ByteOffset, f.Key.Kind, f.Key.Scope, f.Key.Rule, string(f.Text))
+}
+
+// ReadRecording returns the frames of the tokens of a recording that RecordToken wrote.
+// The gaps before the matches are not recorded. The lines of the recordings of earlier versions,
+// which have no offsets in bytes, are read too, with offsets in bytes of 0.
+func ReadRecording(in io.Reader) ([]*Frame, error) {
+	var frames []*Frame
+	r := bufio.NewReader(in)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if line == "" && errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		f := &Frame{}
+		var token int
+		var text string
+		if _, err := fmt.Sscanf(line, "%d %d:%d-%d:%d %d %d %d/%d/%d %q", &token, &f.Line, &f.Column,
+			&f.EndLine, &f.EndColumn, &f.Offset, &f.ByteOffset, &f.Key.Kind, &f.Key.Scope, &f.Key.Rule, &text); err != nil {
+			*f = Frame{}
+			if _, err := fmt.Sscanf(line, "%d %d:%d-%d:%d %d %d/%d/%d %q", &token, &f.Line, &f.Column,
+				&f.EndLine, &f.EndColumn, &f.Offset, &f.Key.Kind, &f.Key.Scope, &f.Key.Rule, &text); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, fmt.Errorf("recording line %d: %w", n, err)
+			}
+		}
+		f.Text = []rune(text)
+		frames = append(frames, f)
+	}
+}
+
+// [END REPLAY]
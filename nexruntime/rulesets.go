@@ -0,0 +1,90 @@
+package nexruntime
+
+// [BEGIN RULESETS]
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// RuleSets tracks the enabled rule sets of a lexer. The masks of the enabled rules are replaced
+// atomically, as they may be read by a scanner in another goroutine.
+type RuleSets struct {
+	dfa     *DFA
+	enabled map[string]bool
+	masks   atomic.Pointer[map[int][]bool] // By scope.
+}
+
+// NewRuleSets returns the rule sets of the given root DFA, all of which are disabled.
+func NewRuleSets(d *DFA) *RuleSets {
+	r := &RuleSets{dfa: d, enabled: map[string]bool{}}
+	r.update()
+	return r
+}
+
+// Set enables or disables a rule set.
+// A rule that belongs to several rule sets is enabled as long as one of them is enabled.
+func (r *RuleSets) Set(name string, enabled bool) error {
+	if !hasSet(r.dfa, name) {
+		return fmt.Errorf("unknown rule set %q", name)
+	}
+	r.enabled[name] = enabled
+	r.update()
+	return nil
+}
+
+// disableAll disables all the rule sets.
+func (r *RuleSets) disableAll() {
+	r.enabled = map[string]bool{}
+	r.update()
+}
+
+func hasSet(d *DFA, name string) bool {
+	if _, ok := d.Sets[name]; ok {
+		return true
+	}
+	for _, nested := range d.Nest {
+		if hasSet(&nested, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleSets) update() {
+	masks := map[int][]bool{}
+	r.addMasks(r.dfa, masks)
+	r.masks.Store(&masks)
+}
+
+func (r *RuleSets) addMasks(d *DFA, masks map[int][]bool) {
+	for _, nested := range d.Nest {
+		r.addMasks(&nested, masks)
+	}
+	if len(d.Sets) == 0 {
+		return
+	}
+	mask := make([]bool, d.IdCount)
+	for i := range mask {
+		mask[i] = true
+	}
+	for _, ids := range d.Sets {
+		for _, id := range ids {
+			mask[id] = false
+		}
+	}
+	for name, ids := range d.Sets {
+		for _, id := range ids {
+			mask[id] = mask[id] || r.enabled[name]
+		}
+	}
+	masks[d.Scope] = mask
+}
+
+// allows returns true if the given rule of the scope of the DFA is enabled.
+func (r *RuleSets) allows(d *DFA, rule int) bool {
+	mask, ok := (*r.masks.Load())[d.Scope]
+	return !ok || mask[rule]
+}
+
+// [END RULESETS]
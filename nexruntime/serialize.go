@@ -0,0 +1,120 @@
+package nexruntime
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"slices"
+)
+
+// [BEGIN SERIALIZE]
+
+// gobDFA is how a DFA is encoded: its maps are slices that are sorted by their keys, so that a DFA
+// always encodes to the same bytes, while gob encodes the entries of a map in a random order.
+type gobDFA struct {
+	States []State
+	Nest   []gobNest
+	Scope  int
+	// [BEGIN TABLES]
+	Tables *Tables
+	// [END TABLES]
+	// [BEGIN SKIP]
+	Skip []int
+	// [END SKIP]
+	// [BEGIN RULESETS]
+	Sets    []gobSet
+	IdCount int
+	// [END RULESETS]
+	// [BEGIN RESYNC]
+	Resync []rune
+	// [END RESYNC]
+}
+
+type gobNest struct {
+	Rule int
+	DFA  DFA
+}
+
+type gobSet struct {
+	Name  string
+	Rules []int
+}
+
+// GobEncode encodes the DFA for a lexer that decodes it from a file at init.
+func (d DFA) GobEncode() ([]byte, error) {
+	g := gobDFA{Scope: d.Scope}
+	g.States = d.States
+	for _, rule := range sortedKeys(d.Nest) {
+		g.Nest = append(g.Nest, gobNest{rule, d.Nest[rule]})
+	}
+	// [BEGIN TABLES]
+	g.Tables = d.Tables
+	// [END TABLES]
+	// [BEGIN SKIP]
+	g.Skip = sortedKeys(d.Skip)
+	// [END SKIP]
+	// [BEGIN RULESETS]
+	for _, name := range sortedKeys(d.Sets) {
+		g.Sets = append(g.Sets, gobSet{name, d.Sets[name]})
+	}
+	g.IdCount = d.IdCount
+	// [END RULESETS]
+	// [BEGIN RESYNC]
+	g.Resync = d.Resync
+	// [END RESYNC]
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&g)
+	return buf.Bytes(), err
+}
+
+// GobDecode decodes a DFA that GobEncode encoded.
+func (d *DFA) GobDecode(data []byte) error {
+	var g gobDFA
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	*d = DFA{Scope: g.Scope}
+	d.States = g.States
+	for _, n := range g.Nest {
+		if d.Nest == nil {
+			d.Nest = map[int]DFA{}
+		}
+		d.Nest[n.Rule] = n.DFA
+	}
+	// [BEGIN TABLES]
+	d.Tables = g.Tables
+	// [END TABLES]
+	// [BEGIN SKIP]
+	for _, rule := range g.Skip {
+		if d.Skip == nil {
+			d.Skip = map[int]bool{}
+		}
+		d.Skip[rule] = true
+	}
+	// [END SKIP]
+	// [BEGIN RULESETS]
+	for _, s := range g.Sets {
+		if d.Sets == nil {
+			d.Sets = map[string][]int{}
+		}
+		d.Sets[s.Name] = s.Rules
+	}
+	d.IdCount = g.IdCount
+	// [END RULESETS]
+	// [BEGIN RESYNC]
+	d.Resync = g.Resync
+	// [END RESYNC]
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// [END SERIALIZE]
@@ -0,0 +1,36 @@
+package nexruntime
+
+// [BEGIN SNIFF]
+
+import "io"
+
+// Sniff returns the top-level rule of the first match that the lexer of the DFA would run the
+// code of, in a prefix of an input, which it scans as if it were all of the input. It returns 0
+// and false if there is no such match, or if text that no rule matches precedes it. Rule sets
+// and guards do not apply.
+func Sniff(d *DFA, prefix []byte) (int, bool) {
+	// The matches of the rules without code are seen too, so the gaps before them are not lost.
+	top := *d
+	// [BEGIN SKIP]
+	top.Skip = nil
+	// [END SKIP]
+	src := newSourceOf(&top, &runeReader{buf: prefix, w: len(prefix), err: io.EOF}, 0, 0)
+	for f := src.Next(); f != nil; f = src.Next() {
+		// The first frame is the start of the input, whose rule is 0.
+		if f.Key.Kind != KStartCode || f.Key.Scope != 0 || f.Key.Rule == 0 {
+			continue
+		}
+		if len(f.Gap) > 0 {
+			return 0, false
+		}
+		// [BEGIN SKIP]
+		if d.Skip[f.Key.Rule] {
+			continue
+		}
+		// [END SKIP]
+		return f.Key.Rule, true
+	}
+	return 0, false
+}
+
+// [END SNIFF]
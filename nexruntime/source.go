@@ -0,0 +1,898 @@
+package nexruntime
+
+import (
+	"io"
+	// [BEGIN STATS]
+	"sync"
+	// [END STATS]
+	"unicode/utf8"
+)
+
+// Source produces the frames of the root scope, and of its nested scopes, on demand.
+type Source struct {
+	// The scanners of the currently open scopes. The innermost scope is last.
+	stack   []*scanner
+	pending []*Frame
+	// The reader of the root scanner, which Reset reuses.
+	reader *runeReader
+	// [BEGIN ERRORS]
+	emitErrors bool
+	// [END ERRORS]
+	// [BEGIN STATS]
+	statsMu sync.Mutex
+	stats   Stats
+	// [END STATS]
+	// [BEGIN ARENA]
+	arena *Arena
+	// [END ARENA]
+}
+
+// NewSource returns a source that scans the input with the given root DFA.
+// The positions of the frames start at the given line and column.
+func NewSource(d *DFA, in io.Reader, line, column int) *Source {
+	return newSourceOf(d, newRuneReader(in), line, column)
+}
+
+// [BEGIN BYTES]
+
+// NewBytesSource is like NewSource, but it reads the runes of data in place, instead of copying
+// them from a reader into a buffer. data must not be modified while the source scans it.
+func NewBytesSource(d *DFA, data []byte, line, column int) *Source {
+	return newSourceOf(d, &runeReader{buf: data, w: len(data), err: io.EOF}, line, column)
+}
+
+// [END BYTES]
+
+func newSourceOf(d *DFA, in *runeReader, line, column int) *Source {
+	root := &scanner{dfa: d, in: in, line: line, column: column, gapLine: line, gapColumn: column}
+	// [BEGIN RESYNC]
+	root.resync = d.Resync
+	// [END RESYNC]
+	src := &Source{stack: []*scanner{root}, reader: in}
+	src.appendFrame(Frame{Key: FrameKey{KStartCode, 0, 0}})
+	return src
+}
+
+// Reset makes the source scan another input from the start, with the settings of the methods
+// that must be called before Next, and with the buffers of the previous input, instead of new
+// ones. The rule sets are disabled. The positions of the frames start at the given line and
+// column. The texts of the frames of the previous input may be overwritten, so they must not be
+// used after Reset.
+func (src *Source) Reset(in io.Reader, line, column int) {
+	// The root scanner stays first in the stack, even once the end of the input pops it.
+	root := src.stack[:1][0]
+	if src.reader.in == nil {
+		// The reader of NewBytesSource reads the data in place, so its buffer is not reused.
+		src.reader = newRuneReader(in)
+	} else {
+		*src.reader = runeReader{in: in, buf: src.reader.buf}
+	}
+	old := *root
+	*root = scanner{
+		dfa: old.dfa, in: src.reader, line: line, column: column, gapLine: line, gapColumn: column,
+		runes: old.runes[:0], asserts: old.asserts[:0], sizes: old.sizes[:0], failed: old.failed,
+		visited: old.visited[:0],
+	}
+	root.clearFailed()
+	// [BEGIN RULESETS]
+	root.rules = old.rules
+	if root.rules != nil {
+		root.rules.disableAll()
+	}
+	// [END RULESETS]
+	// [BEGIN GUARDS]
+	root.guard = old.guard
+	// [END GUARDS]
+	// [BEGIN PUSH]
+	root.unmatchTruncated = old.unmatchTruncated
+	// [END PUSH]
+	// [BEGIN RESYNC]
+	root.resync = old.resync
+	// [END RESYNC]
+	// [BEGIN TRACE]
+	root.trace = old.trace
+	// [END TRACE]
+	// [BEGIN LOSSLESS]
+	root.lossless = old.lossless
+	// [END LOSSLESS]
+	src.stack, src.pending = src.stack[:1], src.pending[:0]
+	// [BEGIN STATS]
+	src.statsMu.Lock()
+	src.stats = Stats{}
+	src.statsMu.Unlock()
+	// [END STATS]
+	src.appendFrame(Frame{Key: FrameKey{KStartCode, 0, 0}})
+}
+
+// [BEGIN RULESETS]
+
+// SetRuleSets makes the source skip the disabled rules. It must be called before Next.
+func (src *Source) SetRuleSets(r *RuleSets) {
+	src.stack[0].rules = r
+}
+
+// [END RULESETS]
+
+// [BEGIN GUARDS]
+
+// SetGuard makes the source skip the accepted rules for which the guard returns false,
+// as if they did not match. The guard is called with the scope of the rule (see DFA.Scope)
+// and its number within the scope. It must be called before Next.
+func (src *Source) SetGuard(guard func(scope, rule int) bool) {
+	src.stack[0].guard = guard
+}
+
+// [END GUARDS]
+
+// [BEGIN PUSH]
+
+// UnmatchTruncated makes the source leave the text that the end of the input cuts in the middle
+// of a match unmatched, like `"abc` for a rule of quoted strings, instead of matching its longest
+// prefix that a rule matches and scanning the rest again. It must be called before Next.
+func (src *Source) UnmatchTruncated() {
+	src.stack[0].unmatchTruncated = true
+}
+
+// [END PUSH]
+
+// [BEGIN ERRORS]
+
+// EmitErrors makes the source produce a KErrorCode frame for each run of unmatched runes,
+// right before the frame that follows them. Its text is the unmatched runes, and its position
+// is theirs. Otherwise, the unmatched runes are only reported as the gap of the next frame.
+// It must be called before Next.
+func (src *Source) EmitErrors() {
+	src.emitErrors = true
+}
+
+// appendErrorFrame reports the runes that the scanner skipped since its previous match, if any.
+func (src *Source) appendErrorFrame(s *scanner) {
+	if !src.emitErrors || len(s.gap) == 0 {
+		return
+	}
+	endLine, endColumn := endPosition(s.gapLine, s.gapColumn, s.gap)
+	f := Frame{
+		Key:  FrameKey{KErrorCode, s.dfa.Scope, 0},
+		Text: s.gap, Line: s.gapLine, Column: s.gapColumn, Offset: s.gapOffset,
+		EndLine: endLine, EndColumn: endColumn,
+	}
+	// The scanner is right after the gap.
+	f.ByteOffset, f.ByteEnd = s.gapByteOffset, s.byteOffset
+	src.appendFrame(f)
+}
+
+// [END ERRORS]
+
+// [BEGIN STATS]
+
+// Stats are the counts of a source so far.
+type Stats struct {
+	Matches   int // The matches of the rules of all scopes.
+	Runes     int // The runes read from the input.
+	Bytes     int // The bytes read from the input.
+	Errors    int // The runs of unmatched text, after which the scanner resynchronized.
+	MaxBuffer int // The most runes that were buffered at once.
+}
+
+// Stats returns the counts of the source so far. It may be called from any goroutine.
+func (src *Source) Stats() Stats {
+	src.statsMu.Lock()
+	defer src.statsMu.Unlock()
+	return src.stats
+}
+
+// countStep adds a step of the scanner, which matched or not, to the stats.
+func (src *Source) countStep(s *scanner, matched bool) {
+	root := src.stack[0]
+	src.statsMu.Lock()
+	defer src.statsMu.Unlock()
+	if matched {
+		src.stats.Matches++
+	}
+	if len(s.gap) > 0 {
+		src.stats.Errors++
+	}
+	src.stats.Runes, src.stats.Bytes, src.stats.MaxBuffer = root.readRunes, root.readBytes, root.maxBuffer
+}
+
+// [END STATS]
+
+// Next returns the next frame, or nil at the end of the input.
+func (src *Source) Next() *Frame {
+	for len(src.pending) == 0 && len(src.stack) > 0 {
+		src.step()
+	}
+	if len(src.pending) == 0 {
+		return nil
+	}
+	f := src.pending[0]
+	src.pending = src.pending[1:]
+	return f
+}
+
+// appendFrame appends a copy of the frame, which the arena allocates, if the source has one.
+func (src *Source) appendFrame(f Frame) {
+	var p *Frame
+	// [BEGIN ARENA]
+	if src.arena != nil {
+		p = src.arena.frame()
+	}
+	// [END ARENA]
+	if p == nil {
+		p = new(Frame)
+	}
+	*p = f
+	src.pending = append(src.pending, p)
+}
+
+// step finds the next match of the innermost scope, and opens its nested scope if it has one.
+// If the innermost scope has no more matches, it is closed, and so is the match that opened it.
+func (src *Source) step() {
+	s := src.stack[len(src.stack)-1]
+	matched := s.match()
+	// [BEGIN STATS]
+	src.countStep(s, matched)
+	// [END STATS]
+	if !matched {
+		// [BEGIN ERRORS]
+		src.appendErrorFrame(s)
+		// [END ERRORS]
+		src.stack = src.stack[:len(src.stack)-1]
+		if len(src.stack) == 0 {
+			// The end of the input is an empty match, which may follow a gap.
+			f := Frame{
+				Key: FrameKey{KEndCode, 0, 0},
+				Gap: s.gap, GapLine: s.gapLine, GapColumn: s.gapColumn, GapOffset: s.gapOffset,
+			}
+			// [BEGIN LOSSLESS]
+			s.prependKept(&f)
+			// [END LOSSLESS]
+			src.appendFrame(f)
+		} else {
+			src.endMatch(src.stack[len(src.stack)-1])
+		}
+		return
+	}
+
+	// [BEGIN ERRORS]
+	src.appendErrorFrame(s)
+	// [END ERRORS]
+	// [BEGIN SKIP]
+	if s.dfa.Skip[s.matchAccept] {
+		// [BEGIN LOSSLESS]
+		s.keepSkipped()
+		// [END LOSSLESS]
+		s.skipMatch()
+		return
+	}
+	// [END SKIP]
+	src.appendFrame(s.matchFrame(KStartCode))
+	if nest := s.getNest(s.matchAccept, s.runes[:s.matchPos]); nest != nil {
+		src.stack = append(src.stack, nest)
+	} else {
+		src.endMatch(s)
+	}
+}
+
+func (src *Source) endMatch(s *scanner) {
+	src.appendFrame(s.matchFrame(KEndCode))
+	s.skipMatch()
+	// [BEGIN LOSSLESS]
+	s.kept = nil
+	// [END LOSSLESS]
+}
+
+// skipMatch discards the text of the current match, after which the next gap starts.
+func (s *scanner) skipMatch() {
+	s.resetBuffer(s.matchPos)
+	s.gap, s.gapLine, s.gapColumn, s.gapOffset = nil, s.line, s.column, s.offset
+	s.gapByteOffset = s.byteOffset
+}
+
+// match runs the DFA until it finds the next match. It returns false at the end of the input.
+func (s *scanner) match() bool {
+	for {
+		// The DFA starts at state 0.
+		st := 0
+		s.matchPos = -1
+		s.matchAccept = -1
+		s.startScan()
+		// [BEGIN TRACE]
+		s.tracef("scan at %d:%d", s.line, s.column)
+		// [END TRACE]
+
+		madeProgress := true
+		for madeProgress && st >= 0 {
+			madeProgress = false
+			if s.hasAssertStep(st) {
+				if a := s.consumeAsserts(s.dfa.States[st].AssertMask); a != 0 {
+					// [BEGIN TRACE]
+					from := st
+					// [END TRACE]
+					st = s.assertStep(st, a)
+					// [BEGIN TRACE]
+					s.traceAsserts(from, a, st)
+					// [END TRACE]
+					s.checkAccept(st)
+					madeProgress = true
+				}
+			}
+
+			if st < 0 {
+				break
+			}
+
+			if s.hasRuneStep(st) {
+				if r, ok := s.consumeRune(); ok {
+					// [BEGIN TRACE]
+					from := st
+					// [END TRACE]
+					st = s.skipFailed(s.runeStep(st, r))
+					// [BEGIN TRACE]
+					s.traceRune(from, r, st)
+					// [END TRACE]
+					s.checkAccept(st)
+					madeProgress = true
+				}
+			}
+		}
+
+		s.markFailed()
+		// [BEGIN PUSH]
+		if s.unmatchTruncated && st >= 0 && s.in == nil && s.pos == len(s.runes) && s.pos > s.matchPos {
+			// The scan reached the end of the input past its match, if any, in the middle of
+			// a longer one, so all of its text is unmatched.
+			s.gap = append(s.gap, s.runes...)
+			s.resetBuffer(len(s.runes))
+			return false
+		}
+		// [END PUSH]
+		if s.matchPos >= s.minCapture {
+			// [BEGIN TRACE]
+			if s.trace != nil {
+				s.tracef("match rule %s, %q", s.traceRule(s.matchAccept), string(s.runes[:s.matchPos]))
+			}
+			// [END TRACE]
+			return true
+		}
+		// DFA is stuck without a match. Advance by one rune and restart.
+		if len(s.runes) == 0 {
+			// This can only happen at the end of input.
+			// [BEGIN TRACE]
+			s.tracef("end of the input")
+			// [END TRACE]
+			return false
+		}
+		// [BEGIN TRACE]
+		s.tracef("no match, %q is unmatched", s.runes[0])
+		// [END TRACE]
+		s.gap = append(s.gap, s.runes[0])
+		s.resetBuffer(1)
+		// [BEGIN RESYNC]
+		// The scan may only match again at a rune of the resync class, so the runes up to it are
+		// skipped without scanning from each of them.
+		for len(s.runes) > 0 && !s.isResync(s.runes[0]) {
+			s.gap = append(s.gap, s.runes[0])
+			s.resetBuffer(1)
+		}
+		// [END RESYNC]
+	}
+}
+
+type scanner struct {
+	dfa *DFA
+
+	// in should be nil when EOF is reached
+	in *runeReader
+
+	runes          []rune
+	asserts        []Asserts
+	pos            int
+	consumedAssert bool
+	minCapture     int
+
+	matchPos, matchAccept int
+	line, column          int
+	offset                int64
+	// The sizes in bytes of the buffered runes, and the offset in bytes of the first of them.
+	sizes      []uint8
+	byteOffset int64
+
+	// The runes that were skipped since the previous match, and where the previous match ended.
+	gap                []rune
+	gapLine, gapColumn int
+	gapOffset          int64
+	gapByteOffset      int64
+
+	// The counts of the runes and bytes read from in, and the most runes buffered at once.
+	readRunes, readBytes, maxBuffer int
+
+	// The configurations from which an earlier scan found no match, which later scans skip, and
+	// the configurations of the current scan since its match, see skipFailed.
+	failed    map[configuration]bool
+	failedMax int64
+	visited   []configuration
+	memoize   bool
+	// [BEGIN RULESETS]
+	failedMasks *map[int][]bool
+	rules       *RuleSets
+	// [END RULESETS]
+	// [BEGIN GUARDS]
+	guard func(scope, rule int) bool
+	// [END GUARDS]
+	// [BEGIN PUSH]
+	unmatchTruncated bool
+	// [END PUSH]
+	// [BEGIN RESYNC]
+	// The ranges of the resync class of the root DFA, see DFA.Resync.
+	resync []rune
+	// [END RESYNC]
+	// [BEGIN TRACE]
+	trace *tracer
+	// [END TRACE]
+	// [BEGIN LOSSLESS]
+	// With Lossless, the text of the skipped matches since the previous match, with the gaps
+	// before them, which precedes the gap in the next frame, and where it starts.
+	lossless             bool
+	kept                 []rune
+	keptLine, keptColumn int
+	keptOffset           int64
+	// [END LOSSLESS]
+}
+
+// matchFrame returns a frame for the current match.
+func (s *scanner) matchFrame(kind FrameKind) Frame {
+	text := s.runes[:s.matchPos]
+	endLine, endColumn := endPosition(s.line, s.column, text)
+	f := Frame{
+		Key:       FrameKey{kind, s.dfa.Scope, s.matchAccept},
+		Text:      text,
+		Line:      s.line,
+		Column:    s.column,
+		Offset:    s.offset,
+		EndLine:   endLine,
+		EndColumn: endColumn,
+		Gap:       s.gap,
+		GapLine:   s.gapLine,
+		GapColumn: s.gapColumn,
+		GapOffset: s.gapOffset,
+	}
+	f.ByteOffset, f.ByteEnd = s.byteOffset, s.byteOffset
+	for _, n := range s.sizes[:s.matchPos] {
+		f.ByteEnd += int64(n)
+	}
+	// [BEGIN LOSSLESS]
+	s.prependKept(&f)
+	// [END LOSSLESS]
+	return f
+}
+
+// The transitions of the states are either their step functions, or the tables of the DFA.
+
+func (s *scanner) hasAssertStep(st int) bool {
+	// [BEGIN TABLES]
+	if t := s.dfa.Tables; t != nil {
+		return t.hasAssertStep(st)
+	}
+	// [END TABLES]
+	return s.dfa.States[st].AssertStep != nil
+}
+
+func (s *scanner) assertStep(st int, a Asserts) int {
+	// [BEGIN TABLES]
+	if t := s.dfa.Tables; t != nil {
+		return t.assertStep(st, a)
+	}
+	// [END TABLES]
+	return s.dfa.States[st].AssertStep(a)
+}
+
+func (s *scanner) hasRuneStep(st int) bool {
+	// [BEGIN TABLES]
+	if t := s.dfa.Tables; t != nil {
+		return t.hasRuneStep(st)
+	}
+	// [END TABLES]
+	return s.dfa.States[st].RuneStep != nil
+}
+
+func (s *scanner) runeStep(st int, r rune) int {
+	// [BEGIN TABLES]
+	if t := s.dfa.Tables; t != nil {
+		return t.runeStep(st, r)
+	}
+	// [END TABLES]
+	return s.dfa.States[st].RuneStep(r)
+}
+
+func (s *scanner) loadNext() {
+	s.loadNextRune()
+	s.loadNextAsserts()
+}
+
+func (s *scanner) loadNextRune() {
+	if s.pos < len(s.runes) || s.in == nil {
+		return
+	}
+
+	r, size, err := s.in.ReadRune()
+	switch err {
+	case nil:
+		s.runes = append(s.runes, r)
+		s.sizes = append(s.sizes, uint8(size))
+		s.readRunes, s.readBytes = s.readRunes+1, s.readBytes+size
+		raise(&s.maxBuffer, len(s.runes))
+	case io.EOF:
+		s.in = nil
+	default:
+		panic(err)
+	}
+}
+
+// runeReader reads the runes of an input through a buffer, like bufio.Reader, which the runtime
+// does without, so the lexers run on TinyGo and small devices too. A reader of bytes in place
+// has them all in its buffer, and the error of their end.
+type runeReader struct {
+	in   io.Reader
+	buf  []byte
+	r, w int
+	err  error
+}
+
+func newRuneReader(in io.Reader) *runeReader {
+	return &runeReader{in: in, buf: make([]byte, 4096)}
+}
+
+func (rr *runeReader) ReadRune() (rune, int, error) {
+	if rr.r < rr.w && rr.buf[rr.r] < utf8.RuneSelf {
+		rr.r++
+		return rune(rr.buf[rr.r-1]), 1, nil
+	}
+	for empty := 0; rr.err == nil && !utf8.FullRune(rr.buf[rr.r:rr.w]); {
+		rr.w = copy(rr.buf, rr.buf[rr.r:rr.w])
+		rr.r = 0
+		var n int
+		n, rr.err = rr.in.Read(rr.buf[rr.w:])
+		rr.w += n
+		// Like bufio, give up on a reader that keeps returning nothing.
+		if empty++; n > 0 {
+			empty = 0
+		} else if empty == 100 && rr.err == nil {
+			rr.err = io.ErrNoProgress
+		}
+	}
+	if rr.r == rr.w {
+		return 0, 0, rr.err
+	}
+	r, size := utf8.DecodeRune(rr.buf[rr.r:rr.w])
+	rr.r += size
+	return r, size, nil
+}
+
+func isWord(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// loadNextAsserts must be called after loadNextRune()
+func (s *scanner) loadNextAsserts() {
+	if s.pos < len(s.asserts) {
+		return
+	}
+
+	var a Asserts
+	var r1, r2 rune
+	if s.pos == 0 {
+		a |= AStartText | AStartLine
+	} else {
+		r1 = s.runes[s.pos-1]
+	}
+
+	if s.pos == len(s.runes) {
+		a |= AEndText | AEndLine
+	} else {
+		r2 = s.runes[s.pos]
+	}
+
+	if r1 == '\n' {
+		a |= AStartLine
+	}
+	if r2 == '\n' {
+		a |= AEndLine
+	}
+
+	if isWord(r1) != isWord(r2) {
+		a |= AWordBoundary
+	} else {
+		a |= ANoWordBoundary
+	}
+
+	s.asserts = append(s.asserts, a)
+}
+
+func (s *scanner) consumeRune() (rune, bool) {
+	s.loadNext()
+	if s.pos == len(s.runes) {
+		return 0, false
+	}
+
+	i := s.pos
+	s.pos++
+	s.consumedAssert = false
+	return s.runes[i], true
+}
+
+func (s *scanner) consumeAsserts(mask Asserts) Asserts {
+	s.loadNext()
+	if s.consumedAssert || s.pos == len(s.asserts) {
+		return 0
+	}
+
+	s.consumedAssert = true
+	return s.asserts[s.pos] & mask
+}
+
+func (s *scanner) checkAccept(st int) {
+	if st < 0 {
+		return
+	}
+	accIndex := s.dfa.States[st].Accept
+	// [BEGIN ACCEPTS]
+	// Some of the accepted rules may be disabled or guarded.
+	accIndex = s.accept(&s.dfa.States[st])
+	// [END ACCEPTS]
+	// Higher precedence match
+	if accIndex > 0 && (s.matchPos < s.pos || accIndex < s.matchAccept) {
+		s.matchAccept, s.matchPos = accIndex, s.pos
+		s.visited = s.visited[:0]
+		// [BEGIN TRACE]
+		if s.trace != nil {
+			s.tracef("state %d accepts rule %s, %q", st, s.traceRule(accIndex), string(s.runes[:s.pos]))
+		}
+		// [END TRACE]
+	}
+}
+
+// A configuration is a state of the DFA at an offset of the input, right after a rune step.
+// The rest of the scan from it only depends on the input that follows, and on the accepted rules.
+type configuration struct {
+	st     int
+	offset int64
+}
+
+// startScan prepares the memo of the failed configurations for a scan from the current offset.
+// The memo makes the scanner linear in the input: a scan may read far beyond its match, or find
+// none, and the next scans would read the same runes again, but each configuration fails at most
+// once, after which the scans stop at it. Guards may accept differently at each scan, so there is
+// no memo with guards, and there is a new one whenever the rule sets change.
+func (s *scanner) startScan() {
+	s.visited = s.visited[:0]
+	s.memoize = true
+	// [BEGIN GUARDS]
+	s.memoize = s.guard == nil
+	// [END GUARDS]
+	// [BEGIN RULESETS]
+	if s.rules != nil {
+		if masks := s.rules.masks.Load(); masks != s.failedMasks {
+			s.clearFailed()
+			s.failedMasks = masks
+		}
+	}
+	// [END RULESETS]
+	// The scans only move forward, so the memo is of no use once they start after all of it.
+	if s.offset >= s.failedMax {
+		s.clearFailed()
+	}
+}
+
+// raise sets *m to v if v is larger. The runtime may be inlined into the package of the lexer,
+// whose code may shadow the builtins max and clear, so the runtime uses raise instead of max, and
+// clearFailed deletes the entries of the memo instead of clear.
+func raise[T int | int64](m *T, v T) {
+	if v > *m {
+		*m = v
+	}
+}
+
+func (s *scanner) clearFailed() {
+	for c := range s.failed {
+		delete(s.failed, c)
+	}
+}
+
+// skipFailed returns -1 instead of the state that a rune step reached if an earlier scan found
+// no match from there, and otherwise records that the scan visited it.
+func (s *scanner) skipFailed(st int) int {
+	if st < 0 || !s.memoize {
+		return st
+	}
+	c := configuration{st, s.offset + int64(s.pos)}
+	if len(s.failed) > 0 && s.failed[c] {
+		return -1
+	}
+	s.visited = append(s.visited, c)
+	return st
+}
+
+// markFailed records the configurations that the scan visited after its match, or all of them if
+// it found none, as no rule matches from them.
+func (s *scanner) markFailed() {
+	if len(s.visited) == 0 {
+		return
+	}
+	if s.failed == nil {
+		s.failed = map[configuration]bool{}
+	}
+	for _, c := range s.visited {
+		s.failed[c] = true
+	}
+	raise(&s.failedMax, s.visited[len(s.visited)-1].offset)
+}
+
+func (s *scanner) resetBuffer(i int) {
+	// We make sure to consume enough runes to discard them.
+	// We load one additional rune before shifting the buffers
+	// because we need both the previous and next runes to correctly
+	// calculate the next assert.
+	for ok := true; ok && s.pos <= i; _, ok = s.consumeRune() {
+	}
+
+	for _, r := range s.runes[:i] {
+		s.line, s.column = advancePosition(s.line, s.column, r)
+	}
+	s.offset += int64(i)
+	for _, n := range s.sizes[:i] {
+		s.byteOffset += int64(n)
+	}
+	s.sizes = s.sizes[i:]
+
+	s.runes = s.runes[i:]
+	s.asserts = s.asserts[i:]
+	s.pos = 0
+	// [BEGIN TRACE]
+	s.tracef("reset the buffer by %d runes, to %d:%d", i, s.line, s.column)
+	// [END TRACE]
+	s.consumedAssert = false
+	if i == 0 {
+		s.minCapture = 1
+	} else {
+		s.minCapture = 0
+	}
+}
+
+func (s *scanner) attemptMapFunc(st int, f map[int]int) int {
+	if f == nil {
+		return st
+	}
+
+	if nextSt, ok := f[st]; ok {
+		s.checkAccept(nextSt)
+		return nextSt
+	}
+
+	return st
+}
+
+func (s *scanner) getNest(st int, text []rune) *scanner {
+	if s.dfa.Nest == nil {
+		return nil
+	}
+	nestedDfa, ok := s.dfa.Nest[st]
+	if !ok {
+		return nil
+	}
+	return &scanner{
+		dfa:           &nestedDfa,
+		runes:         text,
+		line:          s.line,
+		column:        s.column,
+		offset:        s.offset,
+		gapLine:       s.line,
+		gapColumn:     s.column,
+		gapOffset:     s.offset,
+		sizes:         s.sizes[:len(text)],
+		byteOffset:    s.byteOffset,
+		gapByteOffset: s.byteOffset,
+		// [BEGIN RULESETS]
+		rules: s.rules,
+		// [END RULESETS]
+		// [BEGIN GUARDS]
+		guard: s.guard,
+		// [END GUARDS]
+		// [BEGIN RESYNC]
+		resync: s.resync,
+		// [END RESYNC]
+		// [BEGIN TRACE]
+		trace: s.trace,
+		// [END TRACE]
+		// [BEGIN LOSSLESS]
+		lossless: s.lossless,
+		// [END LOSSLESS]
+	}
+}
+
+// [BEGIN RESYNC]
+
+// isResync returns true if the rune is in the resync class, or if there is none.
+func (s *scanner) isResync(r rune) bool {
+	if len(s.resync) == 0 {
+		return true
+	}
+	for i := 0; i+1 < len(s.resync); i += 2 {
+		if s.resync[i] <= r && r <= s.resync[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// [END RESYNC]
+
+// [BEGIN ACCEPTS]
+
+// accept returns the rule of the highest precedence that the state accepts, which is enabled
+// and whose guard holds, or 0 if there is none.
+func (s *scanner) accept(st *State) int {
+	if len(st.Accepts) == 0 {
+		// The lexer has neither rule sets nor guards, so it does not list the accepted rules.
+		return st.Accept
+	}
+	for _, a := range st.Accepts {
+		// [BEGIN RULESETS]
+		if s.rules != nil && !s.rules.allows(s.dfa, a) {
+			continue
+		}
+		// [END RULESETS]
+		// [BEGIN GUARDS]
+		if s.guard != nil && !s.guard(s.dfa.Scope, a) {
+			continue
+		}
+		// [END GUARDS]
+		return a
+	}
+	return 0
+}
+
+// [END ACCEPTS]
+
+// [BEGIN SECTION]
+
+// CountPosition returns the line and column at the end of the given input.
+func CountPosition(in io.Reader) (line, column int, err error) {
+	r := newRuneReader(in)
+	for {
+		c, _, err := r.ReadRune()
+		switch {
+		case err == io.EOF:
+			return line, column, nil
+		case err != nil:
+			return 0, 0, err
+		default:
+			line, column = advancePosition(line, column, c)
+		}
+	}
+}
+
+// [END SECTION]
+
+// endPosition returns the position that follows the given text, which starts at the given position.
+func endPosition(line, column int, text []rune) (int, int) {
+	for _, r := range text {
+		line, column = advancePosition(line, column, r)
+	}
+	return line, column
+}
+
+// advancePosition returns the position that follows the given rune. It saturates at maxPosition.
+func advancePosition(line, column int, r rune) (int, int) {
+	switch {
+	case r != '\n':
+		if column < maxPosition {
+			column++
+		}
+		return line, column
+	case line < maxPosition:
+		return line + 1, 0
+	default:
+		return line, 0
+	}
+}
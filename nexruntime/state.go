@@ -0,0 +1,190 @@
+package nexruntime
+
+// [BEGIN CHECKPOINT]
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// gobState is how SaveState encodes the state of a source.
+type gobState struct {
+	// The scanners of the open scopes, from the root, and the frames that Next did not return yet.
+	Stack   []gobScanner
+	Pending []Frame
+	// The bytes that the reader read from the input and the root scanner did not, whether the
+	// reader reached the end of the input, and whether the root scanner did.
+	Unread    []byte
+	ReadEnded bool
+	Ended     bool
+	// [BEGIN RULESETS]
+	RuleSets []string // The enabled rule sets, sorted.
+	// [END RULESETS]
+	// [BEGIN STATS]
+	Stats Stats
+	// [END STATS]
+}
+
+// gobScanner is the state of a scanner between the steps of its source.
+type gobScanner struct {
+	States int // The states of the DFA of the scanner, which RestoreState checks.
+
+	Runes                 []rune
+	Asserts               []Asserts
+	Sizes                 []uint8
+	Pos                   int
+	ConsumedAssert        bool
+	MinCapture            int
+	MatchPos, MatchAccept int
+
+	Line, Column             int
+	Offset, ByteOffset       int64
+	Gap                      []rune
+	GapLine, GapColumn       int
+	GapOffset, GapByteOffset int64
+
+	ReadRunes, ReadBytes, MaxBuffer int
+	// [BEGIN LOSSLESS]
+	Kept                 []rune
+	KeptLine, KeptColumn int
+	KeptOffset           int64
+	// [END LOSSLESS]
+}
+
+// SaveState returns a checkpoint of the state of the source, from which RestoreState resumes the
+// scan, e.g., after the process restarts, and the offset in bytes of the input at which the source
+// reads on. The checkpoint holds the runes that the source buffered, its positions, the scopes that
+// are open, the enabled rule sets, and the frames that Next did not return yet. It must not be
+// called while Next runs.
+func (src *Source) SaveState() (checkpoint []byte, offset int64, err error) {
+	root := src.stack[:1][0]
+	rr := src.reader
+	g := gobState{Unread: rr.buf[rr.r:rr.w], ReadEnded: rr.err != nil, Ended: root.in == nil}
+	for _, s := range src.stack {
+		g.Stack = append(g.Stack, s.saveState())
+	}
+	for _, f := range src.pending {
+		g.Pending = append(g.Pending, *f)
+	}
+	// [BEGIN RULESETS]
+	if root.rules != nil {
+		for name, enabled := range root.rules.enabled {
+			if enabled {
+				g.RuleSets = append(g.RuleSets, name)
+			}
+		}
+		slices.Sort(g.RuleSets)
+	}
+	// [END RULESETS]
+	// [BEGIN STATS]
+	g.Stats = src.Stats()
+	// [END STATS]
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&g); err != nil {
+		return nil, 0, fmt.Errorf("state: %w", err)
+	}
+	return buf.Bytes(), int64(root.readBytes + len(g.Unread)), nil
+}
+
+// RestoreState makes the source resume the scan from a checkpoint of SaveState, with the settings
+// of the methods that must be called before Next, like Reset. The input must start at the offset
+// that SaveState returned, e.g., a file that is opened again and seeked to it. It returns an
+// error, and leaves the source as it is, unless the checkpoint is of a source of the same DFA.
+func (src *Source) RestoreState(checkpoint []byte, in io.Reader) error {
+	var g gobState
+	if err := gob.NewDecoder(bytes.NewReader(checkpoint)).Decode(&g); err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	root := src.stack[:1][0]
+	d := root.dfa
+	for i, s := range g.Stack {
+		if i > 0 {
+			nested, ok := d.Nest[g.Stack[i-1].MatchAccept]
+			if !ok {
+				return fmt.Errorf("state: rule %d of scope %d has no nested scope", g.Stack[i-1].MatchAccept, d.Scope)
+			}
+			d = &nested
+		}
+		if s.States != len(d.States) {
+			return fmt.Errorf("state: scope %d has %d states, not %d", d.Scope, len(d.States), s.States)
+		}
+	}
+	// [BEGIN RULESETS]
+	for _, name := range g.RuleSets {
+		if root.rules == nil || !hasSet(root.rules.dfa, name) {
+			return fmt.Errorf("state: unknown rule set %q", name)
+		}
+	}
+	// [END RULESETS]
+
+	src.Reset(in, 0, 0)
+	rr := src.reader
+	if len(g.Unread) > len(rr.buf) {
+		rr.buf = make([]byte, len(g.Unread))
+	}
+	rr.w = copy(rr.buf, g.Unread)
+	if g.ReadEnded {
+		rr.err = io.EOF
+	}
+	src.stack, src.pending = src.stack[:0], src.pending[:0]
+	for i, saved := range g.Stack {
+		s := root
+		if i > 0 {
+			parent := src.stack[i-1]
+			s = parent.getNest(parent.matchAccept, nil)
+		}
+		s.restoreState(saved)
+		src.stack = append(src.stack, s)
+	}
+	if g.Ended {
+		root.in = nil
+	}
+	for _, f := range g.Pending {
+		src.appendFrame(f)
+	}
+	// [BEGIN RULESETS]
+	for _, name := range g.RuleSets {
+		_ = root.rules.Set(name, true)
+	}
+	// [END RULESETS]
+	// [BEGIN STATS]
+	src.statsMu.Lock()
+	src.stats = g.Stats
+	src.statsMu.Unlock()
+	// [END STATS]
+	return nil
+}
+
+func (s *scanner) saveState() gobScanner {
+	g := gobScanner{States: len(s.dfa.States)}
+	g.Runes, g.Asserts, g.Sizes = s.runes, s.asserts, s.sizes
+	g.Pos, g.ConsumedAssert, g.MinCapture = s.pos, s.consumedAssert, s.minCapture
+	g.MatchPos, g.MatchAccept = s.matchPos, s.matchAccept
+	g.Line, g.Column, g.Offset, g.ByteOffset = s.line, s.column, s.offset, s.byteOffset
+	g.Gap, g.GapLine, g.GapColumn, g.GapOffset = s.gap, s.gapLine, s.gapColumn, s.gapOffset
+	g.GapByteOffset = s.gapByteOffset
+	g.ReadRunes, g.ReadBytes, g.MaxBuffer = s.readRunes, s.readBytes, s.maxBuffer
+	// [BEGIN LOSSLESS]
+	g.Kept, g.KeptLine, g.KeptColumn, g.KeptOffset = s.kept, s.keptLine, s.keptColumn, s.keptOffset
+	// [END LOSSLESS]
+	return g
+}
+
+// restoreState sets the state of the scanner, whose memo of the failed configurations is empty.
+func (s *scanner) restoreState(g gobScanner) {
+	s.runes, s.asserts, s.sizes = g.Runes, g.Asserts, g.Sizes
+	s.pos, s.consumedAssert, s.minCapture = g.Pos, g.ConsumedAssert, g.MinCapture
+	s.matchPos, s.matchAccept = g.MatchPos, g.MatchAccept
+	s.line, s.column, s.offset, s.byteOffset = g.Line, g.Column, g.Offset, g.ByteOffset
+	s.gap, s.gapLine, s.gapColumn, s.gapOffset = g.Gap, g.GapLine, g.GapColumn, g.GapOffset
+	s.gapByteOffset = g.GapByteOffset
+	s.readRunes, s.readBytes, s.maxBuffer = g.ReadRunes, g.ReadBytes, g.MaxBuffer
+	// [BEGIN LOSSLESS]
+	s.kept, s.keptLine, s.keptColumn, s.keptOffset = g.Kept, g.KeptLine, g.KeptColumn, g.KeptOffset
+	// [END LOSSLESS]
+}
+
+// [END CHECKPOINT]
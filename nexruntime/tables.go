@@ -0,0 +1,68 @@
+package nexruntime
+
+// [BEGIN TABLES]
+
+// Tables are the transitions of all the states of a DFA, as flat slices that the scanner walks
+// instead of calling the step functions of the states. They compile much faster than a function
+// for each state. The rune transitions of state i are the entries from RuneIndex[i] to
+// RuneIndex[i+1], and likewise for the assert transitions.
+type Tables struct {
+	// The rune transitions of a state are ranges that cover all the runes, from 0, sorted by their
+	// first runes. Each range leads to its state, which is -1 where no transition matches.
+	// A state without rune transitions has no ranges, so the scanner does not consume a rune there.
+	RuneIndex []int32
+	RuneStart []rune
+	RuneNext  []int32
+
+	// The assert transitions of a state, by the asserts of the state's mask that hold.
+	// AssertIndex is empty if no state has assert transitions.
+	AssertIndex []int32
+	Asserts     []Asserts
+	AssertNext  []int32
+
+	// [BEGIN BYTES]
+	// The rune transitions of the ASCII runes, 128 for each state, which the scanner looks up
+	// instead of searching the ranges, which it still searches for the other runes.
+	ASCII []int32
+	// [END BYTES]
+}
+
+func (t *Tables) hasRuneStep(st int) bool {
+	return t.RuneIndex[st] < t.RuneIndex[st+1]
+}
+
+// runeStep returns the state that the rune leads to from the given state.
+func (t *Tables) runeStep(st int, r rune) int {
+	// [BEGIN BYTES]
+	if r < 0x80 && t.ASCII != nil {
+		return int(t.ASCII[st<<7|int(r)])
+	}
+	// [END BYTES]
+	// Binary search for the last range that starts at or before the rune.
+	lo, hi := int(t.RuneIndex[st]), int(t.RuneIndex[st+1])
+	for hi-lo > 1 {
+		mid := int(uint(lo+hi) >> 1)
+		if t.RuneStart[mid] <= r {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return int(t.RuneNext[lo])
+}
+
+func (t *Tables) hasAssertStep(st int) bool {
+	return len(t.AssertIndex) > 0 && t.AssertIndex[st] < t.AssertIndex[st+1]
+}
+
+// assertStep returns the state that the asserts lead to from the given state, or -1.
+func (t *Tables) assertStep(st int, a Asserts) int {
+	for i := t.AssertIndex[st]; i < t.AssertIndex[st+1]; i++ {
+		if t.Asserts[i] == a {
+			return int(t.AssertNext[i])
+		}
+	}
+	return -1
+}
+
+// [END TABLES]
@@ -0,0 +1,65 @@
+package nexruntime
+
+// [BEGIN TRACE]
+
+import (
+	"fmt"
+	"io"
+)
+
+// tracer writes the steps of the scanners of a source, see SetTrace.
+type tracer struct {
+	out      io.Writer
+	ruleName func(scope, rule int) string
+}
+
+// SetTrace makes the source write a line to out for each step of its scanners: each scan and
+// where it starts, each transition of the DFA, each rule that matches so far, the match that
+// wins or the rune that no rule matches, and each reset of the buffer. ruleName, if not nil,
+// returns the names of the rules, which follow their numbers in the lines. It must be called
+// before Next. The trace shows why a rule did or did not match, without reading the states.
+func (src *Source) SetTrace(out io.Writer, ruleName func(scope, rule int) string) {
+	src.stack[:1][0].trace = &tracer{out, ruleName}
+}
+
+// tracef writes a line of the trace, if any, which starts with the scope of the scanner.
+func (s *scanner) tracef(format string, args ...any) {
+	if s.trace == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(s.trace.out, "scope %d: %s\n", s.dfa.Scope, fmt.Sprintf(format, args...))
+}
+
+// traceRule returns the number of the rule, and its name if it has one.
+func (s *scanner) traceRule(rule int) string {
+	if s.trace.ruleName != nil {
+		if name := s.trace.ruleName(s.dfa.Scope, rule); name != "" {
+			return fmt.Sprintf("%d (%s)", rule, name)
+		}
+	}
+	return fmt.Sprint(rule)
+}
+
+// traceRune writes a transition of the DFA on a rune, from a state to another.
+func (s *scanner) traceRune(from int, r rune, to int) {
+	if s.trace != nil {
+		s.traceStep(from, fmt.Sprintf("%q", r), to)
+	}
+}
+
+// traceAsserts writes a transition of the DFA on assertions, like the start of a line.
+func (s *scanner) traceAsserts(from int, a Asserts, to int) {
+	if s.trace != nil {
+		s.traceStep(from, fmt.Sprintf("assertions %#b", a), to)
+	}
+}
+
+func (s *scanner) traceStep(from int, on string, to int) {
+	if to < 0 {
+		s.tracef("state %d, %s: stuck", from, on)
+	} else {
+		s.tracef("state %d, %s: state %d", from, on, to)
+	}
+}
+
+// [END TRACE]
@@ -0,0 +1,16 @@
+package nexruntime
+
+// The versions of the API between the generated code and this package that this package supports.
+// MaxVersion is incremented whenever the generated code starts to depend on a new API,
+// and MinVersion is incremented whenever this package drops an API that the generated code used.
+const (
+	MinVersion = 2
+	MaxVersion = 25
+)
+
+// EnforceVersion makes generated code of version V fail to compile with an incompatible runtime,
+// as converting a negative constant to an unsigned type fails:
+//
+//	_ = nexruntime.EnforceVersion(V - nexruntime.MinVersion) // The runtime is too new.
+//	_ = nexruntime.EnforceVersion(nexruntime.MaxVersion - V) // The runtime is too old.
+type EnforceVersion uint
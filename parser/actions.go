@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	goparser "go/parser"
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// actionPrefix wraps the code of an action, so it parses as the body of a function.
+const actionPrefix = "package p\nfunc _() {\n"
+
+// checkActions parses the code of each rule, and reports the first syntax error at its position in
+// the spec. Otherwise, it would only be reported when compiling the generated code.
+func (x *NexProgram) checkActions() error {
+	var err error
+	x.walk(func(r *NexProgram) {
+		if err == nil {
+			err = checkAction(r.StartCode, r.StartCodePos)
+		}
+		if err == nil {
+			err = checkAction(r.EndCode, r.EndCodePos)
+		}
+		if err == nil {
+			err = checkGuard(r.Guard, r.GuardPos)
+		}
+	})
+	return err
+}
+
+// checkGuard parses the expression of a guard, which is on a single line.
+func checkGuard(guard string, pos Position) error {
+	if guard == "" {
+		return nil
+	}
+	_, err := goparser.ParseExprFrom(token.NewFileSet(), "", guard, goparser.SkipObjectResolution)
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) == 0 {
+		return err
+	}
+	first := list[0]
+	return fmt.Errorf("%d:%d: %w: %s", pos.Line, pos.Column+first.Pos.Column-1, ErrBadGuard, first.Msg)
+}
+
+func checkAction(code string, pos Position) error {
+	if code == "" || pos.Line == 0 {
+		return nil
+	}
+	_, err := goparser.ParseFile(token.NewFileSet(), "", actionPrefix+code+"}\n", goparser.SkipObjectResolution)
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) == 0 {
+		return err
+	}
+	first := list[0]
+	line, col := first.Pos.Line-2, first.Pos.Column
+	switch {
+	case line > strings.Count(code, "\n"):
+		// The error is in the closing brace of the wrapper, e.g., the code is incomplete.
+		end := pos.advance([]rune(strings.TrimSuffix(code, "\n")))
+		line, col = end.Line-pos.Line+1, end.Column
+	case line == 1:
+		col += pos.Column - 1
+	}
+	return fmt.Errorf("%d:%d: %w: %s", pos.Line+line-1, col, ErrBadAction, first.Msg)
+}
@@ -0,0 +1,392 @@
+package parser
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/liran-funaro/nex/graph"
+)
+
+// The kinds of a RuleChange.
+const (
+	RuleAdded   = "added"
+	RuleRemoved = "removed"
+	RuleChanged = "changed"
+	RuleMoved   = "moved" // The rule is the same, but its precedence over the others is not.
+)
+
+// Changelog is the machine-readable report of how the rules of a spec changed between two
+// versions of it, see Compare, for the release notes of the languages that are built on nex.
+type Changelog struct {
+	// Retokenizes tells whether any input is split into different matches by the new version.
+	Retokenizes bool         `json:"retokenizes"`
+	Changes     []RuleChange `json:"changes"`
+}
+
+// RuleChange is a rule that the new version of a spec adds, removes or changes.
+type RuleChange struct {
+	Kind string   `json:"kind"`
+	Old  *RuleRef `json:"old,omitempty"`
+	New  *RuleRef `json:"new,omitempty"`
+	// Fields are what changed in a changed rule: regex, guard, ruleSets, action, token, subLexer
+	// or scope, if it opens a nested scope in one version only.
+	Fields []string `json:"fields,omitempty"`
+	// Retokenizes tells whether the change alters the longest match of some input, or its rule.
+	// Example is then the shortest such input.
+	Retokenizes bool   `json:"retokenizes"`
+	Example     string `json:"example,omitempty"`
+}
+
+// Compare returns the changelog of the rules from the old version of a program to the new one.
+// The rules of the versions are paired by their `%name`, or else by their regex, or else by their
+// action, which a rewritten regex likely keeps. Whether a change can alter the tokens of an input
+// is decided by walking the DFAs of both versions together, so a change that no input tells apart,
+// like a rewritten regex that matches the same text, does not retokenize. Assertions are followed
+// like runes of their own, so DFAs that assert differently are told apart even if they match the
+// same text.
+func Compare(old, new *NexProgram) *Changelog {
+	c := &comparison{oldScopes: old.Scopes(), newScopes: new.Scopes()}
+	c.compareScope(old, new)
+	log := &Changelog{Changes: []RuleChange{}}
+	for _, change := range c.changes {
+		log.Retokenizes = log.Retokenizes || change.Retokenizes
+		log.Changes = append(log.Changes, *change)
+	}
+	return log
+}
+
+// Write writes the changelog as JSON.
+func (c *Changelog) Write(writer io.Writer) error {
+	e := json.NewEncoder(writer)
+	e.SetIndent("", "  ")
+	return e.Encode(c)
+}
+
+type comparison struct {
+	oldScopes, newScopes []*NexProgram
+	changes              []*RuleChange
+}
+
+// scopeComparison pairs the rules of a scope in the old and the new versions.
+type scopeComparison struct {
+	*comparison
+	old, new *NexProgram
+	pairs    map[int]int // The IDs of the new rules, by the IDs of the old ones.
+	// The changes that can alter the matches, by the IDs of their old and new rules.
+	oldChanges, newChanges map[int]*RuleChange
+}
+
+func (c *comparison) compareScope(old, new *NexProgram) {
+	s := &scopeComparison{
+		comparison: c, old: old, new: new, pairs: map[int]int{},
+		oldChanges: map[int]*RuleChange{}, newChanges: map[int]*RuleChange{},
+	}
+	paired := map[int]bool{}
+	pair := func(same func(o, n *NexProgram) bool) {
+		for _, o := range old.Children {
+			if _, ok := s.pairs[o.Id]; ok {
+				continue
+			}
+			i := slices.IndexFunc(new.Children, func(n *NexProgram) bool { return !paired[n.Id] && same(o, n) })
+			if i >= 0 {
+				s.pairs[o.Id] = new.Children[i].Id
+				paired[new.Children[i].Id] = true
+			}
+		}
+	}
+	pair(func(o, n *NexProgram) bool { return o.RuleName() != "" && o.RuleName() == n.RuleName() })
+	pair(func(o, n *NexProgram) bool { return o.Regex == n.Regex && o.Flags == n.Flags })
+	pair(func(o, n *NexProgram) bool {
+		return strings.TrimSpace(o.StartCode) != "" && strings.TrimSpace(o.StartCode) == strings.TrimSpace(n.StartCode)
+	})
+
+	var nested [][2]*NexProgram
+	for _, o := range old.Children {
+		id, ok := s.pairs[o.Id]
+		if !ok {
+			s.oldChanges[o.Id] = c.add(RuleChange{Kind: RuleRemoved, Old: c.oldRef(old, o)})
+			continue
+		}
+		n := new.child(id)
+		fields := ruleFields(o, n)
+		if len(o.Children) > 0 && len(n.Children) > 0 {
+			nested = append(nested, [2]*NexProgram{o, n})
+		} else if len(o.Children) > 0 || len(n.Children) > 0 {
+			fields = append(fields, "scope")
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		change := c.add(RuleChange{Kind: RuleChanged, Old: c.oldRef(old, o), New: c.newRef(new, n), Fields: fields})
+		if slices.ContainsFunc(fields, func(f string) bool { return f == "regex" || f == "guard" || f == "ruleSets" }) {
+			s.oldChanges[o.Id], s.newChanges[n.Id] = change, change
+		}
+	}
+	for _, n := range new.Children {
+		if !paired[n.Id] {
+			s.newChanges[n.Id] = c.add(RuleChange{Kind: RuleAdded, New: c.newRef(new, n)})
+		}
+	}
+
+	if len(old.DFA) > 0 && len(new.DFA) > 0 {
+		s.walkDFAs()
+	}
+	for _, p := range nested {
+		c.compareScope(p[0], p[1])
+	}
+}
+
+func (c *comparison) add(change RuleChange) *RuleChange {
+	c.changes = append(c.changes, &change)
+	return &change
+}
+
+func (c *comparison) oldRef(scope, x *NexProgram) *RuleRef {
+	ref := x.ruleRef(slices.Index(c.oldScopes, scope))
+	return &ref
+}
+
+func (c *comparison) newRef(scope, x *NexProgram) *RuleRef {
+	ref := x.ruleRef(slices.Index(c.newScopes, scope))
+	return &ref
+}
+
+// ruleFields returns what changed between the paired rules, apart from their nested scopes.
+func ruleFields(o, n *NexProgram) []string {
+	var fields []string
+	add := func(field string, changed bool) {
+		if changed {
+			fields = append(fields, field)
+		}
+	}
+	add("regex", o.Regex != n.Regex || o.Flags != n.Flags)
+	add("guard", o.Guard != n.Guard)
+	add("ruleSets", !slices.Equal(ruleSetsOf(o), ruleSetsOf(n)))
+	add("action", strings.TrimSpace(o.StartCode) != strings.TrimSpace(n.StartCode) ||
+		strings.TrimSpace(o.EndCode) != strings.TrimSpace(n.EndCode))
+	add("token", o.Token != n.Token)
+	add("subLexer", o.SubLexer != n.SubLexer)
+	return fields
+}
+
+func ruleSetsOf(x *NexProgram) []string {
+	var sets []string
+	for _, p := range x.Parameters {
+		if p.Key == "ruleset" {
+			sets = append(sets, p.Value)
+		}
+	}
+	slices.Sort(sets)
+	return sets
+}
+
+// walkDFAs walks the pairs of states of the DFAs of the scope that the same input leads to,
+// breadth-first, so the first input that tells two states apart is one of the shortest. Two states
+// are told apart if the rules that they accept differ, up to the first rule that is always
+// enabled, as a guard or a rule set may skip the rules before it. The difference is blamed on the
+// changes of these rules, or on the precedence of the rules if none of them changed.
+func (s *scopeComparison) walkDFAs() {
+	oldSkipped, newSkipped := skippableRules(s.old), skippableRules(s.new)
+	type state struct {
+		old, new *graph.Node
+		example  string
+	}
+	states := []state{{s.old.DFA[0], s.new.DFA[0], ""}}
+	visited := map[[2]int]bool{{0, 0}: true}
+	for pos := 0; pos < len(states); pos++ {
+		v := states[pos]
+		olds, news := acceptedRules(v.old, oldSkipped), acceptedRules(v.new, newSkipped)
+		mapped := make([]int, len(olds))
+		for i, id := range olds {
+			if n, ok := s.pairs[id]; ok {
+				mapped[i] = n
+			} else {
+				mapped[i] = -id
+			}
+		}
+		if !slices.Equal(mapped, news) {
+			s.blame(olds, news, mapped, v.example)
+		}
+
+		next := func(o, n *graph.Node, example string) {
+			if o == nil && n == nil {
+				return
+			}
+			key := [2]int{nodeId(o), nodeId(n)}
+			if !visited[key] {
+				visited[key] = true
+				states = append(states, state{o, n, example})
+			}
+		}
+		for _, a := range assertsOf(v.old, v.new) {
+			next(assertStep(v.old, a), assertStep(v.new, a), v.example)
+		}
+		for _, r := range runeSamples(v.old, v.new) {
+			next(runeStep(v.old, r), runeStep(v.new, r), v.example+string(r))
+		}
+	}
+}
+
+// blame marks the changes of the rules that two states accept as retokenizing, with the example
+// that leads to the states.
+func (s *scopeComparison) blame(olds, news, mapped []int, example string) {
+	var changes []*RuleChange
+	for _, id := range olds {
+		if change, ok := s.oldChanges[id]; ok {
+			changes = append(changes, change)
+		}
+	}
+	for _, id := range news {
+		if change, ok := s.newChanges[id]; ok {
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) == 0 {
+		// Unchanged rules accept in another order: the first rules that differ moved.
+		i := 0
+		for i < len(mapped) && i < len(news) && mapped[i] == news[i] {
+			i++
+		}
+		if i < len(olds) {
+			changes = append(changes, s.moved(olds[i], s.pairs[olds[i]]))
+		}
+		if i < len(news) {
+			for o, n := range s.pairs {
+				if n == news[i] {
+					changes = append(changes, s.moved(o, n))
+				}
+			}
+		}
+	}
+	for _, change := range changes {
+		if !change.Retokenizes {
+			change.Retokenizes, change.Example = true, example
+		}
+	}
+}
+
+// moved returns the change of the paired rules, which is added as moved if they have none.
+func (s *scopeComparison) moved(oldId, newId int) *RuleChange {
+	if change, ok := s.oldChanges[oldId]; ok {
+		return change
+	}
+	change := s.add(RuleChange{Kind: RuleMoved, Old: s.oldRef(s.old, s.old.child(oldId)), New: s.newRef(s.new, s.new.child(newId))})
+	s.oldChanges[oldId], s.newChanges[newId] = change, change
+	return change
+}
+
+// acceptedRules returns the rules that the state accepts, up to the first that cannot be skipped.
+func acceptedRules(v *graph.Node, skipped map[int]bool) []int {
+	if v == nil {
+		return nil
+	}
+	i := slices.IndexFunc(v.Accepts, func(id int) bool { return !skipped[id] })
+	if i < 0 {
+		return v.Accepts
+	}
+	return v.Accepts[:i+1]
+}
+
+// nodeId returns the ID of the state, or -1 for the dead state, which is nil.
+func nodeId(v *graph.Node) int {
+	if v == nil {
+		return -1
+	}
+	return v.Id
+}
+
+// assertsOf returns the asserts of the edges of the states, in order.
+func assertsOf(states ...*graph.Node) []graph.Asserts {
+	var asserts []graph.Asserts
+	for _, v := range states {
+		if v == nil {
+			continue
+		}
+		for _, e := range v.GetEdgeKind(graph.KAssert) {
+			asserts = append(asserts, e.A)
+		}
+	}
+	slices.Sort(asserts)
+	return slices.Compact(asserts)
+}
+
+func assertStep(v *graph.Node, a graph.Asserts) *graph.Node {
+	if v == nil {
+		return nil
+	}
+	for _, e := range v.E {
+		if e.Kind == graph.KAssert && e.A == a {
+			return live(e.Dst)
+		}
+	}
+	return nil
+}
+
+// runeSamples returns a rune of each range of runes that both states step the same on. A range
+// is sampled by a printable rune if it has one in its first runes, for readable examples.
+func runeSamples(states ...*graph.Node) []rune {
+	cuts := []rune{0}
+	for _, v := range states {
+		if v == nil {
+			continue
+		}
+		for _, e := range v.E {
+			switch e.Kind {
+			case graph.KRune:
+				cuts = append(cuts, e.R, e.R+1)
+			case graph.KClass:
+				for i := 0; i < len(e.Lim); i += 2 {
+					cuts = append(cuts, e.Lim[i], e.Lim[i+1]+1)
+				}
+			}
+		}
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+	samples := make([]rune, 0, len(cuts))
+	for i, r := range cuts {
+		if r > unicode.MaxRune {
+			break
+		}
+		end := rune(unicode.MaxRune + 1)
+		if i+1 < len(cuts) {
+			end = cuts[i+1]
+		}
+		sample := r
+		for c := r; c < end && c < r+128; c++ {
+			if unicode.IsPrint(c) {
+				sample = c
+				break
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// runeStep returns the state that the rune leads to, like the generated code: the rune edges are
+// tried first, then the class edges, then the wild edge.
+func runeStep(v *graph.Node, r rune) *graph.Node {
+	if v == nil {
+		return nil
+	}
+	for _, kind := range []int{graph.KRune, graph.KClass, graph.KWild} {
+		for _, e := range v.GetEdgeKind(kind) {
+			if kind == graph.KWild || edgeTakes(e, r) {
+				return live(e.Dst)
+			}
+		}
+	}
+	return nil
+}
+
+// live returns the state, or nil if it is the dead state.
+func live(v *graph.Node) *graph.Node {
+	if v.Id == -1 {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"unicode"
+
+	"github.com/liran-funaro/nex/graph"
+)
+
+// findAcceptConflicts warns about each rule that matches the same longest text as a rule of higher
+// precedence, which silently wins. The warning has the shortest such text as an example. Like in
+// findShadowedRules, a rule that a rule set or a guard may skip does not always win, so it is not
+// reported as the winner.
+func (x *NexProgram) findAcceptConflicts() []Warning {
+	var warnings []Warning
+	x.walk(func(scope *NexProgram) {
+		if len(scope.DFA) == 0 {
+			return
+		}
+		examples := dfaExamples(scope.DFA)
+		mayBeSkipped := skippableRules(scope)
+		reported := map[[2]int]bool{}
+		for _, v := range scope.DFA {
+			i := slices.IndexFunc(v.Accepts, func(a int) bool { return !mayBeSkipped[a] })
+			if i < 0 {
+				continue
+			}
+			winner := scope.child(v.Accepts[i])
+			for _, a := range v.Accepts[i+1:] {
+				if reported[[2]int{winner.Id, a}] {
+					continue
+				}
+				reported[[2]int{winner.Id, a}] = true
+				loser := scope.child(a)
+				err := fmt.Errorf("%w: /%s/ loses to /%s/ at line %d on %q",
+					ErrAcceptConflict, loser.Regex, winner.Regex, winner.Line, examples[v.Id])
+				warnings = append(warnings, Warning{Line: loser.Line, Column: loser.Column, Err: err})
+			}
+		}
+	})
+	return warnings
+}
+
+func (x *NexProgram) child(id int) *NexProgram {
+	return x.Children[slices.IndexFunc(x.Children, func(kid *NexProgram) bool { return kid.Id == id })]
+}
+
+// dfaExamples returns the shortest text that leads to each state of the DFA.
+func dfaExamples(dfa []*graph.Node) []string {
+	examples := make([]string, len(dfa))
+	visited := make([]bool, len(dfa))
+	visited[0] = true
+	states := []*graph.Node{dfa[0]}
+	for pos := 0; pos < len(states); pos++ {
+		v := states[pos]
+		for _, e := range v.E {
+			// The dead state, whose ID is -1, leads nowhere.
+			if e.Dst.Id < 0 || visited[e.Dst.Id] {
+				continue
+			}
+			visited[e.Dst.Id] = true
+			examples[e.Dst.Id] = examples[v.Id]
+			if e.Kind != graph.KAssert {
+				examples[e.Dst.Id] += string(edgeExample(v, e))
+			}
+			states = append(states, e.Dst)
+		}
+	}
+	return examples
+}
+
+// edgeExample returns a rune that takes the edge from v.
+func edgeExample(v *graph.Node, e *graph.Edge) rune {
+	switch e.Kind {
+	case graph.KRune:
+		return e.R
+	case graph.KClass:
+		return e.Lim[0]
+	}
+	// A wild edge takes the runes that the other edges do not. Were they all taken, the DFA would
+	// have no wild edge.
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if !slices.ContainsFunc(v.E, func(o *graph.Edge) bool { return o.Kind != graph.KWild && edgeTakes(o, r) }) {
+			return r
+		}
+	}
+	return unicode.ReplacementChar
+}
+
+func edgeTakes(e *graph.Edge, r rune) bool {
+	switch e.Kind {
+	case graph.KRune:
+		return e.R == r
+	case graph.KClass:
+		for i := 0; i < len(e.Lim); i += 2 {
+			if e.Lim[i] <= r && r <= e.Lim[i+1] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func isDefinitionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		isLetter := r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+		if !isLetter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+type definitionExpander struct {
+	defs     map[string]*Definition
+	expanded map[string]string
+}
+
+// expandDefinitions replaces {NAME} references in all the rules with their (transitively expanded) definitions.
+// References to undefined names are left as is, so {NAME} keeps its literal meaning.
+func (x *NexProgram) expandDefinitions() error {
+	if len(x.Definitions) == 0 {
+		return nil
+	}
+
+	e := definitionExpander{defs: map[string]*Definition{}, expanded: map[string]string{}}
+	for i := range x.Definitions {
+		d := &x.Definitions[i]
+		if _, ok := e.defs[d.Name]; ok {
+			return fmt.Errorf("%d:1: %w: {%s}", d.Line, ErrDuplicateDefinition, d.Name)
+		}
+		e.defs[d.Name] = d
+	}
+
+	// Resolve all the definitions first, so cycles are reported at the definitions and not at the rules.
+	for _, d := range x.Definitions {
+		if _, err := e.resolve(d.Name, nil); err != nil {
+			return err
+		}
+	}
+
+	x.walk(func(r *NexProgram) {
+		if r != x && !r.IsLiteral() {
+			// All the definitions are resolved, so this cannot fail.
+			regex, offsets, _ := e.expand(r.Regex, nil)
+			if regex != r.Regex {
+				r.specRegex, r.specOffsets, r.Regex = r.Regex, offsets, regex
+			}
+		}
+	})
+	return nil
+}
+
+func (e *definitionExpander) resolve(name string, chain []string) (string, error) {
+	if s, ok := e.expanded[name]; ok {
+		return s, nil
+	}
+	for i, c := range chain {
+		if c == name {
+			cycle := append(slices.Clone(chain[i:]), name)
+			for j := range cycle {
+				cycle[j] = "{" + cycle[j] + "}"
+			}
+			return "", fmt.Errorf("%d:1: %w: %s", e.defs[name].Line, ErrDefinitionCycle, strings.Join(cycle, " -> "))
+		}
+	}
+
+	s, _, err := e.expand(e.defs[name].Regex, append(chain, name))
+	if err != nil {
+		return "", err
+	}
+	s = "(?:" + s + ")"
+	e.expanded[name] = s
+	return s, nil
+}
+
+// expand replaces the references in the regex. References inside character classes or
+// escaped braces are not expanded. It also returns the offset in the regex of each byte of the
+// expansion, which is that of the reference for the bytes of a definition.
+func (e *definitionExpander) expand(regex string, chain []string) (string, []int, error) {
+	var out strings.Builder
+	var offsets []int
+	write := func(s string, offset int) {
+		out.WriteString(s)
+		for range len(s) {
+			offsets = append(offsets, offset)
+		}
+	}
+	inClass := false
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+		switch {
+		case c == '\\' && i+1 < len(regex):
+			out.WriteString(regex[i : i+2])
+			offsets = append(offsets, i, i+1)
+			i++
+			continue
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '{' && !inClass:
+			end := strings.IndexByte(regex[i:], '}')
+			if end < 0 {
+				break
+			}
+			name := regex[i+1 : i+end]
+			if _, ok := e.defs[name]; !ok {
+				break
+			}
+			s, err := e.resolve(name, chain)
+			if err != nil {
+				return "", nil, err
+			}
+			write(s, i)
+			i += end
+			continue
+		}
+		out.WriteByte(c)
+		offsets = append(offsets, i)
+	}
+	return out.String(), offsets, nil
+}
@@ -0,0 +1,106 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ruleKey identifies a rule when a derived spec overrides the rules of its base spec.
+// Rules are identified by their token, if they have one, and otherwise by their regex.
+func (x *NexProgram) ruleKey() string {
+	if x.Token != "" {
+		return "-> " + x.Token
+	}
+	if x.IsLiteral() {
+		return strconv.Quote(x.Regex)
+	}
+	return "/" + x.Regex
+}
+
+// extendBase merges the spec named by the `%extends` parameter into x, if there is one.
+// The base's rules come first. A derived rule with the same key as a base rule replaces it
+// in place, so it keeps the base rule's precedence. Other derived rules are appended.
+// The base's definitions and parameters are inherited, and the derived ones take precedence.
+func (x *NexProgram) extendBase(dir string, chain []string) error {
+	i := slices.IndexFunc(x.Parameters, func(p Parameter) bool { return p.Key == "extends" })
+	if i < 0 {
+		return nil
+	}
+	name := strings.TrimSpace(x.Parameters[i].Value)
+	x.Parameters = slices.Delete(x.Parameters, i, i+1)
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	if slices.Contains(chain, name) {
+		return fmt.Errorf("%w: %s", ErrExtendsCycle, strings.Join(append(chain, name), " -> "))
+	}
+
+	base, err := parseBase(name)
+	if err != nil {
+		return err
+	}
+	if err = base.extendBase(filepath.Dir(name), append(chain, name)); err != nil {
+		return err
+	}
+
+	for _, kid := range x.Children {
+		j := slices.IndexFunc(base.Children, func(b *NexProgram) bool { return b.ruleKey() == kid.ruleKey() })
+		if j < 0 {
+			base.Children = append(base.Children, kid)
+		} else {
+			base.Children[j] = kid
+		}
+	}
+	x.Children = base.Children
+
+	for _, d := range x.Definitions {
+		j := slices.IndexFunc(base.Definitions, func(b Definition) bool { return b.Name == d.Name })
+		if j < 0 {
+			base.Definitions = append(base.Definitions, d)
+		} else {
+			base.Definitions[j] = d
+		}
+	}
+	x.Definitions = base.Definitions
+	x.Parameters = append(base.Parameters, x.Parameters...)
+
+	if x.StartCode == "" {
+		x.StartCode = base.StartCode
+	}
+	if x.EndCode == "" {
+		x.EndCode = base.EndCode
+	}
+	if strings.TrimSpace(x.UserCode) == "" {
+		x.UserCode = base.UserCode
+	}
+
+	// The rules of both specs were numbered independently.
+	x.walk(func(r *NexProgram) {
+		for i, kid := range r.Children {
+			kid.Id = i + 1
+		}
+	})
+	return nil
+}
+
+func parseBase(name string) (*NexProgram, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("extends: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	p := parser{in: bufio.NewReader(f)}
+	base := p.parseRoot()
+	if p.err != nil {
+		return nil, fmt.Errorf("extends %s: %w", name, p.err)
+	}
+	return base, nil
+}
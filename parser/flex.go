@@ -0,0 +1,310 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+var ErrFlexUnsupported = errors.New("unsupported flex construct")
+
+/*
+Flex Program Grammar
+====================
+
+The sections of a classic flex file are separated by `%%` lines:
+
+	DEFINITIONS
+	%%
+	RULES
+	%%
+	USER-CODE
+
+DEFINITIONS (one per line):
+	(1) NAME PATTERN
+	(2) %{ code %}, or an indented line of code, which precedes the user code
+	(3) %option caseless (or case-insensitive) and nodefault; other options are ignored
+
+RULES (one per line, unindented):
+	PATTERN ACTION
+
+PATTERN: a flex regex, up to the first whitespace outside of quotes and brackets.
+	"quoted text" matches literally.
+
+ACTION (Go code):
+	(1) ; or nothing, to skip the match
+	(2) | for the action of the next rule
+	(3) one line of code
+	(4) { multi line code }
+	ECHO in the code writes the matched text, as yylex.Echo() does.
+
+Like the default rule of flex, the text that no rule matches is echoed, as with `%option echo`,
+unless `%option nodefault` is set.
+*/
+
+// parseFlexRoot parses a flex file into the same tree as a nex spec.
+func (p *parser) parseFlexRoot() *NexProgram {
+	node := p.newProgram("")
+	code, echo := p.parseFlexDefinitions(node)
+	if echo {
+		node.Parameters = append(node.Parameters, Parameter{"option", "echo"})
+	}
+	node.Children = p.parseFlexRules()
+	node.UserCode = code + p.readRemaining()
+	if p.err == nil {
+		p.err = node.checkActions()
+	}
+	return node
+}
+
+// readLine reads the rest of the line, and returns false at the end of the input.
+func (p *parser) readLine() (string, bool) {
+	var line []rune
+	ok := p.read()
+	for ; ok && '\n' != p.r; ok = p.read() {
+		line = append(line, p.r)
+	}
+	return string(line), ok || len(line) > 0
+}
+
+// parseFlexDefinitions parses the definitions section, and returns its code, and whether the
+// unmatched text is echoed, which `%option nodefault` turns off.
+func (p *parser) parseFlexDefinitions(node *NexProgram) (string, bool) {
+	var code []string
+	echo := true
+	for p.err == nil {
+		line, ok := p.readLine()
+		lineNum := p.line - 1
+		if !ok {
+			p.reportError(ErrUnexpectedEOF)
+			break
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "%%" && line == trimmed:
+			return strings.Join(code, ""), echo
+		case trimmed == "" || strings.HasPrefix(trimmed, "/*") && strings.HasSuffix(trimmed, "*/"):
+		case line != trimmed && line[0] != '%':
+			code = append(code, line+"\n")
+		case trimmed == "%{":
+			code = append(code, p.readFlexCodeBlock()...)
+		case strings.HasPrefix(trimmed, "%option"):
+			for _, option := range strings.Fields(trimmed)[1:] {
+				switch option {
+				case "caseless", "case-insensitive":
+					node.Parameters = append(node.Parameters, Parameter{"option", "caseless"})
+				case "nodefault":
+					echo = false
+				}
+			}
+		case strings.HasPrefix(trimmed, "%"):
+			p.err = fmt.Errorf("%d:1: %w: %s", lineNum, ErrFlexUnsupported, strings.Fields(trimmed)[0])
+		default:
+			name, pattern, _ := strings.Cut(strings.Join(strings.Fields(line), " "), " ")
+			if !isDefinitionName(name) {
+				p.err = fmt.Errorf("%d:1: %w: %q", lineNum, ErrBadDefinitionName, name)
+				break
+			}
+			regex, err := flexRegex(pattern)
+			if err != nil {
+				p.err = fmt.Errorf("%d:%d: %w", lineNum, strings.Index(line, pattern)+1, err)
+				break
+			}
+			node.Definitions = append(node.Definitions, Definition{Name: name, Regex: regex, Line: lineNum})
+		}
+	}
+	return "", false
+}
+
+// readFlexCodeBlock reads the lines of a `%{ ... %}` block, whose opening line was read.
+func (p *parser) readFlexCodeBlock() []string {
+	var code []string
+	for {
+		line, ok := p.readLine()
+		if !ok {
+			p.reportError(ErrUnexpectedEOF)
+			return nil
+		}
+		if strings.TrimSpace(line) == "%}" {
+			return code
+		}
+		code = append(code, line+"\n")
+	}
+}
+
+// parseFlexRules parses the rules section, up to the `%%` line or the end of the input.
+func (p *parser) parseFlexRules() []*NexProgram {
+	var items, pending []*NexProgram
+	for p.err == nil && p.read() {
+		switch {
+		case '\n' == p.r:
+			continue
+		case ' ' == p.r || '\t' == p.r:
+			// Indented lines may only have comments.
+			line, _ := p.readLine()
+			if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "/*") && !strings.HasPrefix(trimmed, "//") {
+				p.err = fmt.Errorf("%d:1: %w: indented code in the rules section", p.line-1, ErrFlexUnsupported)
+			}
+			continue
+		case '%' == p.r:
+			line, _ := p.readLine()
+			if "%"+line != "%%" {
+				p.err = fmt.Errorf("%d:1: %w: %%%s", p.line-1, ErrFlexUnsupported, line)
+			}
+			return p.flexItems(items, pending)
+		}
+
+		child := p.readFlexPattern()
+		if child == nil {
+			return nil
+		}
+		pending = append(pending, child)
+		for p.read() && (' ' == p.r || '\t' == p.r) {
+		}
+		if p.eof || '\n' == p.r {
+			// Without an action, the match is skipped.
+			items, pending = append(items, pending...), nil
+			continue
+		}
+		if '|' == p.r {
+			p.readLine()
+			continue
+		}
+		p.unread()
+		code, pos := p.readCode()
+		if strings.TrimSpace(code) != ";" {
+			code = flexEcho(code)
+			for _, x := range pending {
+				x.StartCode, x.StartCodePos = code, pos
+			}
+		}
+		items, pending = append(items, pending...), nil
+	}
+	return p.flexItems(items, pending)
+}
+
+// flexEcho replaces the ECHO macros of the code of an action with calls of yylex.Echo. The code
+// is tokenized, so ECHO in strings and comments, and fields named ECHO, stay as they are.
+func flexEcho(code string) string {
+	src := []byte(code)
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	var out strings.Builder
+	last, prev := 0, token.ILLEGAL
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.IDENT && lit == "ECHO" && prev != token.PERIOD {
+			offset := file.Offset(pos)
+			out.WriteString(code[last:offset])
+			out.WriteString("yylex.Echo()")
+			last = offset + len(lit)
+		}
+		prev = tok
+	}
+	out.WriteString(code[last:])
+	return out.String()
+}
+
+// flexItems numbers the rules. Rules whose action is `|` must be followed by a rule with an action.
+func (p *parser) flexItems(items, pending []*NexProgram) []*NexProgram {
+	if p.err == nil && len(pending) > 0 {
+		last := pending[len(pending)-1]
+		p.err = fmt.Errorf("%d:%d: %w: the action of the last rule is '|'", last.Line, last.Column, ErrFlexUnsupported)
+	}
+	for i, child := range items {
+		child.Id = i + 1
+	}
+	return items
+}
+
+// readFlexPattern reads the pattern of a rule, whose first rune was read, and translates it to a regex.
+func (p *parser) readFlexPattern() *NexProgram {
+	line, col := p.line, p.col
+	var x flexPattern
+	for ok := true; ok; ok = p.read() {
+		if x.add(p.r) {
+			p.unread()
+			break
+		}
+	}
+	if p.err != nil {
+		return nil
+	}
+	regex, err := x.finish()
+	if err != nil {
+		p.err = fmt.Errorf("%d:%d: %w", line, col, err)
+		return nil
+	}
+	prog := p.newProgram(regex)
+	prog.Line, prog.Column = line, col
+	return prog
+}
+
+// flexRegex translates a flex pattern, up to its first whitespace, to a regex.
+func flexRegex(pattern string) (string, error) {
+	var x flexPattern
+	for _, r := range pattern {
+		if x.add(r) {
+			break
+		}
+	}
+	return x.finish()
+}
+
+// flexPattern translates a flex pattern to a regex, rune by rune. Both share most of their syntax,
+// except for quoted text, which flex matches literally.
+type flexPattern struct {
+	regexReader // Tracks the character classes and the escapes outside of quotes.
+	out         strings.Builder
+	quoted      bool
+	err         error
+}
+
+// add adds the next rune of the pattern. It returns true if r is the whitespace that ends the pattern.
+func (x *flexPattern) add(r rune) bool {
+	switch {
+	case x.err != nil:
+	case x.quoted && x.escape:
+		x.escape = false
+		if strings.ContainsRune("nrtfv", r) {
+			x.out.WriteString(`\` + string(r))
+		} else {
+			x.out.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	case x.quoted && '\\' == r:
+		x.escape = true
+	case '"' == r && !x.class && !x.escape:
+		x.quoted = !x.quoted
+	case x.quoted:
+		x.out.WriteString(regexp.QuoteMeta(string(r)))
+	case isSpace(r) && !x.class && !x.escape:
+		return true
+	case len(x.regex) == 0 && '<' == r:
+		x.err = fmt.Errorf("%w: start conditions and <<EOF>> rules", ErrFlexUnsupported)
+	case '/' == r && !x.class && !x.escape:
+		x.err = fmt.Errorf("%w: trailing context", ErrFlexUnsupported)
+	default:
+		x.regexReader.add(r, -1)
+		x.out.WriteRune(r)
+	}
+	return false
+}
+
+func (x *flexPattern) finish() (string, error) {
+	switch {
+	case x.err != nil:
+		return "", x.err
+	case x.quoted:
+		return "", fmt.Errorf("%w: unterminated quote", ErrFlexUnsupported)
+	case x.class:
+		return "", fmt.Errorf("%w: unterminated character class", ErrFlexUnsupported)
+	}
+	return x.out.String(), nil
+}
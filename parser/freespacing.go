@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// regexReader accumulates the runes of a regex, up to its closing delimiter.
+//
+// A regex that starts with a flag group that has the x flag, e.g., `(?x)` or `(?ix)`, is in
+// free-spacing mode, which Go's regexp does not support. Such a regex may span several lines.
+// Its whitespace outside of character classes is ignored, and `#` starts a comment that
+// ends with the line. A comment may contain the delimiter. Escape whitespace and '#' to match them.
+//
+// A backslash escapes the delimiter, unless the regex is raw, and an escaped backslash does not.
+type regexReader struct {
+	regex       []rune
+	freeSpacing bool
+	raw         bool // The delimiter ends the regex even after a backslash.
+	escape      bool
+	comment     bool
+
+	class      bool // In a character class, which starts at classStart.
+	classStart int
+	named      bool // In a named class inside a character class, e.g., `[:alpha:]`.
+}
+
+// add adds the next rune of the regex. It returns true if r is the closing delimiter.
+func (x *regexReader) add(r, delim rune) bool {
+	if x.comment {
+		x.comment = r != '\n'
+		return false
+	}
+	wasEscape := x.escape
+	x.escape = !wasEscape && r == '\\'
+	switch {
+	case r == delim && (!wasEscape || x.raw):
+		return true
+	case wasEscape:
+	case x.class:
+		x.addToClass(r)
+	case r == '[':
+		x.class, x.classStart = true, len(x.regex)
+	case x.freeSpacing && r == '#':
+		x.comment = true
+		return false
+	case x.freeSpacing && unicode.IsSpace(r):
+		return false
+	}
+	x.regex = append(x.regex, r)
+	if !x.freeSpacing && r == ')' {
+		x.checkFreeSpacing()
+	}
+	return false
+}
+
+// addToClass tracks the end of the character class, before r is added.
+func (x *regexReader) addToClass(r rune) {
+	prev := x.regex[len(x.regex)-1]
+	switch {
+	case x.named:
+		x.named = !(r == ']' && prev == ':')
+	case r == ':' && prev == '[' && len(x.regex)-1 > x.classStart:
+		x.named = true
+	case r == ']':
+		// A ']' right after the opening '[' or '[^' is a literal.
+		first := x.regex[x.classStart+1:]
+		x.class = len(first) == 0 || (len(first) == 1 && first[0] == '^')
+	}
+}
+
+// checkFreeSpacing enables free-spacing mode if the regex so far is a flag group with the x flag,
+// and removes the x flag, which Go's regexp does not know.
+func (x *regexReader) checkFreeSpacing() {
+	s := string(x.regex)
+	if !strings.HasPrefix(s, "(?") || !strings.Contains(s, "x") {
+		return
+	}
+	flags := s[2 : len(s)-1]
+	if strings.IndexFunc(flags, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+		return
+	}
+	x.freeSpacing = true
+	x.regex = slices.DeleteFunc(x.regex, func(r rune) bool { return r == 'x' })
+	if len(x.regex) == len("(?)") {
+		x.regex = nil
+	}
+}
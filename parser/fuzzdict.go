@@ -0,0 +1,155 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp/syntax"
+	"unicode"
+)
+
+// maxFuzzSamples bounds the number of samples of a single rule, as alternations multiply them.
+const maxFuzzSamples = 32
+
+// WriteFuzzDictionary writes a dictionary in the format of AFL and libFuzzer, so fuzzers of code
+// that uses the lexer find inputs that the rules match. The dictionary has the literals of
+// each rule, and short texts that it matches, one for every alternative.
+func (x *NexProgram) WriteFuzzDictionary(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	seen := map[string]bool{}
+	var err error
+	x.walk(func(r *NexProgram) {
+		if err != nil || r.Regex == "" {
+			return
+		}
+		var re *syntax.Regexp
+		if re, err = syntax.Parse(r.Regex, r.Flags); err != nil {
+			err = fmt.Errorf("%d:%d: rule /%s/: %w", r.Line, r.Column, r.Regex, err)
+			return
+		}
+		var entries []string
+		for _, s := range append(fuzzSamples(re), fuzzLiterals(re)...) {
+			if s != "" && !seen[s] {
+				seen[s] = true
+				entries = append(entries, s)
+			}
+		}
+		if len(entries) == 0 {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "# %d: /%s/\n", r.Line, r.Regex)
+		for _, s := range entries {
+			_, _ = fmt.Fprintf(w, "%s\n", quoteFuzzEntry(s))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Sample returns a short text that the regex of the rule matches, or "" if it has none.
+func (r *NexProgram) Sample() string {
+	re, err := syntax.Parse(r.Regex, r.Flags)
+	if err != nil {
+		return ""
+	}
+	for _, s := range fuzzSamples(re) {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// fuzzSamples returns short texts that re matches.
+func fuzzSamples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		var samples []string
+		for i := 0; i < len(re.Rune) && len(samples) < maxFuzzSamples; i += 2 {
+			samples = append(samples, string(classSample(re.Rune[i], re.Rune[i+1])))
+		}
+		return samples
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"a"}
+	case syntax.OpCapture:
+		return fuzzSamples(re.Sub[0])
+	case syntax.OpPlus:
+		return fuzzSamples(re.Sub[0])
+	case syntax.OpRepeat:
+		samples := []string{""}
+		for i := 0; i < re.Min; i++ {
+			samples = concatSamples(samples, fuzzSamples(re.Sub[0]))
+		}
+		return samples
+	case syntax.OpConcat:
+		samples := []string{""}
+		for _, sub := range re.Sub {
+			samples = concatSamples(samples, fuzzSamples(sub))
+		}
+		return samples
+	case syntax.OpAlternate:
+		var samples []string
+		for _, sub := range re.Sub {
+			samples = append(samples, fuzzSamples(sub)...)
+		}
+		return samples[:min(len(samples), maxFuzzSamples)]
+	default:
+		// Empty matches, asserts, and optional parts.
+		return []string{""}
+	}
+}
+
+func concatSamples(prefixes, suffixes []string) []string {
+	var samples []string
+	for _, p := range prefixes {
+		for _, s := range suffixes {
+			if len(samples) == maxFuzzSamples {
+				return samples
+			}
+			samples = append(samples, p+s)
+		}
+	}
+	return samples
+}
+
+// classSample returns a rune of the range lo-hi, preferring a printable one.
+func classSample(lo, hi rune) rune {
+	for r := lo; r <= hi && r < lo+0x80; r++ {
+		if unicode.IsPrint(r) {
+			return r
+		}
+	}
+	return lo
+}
+
+// fuzzLiterals returns the literals inside of re.
+func fuzzLiterals(re *syntax.Regexp) []string {
+	if re.Op == syntax.OpLiteral {
+		return []string{string(re.Rune)}
+	}
+	var literals []string
+	for _, sub := range re.Sub {
+		literals = append(literals, fuzzLiterals(sub)...)
+	}
+	return literals
+}
+
+// quoteFuzzEntry quotes s as a dictionary entry, in which only printable ASCII may appear as is.
+func quoteFuzzEntry(s string) string {
+	q := []byte{'"'}
+	for _, b := range []byte(s) {
+		switch {
+		case b == '"' || b == '\\':
+			q = append(q, '\\', b)
+		case b < 0x20 || b >= 0x7f:
+			q = append(q, fmt.Sprintf("\\x%02X", b)...)
+		default:
+			q = append(q, b)
+		}
+	}
+	return string(append(q, '"'))
+}
@@ -0,0 +1,29 @@
+package parser
+
+import "fmt"
+
+// findNullableRules warns about the rules that can match the empty string.
+// Such a match consumes nothing, so the lexer skips a rune instead, which is rarely intended.
+// A rule is nullable if the start state of the DFA accepts it, before reading a rune. A rule that
+// is only accepted after asserts, like /^$/ for an empty line, matches the empty string only
+// where they hold, which is intended, so it is not reported.
+func (x *NexProgram) findNullableRules() []Warning {
+	var warnings []Warning
+	x.walk(func(scope *NexProgram) {
+		if len(scope.DFA) == 0 {
+			return
+		}
+		nullable := map[int]bool{}
+		for _, a := range scope.DFA[0].Accepts {
+			nullable[a] = true
+		}
+
+		for _, kid := range scope.Children {
+			if nullable[kid.Id] {
+				err := fmt.Errorf("%w: /%s/ matches the empty string", ErrNullableRule, kid.Regex)
+				warnings = append(warnings, Warning{Line: kid.Line, Column: kid.Column, Err: err})
+			}
+		}
+	})
+	return warnings
+}
@@ -2,53 +2,339 @@ package parser
 
 import (
 	"bufio"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	goparser "go/parser"
+	"go/scanner"
+	"go/token"
 	"io"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/liran-funaro/nex/graph"
 )
 
 var (
-	ErrUnmatchedRBrace   = errors.New("unmatched '}'")
-	ErrUnmatchedLBrace   = errors.New("unmatched '{'")
-	ErrUnexpectedEOF     = errors.New("unexpected EOF")
-	ErrUnexpectedNewline = errors.New("unexpected newline")
+	ErrUnmatchedRBrace     = errors.New("unmatched '}'")
+	ErrUnmatchedLBrace     = errors.New("unmatched '{'")
+	ErrUnexpectedEOF       = errors.New("unexpected EOF")
+	ErrUnexpectedNewline   = errors.New("unexpected newline")
+	ErrBadDefinitionName   = errors.New("bad definition name")
+	ErrDefinitionCycle     = errors.New("definition cycle")
+	ErrDuplicateDefinition = errors.New("duplicate definition")
+	ErrExtendsCycle        = errors.New("extends cycle")
+	ErrBadRuleParam        = errors.New("bad rule parameter")
+	ErrBadTokenName        = errors.New("bad token name")
+	ErrShadowedRule        = errors.New("shadowed rule")
+	ErrNullableRule        = errors.New("nullable rule")
+	ErrBadAction           = errors.New("bad action code")
+	ErrAcceptConflict      = errors.New("accept conflict")
+	ErrBadRuleName         = errors.New("bad rule name")
+	ErrBadLiteral          = errors.New("bad literal")
+	ErrBadGuard            = errors.New("bad guard")
+	ErrUnknownFlag         = errors.New("unknown regex flag")
+	ErrBadSubLexer         = errors.New("bad sub-lexer")
+	ErrBadPrefix           = errors.New("bad prefix")
+	ErrBadPackage          = errors.New("bad package")
+	ErrBadSection          = errors.New("bad section")
+	ErrBadResync           = errors.New("bad resync class")
+	ErrMissingAction       = errors.New("missing action")
 )
 
+// Options control how a nex program is parsed and compiled.
+type Options struct {
+	Limits Limits
+
+	// Caseless makes all the rules case-insensitive, as if the program had `%option caseless`.
+	Caseless bool
+
+	// Dir is the directory against which relative `%extends` paths are resolved.
+	// An empty Dir means the working directory.
+	Dir string
+
+	// Flex parses a classic flex file, whose sections are separated by `%%` lines, instead of a nex spec.
+	Flex bool
+
+	// Strict fails on the first warning, instead of adding the warnings to the program.
+	Strict bool
+
+	// Conflicts warns about the rules that match the same longest text as an earlier rule,
+	// which wins. Such conflicts are common, e.g., between keywords and identifiers.
+	Conflicts bool
+
+	// YaccTokens, if not nil, are the tokens that the goyacc grammar of the lexer declares, e.g., by
+	// ReadYaccTokens. nex warns about the tokens that the rules return but the grammar does not
+	// declare, and about the declared tokens that no rule returns.
+	YaccTokens []string
+
+	// Progress, if set, is called as the compilation goes, so the compilation of a very large
+	// program can be told apart from a hung one.
+	Progress func(Progress)
+}
+
+// Progress reports how far the compilation of a nex program got.
+// The counts are summed over all the scopes of rules.
+type Progress struct {
+	Phase     string // "parse", "nfa" or "dfa".
+	Rules     int    // The number of rules parsed.
+	NFANodes  int    // The number of NFA nodes built so far.
+	DFAStates int    // The number of DFA states discovered so far.
+}
+
+// Limits bound the resources spent compiling a nex program. A zero field means no limit.
+// MaxStates and MaxNFANodes apply to each automaton (a scope of rules), while
+// Timeout applies to the entire compilation.
+type Limits struct {
+	MaxStates   int
+	MaxNFANodes int
+	Timeout     time.Duration
+}
+
 func ParseNex(in io.Reader) (*NexProgram, error) {
+	return ParseNexWithOptions(in, Options{})
+}
+
+// CompileWithLimits parses a nex program and builds its automata, failing with
+// a *graph.LimitError if the given limits are exceeded.
+// It is intended for systems that compile grammars from untrusted sources.
+func CompileWithLimits(grammar io.Reader, limits Limits) (*NexProgram, error) {
+	return ParseNexWithOptions(grammar, Options{Limits: limits})
+}
+
+func ParseNexWithOptions(in io.Reader, opts Options) (*NexProgram, error) {
+	return ParseNexContext(context.Background(), in, opts)
+}
+
+// ParseNexContext is like ParseNexWithOptions, but it stops compiling the program when the
+// context is done. The error then tells how far the compilation got, and which rules are to blame.
+func ParseNexContext(ctx context.Context, in io.Reader, opts Options) (*NexProgram, error) {
 	p := parser{in: bufio.NewReader(in)}
-	program := p.parseRoot()
+	var program *NexProgram
+	if opts.Flex {
+		program = p.parseFlexRoot()
+	} else {
+		program = p.parseRoot()
+	}
 	if p.err != nil {
 		return nil, p.err
 	}
-	return program, genGraphs(program)
+	if err := program.extendBase(opts.Dir, nil); err != nil {
+		return nil, err
+	}
+	if err := program.checkRuleNames(); err != nil {
+		return nil, err
+	}
+	if err := program.checkPackage(); err != nil {
+		return nil, err
+	}
+	if _, err := program.Resync(); err != nil {
+		return nil, err
+	}
+	if err := program.resolveSubLexers(); err != nil {
+		return nil, err
+	}
+	if err := program.expandDefinitions(); err != nil {
+		return nil, err
+	}
+	set, unset, err := program.regexFlags()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Caseless || program.HasOption("caseless") {
+		set |= syntax.FoldCase
+	}
+	program.walk(func(x *NexProgram) {
+		x.Flags = x.Flags&^unset | set
+		if x == program || err != nil {
+			return
+		}
+		// The `%flags` annotation of a rule overrides the flags of the spec for its regex.
+		ruleSet, ruleUnset, ruleErr := x.regexFlags()
+		if ruleErr != nil {
+			err = fmt.Errorf("%d:%d: %w", x.Line, x.Column, ruleErr)
+		}
+		x.Flags = x.Flags&^ruleUnset | ruleSet
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress := &progressTracker{report: opts.Progress}
+	progress.Rules = program.RuleCount()
+	progress.update("parse", graph.Progress{})
+	if err := genGraphs(ctx, program, opts.graphOptions(), progress); err != nil {
+		return program, err
+	}
+	program.Warnings = append(p.warnings, program.findShadowedRules()...)
+	program.Warnings = append(program.Warnings, program.findNullableRules()...)
+	if opts.Conflicts {
+		program.Warnings = append(program.Warnings, program.findAcceptConflicts()...)
+	}
+	if opts.YaccTokens != nil {
+		program.Warnings = append(program.Warnings, program.findTokenMismatches(opts.YaccTokens)...)
+	}
+	slices.SortStableFunc(program.Warnings, func(a, b Warning) int {
+		return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column))
+	})
+	if opts.Strict && len(program.Warnings) > 0 {
+		return program, program.Warnings[0].error()
+	}
+	return program, nil
+}
+
+func (o *Options) graphOptions() graph.Options {
+	g := graph.Options{
+		MaxStates:   o.Limits.MaxStates,
+		MaxNFANodes: o.Limits.MaxNFANodes,
+	}
+	if o.Limits.Timeout > 0 {
+		g.Deadline = time.Now().Add(o.Limits.Timeout)
+	}
+	return g
 }
 
-func genGraphs(x *NexProgram) error {
+func genGraphs(ctx context.Context, x *NexProgram, opts graph.Options, progress *progressTracker) error {
 	if len(x.Children) == 0 {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Regex -> NFA
 	var err error
-	x.NFA, err = graph.BuildNfa(x.Children)
+	opts.Progress = func(p graph.Progress) { progress.update("nfa", p) }
+	opts.Stats = func(s graph.Stats) { x.NFAStats = s }
+	x.NFA, err = graph.BuildNfaWithOptions(x.Children, opts)
 	if err != nil {
-		return err
+		return x.ruleError(err)
 	}
 
 	// NFA -> DFA
-	x.DFA = graph.BuildDfa(x.NFA)
+	opts.Progress = func(p graph.Progress) { progress.update("dfa", p) }
+	opts.Stats = func(s graph.Stats) { x.DFAStats = s }
+	x.DFA, err = graph.BuildDfaContext(ctx, x.NFA, opts)
+	if err != nil {
+		return x.canceledError(err)
+	}
+	progress.NFANodes += len(x.NFA)
+	progress.DFAStates += len(x.DFA)
 
 	for _, kid := range x.Children {
-		if err = genGraphs(kid); err != nil {
+		if err = genGraphs(ctx, kid, opts, progress); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// progressTracker sums the progress of the automata of all scopes. Its counts do not include
+// the automaton under construction.
+type progressTracker struct {
+	Progress
+	report func(Progress)
+}
+
+func (t *progressTracker) update(phase string, p graph.Progress) {
+	if t.report == nil {
+		return
+	}
+	cur := t.Progress
+	cur.Phase = phase
+	cur.NFANodes += p.NFANodes
+	cur.DFAStates += p.DFAStates
+	t.report(cur)
+}
+
+// ruleError adds the position of the offending rule in the spec to regex errors. If definitions
+// were expanded in the regex, the error is of the regex of the spec, at the reference that the
+// offending part of the expansion comes from.
+func (x *NexProgram) ruleError(err error) error {
+	var rErr *graph.RegexError
+	if !errors.As(err, &rErr) {
+		return err
+	}
+	for _, kid := range x.Children {
+		if kid.Id != rErr.Id {
+			continue
+		}
+		if kid.specRegex != "" {
+			spec := *rErr
+			spec.Regex = kid.specRegex
+			if spec.Pos >= 0 && spec.Pos < len(kid.specOffsets) {
+				spec.Pos = kid.specOffsets[spec.Pos]
+			}
+			rErr, err = &spec, &spec
+		}
+		col := kid.Column
+		if rErr.Pos >= 0 {
+			col += utf8.RuneCountInString(rErr.Regex[:rErr.Pos])
+		}
+		return fmt.Errorf("%d:%d: rule /%s/: %w", kid.Line, col, rErr.Regex, err)
+	}
+	return err
+}
+
+// checkRuleNames checks that the names of `%name NAME` annotations are identifiers,
+// and that no two rules have the same name.
+func (x *NexProgram) checkRuleNames() error {
+	var err error
+	seen := map[string]bool{}
+	x.walk(func(r *NexProgram) {
+		name := r.RuleName()
+		switch {
+		case err != nil || name == "":
+		case !isDefinitionName(name):
+			err = fmt.Errorf("%d:%d: %w: %q", r.Line, r.Column, ErrBadRuleName, name)
+		case seen[name]:
+			err = fmt.Errorf("%d:%d: %w: %q is the name of another rule", r.Line, r.Column, ErrBadRuleName, name)
+		}
+		seen[name] = true
+	})
+	return err
+}
+
+// checkPackage checks that the `%prefix` and `%package` parameters are identifiers, and that the
+// package is the package of the user code, if it has a package clause.
+func (x *NexProgram) checkPackage() error {
+	if prefix := x.Prefix(); prefix != "" && !token.IsIdentifier(prefix) {
+		return fmt.Errorf("%w: %q", ErrBadPrefix, prefix)
+	}
+	pkg := x.Package()
+	if pkg == "" {
+		return nil
+	}
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("%w: %q", ErrBadPackage, pkg)
+	}
+	f, err := goparser.ParseFile(token.NewFileSet(), "", x.UserCode, goparser.PackageClauseOnly)
+	if err == nil && f.Name.Name != pkg {
+		return fmt.Errorf("%w: %q, but the code is in package %q", ErrBadPackage, pkg, f.Name.Name)
+	}
+	return nil
+}
+
+// canceledError adds the rules that a canceled DFA construction blames to its error.
+func (x *NexProgram) canceledError(err error) error {
+	var cErr *graph.CanceledError
+	if !errors.As(err, &cErr) {
+		return err
+	}
+	var rules []string
+	for _, id := range cErr.Rules {
+		i := slices.IndexFunc(x.Children, func(kid *NexProgram) bool { return kid.Id == id })
+		rules = append(rules, fmt.Sprintf("/%s/ at line %d", x.Children[i].Regex, x.Children[i].Line))
+	}
+	return fmt.Errorf("%w; most states come from %s", err, strings.Join(rules, ", "))
+}
+
 type parser struct {
 	in       *bufio.Reader
 	line     int
@@ -57,10 +343,23 @@ type parser struct {
 	err      error
 	eof      bool
 	isUnread bool
-	nextId   int
+
+	// sections is true if a `%%` line ends the parameters, so another one ends the rules.
+	sections bool
+	// defaultSkip is true if the rules without an action skip their matches, see parseExp.
+	defaultSkip bool
+	// literals is true if double quotes delimit literals rather than regexes, see readRule.
+	literals bool
+	// warnings are the problems of the spec that the parser finds, see isNextRule.
+	warnings []Warning
 }
 
 func (p *parser) reportError(err error) {
+	p.reportErrorAt(p.line, p.col, err)
+}
+
+// reportErrorAt reports the error at the given position of the spec.
+func (p *parser) reportErrorAt(line, col int, err error) {
 	if err == nil {
 		return
 	}
@@ -69,13 +368,11 @@ func (p *parser) reportError(err error) {
 	if p.err != nil {
 		return
 	}
-	p.err = fmt.Errorf("%d:%d: %w", p.line, p.col, err)
+	p.err = fmt.Errorf("%d:%d: %w", line, col, err)
 }
 
 func (p *parser) newProgram(regexp string) *NexProgram {
-	prog := &NexProgram{Id: p.nextId, Regex: regexp}
-	p.nextId++
-	return prog
+	return &NexProgram{Regex: regexp, Flags: syntax.Perl}
 }
 
 // read returns true if successful.
@@ -168,69 +465,204 @@ func trimSpaces(buf []rune) []rune {
 	return buf[s : e+1]
 }
 
-func (p *parser) readCode() string {
-	nesting := 0
+// readCode reads the code that follows, and returns it with the position of its first rune.
+func (p *parser) readCode() (string, Position) {
+	if !p.mustReadNextNonWs() {
+		return "", Position{}
+	}
 	var buf []rune
-	for ok := p.mustReadNextNonWs(); ok && (p.r != '\n' || nesting > 0); ok = p.read() {
-		buf = append(buf, p.r)
-		switch p.r {
-		case '{':
-			nesting++
-		case '}':
-			nesting--
-			if nesting < 0 {
-				p.reportError(ErrUnmatchedRBrace)
-				return ""
-			}
+	line, col := p.line, p.col
+	code := codeNesting{line: 1, col: 1}
+	for ok := true; ok; ok = p.read() {
+		if p.r == '\n' && p.isCodeComplete(&code, line, col) {
+			break
 		}
+		buf = append(buf, p.r)
+		code.src = utf8.AppendRune(code.src, p.r)
 	}
-
-	if nesting > 0 {
+	if p.err == nil && p.eof && !p.isCodeComplete(&code, line, col) {
 		p.reportError(ErrUnmatchedLBrace)
-		return ""
 	}
+	if p.err != nil {
+		return "", Position{}
+	}
+
+	pos := Position{line, col}
 	buf = trimSpaces(buf)
 	if len(buf) == 0 {
-		return ""
+		return "", Position{}
 	}
 	if buf[0] == '{' && buf[len(buf)-1] == '}' {
+		start := 1
+		for start < len(buf)-1 && isSpace(buf[start]) {
+			start++
+		}
+		pos = pos.advance(buf[:start])
 		buf = trimSpaces(buf[1 : len(buf)-1])
 	}
 	if len(buf) == 0 {
-		return ""
+		return "", Position{}
 	}
-	return string(append(buf, '\n'))
+	return string(append(buf, '\n')), pos
+}
+
+// codeNesting tracks the nesting of the braces of the code that readCode reads, so each line is
+// tokenized once, rather than the whole code at each line.
+type codeNesting struct {
+	src   []byte // The code so far.
+	done  int    // The bytes of src that were tokenized.
+	line  int    // The position of done in the code, from 1:1, like that of a token.Position.
+	col   int
+	depth int // The nesting of the braces of the tokenized code.
 }
 
+// advance marks the bytes of the code up to the offset from done as tokenized.
+func (c *codeNesting) advance(offset int) {
+	for _, b := range c.src[c.done : c.done+offset] {
+		if b == '\n' {
+			c.line, c.col = c.line+1, 1
+		} else {
+			c.col++
+		}
+	}
+	c.done += offset
+}
+
+// isCodeComplete returns true if the code's braces are balanced, and it does not end inside
+// a raw string or a block comment. The code is tokenized, so braces in strings, runes and
+// comments do not count. Only the code after the last complete token is tokenized again, which
+// is the start of a raw string or a block comment that a line does not end. It reports an
+// unmatched '}' at its position, given where the code starts.
+func (p *parser) isCodeComplete(code *codeNesting, line, col int) bool {
+	src := code.src[code.done:]
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		switch tok {
+		case token.EOF:
+			code.advance(len(src))
+			return code.depth == 0
+		case token.LBRACE:
+			code.depth++
+		case token.RBRACE:
+			code.depth--
+			if code.depth < 0 {
+				at := file.Position(pos)
+				atLine, atCol := code.line+at.Line-1, at.Column
+				if at.Line == 1 {
+					atCol += code.col - 1
+				}
+				if atLine > 1 {
+					col = 1
+				}
+				p.reportErrorAt(line+atLine-1, col+atCol-1, ErrUnmatchedRBrace)
+				return true
+			}
+		case token.STRING:
+			if lit[0] == '`' && (len(lit) == 1 || lit[len(lit)-1] != '`') {
+				code.advance(file.Offset(pos))
+				return false
+			}
+		case token.COMMENT:
+			if strings.HasPrefix(lit, "/*") && (len(lit) < 4 || !strings.HasSuffix(lit, "*/")) {
+				code.advance(file.Offset(pos))
+				return false
+			}
+		}
+	}
+}
+
+// readRegex reads a regex, whose opening delimiter was read. A backtick delimits a raw regex,
+// which cannot contain backticks, and in which a backslash before a backtick is part of the regex.
 func (p *parser) readRegex(delim rune) *NexProgram {
-	var regex []rune
-	isEscape := false
-	for ok := p.mustRead(); ok && (p.r != delim || isEscape); ok = p.mustRead() {
-		if '\n' == p.r {
+	regex := regexReader{raw: '`' == delim}
+	line, col := p.line, p.col+1
+	for ok := p.mustRead(); ok && !regex.add(p.r, delim); ok = p.mustRead() {
+		if '\n' == p.r && !regex.freeSpacing {
 			p.reportError(ErrUnexpectedNewline)
 			return nil
 		}
-		isEscape = '\\' == p.r
-		regex = append(regex, p.r)
 	}
 
 	if p.err != nil {
 		return nil
 	}
-	return p.newProgram(string(regex))
+	prog := p.newProgram(string(regex.regex))
+	prog.Line, prog.Column = line, col
+	return prog
+}
+
+// readRule reads the pattern of a rule, whose first rune was read: a regex, or a `"literal"`
+// with `%option literals`.
+func (p *parser) readRule() *NexProgram {
+	if p.literals && '"' == p.r {
+		return p.readLiteral()
+	}
+	return p.readRegex(p.r)
+}
+
+// readLiteral reads a `"literal"`, whose opening quote was read. It may have the escapes of Go strings,
+// and it matches its text exactly, so the text is not parsed as a regex.
+func (p *parser) readLiteral() *NexProgram {
+	line, col := p.line, p.col+1
+	quoted := []rune{'"'}
+	escape := false
+	for ok := p.mustRead(); ok; ok = p.mustRead() {
+		if '\n' == p.r {
+			p.reportError(ErrUnexpectedNewline)
+			return nil
+		}
+		quoted = append(quoted, p.r)
+		if '"' == p.r && !escape {
+			break
+		}
+		escape = !escape && '\\' == p.r
+	}
+	if p.err != nil {
+		return nil
+	}
+	text, err := strconv.Unquote(string(quoted))
+	if err != nil || text == "" {
+		p.err = fmt.Errorf("%d:%d: %w: %s", line, col-1, ErrBadLiteral, string(quoted))
+		return nil
+	}
+	prog := p.newProgram(text)
+	prog.Flags |= syntax.Literal
+	prog.Line, prog.Column = line, col
+	return prog
 }
 
 func (p *parser) isNextSubExp() bool {
 	if !p.mustReadNextNonWs() {
 		return false
 	}
-	isSubExp := '<' == p.r
+	isSubExp := '<' == p.r && p.peekGroupNames() == nil
 	if !isSubExp {
 		p.unread()
 	}
 	return isSubExp
 }
 
+// groupStart matches the rest of the opening of a group: `<NAME>{` or `<NAME,NAME>{`.
+var groupStart = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:,[A-Za-z_][A-Za-z0-9_]*)*)>\{`)
+
+// peekGroupNames returns the rule sets of the group that the current '<' opens, without reading them,
+// or nil if the '<' does not open a group.
+func (p *parser) peekGroupNames() []string {
+	if p.isUnread {
+		return nil
+	}
+	// The opening must fit in the buffer of the reader, so Peek may return less than asked for.
+	buf, _ := p.in.Peek(p.in.Size())
+	m := groupStart.FindSubmatch(buf)
+	if m == nil {
+		return nil
+	}
+	return strings.Split(string(m[1]), ",")
+}
+
 func (p *parser) isNextParam() bool {
 	if !p.mustReadNextNonWs() {
 		return false
@@ -254,83 +686,402 @@ ROOT:
 	(2) PARAM-LIST
 		SUB-EXP
 		USER-CODE
+	(3) PARAM-LIST
+		%%
+		EXP-LIST or SUB-EXP
+		%%
+		USER-CODE
+	In (3), which is like lex, the `%%` lines must only have `%%`, and the second one may be
+	omitted if there is no user code.
 
 EXP:
-	(1) REGEXP CODE
-	(2) REGEXP SUB-EXP
+	(1) PATTERN RULE-PARAMS CODE
+	(2) PATTERN RULE-PARAMS SUB-EXP
+	(3) PATTERN RULE-PARAMS -> TOKEN
+	(4) PATTERN RULE-PARAMS when GUARD { multi line code }
+	(5) PATTERN RULE-PARAMS -> @NAME, for the SUB-EXP of the rule with `%sublexer NAME`
+
+GUARD: a Go boolean expression, up to the opening brace of the code on its line.
+	If it is false when the rule matches, the rule is skipped as if it did not match.
+
+PATTERN:
+	(1) REGEXP
+	(2) "literal", with the escapes of Go strings, with `%option literals`
 
 EXP-LIST:
 	EXP
-	EXP
+	GROUP
 	...
 
+GROUP (tags each of its rules with `%ruleset NAME`):
+	<NAME,...>{
+		EXP-LIST
+	}
+
 SUB-EXP:
 		< CODE
 			EXP-LIST
 		> CODE
 
 REGEXP: DELIM expression DELIM
+	A backslash escapes DELIM, and a double backslash does not.
+	With backticks as DELIM, the expression is raw, and a backslash does not escape them.
+	A free-spacing expression, which starts with (?x), may span lines.
 
 CODE:
 	(1) one line of code
 	(2) { multi line code }
+	(3) ; or { }, to skip the match
+	(4) nothing, before the next rule, to skip the match with `%option default-skip`
 
 PARAM-LIST:
-	% key CODE
+	(1) % key CODE
+	(2) % define NAME REGEXP
+	...
+
+RULE-PARAMS (on the line of the regex):
+	% key VALUE
 	...
 */
 
 func (p *parser) parseRoot() *NexProgram {
 	node := p.newProgram("")
-	node.Parameters = p.parseParamList()
-	if p.isNextSubExp() {
+	p.parseParamList(node)
+	p.defaultSkip = node.HasOption("default-skip")
+	p.literals = node.HasOption("literals")
+	hasRules := true
+	if p.sections {
+		// The rules may be omitted, and so may the user code.
+		hasRules = p.readNextNonWs()
+		p.unread()
+	}
+	switch {
+	case !hasRules:
+	case p.isNextSubExp():
 		p.parseSubExp(node)
-	} else {
+		if p.sections && p.readNextNonWs() {
+			p.readSeparator()
+		}
+	default:
 		node.Children = p.parseExpList(false)
 	}
 	node.UserCode = p.readRemaining()
+	if p.err == nil {
+		p.err = node.checkActions()
+	}
 	return node
 }
 
-func (p *parser) parseParamList() []Parameter {
-	var params []Parameter
+func (p *parser) parseParamList(node *NexProgram) {
 	for p.isNextParam() {
-		var key []rune
-		for ok := p.readNextNonWs(); ok && !isSpace(p.r); ok = p.read() {
-			key = append(key, p.r)
+		if next, _ := p.in.Peek(1); string(next) == "%" {
+			p.readSeparator()
+			p.sections = true
+			return
+		}
+		key := p.readWord()
+		if key == "define" {
+			p.parseDefinition(node)
+			continue
+		}
+		code, _ := p.readCode()
+		node.Parameters = append(node.Parameters, Parameter{key, code})
+	}
+}
+
+// readWord reads the next sequence of non-whitespace runes, up to an opening brace.
+func (p *parser) readWord() string {
+	var word []rune
+	for ok := p.readNextNonWs(); ok && !isSpace(p.r); ok = p.read() {
+		if p.r == '{' {
+			p.unread()
+			break
 		}
-		params = append(params, Parameter{string(trimSpaces(key)), p.readCode()})
+		word = append(word, p.r)
+	}
+	return string(word)
+}
+
+func (p *parser) parseDefinition(node *NexProgram) {
+	line := p.line
+	name := p.readWord()
+	if !isDefinitionName(name) {
+		p.reportError(fmt.Errorf("%w: %q", ErrBadDefinitionName, name))
+		return
+	}
+	if !p.mustReadNextNonWs() {
+		return
+	}
+	def := p.readRegex(p.r)
+	if def == nil {
+		return
+	}
+	node.Definitions = append(node.Definitions, Definition{Name: name, Regex: def.Regex, Line: line})
+}
+
+// readSeparator reads a `%%` line, whose first rune was read.
+func (p *parser) readSeparator() {
+	line, col := p.line, p.col
+	if '%' != p.r || col != 1 || !p.read() || '%' != p.r {
+		p.reportError(fmt.Errorf("%w: expected a %%%% line", ErrBadSection))
+		return
+	}
+	if rest, _ := p.readLine(); strings.TrimSpace(rest) != "" {
+		p.err = fmt.Errorf("%d:3: %w: %q after %%%%", line, ErrBadSection, rest)
 	}
-	return params
 }
 
 func (p *parser) parseSubExp(node *NexProgram) {
-	node.StartCode = p.readCode()
+	node.StartCode, node.StartCodePos = p.readCode()
 	node.Children = p.parseExpList(true)
-	node.EndCode = p.readCode()
+	node.EndCode, node.EndCodePos = p.readCode()
 }
 
 func (p *parser) parseExpList(isSubExp bool) []*NexProgram {
 	var items []*NexProgram
-	for p.mustReadNextNonWs() {
+	for p.readNextRule(isSubExp) {
 		if isSubExp && '>' == p.r {
 			break
 		}
+		if p.sections && !isSubExp && '%' == p.r && p.col == 1 {
+			p.readSeparator()
+			break
+		}
+		if names := p.peekGroupNames(); '<' == p.r && names != nil {
+			items = append(items, p.parseGroup(names)...)
+			continue
+		}
 
-		child := p.readRegex(p.r)
+		child := p.readRule()
+		if child != nil && p.sections && !isSubExp && child.Regex == "" {
+			p.err = fmt.Errorf("%d:%d: %w: an empty regex does not end the rules; a %%%% line does",
+				child.Line, child.Column-1, ErrBadSection)
+			break
+		}
 		if child == nil || (!isSubExp && child.Regex == "") {
 			break
 		}
 		p.parseExp(child)
 		items = append(items, child)
 	}
+	// The rules of each scope are numbered from 1, as 0 is the scope's parent.
+	for i, child := range items {
+		child.Id = i + 1
+	}
+	return items
+}
+
+// readNextRule reads the first rune of the next rule, and returns false at the end of the input.
+// With sections, the end of the input may end the rules of the root.
+func (p *parser) readNextRule(isSubExp bool) bool {
+	if p.sections && !isSubExp {
+		return p.readNextNonWs()
+	}
+	return p.mustReadNextNonWs()
+}
+
+// parseGroup parses the rules of a group, whose '<' was read, and adds its rule sets to them.
+func (p *parser) parseGroup(names []string) []*NexProgram {
+	// Skip the names, up to the opening brace.
+	for p.read() && p.r != '{' {
+	}
+	line, col := p.line, p.col
+	var items []*NexProgram
+	for p.mustReadNextNonWs() && '}' != p.r {
+		if nested := p.peekGroupNames(); '<' == p.r && nested != nil {
+			items = append(items, p.parseGroup(nested)...)
+			continue
+		}
+
+		child := p.readRule()
+		if child == nil {
+			return nil
+		}
+		if child.Regex == "" {
+			p.err = fmt.Errorf("%d:%d: %w", line, col, ErrUnmatchedLBrace)
+			return nil
+		}
+		p.parseExp(child)
+		items = append(items, child)
+	}
+	for _, child := range items {
+		for _, name := range names {
+			child.Parameters = append(child.Parameters, Parameter{"ruleset", name})
+		}
+	}
 	return items
 }
 
 func (p *parser) parseExp(child *NexProgram) {
-	if p.isNextSubExp() {
+	line := p.line
+	p.parseRuleParams(child)
+	if child.Token != "" || child.SubLexer != "" {
+		return
+	}
+	switch {
+	case p.isNextSubExp():
 		p.parseSubExp(child)
-	} else {
-		child.StartCode = p.readCode()
+	case p.line > line && p.isNextRule(child):
+		// The action is omitted, so the next line is not its code, but the next rule. With
+		// `%option default-skip`, the match is skipped, as with ';'.
+		if !p.defaultSkip {
+			p.err = fmt.Errorf("%d:%d: %w: rule on line %d has no action", child.Line, child.Column-1,
+				ErrMissingAction, child.Line)
+		}
+		return
+	default:
+		child.StartCode, child.StartCodePos = p.readCode()
+	}
+	if child.StartCode == ";\n" {
+		// Like in lex, the match is skipped.
+		child.StartCode, child.StartCodePos = "", Position{}
+	}
+}
+
+// isNextRule returns true if the current rune, which was unread, starts a rule, or ends the
+// rules of a scope or of a group, or of the root with sections, rather than code. A line that
+// only may start a rule, as it is indented deeper than the rule before it or starts with an
+// identifier, like `n = n % 2`, is the code of that rule, with a warning.
+func (p *parser) isNextRule(prev *NexProgram) bool {
+	switch p.r {
+	case '>', '}':
+		return true
+	case '%':
+		return p.sections && p.col == 1
+	}
+	if !p.isNextRegex() {
+		return false
+	}
+	if p.col > prev.Column-1 || '_' == p.r || unicode.IsLetter(p.r) || unicode.IsDigit(p.r) {
+		p.warnings = append(p.warnings, Warning{Line: p.line, Column: p.col, Err: fmt.Errorf(
+			"%w: line %d may be a rule rather than the action of the rule on line %d",
+			ErrMissingAction, p.line, prev.Line)})
+		return false
+	}
+	return true
+}
+
+// isNextRegex returns true if the current rune, which was unread, starts a regex that the rest of
+// its line may follow in a rule, like `!b! { }`, or if it starts the empty regex that ends the rules.
+// A line of code, like `// comment` or `n++`, is not one. The regex is read from the buffered input,
+// which is only peeked at.
+func (p *parser) isNextRegex() bool {
+	buf, _ := p.in.Peek(p.in.Size())
+	text := string(buf)
+	regex := regexReader{raw: '`' == p.r}
+	for i, r := range text {
+		if '\n' == r && !regex.freeSpacing {
+			return false
+		}
+		if !regex.add(r, p.r) {
+			continue
+		}
+		rest := strings.TrimLeft(text[i+utf8.RuneLen(r):], " \t\r")
+		if rest == "" || rest[0] == '\n' {
+			return true
+		}
+		if len(regex.regex) == 0 {
+			return false
+		}
+		for _, next := range []string{"{", ";", "<", "->", "%", "when ", "when\t"} {
+			if strings.HasPrefix(rest, next) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// parseRuleParams reads the `%key value` annotations that follow a regex on its line,
+// and the `-> TOKEN` shorthand, which must be last.
+func (p *parser) parseRuleParams(child *NexProgram) {
+	for p.read() {
+		if p.r == ' ' || p.r == '\t' {
+			continue
+		}
+		if p.r == '-' {
+			p.parseToken(child)
+			return
+		}
+		if p.r == 'w' && p.isNextWord("hen") {
+			p.parseGuard(child)
+			return
+		}
+		if p.r != '%' {
+			p.unread()
+			return
+		}
+		key, value := p.readWord(), p.readWord()
+		if key == "" || value == "" {
+			p.reportError(fmt.Errorf("%w: %%%s %s", ErrBadRuleParam, key, value))
+			return
+		}
+		child.Parameters = append(child.Parameters, Parameter{key, value})
+	}
+}
+
+// isNextWord returns true if the given runes follow the current one, and then a space.
+func (p *parser) isNextWord(rest string) bool {
+	if p.isUnread {
+		return false
+	}
+	buf, _ := p.in.Peek(len(rest) + 1)
+	return len(buf) == len(rest)+1 && string(buf[:len(rest)]) == rest && isSpace(rune(buf[len(rest)]))
+}
+
+// parseGuard reads the guard of `when GUARD {`, after the 'w', up to the opening brace of the code.
+func (p *parser) parseGuard(child *NexProgram) {
+	for range len("hen") {
+		p.read()
+	}
+	var guard []rune
+	for p.mustRead() && p.r != '{' {
+		if p.r == '\n' {
+			p.reportError(fmt.Errorf("%w: expected '{' after the guard", ErrBadGuard))
+			return
+		}
+		if len(guard) == 0 && isSpace(p.r) {
+			continue
+		}
+		if len(guard) == 0 {
+			child.GuardPos = Position{p.line, p.col}
+		}
+		guard = append(guard, p.r)
+	}
+	if p.err != nil {
+		return
+	}
+	p.unread()
+	child.Guard = string(trimSpaces(guard))
+	if child.Guard == "" {
+		p.reportError(fmt.Errorf("%w: empty guard", ErrBadGuard))
+	}
+}
+
+// parseToken reads the name of `-> TOKEN`, after the '-'. The rule's code returns the token.
+// It reads the name of the sub-lexer of `-> @NAME` as well.
+func (p *parser) parseToken(child *NexProgram) {
+	if !p.mustRead() {
+		return
+	}
+	if p.r != '>' {
+		p.reportError(fmt.Errorf("%w: expected '->'", ErrBadTokenName))
+		return
+	}
+	name := p.readWord()
+	if ref, ok := strings.CutPrefix(name, "@"); ok {
+		if !isDefinitionName(ref) {
+			p.reportError(fmt.Errorf("%w: %q", ErrBadSubLexer, name))
+			return
+		}
+		child.SubLexer = ref
+		return
+	}
+	if !isDefinitionName(name) {
+		p.reportError(fmt.Errorf("%w: %q", ErrBadTokenName, name))
+		return
 	}
+	child.Token = name
+	child.StartCode = "return " + name + "\n"
 }
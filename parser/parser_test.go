@@ -0,0 +1,949 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liran-funaro/nex/graph"
+	"github.com/stretchr/testify/require"
+)
+
+// explodingGrammar requires 2^10 DFA states to remember the last 10 runes.
+const explodingGrammar = `/(a|b)*a(a|b)(a|b)(a|b)(a|b)(a|b)(a|b)(a|b)(a|b)(a|b)/ { }
+//
+package main
+`
+
+func TestCompileWithLimits(t *testing.T) {
+	for _, x := range []struct {
+		name   string
+		limits Limits
+		limit  string
+	}{
+		{"states", Limits{MaxStates: 100}, "dfa-states"},
+		{"nfa nodes", Limits{MaxNFANodes: 10}, "nfa-nodes"},
+		{"timeout", Limits{Timeout: time.Nanosecond}, "timeout"},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			_, err := CompileWithLimits(strings.NewReader(explodingGrammar), x.limits)
+			require.ErrorIs(t, err, graph.ErrLimitExceeded)
+			var limitErr *graph.LimitError
+			require.True(t, errors.As(err, &limitErr))
+			require.Equal(t, x.limit, limitErr.Limit)
+		})
+	}
+
+	program, err := CompileWithLimits(strings.NewReader(explodingGrammar), Limits{MaxStates: 10000})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(program.DFA), 1<<10)
+}
+
+func TestCanceledCompilation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	spec := "/if/ { }\n" + explodingGrammar
+	_, err := ParseNexContext(ctx, strings.NewReader(spec), Options{Progress: func(p Progress) {
+		if p.DFAStates >= 100 {
+			cancel()
+		}
+	}})
+	require.ErrorIs(t, err, context.Canceled)
+	var cErr *graph.CanceledError
+	require.ErrorAs(t, err, &cErr)
+	require.GreaterOrEqual(t, cErr.States, 100)
+	require.Less(t, cErr.States, 1<<10)
+	require.Equal(t, []int{2, 1}, cErr.Rules)
+	require.ErrorContains(t, err, "states; most states come from /(a|b)*a")
+	require.ErrorContains(t, err, "/ at line 2, /if/ at line 1")
+}
+
+func TestProgress(t *testing.T) {
+	var phases []string
+	var last Progress
+	program, err := ParseNexWithOptions(strings.NewReader(explodingGrammar), Options{Progress: func(p Progress) {
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+		require.GreaterOrEqual(t, p.DFAStates, last.DFAStates)
+		last = p
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"parse", "nfa", "dfa"}, phases)
+	require.Equal(t, 1, last.Rules)
+	require.Equal(t, len(program.NFA), last.NFANodes)
+	require.Equal(t, len(program.DFA), last.DFAStates)
+}
+
+func TestStats(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("/a/ < { }\n  /b/ { }\n> { }\n/c+/ { }\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, len(program.NFA), program.NFAStats.NFANodes)
+	require.Equal(t, len(program.DFA), program.DFAStats.DFAStates)
+	require.Positive(t, program.DFAStats.Duration)
+
+	kid := program.Children[0]
+	s := program.Stats()
+	require.Equal(t, 2, s.Automata)
+	require.Equal(t, len(program.NFA)+len(kid.NFA), s.NFANodes)
+	require.Equal(t, len(program.DFA)+len(kid.DFA), s.DFAStates)
+	require.Equal(t, program.NFAStats.Duration+kid.NFAStats.Duration, s.NFATime)
+}
+
+func TestUnsupportedRegex(t *testing.T) {
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ {}\n  /ab*?c/ {}\n", "2:6: rule /ab*?c/: unsupported regex construct: non-greedy repetition (at offset 2)"},
+		{"/(?U)a*/ {}\n", "1:2: rule /(?U)a*/: unsupported regex construct: non-greedy repetition (at offset 0)"},
+		{`/(a)\1/ {}`, `1:5: rule /(a)\1/: unsupported regex construct: backreference \1 (at offset 3)`},
+		{`/x[^\x00-\x{10FFFF}]/ {}`, `1:3: rule /x[^\x00-\x{10FFFF}]/: unsupported regex construct: character class that matches nothing (at offset 1)`},
+		{"/a/ < {}\n  /b{2,1}/ {}\n> {}\n", "2:5: rule /b{2,1}/: error parsing regexp: invalid repeat count: `{2,1}` (at offset 1)"},
+		{`/\{2,1}a{2,1}/ {}`, "1:9: rule /\\{2,1}a{2,1}/: error parsing regexp: invalid repeat count: `{2,1}` (at offset 7)"},
+		{`/\\1(a)\1/ {}`, `1:8: rule /\\1(a)\1/: unsupported regex construct: backreference \1 (at offset 6)`},
+		{"%define LAZY /x*?/\n/ab{LAZY}/ {}\n", "2:4: rule /ab{LAZY}/: unsupported regex construct: non-greedy repetition (at offset 2)"},
+		{"%define X /x/\n/{X}(a)\\1/ {}\n", "2:8: rule /{X}(a)\\1/: unsupported regex construct: backreference \\1 (at offset 6)"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec + "\n//\n"))
+		var rErr *graph.RegexError
+		require.ErrorAs(t, err, &rErr)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestFreeSpacing(t *testing.T) {
+	spec := `/(?x)
+  [0-9]+        # The integer part, with a / that does not end the regex.
+  ( \. [0-9]* )? # The fraction.
+  [ ]\ \#       # Escaped spaces and classes are kept.
+/ { }
+/(?ix) if \b/ { }
+/[[:alpha:] ] x/ { }
+//
+`
+	program, err := ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	var regexes []string
+	for _, kid := range program.Children {
+		regexes = append(regexes, kid.Regex)
+	}
+	require.Equal(t, []string{`[0-9]+(\.[0-9]*)?[ ]\ \#`, `(?i)if\b`, `[[:alpha:] ] x`}, regexes)
+	require.Equal(t, 6, program.Children[1].Line)
+
+	_, err = ParseNex(strings.NewReader("/a\n  b/ { }\n//\n"))
+	require.ErrorIs(t, err, ErrUnexpectedNewline)
+}
+
+func TestFuzzDictionary(t *testing.T) {
+	spec := `/if|in|else/ { }
+/[0-9]+(\.[0-9]*)?/ { }
+/"[^"\n]*"/ { }
+/[ \t]/ < { }
+  /\n/ { }
+> { }
+//
+`
+	program, err := ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, program.WriteFuzzDictionary(&buf))
+	require.Equal(t, `# 1: /if|in|else/
+"if"
+"in"
+"else"
+"i"
+# 2: /[0-9]+(\.[0-9]*)?/
+"0"
+"."
+# 3: /"[^"\n]*"/
+"\"\""
+"\""
+# 4: /[ \t]/
+"\x09"
+" "
+# 5: /\n/
+"\x0A"
+`, buf.String())
+}
+
+func TestDefinitions(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%define DIGIT /[0-9]/
+%define NUMBER _{DIGIT}+(\.{DIGIT}*)?_
+/{NUMBER}/ {}
+/[{DIGIT}]\{DIGIT}{UNDEFINED}/ {}
+//
+`))
+	require.NoError(t, err)
+	require.Equal(t, `(?:(?:[0-9])+(\.(?:[0-9])*)?)`, program.Children[0].Regex)
+	require.Equal(t, `[{DIGIT}]\{DIGIT}{UNDEFINED}`, program.Children[1].Regex)
+	require.Equal(t, []int{1, 2}, []int{program.Children[0].Id, program.Children[1].Id})
+
+	_, err = ParseNex(strings.NewReader(`%define A /a{B}/
+%define B /b{C}/
+%define C /c{A}/
+/{A}/ {}
+//
+`))
+	require.ErrorIs(t, err, ErrDefinitionCycle)
+	require.EqualError(t, err, "1:1: definition cycle: {A} -> {B} -> {C} -> {A}")
+}
+
+func TestExtends(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base.nex"), []byte(`%define WORD /[a-z]+/
+%field count int
+/{WORD}/ { base_word() }
+/[0-9]+/ { base_number() }
+/./ { base_other() }
+/"[^"]*"/ -> STRING
+//
+package main
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cycle.nex"), []byte("%extends cycle.nex\n/a/ {}\n//\n"), 0o644))
+
+	program, err := ParseNexWithOptions(strings.NewReader(`%extends base.nex
+%define WORD /[a-z_]+/
+/[0-9]+/ { derived_number() }
+/\n/ { derived_newline() }
+/'[^']*'/ -> STRING
+//
+`), Options{Dir: dir})
+	require.NoError(t, err)
+	require.Equal(t, []Parameter{{"field", "count int\n"}}, program.Parameters)
+	var rules []string
+	for _, x := range program.Children {
+		rules = append(rules, fmt.Sprintf("%d %s %s", x.Id, x.Regex, strings.TrimSpace(x.StartCode)))
+	}
+	require.Equal(t, []string{
+		"1 (?:[a-z_]+) base_word()",
+		"2 [0-9]+ derived_number()",
+		"3 . base_other()",
+		"4 '[^']*' return STRING",
+		`5 \n derived_newline()`,
+	}, rules)
+	require.Equal(t, "package main\n", program.UserCode)
+
+	_, err = ParseNexWithOptions(strings.NewReader("%extends cycle.nex\n//\n"), Options{Dir: dir})
+	require.ErrorIs(t, err, ErrExtendsCycle)
+}
+
+func TestLiterals(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%option literals
+%define X /x/
+"if" { }
+"a.b{X}" { }
+"\"\t" { }
+/[a-z]+/ { }
+//
+`))
+	require.NoError(t, err)
+	var rules []string
+	for _, x := range program.Children {
+		rules = append(rules, fmt.Sprintf("%d:%d %q %v", x.Line, x.Column, x.Regex, x.IsLiteral()))
+	}
+	require.Equal(t, []string{`3:2 "if" true`, `4:2 "a.b{X}" true`, `5:2 "\"\t" true`, `6:2 "[a-z]+" false`}, rules)
+
+	// Without the option, double quotes delimit a regex, and an empty one ends the rules.
+	program, err = ParseNex(strings.NewReader("\"\\s+\" { }\n\"\"\n"))
+	require.NoError(t, err)
+	require.Len(t, program.Children, 1)
+	require.Equal(t, `\s+`, program.Children[0].Regex)
+	require.False(t, program.Children[0].IsLiteral())
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"\"\" { }\n", `2:1: bad literal: ""`},
+		{"/a/ { }\n\"\\q\" { }\n", `3:1: bad literal: "\q"`},
+		{"\"if\n\" { }\n", "3:0: unexpected newline"},
+	} {
+		_, err := ParseNex(strings.NewReader("%option literals\n" + x.spec + "//\n"))
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`/if/ %name ruleIf { }
+/"[^"\t]*"/ < { }
+  /\t/ { }
+> { }
+//
+`))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, program.WriteSymbols(&buf))
+	require.Equal(t, `# scope	rule	position	name	regex
+0	1	1:2	ruleIf	"if"
+0	2	2:2	-	"\"[^\"\\t]*\""
+1	1	3:4	-	"\\t"
+`, buf.String())
+}
+
+func TestRuleSetTable(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%init { yylex.EnableRuleSet("code") }
+/<%/ %name ruleOpen { _ = yylex.EnableRuleSet("code") }
+<code>{
+  /%>/ { yylex.DisableRuleSet("code"); yylex.EnableRuleSet(name) }
+  /"[^"]*"/ < { }
+    /\\./ %ruleset code { }
+  > { yylex.DisableRuleSet("code") }
+}
+//
+`))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, program.WriteRuleSetTable(&buf))
+	var table RuleSetTable
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &table))
+	require.Equal(t, RuleSetTable{
+		RuleSets: []RuleSetEntry{{Name: "code", Rules: []RuleRef{
+			{Scope: 0, Rule: 2, Regex: "%>", Line: 4, Column: 4},
+			{Scope: 0, Rule: 3, Regex: `"[^"]*"`, Line: 5, Column: 4},
+			{Scope: 1, Rule: 1, Regex: `\\.`, Line: 6, Column: 6},
+		}}},
+		Transitions: []RuleSetTransition{
+			{From: RuleRef{}, RuleSet: "code", Enable: true},
+			{From: RuleRef{Rule: 1, Name: "ruleOpen", Regex: "<%", Line: 2, Column: 2}, RuleSet: "code", Enable: true},
+			{From: RuleRef{Rule: 2, Regex: "%>", Line: 4, Column: 4}, RuleSet: "code"},
+			{From: RuleRef{Rule: 3, Regex: `"[^"]*"`, Line: 5, Column: 4}, End: true, RuleSet: "code"},
+		},
+	}, table)
+}
+
+func TestPrefixAndPackage(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("%prefix Calc\n%package  calclexer \n/a/ { }\n//\nfunc f() {}\n"))
+	require.NoError(t, err)
+	require.Equal(t, "Calc", program.Prefix())
+	require.Equal(t, "calclexer", program.Package())
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"%prefix 1x\n/a/ { }\n//\n", `bad prefix: "1x"`},
+		{"%package calc-lexer\n/a/ { }\n//\n", `bad package: "calc-lexer"`},
+		{"%package calclexer\n/a/ { }\n//\npackage main\n", `bad package: "calclexer", but the code is in package "main"`},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec))
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestFlex(t *testing.T) {
+	program, err := ParseNexWithOptions(strings.NewReader(`/* A flex file. */
+%{
+package main
+%}
+%option noyywrap case-insensitive
+DIGIT    [0-9]
+ID       [a-z][a-z0-9]*
+
+%%
+{DIGIT}+      { println("int") }
+"a.b"|"+"     println("op")
+if |
+then          {
+  println("keyword")
+}
+{ID}          println("id")
+[ \t\n]+      ;
+  /* Comments may be indented. */
+[]"]          println("bracket")
+%%
+func main() {}
+`), Options{Flex: true})
+	require.NoError(t, err)
+	var rules []string
+	for _, x := range program.Children {
+		rules = append(rules, fmt.Sprintf("%d %d:%d %s %s", x.Id, x.Line, x.Column, x.Regex, strings.TrimSpace(x.StartCode)))
+	}
+	require.Equal(t, []string{
+		`1 10:1 (?:[0-9])+ println("int")`,
+		`2 11:1 a\.b|\+ println("op")`,
+		`3 12:1 if println("keyword")`,
+		`4 13:1 then println("keyword")`,
+		`5 16:1 (?:[a-z][a-z0-9]*) println("id")`,
+		`6 17:1 [ \t\n]+ `,
+		`7 19:1 []"] println("bracket")`,
+	}, rules)
+	require.True(t, program.HasOption("caseless"))
+	require.Equal(t, "package main\nfunc main() {}\n", program.UserCode)
+
+	// Like the default rule of flex, the unmatched text is echoed, unless %option nodefault is set.
+	// ECHO in an action echoes the match, but not in strings, comments or selectors.
+	program, err = ParseNexWithOptions(strings.NewReader(`%%
+a    ECHO; ECHO
+b    { x.ECHO(); println("ECHO") /* ECHO */ }
+%%
+`), Options{Flex: true})
+	require.NoError(t, err)
+	require.True(t, program.HasOption("echo"))
+	require.Equal(t, "yylex.Echo(); yylex.Echo()", strings.TrimSpace(program.Children[0].StartCode))
+	require.Equal(t, `x.ECHO(); println("ECHO") /* ECHO */`, strings.TrimSpace(program.Children[1].StartCode))
+
+	program, err = ParseNexWithOptions(strings.NewReader("%option nodefault\n%%\na ;\n"), Options{Flex: true})
+	require.NoError(t, err)
+	require.False(t, program.HasOption("echo"))
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"%%\na/b ;\n", "2:1: unsupported flex construct: trailing context"},
+		{"%x STR\n%%\n", "1:1: unsupported flex construct: %x"},
+		{"%%\n<STR>a ;\n", "2:1: unsupported flex construct: start conditions and <<EOF>> rules"},
+		{"%%\na |\n", "2:1: unsupported flex construct: the action of the last rule is '|'"},
+		{"%%\n\"a ;\n", "2:1: unsupported flex construct: unterminated quote"},
+	} {
+		_, err := ParseNexWithOptions(strings.NewReader(x.spec), Options{Flex: true})
+		require.ErrorIs(t, err, ErrFlexUnsupported)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestSections(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%field n int
+%%
+/a/ { }
+ %x%  { }
+/b/ < { }
+  // { }
+> { }
+%%
+package main
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Parameter{{"field", "n int\n"}}, program.Parameters)
+	require.Len(t, program.Children, 3)
+	require.Equal(t, "x", program.Children[1].Regex)
+	require.Equal(t, "package main\n", program.UserCode)
+
+	// The second separator may be omitted, and so may the rules.
+	program, err = ParseNex(strings.NewReader("%%\n< { }\n  /a/ { }\n> { }\n"))
+	require.NoError(t, err)
+	require.Len(t, program.Children, 1)
+	program, err = ParseNex(strings.NewReader("%%\n"))
+	require.NoError(t, err)
+	require.Empty(t, program.Children)
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"%%\n/a/ { }\n//\npackage main\n", "3:1: bad section: an empty regex does not end the rules; a %% line does"},
+		{"%%\n/a/ { }\n%x\npackage main\n", "3:2: bad section: expected a %% line"},
+		{"%% rules\n/a/ { }\n", `1:3: bad section: " rules" after %%`},
+		{"%%\n< { }\n> { }\n/a/ { }\n", "4:1: bad section: expected a %% line"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec))
+		require.ErrorIs(t, err, ErrBadSection)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestMissingAction(t *testing.T) {
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/\n/b/ { }\n//\n", "1:1: missing action: rule on line 1 has no action"},
+		{"/a/ %name ruleA\n//\n", "1:1: missing action: rule on line 1 has no action"},
+		{"/a/ { }\n\"b\"\n\n/c/ { }\n//\n", "2:1: missing action: rule on line 2 has no action"},
+		{"/a/ < { }\n  /b/\n> { }\n//\n", "2:3: missing action: rule on line 2 has no action"},
+		{"<x>{\n  /a/\n}\n//\n", "2:3: missing action: rule on line 2 has no action"},
+		{"%%\n/a/\n%%\npackage main\n", "2:1: missing action: rule on line 2 has no action"},
+		{"/a/\n!b! { }\n//\n", "1:1: missing action: rule on line 1 has no action"},
+		{"/a/\n'b' -> B\n//\n", "1:1: missing action: rule on line 1 has no action"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec))
+		require.ErrorIs(t, err, ErrMissingAction)
+		require.EqualError(t, err, x.err)
+	}
+
+	// Code on the next line is still the action.
+	program, err := ParseNex(strings.NewReader("/a/\n  { return 1 }\n/b/\n  n++\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, "return 1\n", program.Children[0].StartCode)
+	require.Equal(t, "n++\n", program.Children[1].StartCode)
+
+	// So is a comment, which is not the empty regex that ends the rules.
+	program, err = ParseNex(strings.NewReader("/a/\n  // skipped\n/b/ { }\n//\n"))
+	require.NoError(t, err)
+	require.Len(t, program.Children, 2)
+	require.Equal(t, "// skipped\n", program.Children[0].StartCode)
+
+	// A line that only may be a rule, as it is indented or starts with an identifier, is code,
+	// with a warning.
+	program, err = ParseNex(strings.NewReader("/a/\n  n = n % 2\n/b/\nx = x % 2\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, "n = n % 2\n", program.Children[0].StartCode)
+	require.Equal(t, "x = x % 2\n", program.Children[1].StartCode)
+	var warnings []string
+	for _, w := range program.Warnings {
+		require.ErrorIs(t, w.Err, ErrMissingAction)
+		warnings = append(warnings, w.String())
+	}
+	require.Equal(t, []string{
+		"2:3: missing action: line 2 may be a rule rather than the action of the rule on line 1",
+		"4:1: missing action: line 4 may be a rule rather than the action of the rule on line 3",
+	}, warnings)
+
+	// With `%option default-skip`, the rules without an action skip their matches.
+	program, err = ParseNex(strings.NewReader("%option default-skip\n/a/\n/b/ < { }\n  /c/\n> { }\n/d/ { return 1 }\n//\n"))
+	require.NoError(t, err)
+	require.Len(t, program.Children, 3)
+	require.Empty(t, program.Children[0].StartCode)
+	require.Len(t, program.Children[1].Children, 1)
+	require.Empty(t, program.Children[1].Children[0].StartCode)
+	require.Equal(t, "return 1\n", program.Children[2].StartCode)
+}
+
+func TestGroups(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`/a/ { }
+<x,y>{
+  /b/ %ruleset z { }
+  <w>{ /c/ { }
+  }
+}
+/d/ { }
+//
+`))
+	require.NoError(t, err)
+	require.Len(t, program.Children, 4)
+	require.Equal(t, map[string][]int{"w": {3}, "x": {2, 3}, "y": {2, 3}, "z": {2}}, program.RuleSets())
+	require.Equal(t, []Parameter{{"ruleset", "z"}, {"ruleset", "x"}, {"ruleset", "y"}}, program.Children[1].Parameters)
+	require.Equal(t, "d", program.Children[3].Regex)
+
+	_, err = ParseNex(strings.NewReader("/a/ { }\n<x>{\n  /b/ { }\n//\n"))
+	require.ErrorIs(t, err, ErrUnmatchedLBrace)
+	require.EqualError(t, err, "2:4: unmatched '{'")
+}
+
+func TestSubLexers(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`/'[^']*'/ -> @str
+/"[^"]*"/ %sublexer str < { open() }
+  /\\./ %name ruleEscape { }
+  /x/ -> @inner
+> { close() }
+/[a-z]+/ %sublexer inner < { }
+  /y/ { }
+> { }
+//
+`))
+	require.NoError(t, err)
+	ref, def := program.Children[0], program.Children[1]
+	require.Equal(t, "str", ref.SubLexer)
+	require.Equal(t, def.StartCode, ref.StartCode)
+	require.Equal(t, def.EndCode, ref.EndCode)
+	require.Len(t, ref.Children, 2)
+	require.NotSame(t, def.Children[0], ref.Children[0])
+	require.Equal(t, def.Children[0].Regex, ref.Children[0].Regex)
+	require.Empty(t, ref.Children[0].RuleName())
+	require.Equal(t, "y", ref.Children[1].Children[0].Regex)
+	require.Len(t, program.Scopes(), 6)
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ -> @b\n", "1:2: bad sub-lexer: @b is not defined"},
+		{"/a/ -> @\n", `2:0: bad sub-lexer: "@"`},
+		{"/a/ %sublexer b { }\n", "1:2: bad sub-lexer: @b has no nested rules"},
+		{"/a/ %sublexer b < { }\n  /c/ { }\n> { }\n/d/ %sublexer b < { }\n  /c/ { }\n> { }\n", "4:2: bad sub-lexer: @b is already defined at line 1"},
+		{"/a/ %sublexer b < { }\n  /c/ -> @b\n> { }\n", "2:4: bad sub-lexer: @b refers to itself"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec + "//\n"))
+		require.ErrorIs(t, err, ErrBadSubLexer)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestRegexEscapes(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("/a\\// { }\n/b\\\\/ { }\n/c\\\\\\// { }\n`d/\\w+` { }\n`e\\\\` { }\n//\n"))
+	require.NoError(t, err)
+	var regexes []string
+	for _, x := range program.Children {
+		regexes = append(regexes, x.Regex)
+	}
+	require.Equal(t, []string{`a\/`, `b\\`, `c\\\/`, `d/\w+`, `e\\`}, regexes)
+
+	// A raw regex ends at the first backtick.
+	_, err = ParseNex(strings.NewReader("`f\\` { }\n//\n"))
+	require.EqualError(t, err, "1:3: rule /f\\/: error parsing regexp: trailing backslash at end of expression: `` (at offset 1)")
+}
+
+func TestRegexFlags(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%option literals
+%flags dotnl -oneline nongreedy
+%flags -nongreedy -unicode
+/a.b/ { }
+"a.b" { }
+//
+`))
+	require.NoError(t, err)
+	require.Equal(t, syntax.Perl&^(syntax.OneLine|syntax.UnicodeGroups)|syntax.DotNL, program.Children[0].Flags)
+	require.Equal(t, syntax.Perl&^(syntax.OneLine|syntax.UnicodeGroups)|syntax.DotNL|syntax.Literal, program.Children[1].Flags)
+
+	// The flags of %option caseless are set as well.
+	program, err = ParseNex(strings.NewReader("%option caseless\n%flags dotnl\n/a.b/ { }\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, syntax.Perl|syntax.DotNL|syntax.FoldCase, program.Children[0].Flags)
+
+	_, err = ParseNex(strings.NewReader("%flags dotnl -multiline\n/a/ { }\n//\n"))
+	require.ErrorIs(t, err, ErrUnknownFlag)
+	require.EqualError(t, err, `unknown regex flag: "-multiline"`)
+}
+
+func TestRuleFlags(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`%option caseless
+%flags dotnl
+/a.b/ %flags -i,-s { }
+/a.b/ %flags U,m { }
+/a.b/ %flags nongreedy,-caseless %name ruleA < { }
+  /c/ { }
+> { }
+//
+`))
+	require.NoError(t, err)
+	require.Equal(t, syntax.Perl, program.Children[0].Flags)
+	require.Equal(t, syntax.Perl&^syntax.OneLine|syntax.DotNL|syntax.FoldCase|syntax.NonGreedy, program.Children[1].Flags)
+	require.Equal(t, syntax.Perl|syntax.DotNL|syntax.NonGreedy, program.Children[2].Flags)
+	// The rules of a nested scope have the flags of the spec.
+	require.Equal(t, syntax.Perl|syntax.DotNL|syntax.FoldCase, program.Children[2].Children[0].Flags)
+
+	_, err = ParseNex(strings.NewReader("/a/ { }\n/b/ %flags i,x { }\n//\n"))
+	require.ErrorIs(t, err, ErrUnknownFlag)
+	require.EqualError(t, err, `2:2: unknown regex flag: "x"`)
+}
+
+func TestGuards(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`/[a-z]+/ %name ident when  yylex.inMacro && !yylex.done { }
+/[a-z]+/ { }
+/!/ when{ }
+//
+`))
+	require.NoError(t, err)
+	x := program.Children[0]
+	require.Equal(t, "yylex.inMacro && !yylex.done", x.Guard)
+	require.Equal(t, Position{1, 28}, x.GuardPos)
+	require.Equal(t, "ident", x.RuleName())
+	require.Equal(t, []*NexProgram{x}, program.Guarded())
+	// The guarded rule may be skipped, so it does not shadow the next one.
+	require.Empty(t, program.Warnings)
+	require.Equal(t, "when{ }\n", program.Children[2].StartCode)
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ when x { }\n/b/ when x ==  { }\n", "2:14: bad guard: expected operand, found 'EOF'"},
+		{"/a/ when x.y)z { }\n", "1:13: bad guard: expected 'EOF', found ')'"},
+		{"/a/ when { }\n", "1:10: bad guard: empty guard"},
+		{"/a/ when x\n{ }\n", "2:0: bad guard: expected '{' after the guard"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec + "//\n"))
+		require.ErrorIs(t, err, ErrBadGuard)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestRuleIds(t *testing.T) {
+	program, err := ParseNex(strings.NewReader(`/a/ < { }
+  /b/ { }
+  /c/ %name ruleC { }
+> { }
+/d/ < { }
+  /e/ { }
+> { }
+
+/f/ %name ruleF { }
+//
+`))
+	require.NoError(t, err)
+	var ids []string
+	for _, scope := range program.Scopes() {
+		for _, x := range scope.Children {
+			ids = append(ids, fmt.Sprintf("%s:%d", x.Regex, x.Id))
+		}
+	}
+	require.Equal(t, []string{"a:1", "d:2", "f:3", "b:1", "c:2", "e:1"}, ids)
+	require.Equal(t, "ruleC", program.Children[0].Children[1].RuleName())
+	require.Equal(t, 6, program.RuleCount())
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ %name 1a { }\n", `1:2: bad rule name: "1a"`},
+		{"/a/ %name x { }\n/b/ < { }\n  /c/ %name x { }\n> { }\n", `3:4: bad rule name: "x" is the name of another rule`},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec + "//\n"))
+		require.ErrorIs(t, err, ErrBadRuleName)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestCodeBraces(t *testing.T) {
+	spec := "/a/ { s := \"}\"; r := '{' /* } */ }\n" +
+		"/b/ {\n  s := `{\n}}`\n}\n" +
+		"//\n"
+	program, err := ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	require.Equal(t, "s := \"}\"; r := '{' /* } */\n", program.Children[0].StartCode)
+	require.Equal(t, "s := `{\n}}`\n", program.Children[1].StartCode)
+
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ { }\n/b/ { f() } }\n", "2:13: unmatched '}'"},
+		{"/a/ {\n  x := \"}\"\n  }}\n", "3:4: unmatched '}'"},
+		{"/a/ { s := `{\n  ` }}\n", "2:6: unmatched '}'"},
+		{"/a/ { `}\n", "2:0: unmatched '{'"},
+		{"/a/ { /* } */\n", "2:0: unmatched '{'"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec))
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestActionSyntax(t *testing.T) {
+	for _, x := range []struct {
+		spec, err string
+	}{
+		{"/a/ { x := }\n", "1:11: bad action code: expected operand, found '}'"},
+		{"/a/ {\n  f(\n  x := 1\n}\n", "3:5: bad action code: missing ',' in argument list"},
+		{"/a/ < { }\n  /b/ { ok() }\n> { return return }\n", "3:12: bad action code: expected operand, found 'return'"},
+	} {
+		_, err := ParseNex(strings.NewReader(x.spec + "//\n"))
+		require.ErrorIs(t, err, ErrBadAction)
+		require.EqualError(t, err, x.err)
+	}
+}
+
+func TestRuleParams(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("/a/ %ruleset x %ruleset y { }\n/b/\t%ruleset y\n{ }\n/c/ { }\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, []Parameter{{"ruleset", "x"}, {"ruleset", "y"}}, program.Children[0].Parameters)
+	require.Equal(t, map[string][]int{"x": {1}, "y": {1, 2}}, program.RuleSets())
+	require.Equal(t, 3, program.RuleCount())
+
+	_, err = ParseNex(strings.NewReader("/a/ % { }\n//\n"))
+	require.ErrorIs(t, err, ErrBadRuleParam)
+}
+
+func TestSkipAction(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("/ +/ ;\n/a/\n  ;\n/b/ { ; }\n//\n"))
+	require.NoError(t, err)
+	var codes []string
+	for _, x := range program.Children {
+		codes = append(codes, x.StartCode)
+	}
+	require.Equal(t, []string{"", "", ""}, codes)
+}
+
+func TestTokens(t *testing.T) {
+	program, err := ParseNex(strings.NewReader("/[0-9]+/ -> NUMBER\n/[a-z]+/ %ruleset x ->IDENT\n/0x[0-9]+/ -> NUMBER\n/ / { }\n//\n"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"NUMBER", "IDENT"}, program.Tokens())
+	require.Equal(t, "return IDENT\n", program.Children[1].StartCode)
+	require.Equal(t, []Parameter{{"ruleset", "x"}}, program.Children[1].Parameters)
+
+	for _, spec := range []string{"/a/ -> 1A\n//\n", "/a/ - A\n//\n", "/a/ ->\n//\n"} {
+		_, err = ParseNex(strings.NewReader(spec))
+		require.ErrorIs(t, err, ErrBadTokenName, spec)
+	}
+}
+
+func TestYaccTokens(t *testing.T) {
+	grammar := `%{
+package main
+// %token NOT_A_TOKEN
+%}
+%union { n int }
+%token <n> NUMBER IDENT /* a comment */
+	PLUS
+%token '-' EOL
+%left PLUS
+%%
+expr: NUMBER
+%token IGNORED
+`
+	tokens, err := ReadYaccTokens(strings.NewReader(grammar))
+	require.NoError(t, err)
+	require.Equal(t, []string{"NUMBER", "IDENT", "PLUS", "EOL"}, tokens)
+
+	spec := `/[0-9]+/ -> NUMBER
+/[a-z]+/ -> IDENT
+/\+/ { return PLUS }
+/-/ { return MINUS }
+/ / { return int(' ') }
+//
+`
+	program, err := ParseNexWithOptions(strings.NewReader(spec), Options{YaccTokens: tokens})
+	require.NoError(t, err)
+	var warnings []string
+	for _, w := range program.Warnings {
+		warnings = append(warnings, w.String())
+	}
+	require.Equal(t, []string{
+		"unused token: no rule returns EOL",
+		"4:2: undeclared token: /-/ returns MINUS, which the grammar does not declare",
+	}, warnings)
+
+	_, err = ParseNexWithOptions(strings.NewReader(spec), Options{YaccTokens: tokens, Strict: true})
+	require.ErrorIs(t, err, ErrUnusedToken)
+	require.EqualError(t, err, "unused token: no rule returns EOL")
+}
+
+func TestAcceptConflicts(t *testing.T) {
+	conflicts := func(spec string) []string {
+		program, err := ParseNexWithOptions(strings.NewReader(spec), Options{Conflicts: true})
+		require.NoError(t, err)
+		var warnings []string
+		for _, w := range program.Warnings {
+			if errors.Is(w.Err, ErrAcceptConflict) {
+				warnings = append(warnings, w.String())
+			}
+		}
+		return warnings
+	}
+	require.Equal(t, []string{
+		`2:2: accept conflict: /[a-z]+/ loses to /if/ at line 1 on "if"`,
+		`3:2: accept conflict: /i[f]/ loses to /if/ at line 1 on "if"`,
+	}, conflicts("/if/ { }\n/[a-z]+/ { }\n/i[f]/ { }\n//\n"))
+
+	// A rule that a rule set or a guard may skip does not always win, so the next rule does.
+	for _, skippable := range []string{"%ruleset x", "when ok"} {
+		require.Equal(t, []string{
+			`3:2: accept conflict: /i[f]/ loses to /[a-z]+/ at line 2 on "if"`,
+		}, conflicts("/if/ "+skippable+" { }\n/[a-z]+/ { }\n/i[f]/ { }\n//\n"))
+	}
+
+	// The example of a wild edge is the first rune that it takes.
+	require.Equal(t, []string{
+		`2:2: accept conflict: /[^\n]/ loses to /./ at line 1 on "\x00"`,
+	}, conflicts("/./ { }\n/[^\\n]/ { }\n//\n"))
+
+	// The \b can never match between a and b, so the DFA has an edge to the dead state.
+	program, err := ParseNexWithOptions(strings.NewReader("/a\\b/ { }\n/ab/ { }\n//\n"), Options{Conflicts: true})
+	require.NoError(t, err)
+	require.Empty(t, program.Warnings)
+}
+
+func TestShadowedRules(t *testing.T) {
+	spec := `/a*/ { }
+/if/ { }
+/a+/ { }
+/[a-z]+/ %ruleset x { }
+/else/ { }
+/i[a-z]/ { }
+/[^\n]*\n/ < { }
+  /./ { }
+  /x/ { }
+> { }
+//
+`
+	program, err := ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	var warnings []string
+	for _, w := range program.Warnings {
+		if errors.Is(w.Err, ErrNullableRule) {
+			// /a*/ matches the empty string too, see TestNullableRules.
+			continue
+		}
+		require.ErrorIs(t, w.Err, ErrShadowedRule)
+		warnings = append(warnings, w.String())
+	}
+	require.Equal(t, []string{
+		"3:2: shadowed rule: /a+/ never wins over /a*/ at line 1",
+		"9:4: shadowed rule: /x/ never wins over /./ at line 8",
+	}, warnings)
+
+	// Strict fails on the first warning, which is that /a*/ is nullable.
+	_, err = ParseNexWithOptions(strings.NewReader(spec), Options{Strict: true})
+	require.ErrorIs(t, err, ErrNullableRule)
+	require.EqualError(t, err, "1:2: nullable rule: /a*/ matches the empty string")
+}
+
+func TestNullableRules(t *testing.T) {
+	spec := `/a*/ { }
+/b/ { }
+/[ \t]/ < { }
+  /x?/ { }
+> { }
+/^$/ { }
+//
+`
+	program, err := ParseNex(strings.NewReader(spec))
+	require.NoError(t, err)
+	var warnings []string
+	for _, w := range program.Warnings {
+		require.ErrorIs(t, w.Err, ErrNullableRule)
+		warnings = append(warnings, w.String())
+	}
+	require.Equal(t, []string{
+		"1:2: nullable rule: /a*/ matches the empty string",
+		"4:4: nullable rule: /x?/ matches the empty string",
+	}, warnings, "/^$/ only matches the empty string at an empty line")
+
+	_, err = ParseNexWithOptions(strings.NewReader(spec), Options{Strict: true})
+	require.ErrorIs(t, err, ErrNullableRule)
+	require.EqualError(t, err, "1:2: nullable rule: /a*/ matches the empty string")
+}
+
+func TestCompare(t *testing.T) {
+	parse := func(spec string) *NexProgram {
+		program, err := ParseNex(strings.NewReader(spec))
+		require.NoError(t, err)
+		return program
+	}
+	summarize := func(log *Changelog) []string {
+		var changes []string
+		for _, c := range log.Changes {
+			ref := c.New
+			if ref == nil {
+				ref = c.Old
+			}
+			changes = append(changes, fmt.Sprintf("%s %d:/%s/ %v %v %q", c.Kind, ref.Scope, ref.Regex, c.Fields, c.Retokenizes, c.Example))
+		}
+		return changes
+	}
+
+	old := parse(`/if|else/ %name keyword { return 1 }
+/[a-z]+/ { return 2 }
+/[0-9]+/ { return 3 }
+/,/ { return 4 }
+/"[^"]*"/ < { }
+  /[a-z]+/ { }
+  /./ { }
+> { }
+/[ \n]+/ { }
+//
+`)
+	log := Compare(old, parse(`/if|else|while/ %name keyword { return 1 }
+/[0-9][0-9]*/ { return 3 }
+/[a-z]+/ { return 2 }
+/"[^"]*"/ < { }
+  /[a-z]+/ { return 6 }
+  /./ { }
+> { }
+/[ \n]+/ { }
+/->/ { return 7 }
+//
+`))
+	require.True(t, log.Retokenizes)
+	require.Equal(t, []string{
+		`changed 0:/if|else|while/ [regex] true "while"`,
+		`changed 0:/[0-9][0-9]*/ [regex] false ""`,
+		`removed 0:/,/ [] true ","`,
+		`added 0:/->/ [] true "->"`,
+		`changed 1:/[a-z]+/ [action] false ""`,
+	}, summarize(log))
+
+	// Rules that only swap their precedence moved.
+	log = Compare(parse("/a/ { }\n/[a-z]/ { }\n//\n"), parse("/[a-z]/ { }\n/a/ { }\n//\n"))
+	require.Equal(t, []string{`moved 0:/a/ [] true "a"`, `moved 0:/[a-z]/ [] true "a"`}, summarize(log))
+
+	require.False(t, Compare(old, old).Retokenizes)
+	require.Empty(t, Compare(old, old).Changes)
+}
@@ -3,20 +3,68 @@ package parser
 import (
 	"fmt"
 	"io"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/liran-funaro/nex/graph"
 )
 
 type NexProgram struct {
-	Id         int
+	Id         int // The number of the rule within its scope, from 1. The root is 0.
 	Regex      string
+	Flags      syntax.Flags
+	Line       int    // The line of the regex in the spec.
+	Column     int    // The column of the first rune of the regex in the spec.
+	Token      string // The token of a `-> TOKEN` rule, whose StartCode returns it.
+	SubLexer   string // The sub-lexer of a `-> @NAME` rule, whose nested scope is a copy of it.
 	StartCode  string
 	EndCode    string
 	UserCode   string
 	Children   []*NexProgram
 	NFA        []*graph.Node
 	DFA        []*graph.Node
-	Parameters []Parameter
+	NFAStats   graph.Stats // The cost of building NFA.
+	DFAStats   graph.Stats // The cost of building DFA.
+	Parameters []Parameter // The spec's parameters for the root, or the rule's annotations.
+
+	// Definitions are named regexes that can be referenced as {NAME} from rules and other definitions.
+	Definitions []Definition
+
+	// The positions of the first runes of StartCode and EndCode in the spec, if they were read from it.
+	StartCodePos, EndCodePos Position
+
+	// Guard is the Go boolean expression of `when GUARD`. The rule only matches if it holds.
+	Guard    string
+	GuardPos Position
+
+	// Warnings are only set for the root.
+	Warnings []Warning
+
+	// The regex as it is in the spec, if expanding its definitions changed it, and the offset in it
+	// of each byte of Regex, see ruleError.
+	specRegex   string
+	specOffsets []int
+}
+
+// Position is a position in the spec. Both the line and the column start at 1.
+type Position struct {
+	Line, Column int
+}
+
+// advance returns the position that follows the given runes.
+func (pos Position) advance(runes []rune) Position {
+	for _, r := range runes {
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
 }
 
 type Parameter struct {
@@ -24,6 +72,12 @@ type Parameter struct {
 	Value string
 }
 
+type Definition struct {
+	Name  string
+	Regex string
+	Line  int
+}
+
 func (r *NexProgram) GetRegex() string {
 	return r.Regex
 }
@@ -32,26 +86,290 @@ func (r *NexProgram) GetId() int {
 	return r.Id
 }
 
-func (r *NexProgram) WriteNFADotGraph(writer io.Writer) error {
-	if len(r.NFA) == 0 {
-		return nil
+func (r *NexProgram) GetFlags() syntax.Flags {
+	return r.Flags
+}
+
+// HasOption returns true if one of the program's `%option` parameters lists the given option.
+func (r *NexProgram) HasOption(name string) bool {
+	for _, p := range r.Parameters {
+		if p.Key == "option" && slices.Contains(strings.Fields(p.Value), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// regexFlagNames are the flags of the regexes that `%flags` parameters can set, or clear with a '-'.
+var regexFlagNames = map[string]syntax.Flags{
+	"caseless":  syntax.FoldCase,
+	"dotnl":     syntax.DotNL,
+	"oneline":   syntax.OneLine,
+	"nongreedy": syntax.NonGreedy,
+	"unicode":   syntax.UnicodeGroups,
+}
+
+// regexFlagLetters are the letters of the inline flags of the regexes, like the i of `(?i)`, which
+// `%flags` may use instead of the names. m makes `^` and `$` match at the lines, so it clears oneline.
+var regexFlagLetters = map[string]string{
+	"i": "caseless",
+	"s": "dotnl",
+	"U": "nongreedy",
+	"m": "-oneline",
+}
+
+// regexFlags returns the flags that the program's `%flags` parameters set and clear, for all the
+// rules of the spec, or for the rule of a `%flags` annotation. The flags are separated by spaces
+// or commas, and later ones override earlier ones.
+func (r *NexProgram) regexFlags() (set, unset syntax.Flags, err error) {
+	for _, p := range r.Parameters {
+		if p.Key != "flags" {
+			continue
+		}
+		for _, name := range strings.FieldsFunc(p.Value, func(c rune) bool { return c == ',' || unicode.IsSpace(c) }) {
+			off, base := strings.HasPrefix(name, "-"), strings.TrimPrefix(name, "-")
+			if long, ok := regexFlagLetters[base]; ok {
+				base = strings.TrimPrefix(long, "-")
+				off = off != strings.HasPrefix(long, "-")
+			}
+			flag, ok := regexFlagNames[base]
+			switch {
+			case !ok:
+				return 0, 0, fmt.Errorf("%w: %q", ErrUnknownFlag, name)
+			case off:
+				set, unset = set&^flag, unset|flag
+			default:
+				set, unset = set|flag, unset&^flag
+			}
+		}
+	}
+	return set, unset, nil
+}
+
+// RuleSets maps the rule sets, given by `%ruleset NAME` annotations, to the IDs of the rules of
+// the scope that belong to them.
+func (r *NexProgram) RuleSets() map[string][]int {
+	sets := map[string][]int{}
+	for _, x := range r.Children {
+		for _, p := range x.Parameters {
+			if p.Key == "ruleset" {
+				sets[p.Value] = append(sets[p.Value], x.Id)
+			}
+		}
+	}
+	return sets
+}
+
+// RuleSetNames returns the names of the rule sets of all scopes, sorted.
+func (r *NexProgram) RuleSetNames() []string {
+	var names []string
+	for _, scope := range r.Scopes() {
+		for name := range scope.RuleSets() {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Scopes returns the program and its rules that open nested scopes, in pre-order.
+// Frames refer to the scope of their rule by its index in this list.
+func (r *NexProgram) Scopes() []*NexProgram {
+	var scopes []*NexProgram
+	r.walk(func(x *NexProgram) {
+		if len(x.Children) > 0 || x == r {
+			scopes = append(scopes, x)
+		}
+	})
+	return scopes
+}
+
+// IsLiteral returns true if the rule is a `"literal"`, whose Regex is the text it matches.
+func (r *NexProgram) IsLiteral() bool {
+	return r.Flags&syntax.Literal != 0
+}
+
+// RuleName returns the name that a `%name NAME` annotation gives the rule, if any.
+func (r *NexProgram) RuleName() string {
+	for _, p := range r.Parameters {
+		if p.Key == "name" {
+			return p.Value
+		}
 	}
-	graph.WriteDotGraph(writer, r.NFA[0], fmt.Sprintf("NFA_%d", r.Id))
+	return ""
+}
+
+// SymType returns the type that a `%yystype TYPE` parameter gives the semantic values, if any.
+func (r *NexProgram) SymType() string {
+	return r.parameter("yystype")
+}
+
+// Prefix returns the prefix that a `%prefix NAME` parameter gives the generated names, instead
+// of "yy", if any.
+func (r *NexProgram) Prefix() string {
+	return r.parameter("prefix")
+}
+
+// Package returns the package that a `%package NAME` parameter puts the lexer in, if any.
+func (r *NexProgram) Package() string {
+	return r.parameter("package")
+}
+
+// Generator returns the tool that a `%generator TOOL` parameter names in the "Code generated"
+// comment of the generated files, instead of nex, if any.
+func (r *NexProgram) Generator() string {
+	return r.parameter("generator")
+}
+
+// Command returns the command that a `%command COMMAND` parameter writes in the comment of the
+// generated lexer, instead of that of the invocation, if any.
+func (r *NexProgram) Command() string {
+	return r.parameter("command")
+}
+
+// Header returns the block of a `%header{ ... }` parameter, which follows the "Code generated"
+// comment of the generated files, if any.
+func (r *NexProgram) Header() string {
+	return r.parameter("header")
+}
+
+// Resync returns the ranges of the character class of a `%resync [CLASS]` parameter, as pairs of
+// their first and last runes, up to which the scanner skips the input after a failed match, if any.
+func (r *NexProgram) Resync() ([]rune, error) {
+	class := r.parameter("resync")
+	if class == "" {
+		return nil, nil
+	}
+	re, err := syntax.Parse(class, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadResync, err)
+	}
+	switch {
+	case re.Op == syntax.OpCharClass && len(re.Rune) > 0:
+		return re.Rune, nil
+	case re.Op == syntax.OpLiteral && len(re.Rune) == 1:
+		return []rune{re.Rune[0], re.Rune[0]}, nil
+	}
+	return nil, fmt.Errorf("%w: %q is not a character class", ErrBadResync, class)
+}
+
+// parameter returns the trimmed value of the first parameter with the given key, if any.
+func (r *NexProgram) parameter(key string) string {
+	for _, p := range r.Parameters {
+		if p.Key == key {
+			return strings.TrimSpace(p.Value)
+		}
+	}
+	return ""
+}
+
+// Guarded returns the rules with a `when GUARD` expression, in pre-order.
+func (r *NexProgram) Guarded() []*NexProgram {
+	var guarded []*NexProgram
+	r.walk(func(x *NexProgram) {
+		if x.Guard != "" {
+			guarded = append(guarded, x)
+		}
+	})
+	return guarded
+}
+
+// Tokens returns the tokens of the `-> TOKEN` rules, in order of appearance.
+func (r *NexProgram) Tokens() []string {
+	var tokens []string
+	r.walk(func(x *NexProgram) {
+		if x.Token != "" && !slices.Contains(tokens, x.Token) {
+			tokens = append(tokens, x.Token)
+		}
+	})
+	return tokens
+}
+
+// Stats is the cost of the automata of a program.
+type Stats struct {
+	Automata  int // The number of scopes with rules, each of which has an automaton.
+	NFANodes  int
+	DFAStates int
+	NFATime   time.Duration
+	DFATime   time.Duration
+}
+
+// Stats sums the cost of the automata of all scopes.
+func (r *NexProgram) Stats() Stats {
+	var s Stats
+	r.walk(func(x *NexProgram) {
+		if len(x.Children) == 0 {
+			return
+		}
+		s.Automata++
+		s.NFANodes += x.NFAStats.NFANodes
+		s.DFAStates += x.DFAStats.DFAStates
+		s.NFATime += x.NFAStats.Duration
+		s.DFATime += x.DFAStats.Duration
+	})
+	return s
+}
+
+// RuleCount returns the number of rules in all scopes.
+func (r *NexProgram) RuleCount() int {
+	count := 0
+	r.walk(func(*NexProgram) {
+		count++
+	})
+	return count - 1
+}
+
+func (r *NexProgram) walk(f func(*NexProgram)) {
+	f(r)
 	for _, c := range r.Children {
-		if err := c.WriteNFADotGraph(writer); err != nil {
+		c.walk(f)
+	}
+}
+
+// WriteNFADotGraph writes the whole NFAs of all scopes in DOT format.
+func (r *NexProgram) WriteNFADotGraph(writer io.Writer) error {
+	return r.WriteNFADotGraphWithOptions(writer, graph.DotOptions{})
+}
+
+// WriteNFADotGraphWithOptions writes the NFAs of all scopes in DOT format, each capped by the options.
+func (r *NexProgram) WriteNFADotGraphWithOptions(writer io.Writer, opts graph.DotOptions) error {
+	for _, scope := range r.Scopes() {
+		if len(scope.NFA) == 0 {
+			continue
+		}
+		if err := graph.WriteDotGraphWithOptions(writer, scope.NFA[0], fmt.Sprintf("NFA_%d", scope.Id), scope.dotOptions(opts)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r *NexProgram) WriteDFADotGraph(writer io.Writer) error {
-	if len(r.DFA) == 0 {
-		return nil
+// dotOptions labels the rules of the scope in the legends of its graphs with their regexes.
+func (r *NexProgram) dotOptions(opts graph.DotOptions) graph.DotOptions {
+	opts.RuleLabel = func(rule int) string {
+		i := slices.IndexFunc(r.Children, func(kid *NexProgram) bool { return kid.Id == rule })
+		if i < 0 {
+			return fmt.Sprintf("rule %d", rule)
+		}
+		return fmt.Sprintf("/%s/ at line %d", r.Children[i].Regex, r.Children[i].Line)
 	}
-	graph.WriteDotGraph(writer, r.DFA[0], fmt.Sprintf("DFA_%d", r.Id))
-	for _, c := range r.Children {
-		if err := c.WriteDFADotGraph(writer); err != nil {
+	return opts
+}
+
+// WriteDFADotGraph writes the whole DFAs of all scopes in DOT format.
+func (r *NexProgram) WriteDFADotGraph(writer io.Writer) error {
+	return r.WriteDFADotGraphWithOptions(writer, graph.DotOptions{})
+}
+
+// WriteDFADotGraphWithOptions writes the DFAs of all scopes in DOT format, each capped by the options.
+func (r *NexProgram) WriteDFADotGraphWithOptions(writer io.Writer, opts graph.DotOptions) error {
+	for _, scope := range r.Scopes() {
+		if len(scope.DFA) == 0 {
+			continue
+		}
+		if err := graph.WriteDotGraphWithOptions(writer, scope.DFA[0], fmt.Sprintf("DFA_%d", scope.Id), scope.dotOptions(opts)); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,116 @@
+package parser
+
+import (
+	"encoding/json"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"io"
+	"strconv"
+)
+
+// RuleSetTable is the machine-readable table of the rule sets of a spec, which are the start
+// conditions of the lexer, so that tools can draw the graph of its modes: the rules of each rule
+// set, and the actions that enable or disable them.
+type RuleSetTable struct {
+	RuleSets    []RuleSetEntry      `json:"ruleSets"`
+	Transitions []RuleSetTransition `json:"transitions"`
+}
+
+// RuleSetEntry is a rule set of a RuleSetTable with its rules.
+type RuleSetEntry struct {
+	Name  string    `json:"name"`
+	Rules []RuleRef `json:"rules"`
+}
+
+// RuleRef identifies a rule by its scope and number, like the generated code, see WriteSymbols.
+// Rule 0 of scope 0 is the `%init` blocks, which have no position.
+type RuleRef struct {
+	Scope  int    `json:"scope"`
+	Rule   int    `json:"rule"`
+	Name   string `json:"name,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// RuleSetTransition is a call of EnableRuleSet or DisableRuleSet in the action of a rule, which
+// runs at the start of the match, or at its end if the rule opens a nested scope.
+type RuleSetTransition struct {
+	From    RuleRef `json:"from"`
+	End     bool    `json:"end,omitempty"`
+	RuleSet string  `json:"ruleSet"`
+	Enable  bool    `json:"enable"`
+}
+
+// RuleSetTable returns the table of the rule sets of the program. The calls whose rule set is not
+// a string literal are left out, as their rule set is only known at runtime.
+func (r *NexProgram) RuleSetTable() *RuleSetTable {
+	t := &RuleSetTable{RuleSets: []RuleSetEntry{}, Transitions: []RuleSetTransition{}}
+	scopes := r.Scopes()
+	for _, name := range r.RuleSetNames() {
+		e := RuleSetEntry{Name: name}
+		for i, scope := range scopes {
+			for _, id := range scope.RuleSets()[name] {
+				e.Rules = append(e.Rules, scope.child(id).ruleRef(i))
+			}
+		}
+		t.RuleSets = append(t.RuleSets, e)
+	}
+
+	for _, p := range r.Parameters {
+		if p.Key == "init" {
+			t.Transitions = append(t.Transitions, ruleSetCalls(RuleRef{}, false, p.Value)...)
+		}
+	}
+	for i, scope := range scopes {
+		for _, x := range scope.Children {
+			t.Transitions = append(t.Transitions, ruleSetCalls(x.ruleRef(i), false, x.StartCode)...)
+			t.Transitions = append(t.Transitions, ruleSetCalls(x.ruleRef(i), true, x.EndCode)...)
+		}
+	}
+	return t
+}
+
+// WriteRuleSetTable writes the table of the rule sets of the program as JSON.
+func (r *NexProgram) WriteRuleSetTable(writer io.Writer) error {
+	e := json.NewEncoder(writer)
+	e.SetIndent("", "  ")
+	return e.Encode(r.RuleSetTable())
+}
+
+func (r *NexProgram) ruleRef(scope int) RuleRef {
+	return RuleRef{Scope: scope, Rule: r.Id, Name: r.RuleName(), Regex: r.Regex, Line: r.Line, Column: r.Column}
+}
+
+// ruleSetCalls returns the calls of EnableRuleSet and DisableRuleSet in the code of an action.
+func ruleSetCalls(from RuleRef, end bool, code string) []RuleSetTransition {
+	if code == "" {
+		return nil
+	}
+	f, err := goparser.ParseFile(token.NewFileSet(), "", actionPrefix+code+"}\n", goparser.SkipObjectResolution)
+	if err != nil {
+		// checkActions reports the syntax errors of the actions.
+		return nil
+	}
+	var calls []RuleSetTransition
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "EnableRuleSet" && sel.Sel.Name != "DisableRuleSet") {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		if name, err := strconv.Unquote(lit.Value); err == nil {
+			calls = append(calls, RuleSetTransition{From: from, End: end, RuleSet: name, Enable: sel.Sel.Name == "EnableRuleSet"})
+		}
+		return true
+	})
+	return calls
+}
@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Warning is a problem in the spec that does not prevent generating a lexer.
+type Warning struct {
+	Line, Column int
+	Err          error // Wraps the kind of the warning, e.g., ErrShadowedRule.
+}
+
+func (w Warning) String() string {
+	return w.error().Error()
+}
+
+// error returns the error of the warning, at its position in the spec, if it has one.
+func (w Warning) error() error {
+	if w.Line == 0 {
+		return w.Err
+	}
+	return fmt.Errorf("%d:%d: %w", w.Line, w.Column, w.Err)
+}
+
+// findShadowedRules warns about the rules that can never win, as a rule of higher precedence
+// matches everything they match. Rules in rule sets can be disabled, and guarded rules can be skipped,
+// so they do not shadow other rules.
+func (x *NexProgram) findShadowedRules() []Warning {
+	var warnings []Warning
+	x.walk(func(scope *NexProgram) {
+		mayBeSkipped := skippableRules(scope)
+		wins := map[int]bool{}
+		shadowedBy := map[int]int{}
+		for _, v := range scope.DFA {
+			for i, a := range v.Accepts {
+				j := slices.IndexFunc(v.Accepts[:i], func(b int) bool { return !mayBeSkipped[b] })
+				if j < 0 {
+					wins[a] = true
+				} else if _, ok := shadowedBy[a]; !ok {
+					shadowedBy[a] = v.Accepts[j]
+				}
+			}
+		}
+
+		for _, kid := range scope.Children {
+			by, ok := shadowedBy[kid.Id]
+			if wins[kid.Id] || !ok {
+				continue
+			}
+			i := slices.IndexFunc(scope.Children, func(c *NexProgram) bool { return c.Id == by })
+			err := fmt.Errorf("%w: /%s/ never wins over /%s/ at line %d",
+				ErrShadowedRule, kid.Regex, scope.Children[i].Regex, scope.Children[i].Line)
+			warnings = append(warnings, Warning{Line: kid.Line, Column: kid.Column, Err: err})
+		}
+	})
+	return warnings
+}
+
+// skippableRules returns the IDs of the rules of the scope that a guard or a rule set may skip.
+func skippableRules(scope *NexProgram) map[int]bool {
+	skipped := map[int]bool{}
+	for _, ids := range scope.RuleSets() {
+		for _, id := range ids {
+			skipped[id] = true
+		}
+	}
+	for _, kid := range scope.Children {
+		if kid.Guard != "" {
+			skipped[kid.Id] = true
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+)
+
+// resolveSubLexers gives each `-> @NAME` rule a copy of the nested scope of the rule that is
+// annotated with `%sublexer NAME`, including the code that opens and closes it.
+// Each copy is a scope of its own, so the generated code refers to its rules separately.
+func (x *NexProgram) resolveSubLexers() error {
+	defs := map[string]*NexProgram{}
+	var err error
+	x.walk(func(r *NexProgram) {
+		name := r.subLexerName()
+		switch {
+		case err != nil || name == "":
+		case !isDefinitionName(name):
+			err = fmt.Errorf("%d:%d: %w: %q", r.Line, r.Column, ErrBadSubLexer, name)
+		case defs[name] != nil:
+			err = fmt.Errorf("%d:%d: %w: @%s is already defined at line %d", r.Line, r.Column, ErrBadSubLexer, name, defs[name].Line)
+		case len(r.Children) == 0:
+			err = fmt.Errorf("%d:%d: %w: @%s has no nested rules", r.Line, r.Column, ErrBadSubLexer, name)
+		}
+		defs[name] = r
+	})
+	if err != nil {
+		return err
+	}
+	return x.useSubLexers(defs, nil)
+}
+
+// useSubLexers resolves the references of the rules of the scope. The sub-lexers that are in use
+// by the enclosing scopes may not be referenced again, as their copies would never end.
+func (x *NexProgram) useSubLexers(defs map[string]*NexProgram, using []string) error {
+	for _, kid := range x.Children {
+		using := using
+		if name := kid.SubLexer; name != "" {
+			def := defs[name]
+			switch {
+			case def == nil:
+				return fmt.Errorf("%d:%d: %w: @%s is not defined", kid.Line, kid.Column, ErrBadSubLexer, name)
+			case slices.Contains(using, name):
+				return fmt.Errorf("%d:%d: %w: @%s refers to itself", kid.Line, kid.Column, ErrBadSubLexer, name)
+			}
+			kid.StartCode, kid.StartCodePos = def.StartCode, def.StartCodePos
+			kid.EndCode, kid.EndCodePos = def.EndCode, def.EndCodePos
+			kid.Children = make([]*NexProgram, len(def.Children))
+			for i, c := range def.Children {
+				kid.Children[i] = c.clone()
+			}
+			using = append(using, name)
+		}
+		if name := kid.subLexerName(); name != "" {
+			using = append(using, name)
+		}
+		if err := kid.useSubLexers(defs, using); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subLexerName returns the name that a `%sublexer NAME` annotation gives the nested scope of the rule.
+func (r *NexProgram) subLexerName() string {
+	for _, p := range r.Parameters {
+		if p.Key == "sublexer" {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// clone returns a deep copy of the rule, for a copy of a sub-lexer. The copy does not keep the
+// `%name` and `%sublexer` annotations, which name the original.
+func (r *NexProgram) clone() *NexProgram {
+	c := *r
+	c.Parameters = slices.DeleteFunc(slices.Clone(r.Parameters), func(p Parameter) bool {
+		return p.Key == "name" || p.Key == "sublexer"
+	})
+	c.Children = make([]*NexProgram, len(r.Children))
+	for i, kid := range r.Children {
+		c.Children[i] = kid.clone()
+	}
+	return &c
+}
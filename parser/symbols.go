@@ -0,0 +1,25 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteSymbols writes the rules of all scopes, one per line, with the scope and the number that
+// identify them in the generated code, their position in the spec, their name and their regex.
+// It is the symbol file of minified lexers, whose code only refers to the rules by their numbers.
+func (r *NexProgram) WriteSymbols(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	_, _ = fmt.Fprintln(w, "# scope\trule\tposition\tname\tregex")
+	for i, scope := range r.Scopes() {
+		for _, x := range scope.Children {
+			name := x.RuleName()
+			if name == "" {
+				name = "-"
+			}
+			_, _ = fmt.Fprintf(w, "%d\t%d\t%d:%d\t%s\t%q\n", i, x.Id, x.Line, x.Column, name, x.Regex)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,135 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrUndeclaredToken = errors.New("undeclared token")
+	ErrUnusedToken     = errors.New("unused token")
+)
+
+var (
+	yaccDirectiveRegexp = regexp.MustCompile(`^%([a-z]*)`)
+	yaccCommentRegexp   = regexp.MustCompile(`/\*.*?\*/|//.*`)
+	yaccTypeRegexp      = regexp.MustCompile(`<[^>]*>`)
+	allCapsRegexp       = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// ReadYaccTokens returns the tokens that the `%token` declarations of a goyacc grammar declare,
+// in order. Character literals, like '+', are not tokens that rules need to return by name.
+func ReadYaccTokens(in io.Reader) ([]string, error) {
+	tokens := []string{}
+	inCode, inToken := false, false
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		line := strings.TrimSpace(yaccCommentRegexp.ReplaceAllString(s.Text(), ""))
+		switch {
+		case inCode:
+			inCode = line != "%}"
+			continue
+		case line == "%{":
+			inCode = true
+			continue
+		case line == "%%":
+			// The declarations end at the rules.
+			return tokens, nil
+		case strings.HasPrefix(line, "%"):
+			// A declaration lasts until the next one, so it may span several lines.
+			directive := yaccDirectiveRegexp.FindString(line)
+			inToken = directive == "%token"
+			line = line[len(directive):]
+		}
+		if !inToken {
+			continue
+		}
+		// Skip the type, as in `%token <num> NUM`.
+		for _, field := range strings.Fields(yaccTypeRegexp.ReplaceAllString(line, " ")) {
+			if token.IsIdentifier(field) && !slices.Contains(tokens, field) {
+				tokens = append(tokens, field)
+			}
+		}
+	}
+	return tokens, s.Err()
+}
+
+// findTokenMismatches warns about the rules that return tokens that the grammar does not declare,
+// and about the declared tokens that no rule returns. Rules return tokens with `-> TOKEN`, or
+// with `return TOKEN` in their code, where only identifiers in capitals are taken for tokens.
+func (x *NexProgram) findTokenMismatches(declared []string) []Warning {
+	var warnings []Warning
+	returned := map[string]bool{}
+	report := func(r *NexProgram, tok string) {
+		returned[tok] = true
+		if slices.Contains(declared, tok) {
+			return
+		}
+		if r == nil {
+			err := fmt.Errorf("%w: %%error returns %s, which the grammar does not declare", ErrUndeclaredToken, tok)
+			warnings = append(warnings, Warning{Err: err})
+			return
+		}
+		err := fmt.Errorf("%w: /%s/ returns %s, which the grammar does not declare", ErrUndeclaredToken, r.Regex, tok)
+		warnings = append(warnings, Warning{Line: r.Line, Column: r.Column, Err: err})
+	}
+	x.walk(func(r *NexProgram) {
+		// The StartCode of a `-> TOKEN` rule returns its token too, so each token is reported once.
+		var tokens []string
+		if r.Token != "" {
+			tokens = append(tokens, r.Token)
+		}
+		for _, code := range []string{r.StartCode, r.EndCode} {
+			for _, tok := range returnedTokens(code) {
+				if !slices.Contains(tokens, tok) {
+					tokens = append(tokens, tok)
+				}
+			}
+		}
+		for _, tok := range tokens {
+			report(r, tok)
+		}
+	})
+	for _, p := range x.Parameters {
+		if p.Key == "error" {
+			for _, tok := range returnedTokens(p.Value) {
+				report(nil, tok)
+			}
+		}
+	}
+	for _, tok := range declared {
+		if !returned[tok] {
+			warnings = append(warnings, Warning{Err: fmt.Errorf("%w: no rule returns %s", ErrUnusedToken, tok)})
+		}
+	}
+	return warnings
+}
+
+// returnedTokens returns the identifiers in capitals that the code returns, in order.
+func returnedTokens(code string) []string {
+	if code == "" {
+		return nil
+	}
+	f, err := goparser.ParseFile(token.NewFileSet(), "", actionPrefix+code+"}\n", goparser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+	var tokens []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ret, ok := n.(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+			if id, ok := ret.Results[0].(*ast.Ident); ok && allCapsRegexp.MatchString(id.Name) {
+				tokens = append(tokens, id.Name)
+			}
+		}
+		return true
+	})
+	return tokens
+}
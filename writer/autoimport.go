@@ -0,0 +1,138 @@
+package writer
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stdPackages maps the names of standard packages to their paths. Names of several standard
+// packages, like rand and template, are left out, as they are ambiguous.
+var stdPackages = map[string]string{
+	"bufio":   "bufio",
+	"bytes":   "bytes",
+	"cmp":     "cmp",
+	"context": "context",
+	"errors":  "errors",
+	"fmt":     "fmt",
+	"io":      "io",
+	"log":     "log",
+	"maps":    "maps",
+	"math":    "math",
+	"os":      "os",
+	"regexp":  "regexp",
+	"slices":  "slices",
+	"sort":    "sort",
+	"strconv": "strconv",
+	"strings": "strings",
+	"sync":    "sync",
+	"time":    "time",
+	"unicode": "unicode",
+	"utf16":   "unicode/utf16",
+	"utf8":    "unicode/utf8",
+}
+
+// fixImports imports the standard packages that the code refers to without importing them,
+// e.g., in the actions of the rules, and, if removeUnused is set, removes the imports that it does
+// not use and those that it repeats, which goimports does otherwise. Unlike goimports, it does not depend on the packages
+// that happen to be around, so the same spec always gets the same imports. Packages that it does
+// not know are left to goimports. It edits the text of the code, which it leaves unformatted.
+func fixImports(src []byte, removeUnused bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return src, err
+	}
+
+	imported := map[string]bool{}
+	for _, spec := range file.Imports {
+		imported[importName(spec)] = true
+	}
+	var missing []string
+	used := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok || !slices.Contains(file.Unresolved, x) {
+			return true
+		}
+		used[x.Name] = true
+		if p, ok := stdPackages[x.Name]; ok && !imported[x.Name] && !slices.Contains(missing, p) {
+			missing = append(missing, p)
+		}
+		return true
+	})
+
+	// The edits replace the ranges of the text, from the last, so the offsets of the others hold.
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	if removeUnused {
+		// The user code may import the packages that the template imports too.
+		seen := map[string]bool{}
+		for _, d := range file.Decls {
+			d, ok := d.(*ast.GenDecl)
+			if !ok || d.Tok != token.IMPORT {
+				continue
+			}
+			for _, spec := range d.Specs {
+				spec := spec.(*ast.ImportSpec)
+				name := importName(spec)
+				if key := name + " " + spec.Path.Value; !seen[key] && (name == "_" || name == "." || used[name]) {
+					seen[key] = true
+					continue
+				}
+				if d.Lparen.IsValid() {
+					edits = append(edits, edit{offset(spec.Pos()), offset(spec.End()), ""})
+				} else {
+					edits = append(edits, edit{offset(d.Pos()), offset(d.End()), ""})
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		var specs strings.Builder
+		for _, p := range missing {
+			specs.WriteString("\n" + strconv.Quote(p))
+		}
+		// The standard packages join the first group of the first import block, if there is one.
+		at, text := offset(file.Name.End()), "\n\nimport ("+specs.String()+"\n)"
+		for _, d := range file.Decls {
+			if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT && d.Lparen.IsValid() {
+				at, text = offset(d.Lparen)+1, specs.String()
+				break
+			}
+		}
+		edits = append(edits, edit{at, at, text})
+	}
+	if len(edits) == 0 {
+		return src, nil
+	}
+
+	slices.SortFunc(edits, func(a, b edit) int { return b.start - a.start })
+	out := slices.Clone(src)
+	for _, e := range edits {
+		out = slices.Replace(out, e.start, e.end, []byte(e.text)...)
+	}
+	return out, nil
+}
+
+// importName returns the name that the code refers to the package of the import by.
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, _ := strconv.Unquote(spec.Path.Value)
+	return path.Base(p)
+}
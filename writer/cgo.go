@@ -0,0 +1,110 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// cgoWrapper exports the lexer to C, with the C prefix of its names.
+const cgoWrapper = `/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// %[1]s_token is a token of %[1]s_tokenize: what the action of the rule returned, the range of
+// the match in lines and columns, which start at 0, and the offset and length of its bytes in the
+// buffer.
+typedef struct {
+	int32_t kind;
+	int32_t line, column, end_line, end_column;
+	int64_t offset, length;
+} %[1]s_token;
+*/
+import "C"
+
+import (
+	"bytes"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// %[1]s_tokenize scans the buffer of the given size, and returns its tokens in an array that
+// %[1]s_free frees, and their number in count. The lexer scans a copy of the buffer, so the
+// caller may free it when the function returns. The semantic values of the tokens are left out.
+//
+//export %[1]s_tokenize
+func %[1]s_tokenize(buf *C.char, size C.size_t, count *C.size_t) *C.%[1]s_token {
+	in := append([]byte(nil), unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))...)
+
+	var tokens []C.%[1]s_token
+	lexer := NewLexer(bytes.NewReader(in))
+	lval := new(yySymType)
+	for kind := lexer.Lex(lval); kind != 0; kind = lexer.Lex(lval) {
+		// The runes of invalid UTF-8 in the text are longer than their bytes in the buffer.
+		start, end := lexer.ByteOffset(), lexer.ByteOffset()
+		for i := utf8.RuneCountInString(lexer.Text()); i > 0; i-- {
+			_, n := utf8.DecodeRune(in[end:])
+			end += int64(n)
+		}
+		tokens = append(tokens, C.%[1]s_token{
+			kind: C.int32_t(kind),
+			line: C.int32_t(lexer.Line()), column: C.int32_t(lexer.Column()),
+			end_line: C.int32_t(lexer.EndLine()), end_column: C.int32_t(lexer.EndColumn()),
+			offset: C.int64_t(start), length: C.int64_t(end - start),
+		})
+	}
+	*count = C.size_t(len(tokens))
+	if len(tokens) == 0 {
+		return nil
+	}
+	array := (*C.%[1]s_token)(C.malloc(C.size_t(len(tokens)) * C.size_t(unsafe.Sizeof(tokens[0]))))
+	copy(unsafe.Slice(array, len(tokens)), tokens)
+	return array
+}
+
+// %[1]s_free frees the tokens that %[1]s_tokenize returned.
+//
+//export %[1]s_free
+func %[1]s_free(tokens *C.%[1]s_token) {
+	C.free(unsafe.Pointer(tokens))
+}
+`
+
+// DumpCgoWrapper returns a file of the package of the lexer that exports it to C as
+// PREFIX_tokenize, with the lowercase prefix of the lexer, or nex, e.g., calc_tokenize, so that
+// the components of a toolchain in other languages, like editors, can reuse the lexer from a
+// library that `go build -buildmode=c-shared` builds. The lexer must be in package main.
+func (b *LexerBuilder) DumpCgoWrapper(program *parser.NexProgram) ([]byte, error) {
+	if b.Standalone {
+		return nil, fmt.Errorf("a standalone lexer has no Lex method for a cgo wrapper")
+	}
+	if pkg := b.packageOf(program); pkg != "main" {
+		return nil, fmt.Errorf("a cgo wrapper needs the lexer in package main, not %q", pkg)
+	}
+	prefix := cmp.Or(b.CustomPrefix, program.Prefix())
+
+	var out bytes.Buffer
+	b.out, b.err = bufio.NewWriter(&out), nil
+	b.writeBuildConstraint(nil)
+	b.writeHeader(program, false)
+	b.writeString("\npackage main\n\n")
+	b.writeSymTyped(program, b.instantiate(program, fmt.Sprintf(cgoWrapper, cmp.Or(strings.ToLower(prefix), "nex"))))
+	b.flush()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	src := out.Bytes()
+	if prefix != "" {
+		var err error
+		if src, err = renamePrefix(src, prefix, program.SymType()); err != nil {
+			return nil, err
+		}
+	}
+	// The comments are not minified, as the C declarations and the exports are in them.
+	return b.formatCode(src)
+}
@@ -0,0 +1,82 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// lexerExample is the example of a lexer, which go doc shows with NewLexer. It has no output
+// comment, as the tokens depend on the actions, so go test compiles it without running it.
+const lexerExample = `// ExampleNewLexer prints the tokens of a sample of the rules, with their positions.
+func ExampleNewLexer() {
+	lexer := NewLexer(strings.NewReader(%s))
+	lval := new(yySymType)
+	for token := lexer.Lex(lval); token != 0; token = lexer.Lex(lval) {
+		fmt.Println(token, lexer.Text(), lexer.Line(), lexer.Column())
+	}
+}
+`
+
+// packageExample is the example of a lexer that is generated as a package, which go doc shows
+// with New.
+const packageExample = `// ExampleNew prints the tokens of a sample of the rules, with their positions.
+func ExampleNew() {
+	lexer := New(strings.NewReader(%s))
+	for token := lexer.Next(); token.Kind != 0; token = lexer.Next() {
+		fmt.Println(token.Kind, token.Text, token.Line, token.Column)
+	}
+}
+`
+
+// DumpExample returns a test file of the package of the lexer with an example of the lexer,
+// which scans a sample of the top-level rules, so that go doc and pkg.go.dev show how to use it.
+func (b *LexerBuilder) DumpExample(program *parser.NexProgram) ([]byte, error) {
+	if b.Standalone {
+		return nil, fmt.Errorf("a standalone lexer has no Lex method for an example")
+	}
+	pkg := b.packageOf(program)
+	if pkg == "" {
+		return nil, fmt.Errorf("the lexer has no package")
+	}
+	var samples []string
+	for _, x := range program.Children {
+		if s := x.Sample(); s != "" && !slices.Contains(samples, s) {
+			samples = append(samples, s)
+		}
+	}
+
+	var out bytes.Buffer
+	b.out, b.err = bufio.NewWriter(&out), nil
+	b.writeBuildConstraint(nil)
+	b.writeHeader(program, false)
+	b.writef("\npackage %s\n\n", pkg)
+	example := lexerExample
+	if b.Package != "" {
+		example = packageExample
+	}
+	b.writeSymTyped(program, b.instantiate(program, fmt.Sprintf(example, strconv.Quote(strings.Join(samples, " ")))))
+	b.flush()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	src := out.Bytes()
+	if prefix := cmp.Or(b.CustomPrefix, program.Prefix()); prefix != "" {
+		var err error
+		if src, err = renamePrefix(src, prefix, program.SymType()); err != nil {
+			return nil, err
+		}
+	}
+	code, err := b.formatCode(src)
+	if err != nil {
+		return code, err
+	}
+	return b.minify(code)
+}
@@ -0,0 +1,94 @@
+package writer
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/liran-funaro/nex/graph"
+	"github.com/liran-funaro/nex/parser"
+)
+
+// aliveRules returns, for each state of a DFA, the rules that may still match from there: those
+// that the state or a state after it accepts, in the order of the rules.
+func aliveRules(states []*graph.Node) [][]int {
+	// The states that lead to each state, so that each rule is walked back from its accepting states.
+	preds := make([][]int, len(states))
+	var rules []int
+	for i, v := range states {
+		for _, e := range v.E {
+			if e.Dst.Id >= 0 {
+				preds[e.Dst.Id] = append(preds[e.Dst.Id], i)
+			}
+		}
+		for _, a := range v.Accepts {
+			if !slices.Contains(rules, a) {
+				rules = append(rules, a)
+			}
+		}
+	}
+	slices.Sort(rules)
+
+	alive := make([][]int, len(states))
+	for _, rule := range rules {
+		seen := make([]bool, len(states))
+		var todo []int
+		for i, v := range states {
+			if slices.Contains(v.Accepts, rule) {
+				seen[i] = true
+				todo = append(todo, i)
+			}
+		}
+		for len(todo) > 0 {
+			i := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			alive[i] = append(alive[i], rule)
+			for _, p := range preds[i] {
+				if !seen[p] {
+					seen[p] = true
+					todo = append(todo, p)
+				}
+			}
+		}
+	}
+	return alive
+}
+
+// writeStateComment writes the comment above a state, with the rules that it accepts, which of
+// them wins if the longest match ends there, and the rules that are still alive, i.e., that may
+// match if the scan goes on, so the precedence decisions of the subset construction can be read
+// from the generated code.
+func (b *LexerBuilder) writeStateComment(scope *parser.NexProgram, v *graph.Node, alive []int) {
+	ids := func(rules []int) string {
+		s := make([]string, len(rules))
+		for i, rule := range rules {
+			s[i] = b.ruleId(scope, rule)
+		}
+		return strings.Join(s, ", ")
+	}
+	switch {
+	case v.Accept < 0:
+		b.writef("// State %d accepts no rule.", v.Id)
+	case len(v.Accepts) == 1:
+		b.writef("// State %d accepts %s /%s/.", v.Id, ids(v.Accepts), scope.Children[v.Accept-1].Regex)
+	default:
+		b.writef("// State %d accepts %s, of which %s /%s/ wins, as it comes first", v.Id, ids(v.Accepts),
+			b.ruleId(scope, v.Accept), scope.Children[v.Accept-1].Regex)
+		if len(b.ruleSets) > 0 || len(b.guarded) > 0 {
+			b.writeString(", unless it is disabled or guarded")
+		}
+		b.writeString(".")
+	}
+	if len(alive) > 0 {
+		b.writef(" Alive: %s.", ids(alive))
+	}
+	b.writeString("\n")
+}
+
+// explainStates returns the rules that are alive at each state of the DFA, if the states are
+// explained, and nil otherwise. A minified lexer hides the regexes, so its states are not explained.
+func (b *LexerBuilder) explainStates(states []*graph.Node) [][]int {
+	if !b.ExplainStates || b.Minify {
+		return nil
+	}
+	return aliveRules(states)
+}
@@ -0,0 +1,159 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// checkGenericOptions reports the options that a generic lexer may not have, as they need the
+// type of the semantic values.
+func (b *LexerBuilder) checkGenericOptions(program *parser.NexProgram) {
+	if !b.generic {
+		return
+	}
+	for _, o := range []struct {
+		on   bool
+		what string
+	}{
+		{b.Standalone, "a standalone lexer has no Lexer type"},
+		{b.Package != "", "Next needs the type of the semantic values"},
+		{len(b.Aliases) > 0, "the aliases need the type of the semantic values"},
+		{program.SymType() != "", "%yystype sets the type of the semantic values"},
+	} {
+		if o.on {
+			b.reportError(fmt.Errorf("generic: %s", o.what))
+		}
+	}
+}
+
+// instantiate instantiates a generic lexer with any in the code that nex generates around it,
+// like the example, which scans the tokens without their semantic values.
+func (b *LexerBuilder) instantiate(program *parser.NexProgram, code string) string {
+	if !b.Generic && !program.HasOption("generic") {
+		return code
+	}
+	return strings.NewReplacer(" := NewLexer(", " := NewLexer[any](", "yySymType", "any").Replace(code)
+}
+
+// genericLexer makes the lexer of the code generic in the type of its semantic values, T: Lexer
+// becomes Lexer[T any], whose Lex method takes lval *T, and so do the functions that create it,
+// or call those that do. The declarations of the user code are left as they are.
+func genericLexer(code []byte, userCode string) ([]byte, error) {
+	keep, err := userDeclarations(userCode)
+	if err != nil {
+		return nil, fmt.Errorf("generic: %w", err)
+	}
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", code, goparser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("generic: %w", err)
+	}
+
+	skip := map[*ast.Ident]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+		case *ast.KeyValueExpr:
+			if key, ok := n.Key.(*ast.Ident); ok {
+				skip[key] = true
+			}
+		case *ast.Field:
+			for _, name := range n.Names {
+				skip[name] = true
+			}
+		case *ast.FuncDecl:
+			skip[n.Name] = true
+		case *ast.TypeSpec:
+			skip[n.Name] = true
+		}
+		return true
+	})
+	refers := func(n ast.Node, names map[string]bool) bool {
+		found := false
+		ast.Inspect(n, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && !skip[id] && names[id.Name] {
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+
+	// The references to the names of generic are instantiated with T.
+	generic := map[string]bool{"Lexer": true}
+	var lexer *ast.TypeSpec
+	var decls []ast.Decl
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil || !keep[d.Name.Name] {
+				decls = append(decls, d)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok && spec.Name.Name == "Lexer" {
+					lexer = spec
+					decls = append(decls, d)
+				}
+			}
+		}
+	}
+	if lexer == nil {
+		return nil, fmt.Errorf("generic: the code declares no Lexer type")
+	}
+	symType := map[string]bool{"yySymType": true}
+	for changed := true; changed; {
+		changed = false
+		for _, d := range decls {
+			fn, ok := d.(*ast.FuncDecl)
+			if ok && fn.Recv == nil && !generic[fn.Name.Name] && (refers(fn, generic) || refers(fn, symType)) {
+				generic[fn.Name.Name] = true
+				changed = true
+			}
+		}
+	}
+
+	typeParams := func() *ast.FieldList {
+		return &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{ast.NewIdent("T")}, Type: ast.NewIdent("any")}}}
+	}
+	for _, d := range decls {
+		if !refers(d, generic) && !refers(d, symType) {
+			continue
+		}
+		if refers(d, map[string]bool{"T": true}) {
+			return nil, fmt.Errorf("generic: line %d: T conflicts with the type parameter", fset.Position(d.Pos()).Line)
+		}
+		if d, ok := d.(*ast.FuncDecl); ok && d.Recv == nil && generic[d.Name.Name] {
+			d.Type.TypeParams = typeParams()
+		}
+		ast.Inspect(d, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			switch {
+			case !ok || skip[id]:
+			case id.Name == "yySymType":
+				id.Name = "T"
+			case generic[id.Name]:
+				// The printer writes the name as it is, so the instantiation may follow it.
+				id.Name += "[T]"
+			}
+			return true
+		})
+	}
+	// The type parameter of the lexer is added last, so the check above does not take it for a
+	// conflict when a field refers to the lexer, like initFun.
+	lexer.TypeParams = typeParams()
+
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
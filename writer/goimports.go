@@ -0,0 +1,20 @@
+//go:build !nex_stdformat
+
+package writer
+
+import "golang.org/x/tools/imports"
+
+// haveGoimports is true, as nex is built with golang.org/x/tools. Programs that embed nex as a
+// library may build it with the nex_stdformat tag instead, which drops the dependency, and then
+// format the generated code with go/format only, as with the std format.
+const haveGoimports = true
+
+// goimports formats the code and fixes its imports with golang.org/x/tools/imports.
+func goimports(src []byte) ([]byte, error) {
+	return imports.Process("main.go", src, &imports.Options{
+		TabWidth:  8,
+		TabIndent: true,
+		Comments:  true,
+		Fragment:  true,
+	})
+}
@@ -0,0 +1,12 @@
+//go:build nex_stdformat
+
+package writer
+
+import "fmt"
+
+// haveGoimports is false, as nex is built with the nex_stdformat tag, without golang.org/x/tools.
+const haveGoimports = false
+
+func goimports(src []byte) ([]byte, error) {
+	return src, fmt.Errorf("goimports: nex is built without golang.org/x/tools")
+}
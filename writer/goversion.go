@@ -0,0 +1,184 @@
+package writer
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"go/importer"
+	goparser "go/parser"
+	"go/token"
+	"go/types"
+	"go/version"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// writeBuildConstraint writes the `//go:build` line of the BuildConstraint, if any. The program,
+// if any, may not have a line of its own in a `%top` block.
+func (b *LexerBuilder) writeBuildConstraint(program *parser.NexProgram) {
+	if b.BuildConstraint == "" {
+		return
+	}
+	if _, err := constraint.Parse("//go:build " + b.BuildConstraint); err != nil {
+		b.reportError(fmt.Errorf("build constraint: %w", err))
+		return
+	}
+	if program != nil {
+		for _, p := range program.Parameters {
+			if p.Key == "top" && strings.Contains(p.Value, "//go:build") {
+				b.reportError(fmt.Errorf("build constraint: a %%top block has a //go:build line too"))
+			}
+		}
+	}
+	b.writef("//go:build %s\n\n", b.BuildConstraint)
+}
+
+// checkGoVersion returns an error if the code uses features of the language, or names of the
+// standard library, that are newer than GoVersion. The names are looked up in the api files of
+// GOROOT, and are not checked if it has none. The declarations of the other files of the package,
+// and of the packages that the standard library does not have, are not known, so the errors that
+// they cause are ignored.
+func (b *LexerBuilder) checkGoVersion(code []byte) error {
+	if b.GoVersion == "" {
+		return nil
+	}
+	goVersion := b.goVersion()
+	if goVersion == "" {
+		return fmt.Errorf("go version: bad version %q", b.GoVersion)
+	}
+
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", code, 0)
+	if err != nil {
+		return fmt.Errorf("go version: %w", err)
+	}
+	type problem struct {
+		line int
+		msg  string
+	}
+	var problems []problem
+	info := &types.Info{Uses: map[*ast.Ident]types.Object{}}
+	conf := types.Config{
+		GoVersion: goVersion,
+		Importer:  importer.Default(),
+		Error: func(err error) {
+			if e, ok := err.(types.Error); ok && strings.Contains(e.Msg, "requires go1.") {
+				problems = append(problems, problem{fset.Position(e.Pos).Line, e.Msg})
+			}
+		},
+	}
+	_, _ = conf.Check("", fset, []*ast.File{f}, info)
+
+	apis := apiVersions()
+	for id, obj := range info.Uses {
+		name := apiName(obj)
+		if v := apis[name]; v != "" && version.Compare(v, goVersion) > 0 {
+			name = obj.Pkg().Name() + strings.TrimPrefix(name, obj.Pkg().Path())
+			problems = append(problems, problem{fset.Position(id.Pos()).Line, fmt.Sprintf("%s requires %s or later", name, v)})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.SortFunc(problems, func(a, b problem) int { return cmp.Or(a.line-b.line, strings.Compare(a.msg, b.msg)) })
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		msgs[i] = fmt.Sprintf("line %d: %s", p.line, p.msg)
+	}
+	return fmt.Errorf("go version %s: %s", goVersion, strings.Join(slices.Compact(msgs), "; "))
+}
+
+// goVersion returns the language version of GoVersion, like go1.19 for 1.19.2, or "" if it is
+// not set or not valid.
+func (b *LexerBuilder) goVersion() string {
+	v := b.GoVersion
+	if v != "" && !strings.HasPrefix(v, "go") {
+		v = "go" + v
+	}
+	return version.Lang(v)
+}
+
+// apiName returns the name of an exported object of the standard library in the api files, like
+// sync/atomic.Bool for a type and sync/atomic.Bool.Load for its method, or "" for other objects.
+func apiName(obj types.Object) string {
+	if obj.Pkg() == nil || !obj.Exported() || strings.Contains(strings.Split(obj.Pkg().Path(), "/")[0], ".") {
+		return ""
+	}
+	switch obj := obj.(type) {
+	case *types.Func:
+		if recv := obj.Type().(*types.Signature).Recv(); recv != nil {
+			t := recv.Type()
+			if p, ok := t.(*types.Pointer); ok {
+				t = p.Elem()
+			}
+			if named, ok := t.(*types.Named); ok {
+				return obj.Pkg().Path() + "." + named.Obj().Name() + "." + obj.Name()
+			}
+			return ""
+		}
+	case *types.Var:
+		if obj.IsField() {
+			return ""
+		}
+	}
+	if obj.Parent() != obj.Pkg().Scope() {
+		return ""
+	}
+	return obj.Pkg().Path() + "." + obj.Name()
+}
+
+var (
+	apiDecl   = regexp.MustCompile(`^pkg ([^ ,]+)(?: \([^)]*\))?, (?:func|type|const|var) (\w+)`)
+	apiMethod = regexp.MustCompile(`^pkg ([^ ,]+)(?: \([^)]*\))?, method \(\*?(\w+)(?:\[[^\]]*\])?\) (\w+)`)
+)
+
+// apiVersions maps the names of the api files of GOROOT, see apiName, to the versions of Go
+// that added them.
+var apiVersions = sync.OnceValue(func() map[string]string {
+	versions := map[string]string{}
+	files, _ := filepath.Glob(filepath.Join(build.Default.GOROOT, "api", "go1*.txt"))
+	slices.SortFunc(files, func(a, b string) int {
+		return version.Compare(apiFileVersion(a), apiFileVersion(b))
+	})
+	for _, file := range files {
+		v := apiFileVersion(file)
+		if v == "go1" {
+			// The names of the first release need no check.
+			v = ""
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var name string
+			if m := apiMethod.FindStringSubmatch(scanner.Text()); m != nil {
+				name = m[1] + "." + m[2] + "." + m[3]
+			} else if m = apiDecl.FindStringSubmatch(scanner.Text()); m != nil {
+				name = m[1] + "." + m[2]
+			} else {
+				continue
+			}
+			if _, ok := versions[name]; !ok {
+				versions[name] = v
+			}
+		}
+		_ = f.Close()
+	}
+	return versions
+})
+
+// apiFileVersion returns the version of an api file, like go1.19 for go1.19.txt.
+func apiFileVersion(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), ".txt")
+}
@@ -0,0 +1,56 @@
+package writer
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// generator returns the tool that the "Code generated" comments name: the Generator option, or
+// else that of `%generator`, or else nex.
+func (b *LexerBuilder) generator(program *parser.NexProgram) string {
+	generator := b.Generator
+	if program != nil {
+		generator = cmp.Or(generator, program.Generator())
+	}
+	if strings.Contains(generator, "\n") {
+		b.reportError(fmt.Errorf("header: the generator must be a single line"))
+		return "nex"
+	}
+	return cmp.Or(generator, "nex")
+}
+
+// writeHeader writes the "Code generated" comment of a generated file, the command that generated
+// it if command is set, and the header block, if any. The program, if any, may set them with
+// `%generator`, `%command` and `%header`, which the options of the builder override.
+func (b *LexerBuilder) writeHeader(program *parser.NexProgram, command bool) {
+	cmdLine, header := b.Command, b.Header
+	if program != nil {
+		cmdLine = cmp.Or(cmdLine, program.Command())
+		header = cmp.Or(header, program.Header())
+	}
+	if strings.Contains(cmdLine, "\n") {
+		b.reportError(fmt.Errorf("header: the command must be a single line"))
+		return
+	}
+	b.writef("// Code generated by %s. DO NOT EDIT.\n", b.generator(program))
+	if command && !b.Minify && cmdLine != "-" {
+		b.writef("// Command: %s.\n", cmp.Or(cmdLine, strings.Join(os.Args, " ")))
+	}
+	if header = strings.TrimSpace(header); header != "" {
+		b.writeString("\n")
+		for _, line := range strings.Split(header, "\n") {
+			switch line = strings.TrimRight(line, " \t"); {
+			case strings.HasPrefix(line, "//"):
+				b.writeString(line + "\n")
+			case line == "":
+				b.writeString("//\n")
+			default:
+				b.writeString("// " + line + "\n")
+			}
+		}
+	}
+}
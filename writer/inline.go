@@ -0,0 +1,154 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/liran-funaro/nex/nexruntime"
+)
+
+// inlineRuntime returns the source of the nexruntime package without the given regions,
+// so it can be pasted into the generated code, along with the packages it imports.
+// The exported top-level names of the package are unexported (e.g., NewSource becomes newSource),
+// so a generated lexer only exports its own API.
+func inlineRuntime(strip ...string) (imports []string, code string, err error) {
+	names, err := fs.Glob(nexruntime.Sources, "*.go")
+	if err != nil {
+		return nil, "", err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		text, err := fs.ReadFile(nexruntime.Sources, name)
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := goparser.ParseFile(fset, name, stripRegions(string(text), strip...), goparser.ParseComments)
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, f)
+	}
+
+	renames := map[string]string{}
+	for _, f := range files {
+		for _, name := range topLevelNames(f) {
+			if ast.IsExported(name) {
+				renames[name] = unexport(name)
+			}
+		}
+	}
+
+	structs := structTypes(files...)
+	var out strings.Builder
+	for _, f := range files {
+		if err = renameIdents(f, renames, structs); err != nil {
+			return nil, "", fmt.Errorf("inline runtime: %w", err)
+		}
+		cut := f.Name.End()
+		for _, spec := range f.Imports {
+			imports = append(imports, spec.Path.Value)
+		}
+		for _, d := range f.Decls {
+			if g, ok := d.(*ast.GenDecl); ok && g.Tok == token.IMPORT {
+				cut = g.End()
+			}
+		}
+
+		var buf bytes.Buffer
+		if err = format.Node(&buf, fset, f); err != nil {
+			return nil, "", err
+		}
+		out.Write(buf.Bytes()[fset.Position(cut).Offset:])
+	}
+	slices.Sort(imports)
+	return slices.Compact(imports), out.String(), nil
+}
+
+func topLevelNames(f *ast.File) []string {
+	var names []string
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				names = append(names, d.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					names = append(names, spec.Name.Name)
+				case *ast.ValueSpec:
+					for _, n := range spec.Names {
+						names = append(names, n.Name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// unexport lowercases the first letter of a name, or the whole name if it is an acronym (e.g., DFA).
+func unexport(name string) string {
+	if strings.ToUpper(name) == name {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// renameIdents renames the references to the top-level names. Field names, including the keys of
+// the literals of the structs, method names and selectors are never renamed, so the runtime must
+// not use top-level names for them. It fails if another identifier is already named like one of
+// the renamed names, as it would be shadowed or shadow the renamed name.
+func renameIdents(f *ast.File, renames map[string]string, structs map[string]bool) error {
+	names := map[string]bool{}
+	for name := range renames {
+		names[name] = true
+	}
+	skip := map[*ast.Ident]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+		case *ast.CompositeLit:
+			skipFieldKeys(skip, n, structs, names)
+		case *ast.Field:
+			for _, name := range n.Names {
+				skip[name] = true
+			}
+		case *ast.FuncDecl:
+			if n.Recv != nil {
+				skip[n.Name] = true
+			}
+		}
+		return true
+	})
+
+	renamed := map[string]bool{}
+	for _, to := range renames {
+		renamed[to] = true
+	}
+	var err error
+	ast.Inspect(f, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || skip[id] {
+			return true
+		}
+		if to, ok := renames[id.Name]; ok {
+			id.Name = to
+		} else if renamed[id.Name] && err == nil {
+			err = fmt.Errorf("%s: %q conflicts with a renamed identifier", f.Name.Name, id.Name)
+		}
+		return true
+	})
+	return err
+}
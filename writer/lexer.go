@@ -2,18 +2,73 @@ package writer
 
 // [PREAMBLE PLACEHOLDER]
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	// [BEGIN RUNTIME]
+	"github.com/liran-funaro/nex/nexruntime"
+	// [END RUNTIME]
 )
 
+// Lexer scans an input with the rules of the spec. Its Lex method implements the yyLexer
+// interface of goyacc, so a parser can scan its tokens with it.
 type Lexer struct {
-	// The lexer runs in a goroutine, and communicates via a channel.
-	ch       chan *frame
-	ctx      context.Context
-	cancel   context.CancelFunc
+	// The source produces frames for the Lex method.
+	src      *source
 	curFrame *frame
+	stopped  bool
+	// The function of NewLexerWithInit, which Reset runs again.
+	initFun func(*Lexer)
+
+	// [BEGIN ASYNC]
+	// In the asynchronous mode, the source runs in a goroutine, and communicates via a channel.
+	ch     chan *frame
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The high-watermark of the frames in ch and its callback, see SetBuffer, and whether the
+	// source waits for Lex to take a frame.
+	highWatermark int
+	onHigh        func(pending int)
+	blocked       atomic.Bool
+	// [END ASYNC]
+
+	// [BEGIN RULESETS]
+	ruleSets *ruleSets
+	// [END RULESETS]
+
+	// [BEGIN OBSERVER]
+	observer LexerObserver
+	// [END OBSERVER]
+
+	// [BEGIN PUSH]
+	// The input that Write pushes, if the lexer is a push lexer.
+	push *io.PipeWriter
+	// [END PUSH]
+
+	// [BEGIN REPLAY]
+	// The output of Record, and the recorded frames that a replaying lexer returns instead of
+	// scanning.
+	recording io.Writer
+	replaying bool
+	replay    []*frame
+	// [END REPLAY]
+
+	// [BEGIN ARENA]
+	// The arena of the frames and of the strings of Text and Gap, see SetArena.
+	arena *arena
+	// [END ARENA]
+
+	// [BEGIN LOSSLESS]
+	// The gap of the end of the input, see EndGap.
+	endGap []rune
+	// [END LOSSLESS]
+
+	// The output of Echo, or os.Stdout if it is nil.
+	echoOutput io.Writer
 
 	parseResult any
 	parseError  error
@@ -21,7 +76,7 @@ type Lexer struct {
 	// [NEX END OF LEXER STRUCT]
 }
 
-// NewLexer creates a new lexer without init.
+// NewLexer returns a lexer of the input, like NewLexerWithInit without an init function.
 //
 //goland:noinspection GoUnusedExportedFunction
 func NewLexer(in io.Reader) *Lexer {
@@ -31,327 +86,861 @@ func NewLexer(in io.Reader) *Lexer {
 // NewLexerWithInit creates a new Lexer object, runs the given callback on it,
 // then returns it.
 func NewLexerWithInit(in io.Reader, initFun func(*Lexer)) *Lexer {
-	ctx, cancel := context.WithCancel(context.Background())
-	yylex := &Lexer{
-		ch:     make(chan *frame),
-		ctx:    ctx,
-		cancel: cancel,
-	}
-	if initFun != nil {
-		initFun(yylex)
-	}
-	go yylex.scanRoot(in)
+	return newLexerAt(in, 0, 0, initFun)
+}
+
+// [BEGIN PUSH]
+
+// NewPushLexer creates a new lexer whose input is pushed to it with Write, e.g., as it arrives
+// from the network, until Close ends it, instead of being read from a reader. Lex waits for the
+// input that the scanner needs to find the next match, and Write waits for the scanner to read
+// the input, so they are called from different goroutines.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewPushLexer(initFun func(*Lexer)) *Lexer {
+	r, w := io.Pipe()
+	yylex := newLexerAt(r, 0, 0, initFun)
+	yylex.push = w
 	return yylex
 }
 
-// Stop cancels the background scanner.
-func (yylex *Lexer) Stop() {
-	yylex.cancel()
+// Write pushes the input to a push lexer. It returns io.ErrClosedPipe after Close or Stop.
+func (yylex *Lexer) Write(p []byte) (int, error) {
+	if yylex.push == nil {
+		return 0, fmt.Errorf("write: not a push lexer")
+	}
+	return yylex.push.Write(p)
 }
 
-// Text returns the matched text.
-func (yylex *Lexer) Text() string {
-	if yylex.curFrame == nil {
-		return ""
+// Close ends the input of a push lexer, after which Lex returns the tokens of the rest of it,
+// and then 0. SetEndOfInput sets how the scanner resolves a match that Close cuts short.
+func (yylex *Lexer) Close() error {
+	if yylex.push == nil {
+		return fmt.Errorf("close: not a push lexer")
 	}
-	return string(yylex.curFrame.text)
+	return yylex.push.Close()
 }
 
-// Line returns the current line number.
-// The first line is 0.
-func (yylex *Lexer) Line() int {
-	if yylex.curFrame == nil {
-		return 0
+// EndOfInput is how the lexer resolves the text that the end of the input cuts in the middle of
+// a match, like `"abc` for a rule of quoted strings, e.g., when Close ends the input of a push
+// lexer that has not received the rest of it.
+type EndOfInput int
+
+const (
+	// EndLongestMatch matches the longest prefix of the text that a rule matches, and scans the
+	// rest of it again, like at the end of any input. It is the default.
+	EndLongestMatch EndOfInput = iota
+	// EndUnmatched leaves all of the text unmatched, so `%error` and Gap see it as an error.
+	EndUnmatched
+)
+
+// SetEndOfInput sets how the lexer resolves the text that the end of the input cuts in the middle
+// of a match. It must be called in the init function, before the lexer scans.
+func (yylex *Lexer) SetEndOfInput(end EndOfInput) {
+	if end == EndUnmatched {
+		yylex.src.UnmatchTruncated()
 	}
-	return yylex.curFrame.line
 }
 
-// Column returns the current column number.
-// The first column is 0.
-func (yylex *Lexer) Column() int {
-	if yylex.curFrame == nil {
-		return 0
+// [END PUSH]
+
+// [BEGIN SECTION]
+
+// NewSectionLexer creates a new lexer that scans a section of a larger input.
+// If outerPositions is false, Line() and Column() are relative to the beginning of the section.
+// Otherwise, they are relative to the beginning of the underlying input, which requires
+// reading the input that precedes the section.
+// In both cases, the beginning of the section is considered the beginning of the text,
+// and Offset() is relative to it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewSectionLexer(section *io.SectionReader, outerPositions bool, initFun func(*Lexer)) (*Lexer, error) {
+	var line, column int
+	if outerPositions {
+		outer, off, _ := section.Outer()
+		var err error
+		line, column, err = countPosition(io.NewSectionReader(outer, 0, off))
+		if err != nil {
+			return nil, err
+		}
 	}
-	return yylex.curFrame.column
+	return newLexerAt(section, line, column, initFun), nil
+}
+
+// [END SECTION]
+
+// [BEGIN BYTES]
+
+// NewBytesLexer creates a new lexer that scans data in place, instead of reading it from a
+// reader, and that looks up the transitions of the ASCII runes in a table of each state, for the
+// throughput of log processing. data must not be modified while the lexer scans it.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewBytesLexer(data []byte, initFun func(*Lexer)) *Lexer {
+	return newLexerOf(newBytesSource(&programDfa, data, 0, 0), initFun)
+}
+
+// [END BYTES]
+
+func newLexerAt(in io.Reader, line, column int, initFun func(*Lexer)) *Lexer {
+	return newLexerOf(newSource(&programDfa, in, line, column), initFun)
 }
 
-func (yylex *Lexer) appendFrame(kind frameKind, state int, text []rune, line int, column int) {
-	select {
-	case <-yylex.ctx.Done():
-	case yylex.ch <- &frame{frameKey{kind, state}, text, line, column}:
+func newLexerOf(src *source, initFun func(*Lexer)) *Lexer {
+	yylex := &Lexer{src: src, initFun: initFun}
+	// [BEGIN ASYNC]
+	yylex.ctx, yylex.cancel = context.WithCancel(context.Background())
+	yylex.ch = make(chan *frame)
+	// [END ASYNC]
+	// [BEGIN RULESETS]
+	yylex.ruleSets = newRuleSets(&programDfa)
+	yylex.src.SetRuleSets(yylex.ruleSets)
+	// [END RULESETS]
+	// [BEGIN GUARDS]
+	yylex.src.SetGuard(yylex.guard)
+	// [END GUARDS]
+	// [BEGIN ERRORS]
+	yylex.src.EmitErrors()
+	// [END ERRORS]
+	// [BEGIN LOSSLESS]
+	yylex.src.Lossless()
+	// [END LOSSLESS]
+	// [BEGIN INIT]
+	yylex.specInit()
+	// [END INIT]
+	if initFun != nil {
+		initFun(yylex)
 	}
+	// [BEGIN ASYNC]
+	go yylex.produce()
+	// [END ASYNC]
+	return yylex
 }
 
-func (yylex *Lexer) scanRoot(in io.Reader) {
-	defer close(yylex.ch)
-	yylex.appendFrame(kStartCode, 0, nil, 0, 0)
-	yylex.scan(&scanner{dfa: &programDfa, in: bufio.NewReader(in)})
-	yylex.appendFrame(kEndCode, 0, nil, 0, 0)
-}
-
-func (yylex *Lexer) scan(s *scanner) {
-	if s == nil {
-		return
-	}
-
-	for yylex.ctx.Err() == nil {
-		// The DFA starts at state 0.
-		st := 0
-		s.matchPos = -1
-		s.matchAccept = -1
-
-		madeProgress := true
-		for madeProgress && st >= 0 {
-			madeProgress = false
-			if curState := &s.dfa.states[st]; curState.assertStep != nil {
-				if a := s.consumeAsserts(curState.assertMask); a != 0 {
-					st = curState.assertStep(a)
-					s.checkAccept(st)
-					madeProgress = true
-				}
-			}
+// [BEGIN REPLAY]
 
-			if st < 0 {
-				break
-			}
+// NewReplayLexer creates a new lexer that replays a recording of Record instead of scanning an
+// input, e.g., to test a parser without the lexer. It runs the actions of the recorded matches
+// again, so they return the same tokens and set the same values, as long as the rules are the same.
+// Gap() is empty, as the gaps are not recorded.
+//
+//goland:noinspection GoUnusedExportedFunction
+func NewReplayLexer(recording io.Reader) (*Lexer, error) {
+	frames, err := readRecording(recording)
+	if err != nil {
+		return nil, err
+	}
+	yylex := newLexerAt(io.MultiReader(), 0, 0, nil)
+	yylex.replaying, yylex.replay = true, frames
+	return yylex, nil
+}
 
-			if curState := &s.dfa.states[st]; curState.runeStep != nil {
-				if r, ok := s.consumeRune(); ok {
-					st = curState.runeStep(r)
-					s.checkAccept(st)
-					madeProgress = true
-				}
-			}
-		}
+// Record writes each token that Lex returns to out, with its text and position, one per line,
+// or stops recording if out is nil. NewReplayLexer replays the recording.
+func (yylex *Lexer) Record(out io.Writer) {
+	yylex.recording = out
+}
 
-		// DFA is stuck. Return last match if it exists, otherwise advance by one rune and restart.
-		if s.matchPos < s.minCapture {
-			if len(s.runes) == 0 {
-				// This can only happen at the end of input.
-				return
-			}
-			s.resetBuffer(1)
-		} else {
-			text := s.runes[:s.matchPos]
-			yylex.appendFrame(kStartCode, s.matchAccept, text, s.line, s.column)
-			yylex.scan(s.getNest(s.matchAccept, text))
-			yylex.appendFrame(kEndCode, s.matchAccept, text, s.line, s.column)
-			s.resetBuffer(s.matchPos)
+// [END REPLAY]
+
+// [BEGIN SEARCH]
+
+// Match is a match of a top-level rule that FindAll found.
+type Match struct {
+	Rule         int // The number of the rule, from 1, see `%name`.
+	Text         string
+	Line, Column int
+	Offset       int64
+}
+
+// FindAll returns the matches of the top-level rules in the input, like those that Lex sees,
+// without running any action, so the rules of the lexer double as a set of patterns to search for.
+// The unmatched text is skipped. Every rule may match, as rule sets and guards do not apply,
+// including the rules without code, which Lex skips.
+//
+//goland:noinspection GoUnusedExportedFunction
+func FindAll(input string) []Match {
+	d := programDfa
+	// [BEGIN SKIP]
+	d.Skip = nil
+	// [END SKIP]
+	var matches []Match
+	src := newSource(&d, strings.NewReader(input), 0, 0)
+	for f := src.Next(); f != nil; f = src.Next() {
+		if f.Key.Kind == kStartCode && f.Key.Scope == 0 && f.Key.Rule > 0 {
+			matches = append(matches, Match{f.Key.Rule, string(f.Text), f.Line, f.Column, f.Offset})
 		}
 	}
+	return matches
 }
 
-type asserts = uint64
+// [END SEARCH]
 
-const (
-	aStartText asserts = 1 << iota
-	aEndText
-	aStartLine
-	aEndLine
-	aWordBoundary
-	aNoWordBoundary
-)
+// [BEGIN ANONYMIZE]
+
+// Anonymize copies the input to out, with the text of each match of a top-level rule that replace
+// has a function for, by its number, see `%name`, replaced by what the function returns, e.g., to
+// share an input that reproduces a bug without its identifiers, strings or numbers. All the other
+// bytes are copied exactly, including the unmatched ones. Like FindAll, it runs no action, rule
+// sets and guards do not apply, and the rules without code match too.
+//
+//goland:noinspection GoUnusedExportedFunction
+func Anonymize(in io.Reader, out io.Writer, replace map[int]func(text string) string) error {
+	return anonymize(&programDfa, in, out, replace)
+}
 
-type frameKind int
+// [END ANONYMIZE]
 
-const (
-	kStartCode frameKind = iota
-	kEndCode
-)
+// [BEGIN LOSSLESS]
+
+// CheckLossless returns an error, with the first byte where they differ, unless Gap and Text of
+// the matches of the top-level rules of the input, in order, and then EndGap, are the input, byte
+// for byte, as a formatter or a rewrite tool that reproduces the input from the tokens needs. The
+// tests of such a tool can assert it for their inputs. Invalid UTF-8 never round-trips, as it is
+// scanned as the replacement character.
+//
+//goland:noinspection GoUnusedExportedFunction
+func CheckLossless(input []byte) error {
+	return checkLossless(&programDfa, input)
+}
+
+// [END LOSSLESS]
+
+// [BEGIN MATCH]
+
+// MatchRule returns true if a top-level rule matches the whole string, e.g., to check that a
+// string is a valid identifier with the rule of the identifiers, even if a rule of a higher
+// precedence, like a keyword, matches it too. Rule sets and guards do not apply.
+//
+//goland:noinspection GoUnusedExportedFunction
+func MatchRule(rule int, s string) bool {
+	return fullMatch(&programDfa, rule, []rune(s))
+}
+
+// [END MATCH]
+
+// [BEGIN SNIFF]
 
-type frameKey struct {
-	kind  frameKind
-	state int
+// Sniff returns the top-level rule of the first token of a prefix of an input, like the first
+// bytes of a file, which it scans as if it were all of the input, without a lexer, e.g., to detect
+// the format or the dialect of the input before scanning it. The rules without code are skipped,
+// as Lex skips them. It returns 0 and false if no rule matches the prefix up to its first token.
+// Rule sets and guards do not apply.
+//
+//goland:noinspection GoUnusedExportedFunction
+func Sniff(prefix []byte) (ruleID int, ok bool) {
+	return sniff(&programDfa, prefix)
 }
 
-type frame struct {
-	key          frameKey
-	text         []rune
-	line, column int
+// [END SNIFF]
+
+// [BEGIN RULESETS]
+
+// EnableRuleSet enables the rules that are annotated with `%ruleset name`, which are disabled by default.
+// In the asynchronous mode, the lexer scans ahead of Lex(), so the change may only apply after the next match.
+func (yylex *Lexer) EnableRuleSet(name string) error {
+	return yylex.ruleSets.Set(name, true)
 }
 
-type state struct {
-	accept     int               // Accept index.
-	assertMask asserts           // We only apply assert-transition with masked bits.
-	assertStep func(asserts) int // Assert transition.
-	runeStep   func(rune) int    // Rune transition.
+// DisableRuleSet disables the rules that are annotated with `%ruleset name`.
+// A rule that belongs to several rule sets is enabled as long as one of them is enabled.
+func (yylex *Lexer) DisableRuleSet(name string) error {
+	return yylex.ruleSets.Set(name, false)
 }
 
-type dfa struct {
-	states []state
-	nest   map[int]dfa
+// [END RULESETS]
+
+// [BEGIN STATS]
+
+// LexerStats are the counts of a lexer so far. In the asynchronous mode, the lexer scans ahead
+// of Lex(), so they may include the next match.
+type LexerStats struct {
+	Matches   int // The matches of the rules of all scopes.
+	Runes     int // The runes read from the input.
+	Bytes     int // The bytes read from the input.
+	Errors    int // The runs of unmatched text, after which the scanner resynchronized.
+	MaxBuffer int // The most runes that were buffered at once.
 }
 
-type scanner struct {
-	dfa *dfa
+// Stats returns the counts of the lexer so far. It may be called from any goroutine.
+func (yylex *Lexer) Stats() LexerStats {
+	return LexerStats(yylex.src.Stats())
+}
 
-	// in should be nil when EOF is reached
-	in *bufio.Reader
+// [END STATS]
 
-	runes          []rune
-	asserts        []asserts
-	pos            int
-	consumedAssert bool
-	minCapture     int
+// [BEGIN OBSERVER]
 
-	matchPos, matchAccept int
-	line, column          int
+// LexerObserver receives the events of a lexer, so that the embedding program can trace and count
+// them, e.g., with OpenTelemetry spans and counters.
+type LexerObserver interface {
+	// LexStarted is called when Lex() starts. The function that it returns is called with the token
+	// that Lex() returns, which is 0 at the end of the input.
+	LexStarted() (done func(token int))
+	// Unmatched is called for each run of unmatched text, with its position.
+	Unmatched(text string, line, column int)
 }
 
-func (s *scanner) loadNext() {
-	s.loadNextRune()
-	s.loadNextAsserts()
+// SetObserver sets the observer of the lexer's events, or removes it if it is nil.
+// It is not safe to call it concurrently with Lex().
+func (yylex *Lexer) SetObserver(observer LexerObserver) {
+	yylex.observer = observer
 }
 
-func (s *scanner) loadNextRune() {
-	if s.pos < len(s.runes) || s.in == nil {
-		return
-	}
+// [END OBSERVER]
 
-	r, _, err := s.in.ReadRune()
-	switch err {
-	case nil:
-		s.runes = append(s.runes, r)
-	case io.EOF:
-		s.in = nil
-	default:
-		panic(err)
-	}
+// [BEGIN ARENA]
+
+// LexerArena allocates the frames of the lexers that use it, which are the structs of their
+// matches, and the strings of Text and Gap, in slabs that Reset prepares for the next document,
+// so that lexing many small documents in a batch allocates little for each of them. The zero
+// value is an empty arena.
+type LexerArena struct {
+	arena arena
+}
+
+// Reset reuses the frames of the arena for the next document, and starts a slab for its strings
+// that fits those of the previous one. The strings of Text and Gap that the lexer returned stay
+// valid, as their slab is never overwritten. It may only be called after Lex returns 0, or after
+// Stop with -sync.
+func (a *LexerArena) Reset() {
+	a.arena.Reset()
 }
 
-func isWord(r rune) bool {
-	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+// SetArena makes the lexer allocate its frames and the strings of Text and Gap in the arena.
+// An arena is used by one lexer at a time. It must be called in the init function of
+// NewLexerWithInit, before the scanner starts.
+func (yylex *Lexer) SetArena(a *LexerArena) {
+	yylex.arena = &a.arena
+	yylex.src.SetArena(yylex.arena)
 }
 
-// loadNextAsserts must be called after loadNextRune()
-func (s *scanner) loadNextAsserts() {
-	if s.pos < len(s.asserts) {
-		return
+// [END ARENA]
+
+// [BEGIN TRACE]
+
+// SetTrace makes the lexer write a line to out for each step of its scanner: each scan and where
+// it starts, each transition of the DFA, each rule that matches so far, the match that wins or
+// the rune that no rule matches, and each reset of the buffer, e.g., to find out why a rule does
+// not match. It must be called in the init function of NewLexerWithInit, before the scanner
+// starts.
+func (yylex *Lexer) SetTrace(out io.Writer) {
+	yylex.src.SetTrace(out, yylex.ruleName)
+}
+
+// [END TRACE]
+
+// Stop cancels the scanner. Frames that were already scanned may still be processed.
+func (yylex *Lexer) Stop() {
+	yylex.stopped = true
+	// [BEGIN ASYNC]
+	yylex.cancel()
+	// [END ASYNC]
+	// [BEGIN PUSH]
+	if yylex.push != nil {
+		// Ending the input ends the scanner, and fails the writes that wait for it, and the later ones.
+		_ = yylex.push.Close()
 	}
+	// [END PUSH]
+}
 
-	var a asserts
-	var r1, r2 rune
-	if s.pos == 0 {
-		a |= aStartText | aStartLine
-	} else {
-		r1 = s.runes[s.pos-1]
+// Reset makes the lexer scan another input from the start, as a new lexer of NewLexerWithInit
+// would, but it reuses the lexer and the buffers of its scanner, so one lexer may scan many
+// inputs, e.g., one per request of a server. The rule sets are reset to their defaults, and the
+// `%init` code and the init function run again, so the rule sets that it enables stay enabled.
+// Reset ends the scan of the previous input, and waits for the scanner to return from reading it.
+// The input of a push lexer is closed, and it scans in instead. The runes that TextRunes returned
+// for the previous input are invalid afterwards.
+func (yylex *Lexer) Reset(in io.Reader) {
+	yylex.restart()
+	yylex.src.Reset(in, 0, 0)
+	// [BEGIN INIT]
+	yylex.specInit()
+	// [END INIT]
+	if yylex.initFun != nil {
+		yylex.initFun(yylex)
 	}
+	// [BEGIN ASYNC]
+	go yylex.produce()
+	// [END ASYNC]
+}
+
+// [BEGIN CHECKPOINT]
+
+// SaveState returns a checkpoint of the scan, from which RestoreState resumes it, e.g., after a
+// long-running ingestion job restarts, and the offset in bytes of the input at which the scanner
+// reads on. The checkpoint holds the runes that the scanner buffered, the positions, the open
+// scopes, the enabled rule sets and the matches whose actions did not run yet; if SaveState is
+// called from an action, the scan resumes after its match. The fields of the spec are not saved.
+func (yylex *Lexer) SaveState() (checkpoint []byte, offset int64, err error) {
+	return yylex.src.SaveState()
+}
 
-	if s.pos == len(s.runes) {
-		a |= aEndText | aEndLine
-	} else {
-		r2 = s.runes[s.pos]
+// RestoreState makes the lexer resume the scan from a checkpoint of SaveState, as Reset makes
+// it scan another input, but without running the `%init` code again. The input must start at the
+// offset that SaveState returned, e.g., the file of the scan, opened again and seeked to it. It
+// returns an error if the checkpoint is not of a lexer of the same spec.
+func (yylex *Lexer) RestoreState(checkpoint []byte, in io.Reader) error {
+	yylex.restart()
+	return yylex.src.RestoreState(checkpoint, in)
+}
+
+// [END CHECKPOINT]
+
+// restart ends the scan of the input, for Reset.
+func (yylex *Lexer) restart() {
+	// [BEGIN PUSH]
+	if yylex.push != nil {
+		// The writes that wait for the scanner fail, and so do the later ones.
+		_ = yylex.push.Close()
+	}
+	// [END PUSH]
+	// [BEGIN ASYNC]
+	// The scanner ends with each input, so it is started again for the next one.
+	yylex.cancel()
+	for range yylex.ch {
 	}
+	yylex.ctx, yylex.cancel = context.WithCancel(context.Background())
+	yylex.ch = make(chan *frame, cap(yylex.ch))
+	yylex.blocked.Store(false)
+	// [END ASYNC]
+	yylex.curFrame, yylex.stopped = nil, false
+	yylex.parseResult, yylex.parseError = nil, nil
+	// [BEGIN REPLAY]
+	yylex.replaying, yylex.replay = false, nil
+	// [END REPLAY]
+	// [BEGIN LOSSLESS]
+	yylex.endGap = nil
+	// [END LOSSLESS]
+}
 
-	if r1 == '\n' {
-		a |= aStartLine
+// Text returns the matched text.
+// It is the text of the current match, which Line and Column locate, e.g., in an action.
+func (yylex *Lexer) Text() string {
+	if yylex.curFrame == nil {
+		return ""
 	}
-	if r2 == '\n' {
-		a |= aEndLine
+	// [BEGIN ARENA]
+	if yylex.arena != nil {
+		return yylex.arena.String(yylex.curFrame.Text)
 	}
+	// [END ARENA]
+	return string(yylex.curFrame.Text)
+}
 
-	if isWord(r1) != isWord(r2) {
-		a |= aWordBoundary
-	} else {
-		a |= aNoWordBoundary
+// Rule returns the number of the rule of the current match within its scope, from 1, which is
+// the constant that `%name` declares for the rule, e.g., for a driver that classifies the tokens
+// of any lexer. It is 0 at the start and at the end of the input.
+func (yylex *Lexer) Rule() int {
+	if yylex.curFrame == nil {
+		return 0
 	}
+	return yylex.curFrame.Key.Rule
+}
 
-	s.asserts = append(s.asserts, a)
+// RuleName returns the `%name` of the rule of the current match, or "" if the rule has no name,
+// or if the lexer is minified.
+func (yylex *Lexer) RuleName() string {
+	if yylex.curFrame == nil {
+		return ""
+	}
+	return yylex.ruleName(yylex.curFrame.Key.Scope, yylex.curFrame.Key.Rule)
 }
 
-func (s *scanner) consumeRune() (rune, bool) {
-	s.loadNext()
-	if s.pos == len(s.runes) {
-		return 0, false
+// Echo writes the matched text to the output that SetEchoOutput sets, which is os.Stdout by default,
+// like the ECHO of lex. With `%option echo`, the unmatched text is echoed too.
+func (yylex *Lexer) Echo() {
+	out := yylex.echoOutput
+	if out == nil {
+		out = os.Stdout
 	}
+	_, _ = io.WriteString(out, yylex.Text())
+}
 
-	i := s.pos
-	s.pos++
-	s.consumedAssert = false
-	return s.runes[i], true
+// SetEchoOutput sets the output of Echo.
+func (yylex *Lexer) SetEchoOutput(out io.Writer) {
+	yylex.echoOutput = out
 }
 
-func (s *scanner) consumeAsserts(mask asserts) asserts {
-	s.loadNext()
-	if s.consumedAssert || s.pos == len(s.asserts) {
+// Line returns the line where the current match starts.
+// The first line is 0.
+func (yylex *Lexer) Line() int {
+	if yylex.curFrame == nil {
+		return 0
+	}
+	return yylex.curFrame.Line
+}
+
+// Column returns the column where the current match starts, in runes.
+// The first column is 0.
+func (yylex *Lexer) Column() int {
+	if yylex.curFrame == nil {
 		return 0
 	}
+	return yylex.curFrame.Column
+}
 
-	s.consumedAssert = true
-	return s.asserts[s.pos] & mask
+// EndLine returns the line right after the current match.
+// It differs from Line if the match spans lines, like a block comment.
+func (yylex *Lexer) EndLine() int {
+	if yylex.curFrame == nil {
+		return 0
+	}
+	return yylex.curFrame.EndLine
 }
 
-func (s *scanner) checkAccept(st int) {
-	if st < 0 {
-		return
+// EndColumn returns the column right after the current match, which is 0 if the match ends
+// with a newline. Line and Column to EndLine and EndColumn is the range of the match.
+func (yylex *Lexer) EndColumn() int {
+	if yylex.curFrame == nil {
+		return 0
 	}
-	accIndex := s.dfa.states[st].accept
-	// Higher precedence match
-	if accIndex > 0 && (s.matchPos < s.pos || accIndex < s.matchAccept) {
-		s.matchAccept, s.matchPos = accIndex, s.pos
+	return yylex.curFrame.EndColumn
+}
+
+// Offset returns the number of runes that precede the current match in the input.
+// Unlike Column, it does not restart at each line, and it is an int64, so it never overflows.
+func (yylex *Lexer) Offset() int64 {
+	if yylex.curFrame == nil {
+		return 0
 	}
+	return yylex.curFrame.Offset
 }
 
-func (s *scanner) resetBuffer(i int) {
-	// We make sure to consume enough runes to discard them.
-	// We load one additional rune before shifting the buffers
-	// because we need both the previous and next runes to correctly
-	// calculate the next assert.
-	for ok := true; ok && s.pos <= i; _, ok = s.consumeRune() {
+// ByteOffset returns the number of bytes that precede the current match in the input, e.g., for
+// the source maps of a parser or the edits of an editor, which need absolute positions. It is more
+// than Offset if some of the runes take several bytes.
+func (yylex *Lexer) ByteOffset() int64 {
+	if yylex.curFrame == nil {
+		return 0
 	}
+	return yylex.curFrame.ByteOffset
+}
 
-	for _, r := range s.runes[:i] {
+// TextPosition returns the line and column of the rune at the given offset within Text().
+// Actions can use it to report errors inside a composite token, like a bad escape in a string.
+// An offset of len(Text()) in runes is the position right after the match.
+func (yylex *Lexer) TextPosition(offset int) (line, column int) {
+	if yylex.curFrame == nil {
+		return 0, 0
+	}
+	line, column = yylex.curFrame.Line, yylex.curFrame.Column
+	text := yylex.curFrame.Text
+	if offset < 0 {
+		offset = 0
+	} else if offset > len(text) {
+		offset = len(text)
+	}
+	for _, r := range text[:offset] {
 		if r == '\n' {
-			s.line++
-			s.column = 0
+			line++
+			column = 0
 		} else {
-			s.column++
+			column++
 		}
 	}
+	return line, column
+}
+
+// [BEGIN SPANS]
 
-	s.runes = s.runes[i:]
-	s.asserts = s.asserts[i:]
-	s.pos = 0
-	s.consumedAssert = false
-	if i == 0 {
-		s.minCapture = 1
-	} else {
-		s.minCapture = 0
+// TextSpan returns the offsets in bytes of the current match in the input, from its first byte to
+// the byte right after it, so that a program that holds the input, e.g., the data of
+// NewBytesLexer, can slice the text of the match as data[start:end] instead of copying it with
+// Text. The start is ByteOffset.
+func (yylex *Lexer) TextSpan() (start, end int64) {
+	if yylex.curFrame == nil {
+		return 0, 0
 	}
+	return yylex.curFrame.ByteOffset, yylex.curFrame.ByteEnd
 }
 
-func (s *scanner) attemptMapFunc(st int, f map[int]int) int {
-	if f == nil {
-		return st
+// TextRunes returns the runes of the current match in the buffer of the scanner, like Text, but
+// without copying them. They may not be modified.
+func (yylex *Lexer) TextRunes() []rune {
+	if yylex.curFrame == nil {
+		return nil
 	}
+	return yylex.curFrame.Text
+}
 
-	if nextSt, ok := f[st]; ok {
-		s.checkAccept(nextSt)
-		return nextSt
-	}
+// [END SPANS]
+
+// [BEGIN GRAPHEMES]
 
-	return st
+// Grapheme is a user-perceived character of the matched text, like a letter with its combining
+// accents, a flag, or an emoji sequence, and its position.
+type Grapheme struct {
+	Text         string
+	Line, Column int
+	Offset       int64
 }
 
-func (s *scanner) getNest(st int, text []rune) *scanner {
-	if s.dfa.nest == nil {
+// Graphemes splits the matched text into grapheme clusters, so that downstream processing does
+// not split a combining character from its base. Like Column, the positions count runes.
+func (yylex *Lexer) Graphemes() []Grapheme {
+	if yylex.curFrame == nil {
 		return nil
 	}
-	nestedDfa, ok := s.dfa.nest[st]
-	if !ok {
+	var graphemes []Grapheme
+	line, column, offset := yylex.curFrame.Line, yylex.curFrame.Column, yylex.curFrame.Offset
+	for text := yylex.curFrame.Text; len(text) > 0; {
+		n := graphemeLen(text)
+		graphemes = append(graphemes, Grapheme{string(text[:n]), line, column, offset})
+		for _, r := range text[:n] {
+			if r == '\n' {
+				line++
+				column = 0
+			} else {
+				column++
+			}
+		}
+		offset += int64(n)
+		text = text[n:]
+	}
+	return graphemes
+}
+
+// [END GRAPHEMES]
+
+// Gap returns the text that was skipped between the previous match and the current one,
+// as no rule matched it.
+// Within a nested scope, the previous match is the previous match of the scope.
+func (yylex *Lexer) Gap() string {
+	if yylex.curFrame == nil {
+		return ""
+	}
+	// [BEGIN ARENA]
+	if yylex.arena != nil {
+		return yylex.arena.String(yylex.curFrame.Gap)
+	}
+	// [END ARENA]
+	return string(yylex.curFrame.Gap)
+}
+
+// GapLine returns the line where the gap starts, right after the previous match.
+func (yylex *Lexer) GapLine() int {
+	if yylex.curFrame == nil {
+		return 0
+	}
+	return yylex.curFrame.GapLine
+}
+
+// GapColumn returns the column where the gap starts, right after the previous match.
+func (yylex *Lexer) GapColumn() int {
+	if yylex.curFrame == nil {
+		return 0
+	}
+	return yylex.curFrame.GapColumn
+}
+
+// GapOffset returns the offset in runes where the gap starts, right after the previous match.
+func (yylex *Lexer) GapOffset() int64 {
+	if yylex.curFrame == nil {
+		return 0
+	}
+	return yylex.curFrame.GapOffset
+}
+
+// [BEGIN LOSSLESS]
+
+// EndGap returns the text after the last match of the top-level rules, which is the gap of the end
+// of the input, once Lex returned 0. With `%option lossless`, Gap includes the text of the
+// skipped matches, so Gap and Text of the top-level matches, in order, and then EndGap, are the
+// input, see CheckLossless.
+func (yylex *Lexer) EndGap() string {
+	return string(yylex.endGap)
+}
+
+// [END LOSSLESS]
+
+// nextFrame returns the next frame, or nil at the end of the input.
+func (yylex *Lexer) nextFrame() *frame {
+	// [BEGIN REPLAY]
+	if yylex.replaying {
+		if yylex.stopped || len(yylex.replay) == 0 {
+			return nil
+		}
+		f := yylex.replay[0]
+		yylex.replay = yylex.replay[1:]
+		return f
+	}
+	// [END REPLAY]
+	// [BEGIN ASYNC]
+	if yylex.ch != nil {
+		return <-yylex.ch
+	}
+	// [END ASYNC]
+	if yylex.stopped {
 		return nil
 	}
-	return &scanner{
-		dfa:    &nestedDfa,
-		runes:  text,
-		line:   s.line,
-		column: s.column,
+	return yylex.src.Next()
+}
+
+// [BEGIN ASYNC]
+
+// produce runs the source in the background, until the input ends or the lexer is stopped.
+func (yylex *Lexer) produce() {
+	defer close(yylex.ch)
+	for f := yylex.src.Next(); f != nil; f = yylex.src.Next() {
+		select {
+		case <-yylex.ctx.Done():
+			return
+		case yylex.ch <- f:
+		default:
+			yylex.blocked.Store(true)
+			select {
+			case <-yylex.ctx.Done():
+				return
+			case yylex.ch <- f:
+			}
+			yylex.blocked.Store(false)
+		}
+		if pending := len(yylex.ch); yylex.onHigh != nil && pending == yylex.highWatermark {
+			yylex.onHigh(pending)
+		}
 	}
 }
 
+// SetBuffer lets the scanner run up to size frames ahead of Lex, instead of one, and calls
+// onHigh, if it is not nil, from the scanner's goroutine whenever the frames that wait for Lex
+// reach highWatermark, which is from 1 to size, e.g., to slow down the producer of the input.
+// When size frames wait, the scanner blocks until Lex takes one, so a slow parser does not
+// buffer unbounded frames.
+// It must be called in the init function of NewLexerWithInit, before the scanner starts.
+func (yylex *Lexer) SetBuffer(size, highWatermark int, onHigh func(pending int)) {
+	yylex.ch = make(chan *frame, size)
+	yylex.highWatermark, yylex.onHigh = highWatermark, onHigh
+}
+
+// Blocked returns true if the scanner waits for Lex to take a frame, because the frames that
+// SetBuffer lets it scan ahead are pending. It may be called from any goroutine.
+func (yylex *Lexer) Blocked() bool {
+	return yylex.blocked.Load()
+}
+
+// [END ASYNC]
+
+// [BEGIN RUNTIME]
+
+// The scanner core is imported from the nexruntime package.
+type (
+	asserts  = nexruntime.Asserts
+	frameKey = nexruntime.FrameKey
+	frame    = nexruntime.Frame
+	state    = nexruntime.State
+	dfa      = nexruntime.DFA
+	// [BEGIN TABLES]
+	tables = nexruntime.Tables
+	// [END TABLES]
+	source = nexruntime.Source
+	// [BEGIN ARENA]
+	arena = nexruntime.Arena
+	// [END ARENA]
+	// [BEGIN RULESETS]
+	ruleSets = nexruntime.RuleSets
+	// [END RULESETS]
+)
+
+const (
+	aStartText      = nexruntime.AStartText
+	aEndText        = nexruntime.AEndText
+	aStartLine      = nexruntime.AStartLine
+	aEndLine        = nexruntime.AEndLine
+	aWordBoundary   = nexruntime.AWordBoundary
+	aNoWordBoundary = nexruntime.ANoWordBoundary
+	kStartCode      = nexruntime.KStartCode
+	kEndCode        = nexruntime.KEndCode
+	kErrorCode      = nexruntime.KErrorCode
+)
+
+func newSource(d *dfa, in io.Reader, line, column int) *source {
+	return nexruntime.NewSource(d, in, line, column)
+}
+
+// [BEGIN BYTES]
+
+func newBytesSource(d *dfa, data []byte, line, column int) *source {
+	return nexruntime.NewBytesSource(d, data, line, column)
+}
+
+// [END BYTES]
+
+// [BEGIN RULESETS]
+
+func newRuleSets(d *dfa) *ruleSets {
+	return nexruntime.NewRuleSets(d)
+}
+
+// [END RULESETS]
+
+// [BEGIN SECTION]
+
+func countPosition(in io.Reader) (line, column int, err error) {
+	return nexruntime.CountPosition(in)
+}
+
+// [END SECTION]
+
+// [BEGIN GRAPHEMES]
+
+func graphemeLen(text []rune) int {
+	return nexruntime.GraphemeLen(text)
+}
+
+// [END GRAPHEMES]
+
+// [BEGIN REPLAY]
+
+func recordToken(w io.Writer, token int, f *frame) {
+	nexruntime.RecordToken(w, token, f)
+}
+
+func readRecording(in io.Reader) ([]*frame, error) {
+	return nexruntime.ReadRecording(in)
+}
+
+// [END REPLAY]
+
+// [BEGIN ANONYMIZE]
+
+func anonymize(d *dfa, in io.Reader, out io.Writer, replace map[int]func(text string) string) error {
+	return nexruntime.Anonymize(d, in, out, replace)
+}
+
+// [END ANONYMIZE]
+
+// [BEGIN LOSSLESS]
+
+func checkLossless(d *dfa, data []byte) error {
+	return nexruntime.CheckLossless(d, data)
+}
+
+// [END LOSSLESS]
+
+// [BEGIN MATCH]
+
+func fullMatch(d *dfa, rule int, text []rune) bool {
+	return nexruntime.FullMatch(d, rule, text)
+}
+
+// [END MATCH]
+
+// [BEGIN SNIFF]
+
+func sniff(d *dfa, prefix []byte) (int, bool) {
+	return nexruntime.Sniff(d, prefix)
+}
+
+// [END SNIFF]
+
+// [END RUNTIME]
+
 // [LEX METHOD PLACEHOLDER]
 
-// Lex runs the lexer.
+// Lex runs the lexer: it runs the actions of the matches until one of them returns a token,
+// and returns it. The action may store the semantic value of the token in lval.
+// It returns 0 at the end of the input.
 //
 //goland:noinspection GoUnusedParameter
 func (yylex *Lexer) Lex(lval *yySymType) int {
@@ -370,4 +959,13 @@ func (yylex *Lexer) Error(e string) {
 
 type yySymType any
 
+// specInit runs the `%init` blocks of the spec. It is generated.
+func (yylex *Lexer) specInit() {}
+
+// guard evaluates the `when GUARD` expressions of the rules. It is generated.
+func (yylex *Lexer) guard(scope, rule int) bool { return true }
+
+// ruleName returns the `%name` of a rule. It is generated.
+func (yylex *Lexer) ruleName(scope, rule int) string { return "" }
+
 var programDfa dfa
@@ -0,0 +1,55 @@
+package writer
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// stripComments removes the comments of the code, except for the comments that precede the
+// package clause, like build constraints and the "Code generated" header, and directives,
+// like `//go:embed`, which the code may depend on.
+func stripComments(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return src, err
+	}
+	var kept []*ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.End() < file.Package {
+			kept = append(kept, group)
+			continue
+		}
+		var directives []*ast.Comment
+		for _, c := range group.List {
+			if isDirective(c.Text) {
+				directives = append(directives, c)
+			}
+		}
+		if len(directives) > 0 {
+			kept = append(kept, &ast.CommentGroup{List: directives})
+		}
+	}
+	file.Comments = kept
+
+	var out bytes.Buffer
+	if err := format.Node(&out, fset, file); err != nil {
+		return src, err
+	}
+	return out.Bytes(), nil
+}
+
+// isDirective returns true if the comment is a directive of a Go tool, like `//go:generate`,
+// `//line` or `//export`.
+func isDirective(text string) bool {
+	for _, prefix := range []string{"//go:", "//line ", "//export ", "//nolint"} {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
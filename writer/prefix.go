@@ -0,0 +1,163 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"strings"
+)
+
+// aliasLex is the wrapper of the lexer for an alias prefix, %[1]s, whose semantic values convert
+// to those of the lexer, %[2]s. It is written after the prefix renames the identifiers.
+const aliasLex = `
+// %[1]sLex is a Lexer whose Lex method implements the %[1]sLexer interface of a parser that
+// goyacc generates with -p %[1]s, whose %[1]sSymType has the same underlying type as %[2]s.
+type %[1]sLex struct{ *Lexer }
+
+// Lex runs the lexer with the semantic value of the %[1]s parser, see Lexer.Lex.
+func (l %[1]sLex) Lex(lval *%[1]sSymType) int {
+	return l.Lexer.Lex((*%[2]s)(lval))
+}
+`
+
+// appendAliases appends the wrappers of the lexer for the Aliases to its code.
+func (b *LexerBuilder) appendAliases(code []byte, prefix, symType string) ([]byte, error) {
+	if len(b.Aliases) > 0 && b.Standalone {
+		return nil, fmt.Errorf("aliases: a standalone lexer has no Lex method")
+	}
+	seen := map[string]bool{prefix: true}
+	for _, alias := range b.Aliases {
+		if !token.IsIdentifier(alias) {
+			return nil, fmt.Errorf("aliases: bad prefix %q", alias)
+		}
+		if seen[alias] {
+			return nil, fmt.Errorf("aliases: prefix %s is repeated or is the prefix of the lexer", alias)
+		}
+		seen[alias] = true
+		code = fmt.Appendf(code, aliasLex, alias, symType)
+	}
+	return code, nil
+}
+
+// renamePrefix replaces the yy prefix of the identifiers of the code, like yylex and yySymType,
+// in the generated code as well as in the actions and the user code, so they may use either name.
+// Unlike a textual replacement, it leaves strings, comments, and identifiers that only contain yy,
+// like keyyard, intact. Field names, including the keys of struct literals, and selectors keep
+// their names, like the yys field of goyacc's yySymType, and so do the identifiers of the type
+// that `%yystype` sets.
+func renamePrefix(code []byte, prefix, symType string) ([]byte, error) {
+	keep := map[string]bool{}
+	if symType != "" {
+		t, err := goparser.ParseExpr(symType)
+		if err != nil {
+			return nil, fmt.Errorf("rename prefix: %%yystype %s: %w", symType, err)
+		}
+		ast.Inspect(t, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				keep[id.Name] = true
+			}
+			return true
+		})
+	}
+
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", code, goparser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("rename prefix: %w", err)
+	}
+	names := map[string]bool{}
+	for _, name := range topLevelNames(f) {
+		names[name] = true
+	}
+	structs := structTypes(f)
+	skip := map[*ast.Ident]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+		case *ast.CompositeLit:
+			skipFieldKeys(skip, n, structs, names)
+		case *ast.StructType:
+			for _, field := range n.Fields.List {
+				for _, name := range field.Names {
+					skip[name] = true
+				}
+			}
+		case *ast.InterfaceType:
+			for _, method := range n.Methods.List {
+				for _, name := range method.Names {
+					skip[name] = true
+				}
+			}
+		case *ast.FuncDecl:
+			if n.Recv != nil {
+				skip[n.Name] = true
+			}
+		}
+		return true
+	})
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && !skip[id] && !keep[id.Name] && strings.HasPrefix(id.Name, "yy") {
+			id.Name = prefix + id.Name[2:]
+		}
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// structTypes returns the names of the struct types that the files declare at the top level.
+func structTypes(files ...*ast.File) map[string]bool {
+	structs := map[string]bool{}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			if g, ok := d.(*ast.GenDecl); ok && g.Tok == token.TYPE {
+				for _, spec := range g.Specs {
+					t := spec.(*ast.TypeSpec)
+					if _, ok := t.Type.(*ast.StructType); ok {
+						structs[t.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return structs
+}
+
+// skipFieldKeys adds the keys of the composite literal that name fields rather than refer to
+// package-level names: every key of a struct literal, and the keys of a literal whose type is
+// elided or declared elsewhere that are not among the names. The keys of a map, a slice or an
+// array literal are expressions, like map[int]string{yyKindA: "A"}.
+func skipFieldKeys(skip map[*ast.Ident]bool, lit *ast.CompositeLit, structs, names map[string]bool) {
+	typ := lit.Type
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+	switch t := typ.(type) {
+	case *ast.MapType, *ast.ArrayType:
+		return
+	case *ast.Ident:
+		if structs[t.Name] {
+			names = nil
+		}
+	case *ast.StructType:
+		names = nil
+	}
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			if key, ok := kv.Key.(*ast.Ident); ok && !names[key.Name] {
+				skip[key] = true
+			}
+		}
+	}
+}
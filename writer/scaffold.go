@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"fmt"
+	goparser "go/parser"
+	"go/token"
+	"slices"
+)
+
+// standaloneMain is the main function of StandaloneMain, whose NN_FUN is replaced like those of
+// the user code.
+const standaloneMain = `
+// main runs the rules on the standard input. Their actions may write to the standard output,
+// e.g., with Echo.
+func main() {
+	` + funMacro + `(NewLexer(os.Stdin))
+}
+`
+
+// scaffoldMain returns the user code with the main function of StandaloneMain, if it is set, and
+// the package clause of package main if it has none, so that a spec of rules alone is a program.
+func (b *LexerBuilder) scaffoldMain(userCode string) string {
+	if !b.StandaloneMain {
+		return userCode
+	}
+	if !b.Standalone {
+		b.reportError(fmt.Errorf("a main function needs a standalone lexer"))
+		return userCode
+	}
+	switch packageName(userCode) {
+	case "":
+		userCode = "package main\n" + userCode
+	case "main":
+	default:
+		b.reportError(fmt.Errorf("a main function needs the lexer in package main, not %q", packageName(userCode)))
+		return userCode
+	}
+	u, err := goparser.ParseFile(token.NewFileSet(), "", userCode, 0)
+	if err != nil {
+		b.reportError(fmt.Errorf("main: user code: %w", err))
+		return userCode
+	}
+	if slices.Contains(topLevelNames(u), "main") {
+		b.reportError(fmt.Errorf("the user code declares main already"))
+		return userCode
+	}
+	return userCode + standaloneMain
+}
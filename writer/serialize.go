@@ -0,0 +1,79 @@
+package writer
+
+import (
+	"encoding/gob"
+	"io"
+
+	"github.com/liran-funaro/nex/graph"
+	"github.com/liran-funaro/nex/nexruntime"
+	"github.com/liran-funaro/nex/parser"
+)
+
+// useTables returns true if the states have no step functions, as the lexer walks tables.
+// The serialized DFAs have tables, as functions cannot be serialized, and so do the DFAs of
+// NewBytesLexer, whose ASCII transitions are in them.
+func (b *LexerBuilder) useTables() bool {
+	return b.Tables || b.DFAFile != "" || b.bytes
+}
+
+// WriteDFAFile writes the DFAs of the program to the file that a lexer, which was generated
+// with DFAFile, embeds and decodes at init.
+func (b *LexerBuilder) WriteDFAFile(program *parser.NexProgram, writer io.Writer) error {
+	b.reset(program)
+	d := b.dfaOf(program)
+	return gob.NewEncoder(writer).Encode(&d)
+}
+
+// dfaOf returns the DFA of a scope, and of its nested scopes, like writeDFAs writes them.
+func (b *LexerBuilder) dfaOf(x *parser.NexProgram) nexruntime.DFA {
+	d := nexruntime.DFA{Scope: b.scopes[x]}
+	if len(x.DFA) > 0 {
+		for _, v := range x.DFA {
+			var st nexruntime.State
+			if v.Accept >= 0 {
+				st.Accept = v.Accept
+				if b.listAccepts() {
+					st.Accepts = v.Accepts
+				}
+			}
+			for _, e := range v.GetEdgeKind(graph.KAssert) {
+				st.AssertMask |= e.A
+			}
+			d.States = append(d.States, st)
+		}
+		d.Tables = tablesOf(x.DFA, b.bytes)
+	}
+	for _, kid := range x.Children {
+		if len(kid.Children) > 0 {
+			if d.Nest == nil {
+				d.Nest = map[int]nexruntime.DFA{}
+			}
+			d.Nest[kid.Id] = b.dfaOf(kid)
+		}
+		if isSkipped(kid) {
+			if d.Skip == nil {
+				d.Skip = map[int]bool{}
+			}
+			d.Skip[kid.Id] = true
+		}
+	}
+	if sets := x.RuleSets(); len(sets) > 0 {
+		d.Sets, d.IdCount = sets, len(x.Children)+1
+	}
+	if b.scopes[x] == 0 {
+		d.Resync = b.resync
+	}
+	return d
+}
+
+// writeDFADecoder writes the declaration of programDfa, which is decoded from the embedded file.
+func (b *LexerBuilder) writeDFADecoder() {
+	b.writeString("// programDfa is decoded from programDfaFile at initialization, and never modified after.\n")
+	b.writeString("// They are the only package-level variables that the lexer uses. Hence, lexers are\n")
+	b.writeString("// re-entrant and may be loaded via plugins.\n")
+	b.writeString("var programDfa dfa\n\n")
+	b.writef("//go:embed %s\nvar programDfaFile []byte\n\n", b.DFAFile)
+	b.writeString("func init() {\n")
+	b.writeString("if err := gob.NewDecoder(bytes.NewReader(programDfaFile)).Decode(&programDfa); err != nil {\n")
+	b.writeString("panic(fmt.Sprintf(\"decode the DFA: %v\", err))\n}\n}\n")
+}
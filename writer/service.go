@@ -0,0 +1,179 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	goparser "go/parser"
+	"go/token"
+	"slices"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// serviceProto is the protobuf definition of the tokenizer service, in the package %[1]s, which
+// the tool %[2]s generated.
+const serviceProto = `// Code generated by %[2]s. DO NOT EDIT.
+
+syntax = "proto3";
+
+package %[1]s;
+
+// Tokenizer tokenizes texts with the rules of the spec.
+service Tokenizer {
+  rpc Tokenize(TokenizeRequest) returns (TokenizeResponse);
+}
+
+message TokenizeRequest {
+  string text = 1;
+}
+
+// Token is what the action of a rule returned, and the range of its match in lines and columns,
+// which start at 0, and the offset of its first rune in the text.
+message Token {
+  int32 kind = 1;
+  string text = 2;
+  int32 line = 3;
+  int32 column = 4;
+  int32 end_line = 5;
+  int32 end_column = 6;
+  int64 offset = 7;
+}
+
+message TokenizeResponse {
+  repeated Token tokens = 1;
+}
+`
+
+// serviceMain is the server of the tokenizer service, whose route is that of the Tokenize method
+// of the %[1]s.Tokenizer service.
+const serviceMain = `import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxTokenizeBytes is the largest request that the tokenizer service accepts.
+const maxTokenizeBytes = 16 << 20
+
+// The messages of the %[1]s.Tokenizer service in the JSON mapping of protobuf.
+type (
+	tokenizeRequest struct {
+		Text string ` + "`json:\"text\"`" + `
+	}
+	tokenizeToken struct {
+		Kind      int32  ` + "`json:\"kind\"`" + `
+		Text      string ` + "`json:\"text\"`" + `
+		Line      int32  ` + "`json:\"line\"`" + `
+		Column    int32  ` + "`json:\"column\"`" + `
+		EndLine   int32  ` + "`json:\"endLine\"`" + `
+		EndColumn int32  ` + "`json:\"endColumn\"`" + `
+		Offset    int64  ` + "`json:\"offset,string\"`" + `
+	}
+	tokenizeResponse struct {
+		Tokens []tokenizeToken ` + "`json:\"tokens\"`" + `
+	}
+)
+
+// tokenize serves the Tokenize method: it scans the text of the request, and responds with its
+// tokens. The semantic values of the tokens are left out.
+func tokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "the Tokenize method takes a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	var req tokenizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTokenizeBytes)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := tokenizeResponse{Tokens: []tokenizeToken{}}
+	lexer := NewLexer(strings.NewReader(req.Text))
+	lval := new(yySymType)
+	for kind := lexer.Lex(lval); kind != 0; kind = lexer.Lex(lval) {
+		resp.Tokens = append(resp.Tokens, tokenizeToken{
+			Kind: int32(kind), Text: lexer.Text(),
+			Line: int32(lexer.Line()), Column: int32(lexer.Column()),
+			EndLine: int32(lexer.EndLine()), EndColumn: int32(lexer.EndColumn()),
+			Offset: lexer.Offset(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log.Printf("tokenize: %%v", err)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "the address that the tokenizer service listens on")
+	flag.Parse()
+	http.HandleFunc("/%[1]s.Tokenizer/Tokenize", tokenize)
+	log.Printf("the tokenizer service listens on %%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+`
+
+// serviceName returns the protobuf package of the tokenizer service of the program: the lowercase
+// prefix of the lexer, or nex.
+func (b *LexerBuilder) serviceName(program *parser.NexProgram) string {
+	return cmp.Or(strings.ToLower(cmp.Or(b.CustomPrefix, program.Prefix())), "nex")
+}
+
+// DumpServiceProto returns the protobuf definition of the tokenizer service that DumpService
+// serves, from which the clients of the service, or a gRPC server, may be generated.
+func (b *LexerBuilder) DumpServiceProto(program *parser.NexProgram) []byte {
+	return fmt.Appendf(nil, serviceProto, b.serviceName(program), b.generator(program))
+}
+
+// DumpService returns a file of the package of the lexer with the main function of a service that
+// tokenizes texts with the lexer over HTTP, for organizations that tokenize behind a service
+// boundary, e.g., to scrub PII from logs. It serves the Tokenize method of the Tokenizer service
+// of DumpServiceProto, e.g., POST /calc.Tokenizer/Tokenize for the prefix calc, whose messages
+// are in the JSON mapping of protobuf, as the unary calls of the Connect protocol are. The lexer
+// must be in package main, and the user code may not declare main.
+func (b *LexerBuilder) DumpService(program *parser.NexProgram) ([]byte, error) {
+	if b.Standalone {
+		return nil, fmt.Errorf("a standalone lexer has no Lex method for a service")
+	}
+	if pkg := b.packageOf(program); pkg != "main" {
+		return nil, fmt.Errorf("a service needs the lexer in package main, not %q", pkg)
+	}
+	userCode := program.UserCode
+	if packageName(userCode) == "" {
+		userCode = "package main\n" + userCode
+	}
+	u, err := goparser.ParseFile(token.NewFileSet(), "", userCode, 0)
+	if err != nil {
+		return nil, fmt.Errorf("service: user code: %w", err)
+	}
+	if slices.Contains(topLevelNames(u), "main") {
+		return nil, fmt.Errorf("a service declares main, which the user code declares too")
+	}
+
+	var out bytes.Buffer
+	b.out, b.err = bufio.NewWriter(&out), nil
+	b.writeBuildConstraint(nil)
+	b.writeHeader(program, false)
+	b.writeString("\npackage main\n\n")
+	b.writeSymTyped(program, b.instantiate(program, fmt.Sprintf(serviceMain, b.serviceName(program))))
+	b.flush()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	src := out.Bytes()
+	if prefix := cmp.Or(b.CustomPrefix, program.Prefix()); prefix != "" {
+		if src, err = renamePrefix(src, prefix, program.SymType()); err != nil {
+			return nil, err
+		}
+	}
+	code, err := b.formatCode(src)
+	if err != nil {
+		return code, err
+	}
+	return b.minify(code)
+}
@@ -0,0 +1,136 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"slices"
+	"strings"
+
+	"github.com/liran-funaro/nex/parser"
+)
+
+// DumpSharedRuntime returns the file of the runtime that the lexers of the programs share when
+// they are generated into one package with SharedPrefix: the scanner core with what any of them
+// needs, or the declarations that refer to the nexruntime package.
+func (b *LexerBuilder) DumpSharedRuntime(programs []*parser.NexProgram) ([]byte, error) {
+	var pkg string
+	var strip []string
+	inline := false
+	for i, program := range programs {
+		b.reset(program)
+		// A tiny lexer needs the inlined runtime.
+		inline = inline || b.inline
+		name := b.packageOf(program)
+		regions := b.strippedRegions()
+		if i == 0 {
+			pkg, strip = name, regions
+			continue
+		}
+		if name != pkg {
+			return nil, fmt.Errorf("the lexers are in packages %s and %s", pkg, name)
+		}
+		// The runtime has the regions of a lexer unless all the lexers strip them.
+		strip = slices.DeleteFunc(strip, func(r string) bool { return !slices.Contains(regions, r) })
+	}
+	if pkg == "" {
+		return nil, fmt.Errorf("the lexers have no package")
+	}
+
+	var out bytes.Buffer
+	b.out, b.err = bufio.NewWriter(&out), nil
+	b.writeBuildConstraint(nil)
+	b.writeHeader(nil, true)
+	b.writef("\npackage %s\n\n", pkg)
+	if !inline {
+		// The region in the import block of the template is indented, unlike the declarations.
+		var imports, decls strings.Builder
+		for _, region := range regionRegexps["RUNTIME"].FindAllString(cmp.Or(b.Template, lexerTextFull), -1) {
+			region = stripRegions(region, strip...)
+			if strings.HasPrefix(region, "\t") {
+				imports.WriteString(region)
+			} else {
+				decls.WriteString(region + "\n")
+			}
+		}
+		b.writef("import (\n%s)\n\n%s", imports.String(), decls.String())
+		b.writeVersionCheck()
+	} else {
+		imports, code, err := inlineRuntime(strip...)
+		b.reportError(err)
+		b.writef("import (\n%s\n)\n\n%s", strings.Join(imports, "\n"), code)
+	}
+	b.flush()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	code, err := b.formatCode(out.Bytes())
+	if err == nil {
+		err = b.checkGoVersion(code)
+	}
+	if err != nil {
+		return code, err
+	}
+	return b.minify(code)
+}
+
+// prefixDeclarations starts the top-level names that the code of a lexer declares, apart from
+// those of the user code, with the prefix, and renames the references to them: Lexer becomes
+// CalcLexer and programDfa becomes calcProgramDfa for the prefix calc.
+func prefixDeclarations(code []byte, userCode, prefix string) ([]byte, error) {
+	keep, err := userDeclarations(userCode)
+	if err != nil {
+		return nil, fmt.Errorf("prefix declarations: %w", err)
+	}
+
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", code, goparser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("prefix declarations: %w", err)
+	}
+	renames := map[string]string{}
+	for _, name := range topLevelNames(f) {
+		if !keep[name] {
+			renames[name] = prefixName(prefix, name)
+		}
+	}
+	if err = renameIdents(f, renames, structTypes(f)); err != nil {
+		return nil, fmt.Errorf("prefix declarations: %w", err)
+	}
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// userDeclarations returns the top-level names that the user code declares, and those that Go
+// reserves, like init.
+func userDeclarations(userCode string) (map[string]bool, error) {
+	if packageName(userCode) == "" {
+		userCode = "package p\n" + userCode
+	}
+	u, err := goparser.ParseFile(token.NewFileSet(), "", userCode, 0)
+	if err != nil {
+		return nil, fmt.Errorf("user code: %w", err)
+	}
+	keep := map[string]bool{"_": true, "init": true, "main": true}
+	for _, name := range topLevelNames(u) {
+		keep[name] = true
+	}
+	return keep, nil
+}
+
+// prefixName starts the name with the prefix, and exports it if the name is exported.
+func prefixName(prefix, name string) string {
+	if ast.IsExported(name) {
+		return strings.ToUpper(prefix[:1]) + prefix[1:] + name
+	}
+	return unexport(prefix) + strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,184 @@
+package writer
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/liran-funaro/nex/graph"
+	"github.com/liran-funaro/nex/nexruntime"
+	"github.com/liran-funaro/nex/parser"
+)
+
+// writeTableState writes a state without step functions, whose transitions are in the tables.
+func (b *LexerBuilder) writeTableState(scope *parser.NexProgram, v *graph.Node) {
+	var fields []string
+	if v.Accept >= 0 {
+		fields = append(fields, "Accept: "+b.ruleId(scope, v.Accept))
+		if b.listAccepts() {
+			accepts := make([]string, len(v.Accepts))
+			for j, a := range v.Accepts {
+				accepts[j] = b.ruleId(scope, a)
+			}
+			fields = append(fields, "Accepts: []int{"+strings.Join(accepts, ", ")+"}")
+		}
+	}
+	var assertMask asserts
+	for _, e := range v.GetEdgeKind(graph.KAssert) {
+		assertMask |= e.A
+	}
+	if assertMask != 0 {
+		fields = append(fields, "AssertMask: "+assertsToString(assertMask))
+	}
+	b.writef("{%s},\n", strings.Join(fields, ", "))
+}
+
+// tablesOf returns the transitions of the states of a scope as tables, with those of the ASCII
+// runes of each state if ascii is set.
+func tablesOf(states []*graph.Node, ascii bool) *nexruntime.Tables {
+	t := &nexruntime.Tables{}
+	for _, v := range states {
+		t.RuneIndex = append(t.RuneIndex, int32(len(t.RuneStart)))
+		ranges := runeRanges(v)
+		for _, r := range ranges {
+			t.RuneStart = append(t.RuneStart, r.start)
+			t.RuneNext = append(t.RuneNext, int32(r.dst))
+		}
+		if ascii {
+			// A state without rune transitions never looks its runes up.
+			next, i := int32(-1), 0
+			for r := rune(0); r < 0x80; r++ {
+				for ; i < len(ranges) && ranges[i].start <= r; i++ {
+					next = int32(ranges[i].dst)
+				}
+				t.ASCII = append(t.ASCII, next)
+			}
+		}
+
+		t.AssertIndex = append(t.AssertIndex, int32(len(t.Asserts)))
+		assertE := v.GetEdgeKind(graph.KAssert)
+		slices.SortFunc(assertE, func(e, f *graph.Edge) int { return cmp.Compare(e.A, f.A) })
+		for _, e := range assertE {
+			t.Asserts = append(t.Asserts, e.A)
+			t.AssertNext = append(t.AssertNext, int32(e.Dst.Id))
+		}
+	}
+	t.RuneIndex = append(t.RuneIndex, int32(len(t.RuneStart)))
+	t.AssertIndex = append(t.AssertIndex, int32(len(t.Asserts)))
+	if len(t.Asserts) == 0 {
+		t.AssertIndex = nil
+	}
+	return t
+}
+
+// writeTables writes the transitions of the states of a scope as tables, see nexruntime.Tables.
+func (b *LexerBuilder) writeTables(states []*graph.Node) {
+	t := tablesOf(states, b.bytes)
+	b.writeString("Tables: &tables{\n")
+	b.writeTable("RuneIndex", "int32", formatInts(t.RuneIndex))
+	b.writeTable("RuneStart", "rune", formatInts(t.RuneStart))
+	b.writeTable("RuneNext", "int32", formatInts(t.RuneNext))
+	b.writeTable("AssertIndex", "int32", formatInts(t.AssertIndex))
+	asserts := make([]string, len(t.Asserts))
+	for i, a := range t.Asserts {
+		asserts[i] = assertsToString(a)
+	}
+	b.writeTable("Asserts", "asserts", asserts)
+	b.writeTable("AssertNext", "int32", formatInts(t.AssertNext))
+	b.writeTable("ASCII", "int32", formatInts(t.ASCII))
+	b.writeString("},\n")
+}
+
+func formatInts(values []int32) []string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return s
+}
+
+// writeTable writes a field of the tables, with a few values on each line.
+func (b *LexerBuilder) writeTable(name, typ string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	b.writef("%s: []%s{", name, typ)
+	for i, v := range values {
+		if i%16 == 0 {
+			b.writeString("\n")
+		}
+		b.writeString(v + ", ")
+	}
+	b.writeString("\n},\n")
+}
+
+// runeRange is a range of runes, from its start up to the start of the next one, that leads to
+// the state dst, or to -1.
+type runeRange struct {
+	start rune
+	dst   int
+}
+
+// runeRanges returns the rune transitions of a state as sorted ranges that cover all the runes,
+// from 0, like the step function of the state: single runes precede classes, which precede the
+// wildcard. It returns no ranges if the state has no rune transitions, like the step function.
+func runeRanges(v *graph.Node) []runeRange {
+	wildDst := -1
+	if wildE := v.GetEdgeKind(graph.KWild); len(wildE) > 0 {
+		wildDst = wildE[0].Dst.Id
+	}
+	runeE, classE := v.GetEdgeKind(graph.KRune), v.GetEdgeKind(graph.KClass)
+	if wildDst == -1 && len(runeE) == 0 && len(classE) == 0 {
+		return nil
+	}
+
+	// The classes of a DFA state are disjoint, but they may contain its single runes.
+	type span struct {
+		lo, hi rune
+		dst    int
+	}
+	var spans []span
+	for _, e := range classE {
+		spans = append(spans, span{e.Lim[0], e.Lim[1], e.Dst.Id})
+	}
+	slices.SortFunc(spans, func(s, t span) int { return cmp.Compare(s.lo, t.lo) })
+	singles := map[rune]int{}
+	for _, e := range runeE {
+		singles[e.R] = e.Dst.Id
+	}
+
+	// The destination only changes at the bounds of the spans and of the single runes.
+	bounds := []rune{0}
+	for _, s := range spans {
+		bounds = append(bounds, s.lo, s.hi+1)
+	}
+	for r := range singles {
+		bounds = append(bounds, r, r+1)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	if bounds[len(bounds)-1] > unicode.MaxRune {
+		bounds = bounds[:len(bounds)-1]
+	}
+
+	var ranges []runeRange
+	for _, r := range bounds {
+		dst, ok := singles[r]
+		if !ok {
+			dst = wildDst
+			i, found := slices.BinarySearchFunc(spans, r, func(s span, r rune) int { return cmp.Compare(s.lo, r) })
+			if !found {
+				i--
+			}
+			if i >= 0 && r <= spans[i].hi {
+				dst = spans[i].dst
+			}
+		}
+		if len(ranges) == 0 || ranges[len(ranges)-1].dst != dst {
+			ranges = append(ranges, runeRange{r, dst})
+		}
+	}
+	return ranges
+}
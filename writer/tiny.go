@@ -0,0 +1,78 @@
+package writer
+
+import (
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tinyImports are the packages that a tiny lexer may not import.
+var tinyImports = []string{"bufio", "context"}
+
+// checkTinyOptions reports the options that a tiny lexer may not have, as they need goroutines,
+// or packages that a tiny lexer does without.
+func (b *LexerBuilder) checkTinyOptions() {
+	if !b.tiny {
+		return
+	}
+	for _, o := range []struct {
+		on   bool
+		what string
+	}{
+		{b.push, "%option push needs goroutines"},
+		{b.Replay, "replaying needs bufio"},
+		{b.DFAFile != "", "serialized DFAs need encoding/gob"},
+		{b.checkpoint, "checkpoints need encoding/gob"},
+	} {
+		if o.on {
+			b.reportError(fmt.Errorf("tiny: %s", o.what))
+		}
+	}
+}
+
+// checkTiny returns an error if the code of a tiny lexer, with the actions and the user code of
+// its spec, starts goroutines, uses channels, or imports bufio or context.
+func (b *LexerBuilder) checkTiny(code []byte) error {
+	if !b.tiny {
+		return nil
+	}
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", code, 0)
+	if err != nil {
+		return fmt.Errorf("tiny: %w", err)
+	}
+	var problems []string
+	report := func(pos token.Pos, what string) {
+		problems = append(problems, fmt.Sprintf("line %d: %s", fset.Position(pos).Line, what))
+	}
+	for _, spec := range f.Imports {
+		if path, _ := strconv.Unquote(spec.Path.Value); slices.Contains(tinyImports, path) {
+			report(spec.Pos(), "imports "+path)
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.GoStmt:
+			report(n.Pos(), "a go statement")
+		case *ast.ChanType:
+			report(n.Pos(), "a channel")
+		case *ast.SelectStmt:
+			report(n.Pos(), "a select statement")
+		case *ast.SendStmt:
+			report(n.Pos(), "a channel send")
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW {
+				report(n.Pos(), "a channel receive")
+			}
+		}
+		return true
+	})
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("tiny: %s", strings.Join(problems, "; "))
+}
@@ -3,48 +3,193 @@ package writer
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	_ "embed"
 	"fmt"
-	"go/format"
+	gofmt "go/format"
 	goparser "go/parser"
 	"go/printer"
 	"go/token"
+	"go/version"
 	"io"
-	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/liran-funaro/nex/graph"
+	"github.com/liran-funaro/nex/nexruntime"
 	"github.com/liran-funaro/nex/parser"
-	"golang.org/x/tools/imports"
 )
 
 const funMacro = "NN_FUN"
 
+//go:embed lexer.go
+var lexerTextFull string
+
 var (
-	lexerStruct, lexerCode, lexerLexMethodIntro, lexerLexMethodOutro, lexerErrorMethod = lexerText()
+	regionMarkerRegexp = regexp.MustCompile(`[ \t]*// \[(BEGIN|END) [A-Z_]+]\n`)
+	regionRegexps      = map[string]*regexp.Regexp{}
 )
 
-//go:embed lexer.go
-var lexerTextFull string
+func init() {
+	for _, name := range []string{"ASYNC", "RULESETS", "GUARDS", "ACCEPTS", "ERRORS", "OBSERVER", "STATS", "SKIP", "INIT", "TABLES", "GRAPHEMES", "REPLAY", "SEARCH", "MATCH", "SNIFF", "PUSH", "SECTION", "SERIALIZE", "BYTES", "ARENA", "SPANS", "ANONYMIZE", "LOSSLESS", "RESYNC", "CHECKPOINT", "TRACE", "RUNTIME"} {
+		regionRegexps[name] = regexp.MustCompile(`(?s)[ \t]*// \[BEGIN ` + name + `]\n.*?// \[END ` + name + `]\n`)
+	}
+}
+
+// stripRegions removes the regions of the template between `// [BEGIN NAME]` and `// [END NAME]`
+// for the given names, and then removes the markers of the remaining regions.
+func stripRegions(text string, names ...string) string {
+	for _, name := range names {
+		text = regionRegexps[name].ReplaceAllString(text, "")
+	}
+	return regionMarkerRegexp.ReplaceAllString(text, "")
+}
+
+type lexerTemplate struct {
+	lexerStruct, lexerCode, lexerLexMethodIntro, lexerLexMethodOutro, lexerErrorMethod string
+
+	// The inlined runtime, unless it is imported.
+	runtimeImports []string
+	runtimeCode    string
+}
 
-func lexerText() (string, string, string, string, string) {
-	s := regexp.MustCompile(
-		`(?s)^.*?
-// \[PREAMBLE PLACEHOLDER]
-(.*?)
-	// \[NEX END OF LEXER STRUCT]
-(.*?)
-// \[LEX METHOD PLACEHOLDER]
-(.*?)
-	// \[LEX IMPLEMENTATION PLACEHOLDER]
-(.*?)
-// \[ERROR METHOD PLACEHOLDER]
-(.*?)
-// \[SUFFIX PLACEHOLDER]
-.*$`,
-	).FindStringSubmatch(lexerTextFull)
-	return s[1], s[2], s[3], s[4], s[5]
+func (b *LexerBuilder) lexerTemplate() lexerTemplate {
+	text := cmp.Or(b.Template, lexerTextFull)
+	strip := b.strippedRegions()
+	if b.SharedPrefix != "" {
+		// The runtime is in the file of DumpSharedRuntime.
+		return b.lexerText(stripRegions(text, append(strip, "RUNTIME")...))
+	}
+	if !b.inline {
+		return b.lexerText(stripRegions(text, strip...))
+	}
+	t := b.lexerText(stripRegions(text, append(strip, "RUNTIME")...))
+	var err error
+	t.runtimeImports, t.runtimeCode, err = inlineRuntime(strip...)
+	b.reportError(err)
+	return t
+}
+
+// strippedRegions returns the regions of the template and the runtime that the lexer does not need.
+func (b *LexerBuilder) strippedRegions() []string {
+	var strip []string
+	if b.sync {
+		strip = append(strip, "ASYNC")
+	}
+	if len(b.ruleSets) == 0 {
+		strip = append(strip, "RULESETS")
+	}
+	if len(b.guarded) == 0 {
+		strip = append(strip, "GUARDS")
+	}
+	if !b.listAccepts() {
+		strip = append(strip, "ACCEPTS")
+	}
+	if len(b.errorCode) == 0 && !b.echo && !b.Observer {
+		strip = append(strip, "ERRORS")
+	}
+	if !b.Observer {
+		strip = append(strip, "OBSERVER")
+	}
+	if !b.stats {
+		strip = append(strip, "STATS")
+	}
+	if !b.skips {
+		strip = append(strip, "SKIP")
+	}
+	if len(b.initCode) == 0 {
+		strip = append(strip, "INIT")
+	}
+	if !b.useTables() {
+		strip = append(strip, "TABLES")
+	}
+	if !b.graphemes {
+		strip = append(strip, "GRAPHEMES")
+	}
+	if !b.Trace {
+		strip = append(strip, "TRACE")
+	}
+	if !b.Replay {
+		strip = append(strip, "REPLAY")
+	}
+	if !b.search {
+		strip = append(strip, "SEARCH")
+	}
+	if !b.match {
+		strip = append(strip, "MATCH")
+	}
+	if !b.sniff {
+		strip = append(strip, "SNIFF")
+	}
+	if !b.push {
+		strip = append(strip, "PUSH")
+	}
+	if b.DFAFile == "" {
+		strip = append(strip, "SERIALIZE")
+	}
+	if !b.bytes {
+		strip = append(strip, "BYTES")
+	}
+	if !b.arena {
+		strip = append(strip, "ARENA")
+	}
+	if !b.spans {
+		strip = append(strip, "SPANS")
+	}
+	if !b.anonymize {
+		strip = append(strip, "ANONYMIZE")
+	}
+	if !b.lossless {
+		strip = append(strip, "LOSSLESS")
+	}
+	if len(b.resync) == 0 {
+		strip = append(strip, "RESYNC")
+	}
+	if !b.checkpoint {
+		strip = append(strip, "CHECKPOINT")
+	}
+	if v := b.goVersion(); v != "" && version.Compare(v, "go1.22") < 0 {
+		// NewSectionLexer needs io.SectionReader.Outer.
+		strip = append(strip, "SECTION")
+	}
+	return strip
+}
+
+// templatePlaceholders are the lines that split the template into its parts, in order.
+var templatePlaceholders = []string{
+	"// [PREAMBLE PLACEHOLDER]",
+	"\t// [NEX END OF LEXER STRUCT]",
+	"// [LEX METHOD PLACEHOLDER]",
+	"\t// [LEX IMPLEMENTATION PLACEHOLDER]",
+	"// [ERROR METHOD PLACEHOLDER]",
+	"// [SUFFIX PLACEHOLDER]",
+}
+
+var templateRegexp = func() *regexp.Regexp {
+	quoted := make([]string, len(templatePlaceholders))
+	for i, p := range templatePlaceholders {
+		quoted[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile(`(?s)^.*?\n` + strings.Join(quoted, `\n(.*?)\n`) + `\n.*$`)
+}()
+
+func (b *LexerBuilder) lexerText(text string) lexerTemplate {
+	s := templateRegexp.FindStringSubmatch(text)
+	if s == nil {
+		for _, p := range templatePlaceholders {
+			if !strings.Contains(text, p+"\n") {
+				b.reportError(fmt.Errorf("the template has no %q line", p))
+				return lexerTemplate{}
+			}
+		}
+		b.reportError(fmt.Errorf("the placeholders of the template are out of order"))
+		return lexerTemplate{}
+	}
+	return lexerTemplate{
+		lexerStruct: s[1], lexerCode: s[2], lexerLexMethodIntro: s[3], lexerLexMethodOutro: s[4], lexerErrorMethod: s[5],
+	}
 }
 
 type LexerBuilder struct {
@@ -52,9 +197,147 @@ type LexerBuilder struct {
 	CustomError  bool
 	CustomPrefix string
 
-	out      *bufio.Writer
-	replacer *strings.Replacer
-	err      error
+	// StandaloneMain appends a main function to the user code of a Standalone lexer, which runs the
+	// rules on the standard input, so that a filter needs no driver. The user code may be empty,
+	// or only declare what the actions use.
+	StandaloneMain bool
+
+	// Aliases generates, for each of its prefixes, a thin wrapper of Lexer, like yyLex for yy,
+	// whose Lex method takes the semantic values of a goyacc parser with that prefix, so that
+	// parsers of other prefixes than the one of the lexer may use it too.
+	Aliases []string
+
+	// Synchronous generates a lexer that scans on demand in the caller's goroutine,
+	// instead of scanning in a background goroutine, like `%option sync`.
+	Synchronous bool
+
+	// Tiny generates a lexer for TinyGo and small devices, like `%option tiny`: it scans like a
+	// Synchronous lexer with the InlineRuntime, without goroutines, channels, context or bufio,
+	// and it fails if the options or the code of the spec need them.
+	Tiny bool
+
+	// Generic generates Lexer[T any], whose Lex method takes lval *T, like `%option generic`, so
+	// that the same lexer scans the tokens of parsers with different types of semantic values, or
+	// of programs that are not parsers, without a yySymType.
+	Generic bool
+
+	// InlineRuntime generates a lexer that has a copy of the scanner core, so it builds without
+	// the module of nex, instead of importing the nexruntime package.
+	InlineRuntime bool
+
+	// Observer generates a lexer that reports its events to a LexerObserver, which SetObserver sets.
+	Observer bool
+
+	// Replay generates a lexer that records the tokens of Lex with its Record method, and
+	// NewReplayLexer, which replays a recording through Lex without the input.
+	Replay bool
+
+	// Trace generates a lexer that writes the steps of its scanner to the writer of SetTrace, for
+	// debugging the rules.
+	Trace bool
+
+	// Minify generates a lexer without comments, which would show the regexes of the rules, and
+	// refers to the rules by their numbers instead of their names, e.g., to distribute a
+	// proprietary grammar. parser.NexProgram.WriteSymbols writes what is left out.
+	// The comments are only stripped by DumpFormattedLexer.
+	Minify bool
+
+	// Format is how the generated files are formatted: "goimports", the default, formats them with
+	// go/format, and then with goimports, which also imports the packages of the actions that are
+	// not standard; "std" only uses go/format and the standard imports that nex knows, and it
+	// works without golang.org/x/tools, see goimports; "none" only fixes the imports, and leaves
+	// the code unformatted, for fast generation in CI, where nobody reads it.
+	Format string
+
+	// Tables generates the transitions of the DFAs as tables that the scanner walks, instead of a
+	// function for each state, so large grammars compile faster.
+	Tables bool
+
+	// Bytes generates NewBytesLexer, like `%option bytes`, which scans a []byte in place, and whose
+	// scanner looks up the transitions of the ASCII runes in a table of each state, instead of
+	// searching the ranges of the state, for the throughput of log processing. It implies Tables.
+	Bytes bool
+
+	// ExplainStates writes a comment above each state of the DFAs with the rules that it accepts,
+	// the one that wins by precedence if the match ends there, and the rules that may still match
+	// from there, to debug the precedence of the rules from the generated code.
+	ExplainStates bool
+
+	// DFAFile, if set, generates a lexer that embeds the file of that name, in its directory, and
+	// decodes its DFAs from it at init, instead of a Go literal of them, so that the code of a large
+	// grammar stays small, and so do its diffs. WriteDFAFile writes the file. It implies Tables.
+	DFAFile string
+
+	// Template, if set, replaces the embedded template of the lexer, writer/lexer.go, which it
+	// should start from: the placeholder lines split it into the parts that the builder writes
+	// around the generated code, and the regions between `// [BEGIN NAME]` and `// [END NAME]`
+	// are stripped when the lexer does not need them.
+	Template string
+
+	// Package, if set, generates the lexer as a package of that name, which overrides `%package`,
+	// for the programs of other packages: it exports Token, New and the Next method of Lexer,
+	// which scans a token without a semantic value type of the caller.
+	Package string
+
+	// SharedPrefix, if set, generates a lexer that shares the runtime with the other lexers of its
+	// package, which DumpSharedRuntime writes once for all of them, and whose top-level
+	// declarations start with the prefix, so they do not collide with those of the other lexers.
+	SharedPrefix string
+
+	// PackageName, if set, puts the lexer in the package of that name, like `%package`, which it
+	// overrides, without the API of Package.
+	PackageName string
+
+	// Generator, if set, is the tool that the "Code generated" comments of the generated files
+	// name instead of nex, like `%generator`, e.g., the script that runs nex.
+	Generator string
+
+	// Command, if set, replaces the command line of the invocation in the comment of the generated
+	// lexer, like `%command`, so that the file does not depend on the paths and the flags of each
+	// run, or omits the comment if it is "-".
+	Command string
+
+	// Header, if set, is a block of comments that follows the "Code generated" comment of the
+	// generated files, like `%header{ ... }`, e.g., a license. The lines that are not comments
+	// become comments.
+	Header string
+
+	// BuildConstraint, if set, is the expression of a `//go:build` line at the top of the
+	// generated files, e.g., "linux && !purego".
+	BuildConstraint string
+
+	// GoVersion, if set, is the oldest version of Go that the generated lexer may require, e.g.,
+	// 1.19, so it can be vendored into modules of older toolchains. DumpFormattedLexer fails if the
+	// lexer or its actions use newer features of the language or of the standard library.
+	GoVersion string
+
+	out        *bufio.Writer
+	template   lexerTemplate
+	ruleSets   []string
+	guarded    []*parser.NexProgram
+	scopes     map[*parser.NexProgram]int
+	initCode   []string
+	errorCode  []string
+	stats      bool
+	sync       bool
+	tiny       bool
+	inline     bool
+	generic    bool
+	search     bool
+	match      bool
+	sniff      bool
+	push       bool
+	bytes      bool
+	arena      bool
+	spans      bool
+	anonymize  bool
+	lossless   bool
+	resync     []rune
+	checkpoint bool
+	echo       bool
+	graphemes  bool
+	skips      bool
+	err        error
 }
 
 func (b *LexerBuilder) DumpFormattedLexer(program *parser.NexProgram) ([]byte, error) {
@@ -62,28 +345,169 @@ func (b *LexerBuilder) DumpFormattedLexer(program *parser.NexProgram) ([]byte, e
 	if err := b.WriteLexer(program, &outputBuffer); err != nil {
 		return nil, err
 	}
-	return formatCode(outputBuffer.Bytes())
+	code, err := b.formatCode(outputBuffer.Bytes())
+	if err == nil && b.SharedPrefix != "" {
+		code, err = prefixDeclarations(code, program.UserCode, b.SharedPrefix)
+	}
+	if err != nil {
+		return code, err
+	}
+	if err = b.checkGoVersion(code); err != nil {
+		return code, err
+	}
+	if err = b.checkTiny(code); err != nil {
+		return code, err
+	}
+	return b.minify(code)
+}
+
+// minify strips the comments of the formatted code with Minify.
+func (b *LexerBuilder) minify(code []byte) ([]byte, error) {
+	if !b.Minify {
+		return code, nil
+	}
+	code, err := stripComments(code)
+	if err != nil {
+		return code, fmt.Errorf("failed stripping comments: %w", err)
+	}
+	return code, nil
+}
+
+// reset sets the state of the builder for the program.
+func (b *LexerBuilder) reset(program *parser.NexProgram) {
+	b.ruleSets = program.RuleSetNames()
+	b.guarded = program.Guarded()
+	b.scopes = map[*parser.NexProgram]int{}
+	for i, scope := range program.Scopes() {
+		b.scopes[scope] = i
+	}
+	b.initCode, b.errorCode = nil, nil
+	b.stats = program.HasOption("stats")
+	b.tiny = b.Tiny || program.HasOption("tiny")
+	b.inline = b.InlineRuntime || b.tiny
+	b.checkpoint = program.HasOption("checkpoint")
+	// A checkpoint is taken where Lex stops, which the scanner of an asynchronous lexer runs ahead of.
+	b.sync = b.Synchronous || program.HasOption("sync") || b.tiny || b.checkpoint
+	b.generic = b.Generic || program.HasOption("generic")
+	b.echo = program.HasOption("echo")
+	b.graphemes = program.HasOption("graphemes")
+	b.search = program.HasOption("search")
+	b.match = program.HasOption("match")
+	b.sniff = program.HasOption("sniff")
+	b.push = program.HasOption("push")
+	b.bytes = b.Bytes || program.HasOption("bytes")
+	b.arena = program.HasOption("arena")
+	b.anonymize = program.HasOption("anonymize")
+	b.lossless = program.HasOption("lossless")
+	// ParseNex checks the class.
+	b.resync, _ = program.Resync()
+	// Anonymize copies the bytes of the input by the spans of the matches.
+	b.spans = program.HasOption("spans") || b.anonymize
+	b.skips = false
+	for _, scope := range program.Scopes() {
+		b.skips = b.skips || slices.ContainsFunc(scope.Children, isSkipped)
+	}
+	for _, p := range program.Parameters {
+		switch p.Key {
+		case "init":
+			b.initCode = append(b.initCode, p.Value)
+		case "error":
+			b.errorCode = append(b.errorCode, p.Value)
+		}
+	}
 }
 
 func (b *LexerBuilder) WriteLexer(program *parser.NexProgram, writer io.Writer) error {
-	b.out = bufio.NewWriter(writer)
-	if b.CustomPrefix != "" {
-		b.replacer = strings.NewReplacer("yy", b.CustomPrefix)
+	// The flag overrides the spec.
+	prefix := cmp.Or(b.CustomPrefix, program.Prefix())
+	generic := b.Generic || program.HasOption("generic")
+	if prefix == "" && len(b.Aliases) == 0 && !generic {
+		return b.writeLexer(program, writer)
 	}
+	var buf bytes.Buffer
+	if err := b.writeLexer(program, &buf); err != nil {
+		return err
+	}
+	code := buf.Bytes()
+	var err error
+	if generic {
+		if code, err = genericLexer(code, program.UserCode); err != nil {
+			return fmt.Errorf("builder: %w", err)
+		}
+	}
+	if prefix != "" {
+		if code, err = renamePrefix(code, prefix, program.SymType()); err != nil {
+			return fmt.Errorf("builder: %w", err)
+		}
+	}
+	code, err = b.appendAliases(code, cmp.Or(prefix, "yy"), cmp.Or(program.SymType(), cmp.Or(prefix, "yy")+"SymType"))
+	if err != nil {
+		return fmt.Errorf("builder: %w", err)
+	}
+	_, err = writer.Write(code)
+	return err
+}
 
-	b.writeString("// Code generated by nex. DO NOT EDIT.\n")
-	b.writef("// Command: %s.\n\n", strings.Join(os.Args, " "))
-	userCode := b.writeUserPreamble(program.UserCode)
-	b.writeStringWithReplace(lexerStruct + "\n")
+// writeLexer writes the lexer with the names of the template, which start with yy.
+func (b *LexerBuilder) writeLexer(program *parser.NexProgram, writer io.Writer) error {
+	b.out, b.err = bufio.NewWriter(writer), nil
+	b.reset(program)
+	b.template = b.lexerTemplate()
+	b.checkTinyOptions()
+	b.checkGenericOptions(program)
+
+	// The top blocks precede everything else, so they may hold build constraints and license headers.
 	for _, p := range program.Parameters {
-		if p.Key == "field" {
+		if p.Key == "top" {
 			b.writeString(p.Value + "\n")
 		}
 	}
-	b.writeStringWithReplace(lexerCode + "\n")
+	b.writeBuildConstraint(program)
+	b.writeHeader(program, true)
+	b.writeString("\n")
+	userCode := b.scaffoldMain(program.UserCode)
+	b.checkPackage(userCode)
+	if pkg := cmp.Or(b.Package, b.PackageName, program.Package()); pkg != "" && packageName(userCode) == "" {
+		userCode = "package " + pkg + "\n" + userCode
+	}
+	userCode = b.writeUserPreamble(userCode)
+	imports := b.template.runtimeImports
+	if b.DFAFile != "" {
+		imports = append(slices.Clip(imports), `"bytes"`, `_ "embed"`, `"encoding/gob"`)
+	}
+	if len(imports) > 0 {
+		b.writef("import (\n%s\n)\n\n", strings.Join(imports, "\n"))
+	}
+	b.writeString(b.template.lexerStruct + "\n")
+	for _, p := range program.Parameters {
+		if p.Key == "field" || p.Key == "fields" {
+			b.writeString(p.Value + "\n")
+		}
+	}
+	b.writeString(b.template.lexerCode + "\n")
+	b.writeString(b.template.runtimeCode)
+	if !b.inline && b.SharedPrefix == "" {
+		b.writeVersionCheck()
+	}
+	if program.HasOption("tokens") {
+		b.writeTokens(program.Tokens())
+	}
+	b.writeRuleNames(program)
+	if len(b.initCode) > 0 {
+		b.writeString("// specInit runs the `%init` blocks of the spec.\nfunc (yylex *Lexer) specInit() {\n")
+		for _, code := range b.initCode {
+			b.writeString(code)
+		}
+		b.writeString("}\n\n")
+	}
+	b.writeGuard(program)
+	b.writeRuleName(program)
 
 	if !b.Standalone {
 		b.writeLex(program)
+		if b.Package != "" {
+			b.writePackageAPI(program)
+		}
 	} else {
 		for i := strings.Index(userCode, funMacro); i >= 0; i = strings.Index(userCode, funMacro) {
 			b.writeString(userCode[:i])
@@ -95,6 +519,13 @@ func (b *LexerBuilder) WriteLexer(program *parser.NexProgram, writer io.Writer)
 	b.writeString(userCode)
 
 	// Write DFA states at the end of the file for readability.
+	if b.DFAFile != "" {
+		b.writeDFADecoder()
+		b.flush()
+		return b.err
+	}
+	b.writeString("// programDfa is never modified after initialization, and it is the only package-level\n")
+	b.writeString("// variable that the lexer uses. Hence, lexers are re-entrant and may be loaded via plugins.\n")
 	b.writeString("var programDfa = ")
 	b.writeDFAs(program)
 	b.writeString("\n")
@@ -102,6 +533,14 @@ func (b *LexerBuilder) WriteLexer(program *parser.NexProgram, writer io.Writer)
 	return b.err
 }
 
+// writeVersionCheck writes the constants that fail to compile with an incompatible nexruntime.
+func (b *LexerBuilder) writeVersionCheck() {
+	v := nexruntime.MaxVersion
+	b.writef("// This code requires version %d of the nexruntime API, and fails to compile otherwise.\n", v)
+	b.writef("const (\n_ = nexruntime.EnforceVersion(%d - nexruntime.MinVersion)\n", v)
+	b.writef("_ = nexruntime.EnforceVersion(nexruntime.MaxVersion - %d)\n)\n\n", v)
+}
+
 func (b *LexerBuilder) reportError(err error) {
 	if err == nil {
 		return
@@ -135,6 +574,36 @@ func (b *LexerBuilder) writeUserPreamble(userCode string) string {
 	return userCode[findNthLineIndex(userCode, skipLineCount):]
 }
 
+// packageName returns the name of the package clause that the code starts with, after its
+// comments, or "" if it has none.
+func packageName(code string) string {
+	f, err := goparser.ParseFile(token.NewFileSet(), "", code, goparser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return f.Name.Name
+}
+
+// packageOf returns the package of the lexer: that of the package clause of the user code, or
+// else the Package option, or `%package`.
+func (b *LexerBuilder) packageOf(program *parser.NexProgram) string {
+	return cmp.Or(packageName(program.UserCode), b.Package, b.PackageName, program.Package())
+}
+
+// checkPackage reports an error if the lexer cannot be generated as the package of the Package
+// option, which Next needs the Lex method for.
+func (b *LexerBuilder) checkPackage(userCode string) {
+	switch name := packageName(userCode); {
+	case b.Package == "":
+	case !token.IsIdentifier(b.Package) || b.Package == "main":
+		b.reportError(fmt.Errorf("the lexer cannot be generated as package %q", b.Package))
+	case b.Standalone:
+		b.reportError(fmt.Errorf("a standalone lexer cannot be generated as a package"))
+	case name != "" && name != b.Package:
+		b.reportError(fmt.Errorf("the user code is in package %s, not in package %s", name, b.Package))
+	}
+}
+
 func (b *LexerBuilder) flush() {
 	b.reportError(b.out.Flush())
 }
@@ -155,18 +624,6 @@ func (b *LexerBuilder) writeString(s string) {
 	b.reportError(err)
 }
 
-func (b *LexerBuilder) writeStringWithReplace(s string) {
-	if b.err != nil {
-		return
-	}
-	if b.replacer != nil {
-		_, err := b.replacer.WriteString(b.out, s)
-		b.reportError(err)
-	} else {
-		b.writeString(s)
-	}
-}
-
 func (b *LexerBuilder) writeByte(c byte) {
 	if b.err != nil {
 		return
@@ -182,25 +639,15 @@ func (b *LexerBuilder) writef(format string, a ...any) {
 	b.reportError(err)
 }
 
-func (b *LexerBuilder) writefWithReplace(format string, a ...any) {
-	if b.err != nil {
-		return
-	}
-	if b.replacer != nil {
-		_, err := b.replacer.WriteString(b.out, fmt.Sprintf(format, a...))
-		b.reportError(err)
-	} else {
-		b.writef(format, a...)
-	}
-}
-
-var assertsString = map[asserts]string{
-	aStartText:      "aStartText",
-	aEndText:        "aEndText",
-	aStartLine:      "aStartLine",
-	aEndLine:        "aEndLine",
-	aWordBoundary:   "aWordBoundary",
-	aNoWordBoundary: "aNoWordBoundary",
+// assertsString are the names of the asserts, in the order of their bits, so that the generated
+// code lists them in the same order every time.
+var assertsString = [...]string{
+	"aStartText",
+	"aEndText",
+	"aStartLine",
+	"aEndLine",
+	"aWordBoundary",
+	"aNoWordBoundary",
 }
 
 func assertsToString(a asserts) string {
@@ -209,67 +656,80 @@ func assertsToString(a asserts) string {
 	}
 
 	var asList []string
-	for k, v := range assertsString {
-		if a&k != 0 {
-			asList = append(asList, v)
+	for i, name := range assertsString {
+		if a&(1<<i) != 0 {
+			asList = append(asList, name)
 		}
 	}
 	return strings.Join(asList, "|")
 }
 
-func (b *LexerBuilder) writeState(i int, v *graph.Node) {
+// groupByDst groups the cases of the edges by their destinations, which are listed in the order
+// in which they first appear, so that the generated code does not depend on the iteration of a map.
+func groupByDst(edges []*graph.Edge, caseOf func(e *graph.Edge) string) (dsts []int, cases map[int][]string) {
+	cases = map[int][]string{}
+	for _, e := range edges {
+		if _, ok := cases[e.Dst.Id]; !ok {
+			dsts = append(dsts, e.Dst.Id)
+		}
+		cases[e.Dst.Id] = append(cases[e.Dst.Id], caseOf(e))
+	}
+	return dsts, cases
+}
+
+func (b *LexerBuilder) writeState(scope *parser.NexProgram, i int, v *graph.Node) {
 	b.writef("{ // State %d\n", i)
 	if v.Accept >= 0 {
-		b.writef("accept: %d,\n", v.Accept)
+		b.writef("Accept: %s,\n", b.ruleId(scope, v.Accept))
+		if b.listAccepts() {
+			accepts := make([]string, len(v.Accepts))
+			for j, a := range v.Accepts {
+				accepts[j] = b.ruleId(scope, a)
+			}
+			b.writef("Accepts: []int{%s},\n", strings.Join(accepts, ", "))
+		}
 	}
 
 	if assertE := v.GetEdgeKind(graph.KAssert); len(assertE) > 0 {
 		var assertMask asserts
-		assertMap := map[int][]string{}
 		for _, e := range assertE {
-			assertMap[e.Dst.Id] = append(assertMap[e.Dst.Id], assertsToString(e.A))
 			assertMask |= e.A
 		}
+		dsts, assertMap := groupByDst(assertE, func(e *graph.Edge) string { return assertsToString(e.A) })
 
-		b.writef("assertMask: %s,\n", assertsToString(assertMask))
-		b.writeString("assertStep: func(a asserts) int {\nswitch (a) {\n")
-		for ret, caseValue := range assertMap {
-			b.writef("case %s: return %d\n", strings.Join(caseValue, ","), ret)
+		b.writef("AssertMask: %s,\n", assertsToString(assertMask))
+		b.writeString("AssertStep: func(a asserts) int {\nswitch (a) {\n")
+		for _, ret := range dsts {
+			b.writef("case %s: return %d\n", strings.Join(assertMap[ret], ","), ret)
 		}
 		b.writeString("default: return -1\n}\n},\n")
 	}
 
-	var runeMap, classMap map[int][]string
 	wildDst := -1
 	if wildE := v.GetEdgeKind(graph.KWild); len(wildE) > 0 {
 		wildDst = wildE[0].Dst.Id
 	}
-	if runeE := v.GetEdgeKind(graph.KRune); len(runeE) > 0 {
-		runeMap = map[int][]string{}
-		for _, e := range runeE {
-			runeMap[e.Dst.Id] = append(runeMap[e.Dst.Id], fmt.Sprintf("%q", e.R))
-		}
-	}
-	if classE := v.GetEdgeKind(graph.KClass); len(classE) > 0 {
-		classMap = map[int][]string{}
-		for _, e := range classE {
-			classMap[e.Dst.Id] = append(classMap[e.Dst.Id], fmt.Sprintf("%q <= r && r <= %q", e.Lim[0], e.Lim[1]))
-		}
-	}
+	runeDsts, runeMap := groupByDst(v.GetEdgeKind(graph.KRune), func(e *graph.Edge) string {
+		return fmt.Sprintf("%q", e.R)
+	})
+	classDsts, classMap := groupByDst(v.GetEdgeKind(graph.KClass), func(e *graph.Edge) string {
+		return fmt.Sprintf("%q <= r && r <= %q", e.Lim[0], e.Lim[1])
+	})
 	if wildDst != -1 || len(runeMap) > 0 || len(classMap) > 0 {
-		b.writeString("runeStep: func(r rune) int {\n")
+		b.writeString("RuneStep: func(r rune) int {\n")
 
 		if len(runeMap) > 0 {
 			b.writeString("switch(r) {\n")
-			for ret, caseValue := range runeMap {
-				b.writef("case %s: return %d\n", strings.Join(caseValue, ","), ret)
+			for _, ret := range runeDsts {
+				b.writef("case %s: return %d\n", strings.Join(runeMap[ret], ","), ret)
 			}
 			b.writeString("}\n")
 		}
 
 		if len(classMap) > 0 {
 			b.writeString("switch {\n")
-			for ret, caseValue := range classMap {
+			for _, ret := range classDsts {
+				caseValue := classMap[ret]
 				if len(caseValue) > 1 {
 					for i, c := range caseValue {
 						caseValue[i] = fmt.Sprintf("(%s)", c)
@@ -295,11 +755,25 @@ func (b *LexerBuilder) writeDFAs(x *parser.NexProgram) {
 	}
 
 	if len(x.DFA) > 0 {
-		b.writeString("states: []state{\n")
+		b.writeString("States: []state{\n")
+		alive := b.explainStates(x.DFA)
 		for i, v := range x.DFA {
-			b.writeState(i, v)
+			if alive != nil {
+				if i > 0 && !b.useTables() {
+					b.writeString("\n")
+				}
+				b.writeStateComment(x, v, alive[i])
+			}
+			if b.useTables() {
+				b.writeTableState(x, v)
+			} else {
+				b.writeState(x, i, v)
+			}
 		}
 		b.writeString("\n},\n")
+		if b.useTables() {
+			b.writeTables(x.DFA)
+		}
 	}
 
 	haveNest := false
@@ -307,9 +781,9 @@ func (b *LexerBuilder) writeDFAs(x *parser.NexProgram) {
 		if len(kid.Children) > 0 {
 			if !haveNest {
 				haveNest = true
-				b.writeString("nest: map[int]dfa{\n")
+				b.writeString("Nest: map[int]dfa{\n")
 			}
-			b.writef("%d:", kid.Id)
+			b.writef("%s:", b.ruleId(x, kid.Id))
 			b.writeDFAs(kid)
 			b.writeString(",\n")
 		}
@@ -317,40 +791,329 @@ func (b *LexerBuilder) writeDFAs(x *parser.NexProgram) {
 	if haveNest {
 		b.writeString("},\n")
 	}
+	if scope := b.scopes[x]; scope > 0 {
+		b.writef("Scope: %d,\n", scope)
+	}
+	var skip []string
+	for _, kid := range x.Children {
+		if isSkipped(kid) {
+			skip = append(skip, b.ruleId(x, kid.Id)+": true")
+		}
+	}
+	if len(skip) > 0 {
+		b.writef("Skip: map[int]bool{%s},\n", strings.Join(skip, ", "))
+	}
+
+	if sets := x.RuleSets(); len(sets) > 0 {
+		var names []string
+		for name := range sets {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		b.writeString("Sets: map[string][]int{\n")
+		for _, name := range names {
+			ids := make([]string, len(sets[name]))
+			for i, id := range sets[name] {
+				ids[i] = b.ruleId(x, id)
+			}
+			b.writef("%q: {%s},\n", name, strings.Join(ids, ", "))
+		}
+		b.writef("},\nIdCount: %d,\n", len(x.Children)+1)
+	}
+	if b.scopes[x] == 0 && len(b.resync) > 0 {
+		runes := make([]string, len(b.resync))
+		for i, r := range b.resync {
+			runes[i] = strconv.QuoteRune(r)
+		}
+		b.writef("Resync: []rune{%s},\n", strings.Join(runes, ", "))
+	}
 	b.writeString("}")
 }
 
-func (b *LexerBuilder) writeFamilyCases(node *parser.NexProgram) {
+// isSkipped returns true if the rule has no code, so the scanner can skip its matches without
+// producing frames for them.
+func isSkipped(x *parser.NexProgram) bool {
+	return x.StartCode == "" && x.EndCode == "" && len(x.Children) == 0
+}
+
+// ruleId returns the constant of the rule of the scope with the given ID, if the rule is named
+// and the lexer is not minified, or else its ID.
+func (b *LexerBuilder) ruleId(scope *parser.NexProgram, id int) string {
+	if kid := scope.Children[id-1]; kid.RuleName() != "" && !b.Minify {
+		return kid.RuleName()
+	}
+	return strconv.Itoa(id)
+}
+
+// listAccepts returns true if the states list all the rules they accept, as the scanner may skip
+// some of them, or MatchRule may look for any of them.
+func (b *LexerBuilder) listAccepts() bool {
+	return len(b.ruleSets) > 0 || len(b.guarded) > 0 || b.match
+}
+
+// writeGuard writes the method that evaluates the `when GUARD` expressions of the rules.
+func (b *LexerBuilder) writeGuard(program *parser.NexProgram) {
+	if len(b.guarded) == 0 {
+		return
+	}
+	b.writeString("// guard returns false if the given rule is guarded by an expression that does not hold.\n")
+	b.writeString("func (yylex *Lexer) guard(scope, rule int) bool {\nswitch (frameKey{Kind: kStartCode, Scope: scope, Rule: rule}) {\n")
+	for _, scope := range program.Scopes() {
+		for _, kid := range scope.Children {
+			if kid.Guard != "" {
+				b.writef("case frameKey{Kind: kStartCode, Scope: %d, Rule: %s}: // %s\n", b.scopes[scope], b.ruleId(scope, kid.Id), kid.Regex)
+				b.writef("return %s\n", kid.Guard)
+			}
+		}
+	}
+	b.writeString("}\nreturn true\n}\n\n")
+}
+
+// writeRuleNames writes constants for the rules that are named by `%name NAME` annotations.
+// The generated code refers to named rules by their constants, so adding a rule before them
+// only changes the constants.
+func (b *LexerBuilder) writeRuleNames(program *parser.NexProgram) {
+	if b.Minify {
+		return
+	}
+	var names []string
+	var walk func(x *parser.NexProgram)
+	walk = func(x *parser.NexProgram) {
+		if name := x.RuleName(); name != "" {
+			names = append(names, fmt.Sprintf("%s = %d // %s", name, x.Id, x.Regex))
+		}
+		for _, kid := range x.Children {
+			walk(kid)
+		}
+	}
+	walk(program)
+	if len(names) == 0 {
+		return
+	}
+	b.writeString("// The numbers of the named rules within their scopes.\nconst (\n")
+	for _, name := range names {
+		b.writeString(name + "\n")
+	}
+	b.writeString(")\n\n")
+}
+
+// writeRuleName writes the method that returns the `%name` of a rule, for RuleName. A minified
+// lexer has no names.
+func (b *LexerBuilder) writeRuleName(program *parser.NexProgram) {
+	b.writeString("// ruleName returns the `%name` of the rule of the scope, or \"\" if it has none.\n")
+	b.writeString("func (yylex *Lexer) ruleName(scope, rule int) string {\n")
+	var cases []string
+	for _, scope := range program.Scopes() {
+		for _, kid := range scope.Children {
+			if name := kid.RuleName(); name != "" && !b.Minify {
+				cases = append(cases, fmt.Sprintf("case frameKey{Kind: kStartCode, Scope: %d, Rule: %s}:\nreturn %q\n", b.scopes[scope], name, name))
+			}
+		}
+	}
+	if len(cases) > 0 {
+		b.writeString("switch (frameKey{Kind: kStartCode, Scope: scope, Rule: rule}) {\n" + strings.Join(cases, "") + "}\n")
+	}
+	b.writeString("return \"\"\n}\n\n")
+}
+
+// writeTokens writes constants for the tokens of the `-> TOKEN` rules, and the yyTokenKind type,
+// whose String method returns their names. Lexers that are used with goyacc should not generate
+// them, as goyacc generates the token constants. The constants are untyped, so the actions may
+// return them as ints. Like yySymType, the type is renamed with the prefix of the lexer, so lexers
+// of several prefixes may share a package. In a package of several lexers, it is TokenKind, which
+// prefixDeclarations starts with the prefix like the other declarations.
+func (b *LexerBuilder) writeTokens(tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+	b.writeString("// Token kinds. Lex() returns 0 at the end of the input.\nconst (\n_ = iota\n")
+	for _, t := range tokens {
+		b.writeString(t + "\n")
+	}
+	b.writeString(")\n\n")
+
+	kind := "yyTokenKind"
+	if b.SharedPrefix != "" {
+		kind = "TokenKind"
+	}
+	b.writef("// %s is a token kind that Lex returns, whose String method returns its name,\n", kind)
+	b.writef("// e.g., for fmt.Println(%s(kind)) in a debugging output or an error message.\n", kind)
+	b.writef("type %s int\n\n", kind)
+	b.writeString("// String returns the name of the token kind, EOF for 0, or TokenKind(N) for other kinds.\n")
+	b.writef("func (k %s) String() string {\nswitch k {\ncase 0:\nreturn \"EOF\"\n", kind)
+	for _, t := range tokens {
+		b.writef("case %s:\nreturn %q\n", t, t)
+	}
+	b.writeString("}\nreturn fmt.Sprintf(\"TokenKind(%d)\", int(k))\n}\n\n")
+}
+
+func (b *LexerBuilder) writeFamilyCases(scope, node *parser.NexProgram) {
+	key := "Scope: 0, Rule: 0"
+	if scope != nil {
+		key = fmt.Sprintf("Scope: %d, Rule: %s", b.scopes[scope], b.ruleId(scope, node.Id))
+	}
 	if node.StartCode != "" {
-		b.writefWithReplace("case frameKey{kStartCode, %d}: // %s\n", node.Id, node.Regex)
+		b.writef("case frameKey{Kind: kStartCode, %s}: // %s\n", key, node.Regex)
 		b.writeString(node.StartCode)
 	}
 	for _, x := range node.Children {
-		b.writeFamilyCases(x)
+		b.writeFamilyCases(node, x)
 	}
 	if node.EndCode != "" {
-		b.writefWithReplace("case frameKey{kEndCode, %d}: // %s\n", node.Id, node.Regex)
+		b.writef("case frameKey{Kind: kEndCode, %s}: // %s\n", key, node.Regex)
 		b.writeString(node.EndCode)
 	}
 }
 
+// writeErrorCase writes the case of the `%error` blocks, which run for the unmatched text of all scopes.
+// With `%option echo`, the case echoes the text first.
+func (b *LexerBuilder) writeErrorCase() {
+	if len(b.errorCode) == 0 && !b.echo {
+		return
+	}
+	keys := make([]string, len(b.scopes))
+	for _, i := range b.scopes {
+		keys[i] = fmt.Sprintf("frameKey{Kind: kErrorCode, Scope: %d}", i)
+	}
+	b.writef("case %s: // Unmatched text\n", strings.Join(keys, ", "))
+	if b.echo {
+		b.writeString("yylex.Echo()\n")
+	}
+	for _, code := range b.errorCode {
+		b.writeString(code)
+	}
+}
+
 func (b *LexerBuilder) writeFamily(node *parser.NexProgram) {
-	b.writeStringWithReplace("for yylex.curFrame = range yylex.ch {\nswitch yylex.curFrame.key {\n")
-	b.writeFamilyCases(node)
+	b.writeString("for yylex.curFrame = yylex.nextFrame(); yylex.curFrame != nil; yylex.curFrame = yylex.nextFrame() {\n")
+	if b.Observer {
+		b.writeString("if yylex.observer != nil && yylex.curFrame.Key.Kind == kErrorCode {\n")
+		b.writeString("yylex.observer.Unmatched(yylex.Text(), yylex.Line(), yylex.Column())\n}\n")
+	}
+	if b.lossless {
+		b.writeString("if yylex.curFrame.Key == (frameKey{Kind: kEndCode}) {\nyylex.endGap = yylex.curFrame.Gap\n}\n")
+	}
+	b.writeString("switch yylex.curFrame.Key {\n")
+	b.writeFamilyCases(nil, node)
+	b.writeErrorCase()
 	b.writeString("}\n}\n")
 }
 
 func (b *LexerBuilder) writeLex(root *parser.NexProgram) {
 	if !b.CustomError {
-		b.writeStringWithReplace(lexerErrorMethod)
+		b.writeString(b.template.lexerErrorMethod)
+	}
+	intro := b.template.lexerLexMethodIntro
+	if b.Observer || b.Replay {
+		// Lex observes or records the calls of the generated method, which is unexported.
+		b.writeSymTyped(root, stripRegions(wrappedLex, b.strippedRegions()...))
+		intro = strings.NewReplacer("// Lex ", "// lex ", ") Lex(", ") lex(").Replace(intro)
 	}
-	b.writeStringWithReplace(lexerLexMethodIntro + "\n")
+	b.writeSymTyped(root, intro+"\n")
 	b.writeFamily(root)
-	b.writeString(lexerLexMethodOutro + "\n")
+	b.writeString(b.template.lexerLexMethodOutro + "\n")
+}
+
+// wrappedLex is the Lex method of lexers with an observer or a recording, whose regions are
+// stripped like those of the template.
+const wrappedLex = `// Lex runs the lexer: it runs the actions of the matches until one of them returns a token,
+// and returns it. The action may store the semantic value of the token in lval.
+// It returns 0 at the end of the input.
+// [BEGIN OBSERVER]
+// It reports the call to the observer, if any.
+// [END OBSERVER]
+// [BEGIN REPLAY]
+// It records the token, if the lexer records.
+// [END REPLAY]
+func (yylex *Lexer) Lex(lval *yySymType) int {
+	// [BEGIN OBSERVER]
+	var done func(token int)
+	if yylex.observer != nil {
+		done = yylex.observer.LexStarted()
+	}
+	// [END OBSERVER]
+	token := yylex.lex(lval)
+	// [BEGIN REPLAY]
+	if yylex.recording != nil && token != 0 {
+		recordToken(yylex.recording, token, yylex.curFrame)
+	}
+	// [END REPLAY]
+	// [BEGIN OBSERVER]
+	if done != nil {
+		done(token)
+	}
+	// [END OBSERVER]
+	return token
+}
+
+`
+
+// writeSymTyped writes code with the type of the semantic values, which a `%yystype TYPE`
+// parameter may set. The prefix does not rename the type, see renamePrefix.
+func (b *LexerBuilder) writeSymTyped(root *parser.NexProgram, code string) {
+	if t := root.SymType(); t != "" {
+		code = strings.ReplaceAll(code, "yySymType", t)
+	}
+	b.writeString(code)
+}
+
+// packageAPI is the API of a lexer that is generated as a package, which the programs of other
+// packages use instead of Lex.
+const packageAPI = `// Token is a token that Next scans.
+type Token struct {
+	// Kind is what the action of the rule returned. It is 0 at the end of the input.
+	Kind int
+	// Value is what the action stored in lval, if anything.
+	Value any
+
+	Text               string
+	Line, Column       int
+	EndLine, EndColumn int
+	Offset, ByteOffset int64
+	// Rule is the number of the rule within its scope, and RuleName is its %name, if it has one.
+	Rule     int
+	RuleName string
+}
+
+// New creates a new lexer of the input.
+func New(in io.Reader) *Lexer {
+	return NewLexer(in)
+}
+
+// Next scans the next token. Its Kind is 0 at the end of the input.
+func (yylex *Lexer) Next() Token {
+	lval := new(yySymType)
+	kind := yylex.Lex(lval)
+	return Token{
+		Kind:       kind,
+		Value:      *lval,
+		Text:       yylex.Text(),
+		Line:       yylex.Line(),
+		Column:     yylex.Column(),
+		EndLine:    yylex.EndLine(),
+		EndColumn:  yylex.EndColumn(),
+		Offset:     yylex.Offset(),
+		ByteOffset: yylex.ByteOffset(),
+		Rule:       yylex.Rule(),
+		RuleName:   yylex.RuleName(),
+	}
+}
+
+`
+
+// writePackageAPI writes the API of a lexer that is generated as a package. Unless `%yystype`
+// names the type of the semantic values, which a parser in the package may declare, the lexer
+// declares it as any.
+func (b *LexerBuilder) writePackageAPI(root *parser.NexProgram) {
+	if root.SymType() == "" {
+		b.writeString("// yySymType is the type of the semantic values, which Next returns as Token.Value.\n")
+		b.writeString("type yySymType = any\n\n")
+	}
+	b.writeSymTyped(root, packageAPI)
 }
 
 func (b *LexerBuilder) writeNNFun(root *parser.NexProgram) {
-	b.writeStringWithReplace("func(yylex *Lexer) {\n")
+	b.writeString("func(yylex *Lexer) {\n")
 	b.writeFamily(root)
 	b.writeString("}")
 }
@@ -370,15 +1133,35 @@ func findNthLineIndex(buffer string, n int) int {
 	return len(buffer)
 }
 
-func formatCode(src []byte) ([]byte, error) {
-	src, err := format.Source(src)
-	if err != nil {
-		return src, fmt.Errorf("failed formmatting code: %w", err)
+// formatCode formats the generated code, and fixes its imports, as the Format option says.
+func (b *LexerBuilder) formatCode(src []byte) ([]byte, error) {
+	format := cmp.Or(b.Format, "goimports")
+	if format == "goimports" && !haveGoimports {
+		// nex is built without golang.org/x/tools, see goimports.
+		format = "std"
+	}
+	var err error
+	switch format {
+	case "goimports":
+		if src, err = gofmt.Source(src); err != nil {
+			return src, fmt.Errorf("failed formmatting code: %w", err)
+		}
+		if src, err = fixImports(src, false); err != nil {
+			return src, fmt.Errorf("failed adding imports: %w", err)
+		}
+		return goimports(src)
+	case "std", "none":
+		if src, err = fixImports(src, true); err != nil {
+			return src, fmt.Errorf("failed fixing imports: %w", err)
+		}
+		if format == "none" {
+			return src, nil
+		}
+		if src, err = gofmt.Source(src); err != nil {
+			return src, fmt.Errorf("failed formmatting code: %w", err)
+		}
+		return src, nil
+	default:
+		return src, fmt.Errorf("unknown format %q; expected goimports, std or none", b.Format)
 	}
-	return imports.Process("main.go", src, &imports.Options{
-		TabWidth:  8,
-		TabIndent: true,
-		Comments:  true,
-		Fragment:  true,
-	})
 }